@@ -1,60 +1,258 @@
 package polarisdb
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// every record in a segment file is a length prefix and a crc32 of the data followed by the block data
+const recordHeaderSize = 8
+
+var (
+	ErrBadRecord        = errors.New("bad aof record")
+	ErrTruncatedRecord  = fmt.Errorf("%w: truncated", ErrBadRecord)
+	ErrChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrBadRecord)
+	// every record holds an action block, a zero length one is zeroed space like a
+	// preallocated tail, its crc32 of nothing is zero as well
+	ErrEmptyRecord     = fmt.Errorf("%w: empty", ErrBadRecord)
+	ErrOversizedRecord = fmt.Errorf("%w: larger than a segment", ErrBadRecord)
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptRecordError locates a bad record in the log
+type CorruptRecordError struct {
+	Segment int
+	Offset  int64
+	Err     error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("aof segment %d offset %d: %v", e.Segment, e.Offset, e.Err)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Err
+}
+
+// fsync policies, same meaning as the redis appendfsync option
+var (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
 )
 
 type Log struct {
+	sync.Mutex
+	// basePath is the configured directory, path the directory of the current segment generation
+	basePath       string
 	path           string
+	generation     int
 	lastIndex      int
 	lastFilePath   string
 	maxSegSize     int64
 	indexToSegFile map[int]string
+	// the segment that is open for appending
+	file        *os.File
+	fileSize    int64
+	fsyncPolicy string
+	// bytes were written since the last fsync
+	dirty       bool
+	lastFsync   time.Time
+	fsyncErr    error
+	fsyncErrors int64
+	// syncFile fsyncs the open segment, nil is File.Sync
+	syncFile func(file *os.File) error
+	// appends are refused once a record that failed to sync could not be cut off again
+	appendErr error
+	stopSync  chan struct{}
+	syncDone  chan struct{}
+	// refuse to open instead of cutting a torn tail off the last segment
+	refuseTornTail bool
+	// totalSize is the size of all segments, baseSize the size after the last rewrite
+	totalSize int64
+	baseSize  int64
+	// records appended while a rewrite is running, nil when no rewrite is running
+	rewriteBuf     [][]byte
+	rewrites       int64
+	lastRewriteErr error
 }
 
-type Segment struct {
-	Index  int
-	path   string
-	Blocks []*Block
+// FsyncStatus reports the durability state of the log
+type FsyncStatus struct {
+	Policy    string    `json:"policy"`
+	LastFsync time.Time `json:"last_fsync"`
+	// LastError is the error of the last fsync, nil once an fsync succeeds again
+	LastError   error `json:"-"`
+	TotalErrors int64 `json:"total_errors"`
+}
+
+// LogPosition is the point right after a record, records appended later start there
+type LogPosition struct {
+	Generation int
+	Segment    int
+	Offset     int64
 }
 
 type Block struct {
 	Data []byte
 }
-type BlockIndex struct {
-	start int
-	end   int
+
+func encodeRecord(block *Block) []byte {
+	buf := make([]byte, recordHeaderSize+len(block.Data))
+	binary.BigEndian.PutUint32(buf, uint32(len(block.Data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(block.Data, crcTable))
+	copy(buf[recordHeaderSize:], block.Data)
+	return buf
+}
+
+// SegmentReader streams the records of one segment file
+type SegmentReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+	// size of the file, a record never reaches past it
+	size int64
+	// records after the first one of a segment are at most this large, 0 is no limit
+	maxRecord int64
+}
+
+func OpenSegment(path string) (*SegmentReader, error) {
+	return OpenSegmentAt(path, 0)
 }
 
-func (s *Segment) Serialize() (io.Reader, error) {
-	// serialize by gob
-	var buf bytes.Buffer
-	err := gob.NewEncoder(&buf).Encode(s)
+// OpenSegmentAt opens a segment to read the records starting at offset
+func OpenSegmentAt(path string, offset int64) (*SegmentReader, error) {
+	segFile, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	return &buf, nil
-}
-func (s *Segment) Deserialize(reader io.Reader) error {
-	return gob.NewDecoder(reader).Decode(s)
+	stat, err := segFile.Stat()
+	if err != nil {
+		segFile.Close()
+		return nil, err
+	}
+	if _, err = segFile.Seek(offset, io.SeekStart); err != nil {
+		segFile.Close()
+		return nil, err
+	}
+	return &SegmentReader{
+		file:   segFile,
+		reader: bufio.NewReader(segFile),
+		offset: offset,
+		size:   stat.Size(),
+	}, nil
 }
-func OpenSegment(path string) (*Segment, error) {
-	segFile, err := os.Open(path)
+
+// openSegment opens a segment of the log, its records are checked against the segment size
+func (l *Log) openSegment(path string, offset int64) (*SegmentReader, error) {
+	reader, err := OpenSegmentAt(path, offset)
 	if err != nil {
 		return nil, err
 	}
-	seg := &Segment{}
-	err = seg.Deserialize(segFile)
+	reader.maxRecord = l.maxSegSize
+	return reader, nil
+}
+
+// Next returns the next block, io.EOF at the end of the segment, ErrTruncatedRecord
+// when the segment ends inside the record, ErrEmptyRecord for a zero length record,
+// ErrOversizedRecord for a record no segment holds and ErrChecksumMismatch when the
+// record data is damaged. The offset stays at the start of a bad record.
+func (r *SegmentReader) Next() (*Block, error) {
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r.reader, header)
 	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncatedRecord
+		}
 		return nil, err
 	}
-	return seg, nil
+	size := int64(binary.BigEndian.Uint32(header))
+	if size == 0 {
+		return nil, ErrEmptyRecord
+	}
+	// check the length before trusting it with an allocation
+	if size > r.size-r.offset-recordHeaderSize {
+		return nil, ErrTruncatedRecord
+	}
+	// appends start a new segment for a record that does not fit, only the first one may be larger
+	if r.maxRecord > 0 && r.offset > 0 && recordHeaderSize+size > r.maxRecord {
+		return nil, ErrOversizedRecord
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r.reader, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncatedRecord
+		}
+		return nil, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, ErrChecksumMismatch
+	}
+	r.offset += int64(recordHeaderSize) + int64(size)
+	return &Block{Data: data}, nil
 }
+
+// AtEnd reports whether everything in the segment has been consumed
+func (r *SegmentReader) AtEnd() bool {
+	_, err := r.reader.Peek(1)
+	return err == io.EOF
+}
+
+// validRecordFollows reports whether a valid record starts anywhere after the start of
+// the bad record at the offset, a torn append is the last thing in a segment
+func (r *SegmentReader) validRecordFollows() (bool, error) {
+	rest := make([]byte, r.size-r.offset-1)
+	if _, err := r.file.ReadAt(rest, r.offset+1); err != nil && err != io.EOF {
+		return false, err
+	}
+	for i := 0; i+recordHeaderSize < len(rest); i++ {
+		size := int(binary.BigEndian.Uint32(rest[i:]))
+		if size == 0 || size > len(rest)-i-recordHeaderSize {
+			continue
+		}
+		data := rest[i+recordHeaderSize : i+recordHeaderSize+size]
+		if crc32.Checksum(data, crcTable) == binary.BigEndian.Uint32(rest[i+4:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// restIsZero reports whether only zero bytes follow the header that was read, it consumes them
+func (r *SegmentReader) restIsZero() bool {
+	for {
+		c, err := r.reader.ReadByte()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil || c != 0 {
+			return false
+		}
+	}
+}
+
+// Offset is the byte offset of the next record
+func (r *SegmentReader) Offset() int64 {
+	return r.offset
+}
+
+func (r *SegmentReader) Close() error {
+	return r.file.Close()
+}
+
 func (l *Log) Open(path string) error {
 	if l.maxSegSize == 0 {
 		l.maxSegSize = 20 * 1024 * 1024 // 20MB
@@ -62,136 +260,475 @@ func (l *Log) Open(path string) error {
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		return err
 	}
-	l.path = path
-	items, err := os.ReadDir(path)
+	l.basePath = path
+	if l.fsyncPolicy == "" {
+		l.fsyncPolicy = FsyncNo
+	}
+	segDir, generation, err := currentSegmentDir(path)
+	if err != nil {
+		return err
+	}
+	l.path = segDir
+	l.generation = generation
+	if err = removeStaleGenerations(path, generation); err != nil {
+		return err
+	}
+	items, err := os.ReadDir(l.path)
 	if err != nil {
 		return err
 	}
 	l.indexToSegFile = make(map[int]string)
+	l.totalSize = 0
 	for _, item := range items {
 		if item.IsDir() {
 			continue
 		}
-		// read and parse to segment
-		itemPath := filepath.Join(path, item.Name())
-		seg, err := OpenSegment(itemPath)
+		// segment files are named by their index
+		index, err := strconv.Atoi(item.Name())
+		if err != nil {
+			continue
+		}
+		segPath := filepath.Join(l.path, item.Name())
+		// only a directory that was never rewritten can hold the first format
+		if generation == 0 {
+			if err = migrateLegacySegment(segPath); err != nil {
+				return err
+			}
+		}
+		info, err := os.Stat(segPath)
+		if err != nil {
+			return err
+		}
+		l.totalSize += info.Size()
+		l.indexToSegFile[index] = segPath
+	}
+	if len(l.indexToSegFile) > 0 {
+		// find last
+		l.lastIndex = -1
+		for key := range l.indexToSegFile {
+			if key > l.lastIndex {
+				l.lastIndex = key
+			}
+		}
+		l.lastFilePath = l.indexToSegFile[l.lastIndex]
+		if err = l.recoverTail(); err != nil {
+			return err
+		}
+	}
+	l.baseSize = l.totalSize
+	if l.fsyncPolicy == FsyncEverySec && l.stopSync == nil {
+		l.stopSync = make(chan struct{})
+		l.syncDone = make(chan struct{})
+		go l.syncLoop(l.stopSync, l.syncDone)
+	}
+	return nil
+}
+
+// recoverTail checks the last segment, a crash while appending leaves an
+// incomplete or damaged record at its end which is cut off unless refuseTornTail is set
+func (l *Log) recoverTail() error {
+	reader, err := l.openSegment(l.lastFilePath, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for {
+		_, err = reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+		corruptErr := &CorruptRecordError{Segment: l.lastIndex, Offset: reader.Offset(), Err: err}
+		// a segment that is bad from its first byte is not a torn append, it is not ours
+		if reader.Offset() == 0 {
+			return corruptErr
+		}
+		isTail := errors.Is(err, ErrTruncatedRecord) ||
+			(errors.Is(err, ErrChecksumMismatch) && reader.AtEnd()) ||
+			(errors.Is(err, ErrEmptyRecord) && reader.restIsZero())
+		if isTail && errors.Is(err, ErrTruncatedRecord) {
+			// a damaged length reaches past the end too, the records after it must stay
+			follows, scanErr := reader.validRecordFollows()
+			if scanErr != nil {
+				return scanErr
+			}
+			isTail = !follows
+		}
+		if !isTail || l.refuseTornTail {
+			return corruptErr
+		}
+		stat, err := os.Stat(l.lastFilePath)
 		if err != nil {
 			return err
 		}
-		l.indexToSegFile[seg.Index] = itemPath
+		if err = os.Truncate(l.lastFilePath, reader.Offset()); err != nil {
+			return err
+		}
+		l.totalSize -= stat.Size() - reader.Offset()
+		log.Printf("aof: %v, truncated %d bytes of torn tail", corruptErr, stat.Size()-reader.Offset())
+		return nil
+	}
+}
+
+// legacySegment is a segment file of the first aof format, a single gob of all its
+// blocks that every append rewrote
+type legacySegment struct {
+	Index  int
+	Blocks []*Block
+}
+
+// migrateLegacySegment rewrites a segment file of the first format as records in
+// place, a file that does not start with a valid record and is no legacy segment is
+// left for the recovery to report
+func migrateLegacySegment(path string) error {
+	reader, err := OpenSegment(path)
+	if err != nil {
+		return err
+	}
+	_, err = reader.Next()
+	reader.Close()
+	if err == nil || err == io.EOF {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	if len(l.indexToSegFile) == 0 {
+	seg := legacySegment{}
+	decodeErr := gob.NewDecoder(bufio.NewReader(file)).Decode(&seg)
+	file.Close()
+	if decodeErr != nil {
 		return nil
 	}
-	// find last
-	l.lastIndex = -1
-	for key, _ := range l.indexToSegFile {
-		if key > l.lastIndex {
-			l.lastIndex = key
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, block := range seg.Blocks {
+		if block == nil || len(block.Data) == 0 {
+			continue
+		}
+		if _, err = writer.Write(encodeRecord(block)); err != nil {
+			break
 		}
 	}
-	l.lastFilePath = l.indexToSegFile[l.lastIndex]
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
 	if err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
+	log.Printf("aof: migrated %d blocks of %s from the legacy format", len(seg.Blocks), path)
+	return syncDir(filepath.Dir(path))
+}
+
+func (l *Log) openLastSegment() error {
+	if len(l.lastFilePath) == 0 {
+		l.lastFilePath = filepath.Join(l.path, fmt.Sprintf("%d", l.lastIndex))
+	}
+	file, err := os.OpenFile(l.lastFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.fileSize = stat.Size()
+	l.indexToSegFile[l.lastIndex] = l.lastFilePath
 	return nil
 }
+
 func (l *Log) Append(block *Block) error {
-	// check if need to create new segment
-	if len(l.lastFilePath) != 0 {
-		stat, err := os.Stat(l.lastFilePath)
-		if err != nil {
+	l.Lock()
+	defer l.Unlock()
+	record := encodeRecord(block)
+	err := l.appendRecord(record)
+	if err == nil && l.rewriteBuf != nil {
+		l.rewriteBuf = append(l.rewriteBuf, record)
+	}
+	return err
+}
+
+// AppendSync appends a block and fsyncs it. A record that fails to sync is cut off
+// the segment, the caller does not apply it and the next open must not replay it.
+func (l *Log) AppendSync(block *Block) error {
+	l.Lock()
+	defer l.Unlock()
+	record := encodeRecord(block)
+	if err := l.appendRecord(record); err != nil {
+		return err
+	}
+	if err := l.syncLocked(); err != nil {
+		size := int64(len(record))
+		if truncErr := l.file.Truncate(l.fileSize - size); truncErr != nil {
+			// the record may come back on the next open, like redis stop taking writes
+			l.appendErr = fmt.Errorf("aof record failed to sync and could not be removed: %w", truncErr)
 			return err
 		}
-		if (stat.Size() + int64(len(block.Data))) > l.maxSegSize {
-			l.lastIndex++
-			l.lastFilePath = ""
-		}
+		l.fileSize -= size
+		l.totalSize -= size
+		return err
 	}
+	if l.rewriteBuf != nil {
+		l.rewriteBuf = append(l.rewriteBuf, record)
+	}
+	return nil
+}
 
-	seg := &Segment{}
-	if len(l.lastFilePath) == 0 {
-		saveName := fmt.Sprintf("%d", l.lastIndex)
-		seg.Blocks = make([]*Block, 0)
-		seg.Index = l.lastIndex
-		l.lastFilePath = filepath.Join(l.path, saveName)
-	} else {
-		file, err := os.Open(l.lastFilePath)
-		if err != nil {
+func (l *Log) appendRecord(record []byte) error {
+	if l.appendErr != nil {
+		return l.appendErr
+	}
+	if l.file == nil {
+		if err := l.openLastSegment(); err != nil {
 			return err
 		}
-		err = seg.Deserialize(file)
-		if err != nil {
+	}
+	// check if need to create new segment
+	if l.fileSize > 0 && l.fileSize+int64(len(record)) > l.maxSegSize {
+		// the finished segment is never written again, make it durable before leaving it
+		if l.fsyncPolicy != FsyncNo {
+			l.syncLocked()
+		}
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+		l.lastIndex++
+		l.lastFilePath = ""
+		if err := l.openLastSegment(); err != nil {
 			return err
 		}
 	}
-	seg.Blocks = append(seg.Blocks, block)
-	// write to file
-	segReader, err := seg.Serialize()
+	n, err := l.file.Write(record)
 	if err != nil {
+		// cut the partial record off, later records must not follow a torn one
+		if n > 0 && l.file.Truncate(l.fileSize) != nil {
+			l.fileSize += int64(n)
+			l.totalSize += int64(n)
+		}
 		return err
 	}
-	var buf bytes.Buffer
-	_, err = buf.ReadFrom(segReader)
-	if err != nil {
-		return err
+	l.fileSize += int64(n)
+	l.totalSize += int64(n)
+	l.dirty = true
+	return nil
+}
+
+// Size returns the size of all segments and the size right after the last rewrite
+func (l *Log) Size() (total int64, base int64) {
+	l.Lock()
+	defer l.Unlock()
+	return l.totalSize, l.baseSize
+}
+
+// Position returns the end of the log
+func (l *Log) Position() (LogPosition, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		if err := l.openLastSegment(); err != nil {
+			return LogPosition{}, err
+		}
+	}
+	return LogPosition{Generation: l.generation, Segment: l.lastIndex, Offset: l.fileSize}, nil
+}
+
+// Contains reports whether pos points into the current generation of the log
+func (l *Log) Contains(pos LogPosition) bool {
+	l.Lock()
+	defer l.Unlock()
+	if pos.Generation != l.generation {
+		return false
+	}
+	segFile, ok := l.indexToSegFile[pos.Segment]
+	if !ok {
+		return false
+	}
+	stat, err := os.Stat(segFile)
+	return err == nil && pos.Offset <= stat.Size()
+}
+
+// Sync flushes the open segment to stable storage
+func (l *Log) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.syncLocked()
+}
+
+func (l *Log) syncLocked() error {
+	if l.file == nil || !l.dirty {
+		return nil
+	}
+	var err error
+	if l.syncFile != nil {
+		err = l.syncFile(l.file)
+	} else {
+		err = l.file.Sync()
 	}
-	err = os.WriteFile(l.lastFilePath, buf.Bytes(), os.ModePerm)
 	if err != nil {
+		l.fsyncErr = err
+		l.fsyncErrors++
 		return err
 	}
-	if _, exist := l.indexToSegFile[seg.Index]; !exist {
-		l.indexToSegFile[seg.Index] = l.lastFilePath
-	}
+	l.dirty = false
+	l.fsyncErr = nil
+	l.lastFsync = time.Now()
 	return nil
 }
 
+func (l *Log) syncLoop(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (l *Log) FsyncStatus() FsyncStatus {
+	l.Lock()
+	defer l.Unlock()
+	return FsyncStatus{
+		Policy:      l.fsyncPolicy,
+		LastFsync:   l.lastFsync,
+		LastError:   l.fsyncErr,
+		TotalErrors: l.fsyncErrors,
+	}
+}
+
+func (l *Log) Close() error {
+	if l.stopSync != nil {
+		close(l.stopSync)
+		<-l.syncDone
+		l.stopSync = nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.syncLocked()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+func (l *Log) segmentIndexes() []int {
+	indexes := make([]int, 0, len(l.indexToSegFile))
+	for index := range l.indexToSegFile {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
 type LogIterator struct {
-	log           *Log
-	curBlockIndex int
-	curSegIndex   int
-	curSeg        *Segment
-	empty         bool
+	log         *Log
+	segIndexes  []int
+	curSegIndex int
+	curSeg      *SegmentReader
+	// offset to start reading the first segment at
+	startOffset int64
+	// start of the record Next returned last
+	recordSegment int
+	recordOffset  int64
+	err           error
 }
 
 func (l *Log) NewLogIterator() (*LogIterator, error) {
 	iter := &LogIterator{
-		log:           l,
-		curBlockIndex: 0,
-	}
-	if len(l.indexToSegFile) == 0 {
-		iter.empty = true
-		return iter, nil
+		log:         l,
+		segIndexes:  l.segmentIndexes(),
+		curSegIndex: -1,
 	}
-	initSeg, err := OpenSegment(l.indexToSegFile[0])
-	if err != nil {
-		return nil, err
-	}
-	iter.curSeg = initSeg
 	return iter, nil
 }
 
-func (it *LogIterator) Next() *Block {
-	if it.empty {
-		return nil
+// NewLogIteratorFrom iterates the records appended after pos, see Contains
+func (l *Log) NewLogIteratorFrom(pos LogPosition) (*LogIterator, error) {
+	if !l.Contains(pos) {
+		return nil, fmt.Errorf("aof position %+v is not in the log", pos)
 	}
-	if it.curSegIndex >= len(it.log.indexToSegFile) {
-		return nil
+	segIndexes := make([]int, 0)
+	for _, index := range l.segmentIndexes() {
+		if index >= pos.Segment {
+			segIndexes = append(segIndexes, index)
+		}
 	}
-	if it.curBlockIndex >= len(it.curSeg.Blocks) {
-		// next segment
-		it.curSegIndex++
-		if it.curSegIndex >= len(it.log.indexToSegFile) {
-			return nil
+	return &LogIterator{
+		log:         l,
+		segIndexes:  segIndexes,
+		curSegIndex: -1,
+		startOffset: pos.Offset,
+	}, nil
+}
+
+// Next returns the next block or nil when the log is exhausted or a read failed, see Err
+func (it *LogIterator) Next() *Block {
+	for it.err == nil {
+		if it.curSeg == nil {
+			it.curSegIndex++
+			if it.curSegIndex >= len(it.segIndexes) {
+				return nil
+			}
+			var offset int64
+			if it.curSegIndex == 0 {
+				offset = it.startOffset
+			}
+			seg, err := it.log.openSegment(it.log.indexToSegFile[it.segIndexes[it.curSegIndex]], offset)
+			if err != nil {
+				it.err = err
+				return nil
+			}
+			it.curSeg = seg
 		}
-		seg, err := OpenSegment(it.log.indexToSegFile[it.curSegIndex])
-		if err != nil {
-			return nil
+		offset := it.curSeg.Offset()
+		block, err := it.curSeg.Next()
+		if err == nil {
+			it.recordSegment, it.recordOffset = it.segIndexes[it.curSegIndex], offset
+			return block
 		}
-		it.curSeg = seg
-		it.curBlockIndex = 0
+		it.curSeg.Close()
+		if err != io.EOF {
+			it.err = &CorruptRecordError{Segment: it.segIndexes[it.curSegIndex], Offset: it.curSeg.Offset(), Err: err}
+		}
+		it.curSeg = nil
 	}
-	block := it.curSeg.Blocks[it.curBlockIndex]
-	it.curBlockIndex++
-	return block
+	return nil
+}
+
+// Corrupt locates the record Next returned last, for a record that reads back fine
+// but does not decode
+func (it *LogIterator) Corrupt(err error) *CorruptRecordError {
+	return &CorruptRecordError{Segment: it.recordSegment, Offset: it.recordOffset, Err: err}
+}
+
+// Err returns the error that stopped the iteration
+func (it *LogIterator) Err() error {
+	return it.err
 }
@@ -3,9 +3,8 @@ package polarisdb
 import (
 	"bytes"
 	"encoding/gob"
-	"errors"
+	"fmt"
 	"io"
-	"time"
 )
 
 type ActionType int
@@ -26,6 +25,17 @@ const (
 	DelAction
 	ZAddAction
 	ZRemAction
+	BatchAction
+	UnlinkAction
+	RenameAction
+	RenameNXAction
+	CopyAction
+	PersistAction
+	SelectAction
+	MoveAction
+	SwapDBAction
+	FlushDBAction
+	FlushAllAction
 )
 
 type ActionBlock struct {
@@ -65,22 +75,143 @@ func GenerateActionBlock(action interface{}, actionType ActionType) (*ActionBloc
 	}, nil
 }
 
+// BatchAct carries every action of one transaction in a single aof record,
+// a torn record drops the whole transaction so replay never applies half of it
+type BatchAct struct {
+	Blocks []ActionBlock
+}
+
+func (a *BatchAct) Write(tx *TX) (err error) {
+	for i := range a.Blocks {
+		if err = applyActionBlock(tx, &a.Blocks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *BatchAct) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, BatchAction)
+}
+
+func (a *BatchAct) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+// encodeWriters serializes the actions of a transaction into the data of one aof record
+func encodeWriters(writers []DataWriter) ([]byte, error) {
+	if len(writers) == 1 {
+		block, err := writers[0].GetActionBlock()
+		if err != nil {
+			return nil, err
+		}
+		return block.Serialize()
+	}
+	batch := &BatchAct{Blocks: make([]ActionBlock, 0, len(writers))}
+	for _, writer := range writers {
+		block, err := writer.GetActionBlock()
+		if err != nil {
+			return nil, err
+		}
+		batch.Blocks = append(batch.Blocks, *block)
+	}
+	block, err := batch.GetActionBlock()
+	if err != nil {
+		return nil, err
+	}
+	return block.Serialize()
+}
+
+// applyActionBlock replays one logged action, only undecodable blocks are reported,
+// an action that no longer applies (e.g. expire of a gone key) is skipped like it was at runtime
+func applyActionBlock(tx *TX, block *ActionBlock) error {
+	var action interface {
+		DataWriter
+		Deserialize(reader io.Reader) error
+	}
+	switch block.Type {
+	case SetStringAction:
+		action = &StringAct{}
+	case SetExpireAction:
+		action = &ExpireAct{}
+	case GetDelAction:
+		action = &StringDelAction{}
+	case GetExAction:
+		action = &SetExAction{}
+	case HSetAction:
+		action = &HashHSetAction{}
+	case HDelAction:
+		action = &HashHDelAction{}
+	case LPushAction:
+		action = &ListLPushAction{}
+	case LPopAction:
+		action = &ListLPopAction{}
+	case LInsertAction:
+		action = &ListInsertAction{}
+	case SAddAction:
+		action = &SetAddAction{}
+	case SRemAction:
+		action = &SetRemAction{}
+	case ZAddAction:
+		action = &ZsetAddAction{}
+	case ZRemAction:
+		action = &ZsetRemAction{}
+	case DelAction:
+		action = &KeyDelAction{}
+	case UnlinkAction:
+		action = &KeyUnlinkAction{}
+	case RenameAction:
+		action = &KeyRenameAction{}
+	case RenameNXAction:
+		action = &KeyRenameNXAction{}
+	case CopyAction:
+		action = &KeyCopyAction{}
+	case PersistAction:
+		action = &KeyPersistAction{}
+	case SelectAction:
+		// the following actions must not land in another database
+		selectAct := &SelectAct{}
+		if err := selectAct.Deserialize(bytes.NewBuffer(block.Data)); err != nil {
+			return err
+		}
+		return selectAct.Write(tx)
+	case MoveAction:
+		action = &KeyMoveAction{}
+	case SwapDBAction:
+		action = &SwapDBAct{}
+	case FlushDBAction:
+		action = &FlushDBAct{}
+	case FlushAllAction:
+		action = &FlushAllAct{}
+	case BatchAction:
+		batch := &BatchAct{}
+		if err := batch.Deserialize(bytes.NewBuffer(block.Data)); err != nil {
+			return err
+		}
+		return batch.Write(tx)
+	default:
+		return fmt.Errorf("unknown action type %d", block.Type)
+	}
+	if err := action.Deserialize(bytes.NewBuffer(block.Data)); err != nil {
+		return err
+	}
+	action.Write(tx)
+	return nil
+}
+
 type ExpireAct struct {
 	Key string
 	TTL int64
 }
 
-func (a *ExpireAct) Write(db *PolarisDB) (err error) {
-	// check if key exists
-	_, isExist := db.Dict.Find(a.Key)
+func (a *ExpireAct) Write(tx *TX) (err error) {
+	// check if key exists, the ttl may already have passed when the action is applied
+	_, isExist := tx.lookup(a.Key, false)
 	if !isExist {
-		return errors.New("key not exist")
+		return ErrKeyNotFound
 	}
-	if a.TTL == -1 {
-		return SetExpire(db, a.Key, -1)
-	}
-	a.TTL = time.Now().Unix() + a.TTL
-	return SetExpire(db, a.Key, a.TTL)
+	// TTL is the absolute deadline in milliseconds, -1 removes the ttl
+	return SetExpire(tx, a.Key, a.TTL)
 }
 
 func (a *ExpireAct) Deserialize(reader io.Reader) error {
@@ -95,8 +226,8 @@ type HashHSetAction struct {
 	Paris []Paris
 }
 
-func (a *HashHSetAction) Write(db *PolarisDB) (err error) {
-	return SetHashField(db, string(a.Key), a.Paris...)
+func (a *HashHSetAction) Write(tx *TX) (err error) {
+	return SetHashField(tx, string(a.Key), a.Paris...)
 }
 
 func (a *HashHSetAction) Deserialize(reader io.Reader) error {
@@ -112,12 +243,12 @@ type HashHDelAction struct {
 	Fields [][]byte
 }
 
-func (a *HashHDelAction) Write(db *PolarisDB) (err error) {
+func (a *HashHDelAction) Write(tx *TX) (err error) {
 	strs := make([]string, len(a.Fields))
 	for i, field := range a.Fields {
 		strs[i] = string(field)
 	}
-	return HashDeleteFields(db, string(a.Key), strs...)
+	return HashDeleteFields(tx, string(a.Key), strs...)
 }
 
 func (a *HashHDelAction) GetActionBlock() (*ActionBlock, error) {
@@ -132,8 +263,8 @@ type ListLPushAction struct {
 	Data [][]byte
 }
 
-func (a *ListLPushAction) Write(db *PolarisDB) (err error) {
-	_, err = ListPush(db, string(a.Key), a.Data...)
+func (a *ListLPushAction) Write(tx *TX) (err error) {
+	err = ListPush(tx, string(a.Key), a.Data...)
 	if err != nil {
 		return err
 	}
@@ -153,8 +284,8 @@ type ListLPopAction struct {
 	Count int
 }
 
-func (a *ListLPopAction) Write(db *PolarisDB) (err error) {
-	_, err = ListPop(db, string(a.Key), a.Count)
+func (a *ListLPopAction) Write(tx *TX) (err error) {
+	_, err = ListPop(tx, string(a.Key), a.Count)
 	return err
 }
 
@@ -172,8 +303,8 @@ type ListInsertAction struct {
 	Index int
 }
 
-func (a *ListInsertAction) Write(db *PolarisDB) (err error) {
-	return ListInsert(db, string(a.Key), a.Index, a.Data)
+func (a *ListInsertAction) Write(tx *TX) (err error) {
+	return ListInsert(tx, string(a.Key), a.Index, a.Data)
 }
 
 func (a *ListInsertAction) GetActionBlock() (*ActionBlock, error) {
@@ -189,8 +320,8 @@ type SetAddAction struct {
 	Value []interface{}
 }
 
-func (a *SetAddAction) Write(db *PolarisDB) (err error) {
-	_, err = SetAdd(db, a.Key, a.Value...)
+func (a *SetAddAction) Write(tx *TX) (err error) {
+	err = SetAdd(tx, a.Key, a.Value...)
 	if err != nil {
 		return err
 	}
@@ -210,8 +341,8 @@ type SetRemAction struct {
 	Value []interface{}
 }
 
-func (a *SetRemAction) Write(db *PolarisDB) (err error) {
-	_, err = SetRemove(db, a.Key, a.Value...)
+func (a *SetRemAction) Write(tx *TX) (err error) {
+	err = SetRemove(tx, a.Key, a.Value...)
 	if err != nil {
 		return err
 	}
@@ -237,8 +368,8 @@ type StringAct struct {
 	KeepTTL bool
 }
 
-func (a *StringAct) Write(db *PolarisDB) (err error) {
-	WriteStringToStore(db, []byte(a.Key), []byte(a.Data), a.KeepTTL)
+func (a *StringAct) Write(tx *TX) (err error) {
+	WriteStringToStore(tx, []byte(a.Key), []byte(a.Data), a.KeepTTL)
 	return nil
 }
 
@@ -253,11 +384,8 @@ type StringDelAction struct {
 	Key string
 }
 
-func (a *StringDelAction) Write(db *PolarisDB) (err error) {
-	err = db.StringStore.delete([]byte(a.Key))
-	if err != nil {
-		return err
-	}
+func (a *StringDelAction) Write(tx *TX) (err error) {
+	tx.delete(a.Key)
 	return nil
 }
 
@@ -274,8 +402,8 @@ type SetExAction struct {
 	TTL int64
 }
 
-func (a *SetExAction) Write(db *PolarisDB) (err error) {
-	db.Sweeper.SetKeyExpire(a.Key, a.TTL)
+func (a *SetExAction) Write(tx *TX) (err error) {
+	tx.setExpire(a.Key, a.TTL)
 	return nil
 }
 
@@ -292,8 +420,8 @@ type ZsetAddAction struct {
 	Pairs []ZsetPair
 }
 
-func (a *ZsetAddAction) Write(db *PolarisDB) (err error) {
-	_, err = ZsetAdd(db, a.Key, a.Pairs...)
+func (a *ZsetAddAction) Write(tx *TX) (err error) {
+	err = ZsetAdd(tx, a.Key, a.Pairs...)
 	return err
 }
 
@@ -310,8 +438,8 @@ type ZsetRemAction struct {
 	Members []string
 }
 
-func (a *ZsetRemAction) Write(db *PolarisDB) (err error) {
-	_, err = ZsetRemove(db, a.Key, a.Members...)
+func (a *ZsetRemAction) Write(tx *TX) (err error) {
+	err = ZsetRemove(tx, a.Key, a.Members...)
 	return err
 }
 
@@ -322,3 +450,196 @@ func (a *ZsetRemAction) GetActionBlock() (*ActionBlock, error) {
 func (a *ZsetRemAction) Deserialize(reader io.Reader) error {
 	return gob.NewDecoder(reader).Decode(a)
 }
+
+type KeyDelAction struct {
+	Keys []string
+}
+
+func (a *KeyDelAction) Write(tx *TX) (err error) {
+	KeyDelete(tx, a.Keys...)
+	return nil
+}
+
+func (a *KeyDelAction) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, DelAction)
+}
+
+func (a *KeyDelAction) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+type KeyUnlinkAction struct {
+	Keys []string
+}
+
+func (a *KeyUnlinkAction) Write(tx *TX) (err error) {
+	KeyDelete(tx, a.Keys...)
+	return nil
+}
+
+func (a *KeyUnlinkAction) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, UnlinkAction)
+}
+
+func (a *KeyUnlinkAction) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+type KeyRenameAction struct {
+	Key    string
+	NewKey string
+}
+
+func (a *KeyRenameAction) Write(tx *TX) (err error) {
+	_, err = KeyRename(tx, a.Key, a.NewKey, false)
+	return err
+}
+
+func (a *KeyRenameAction) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, RenameAction)
+}
+
+func (a *KeyRenameAction) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+type KeyRenameNXAction struct {
+	Key    string
+	NewKey string
+}
+
+func (a *KeyRenameNXAction) Write(tx *TX) (err error) {
+	_, err = KeyRename(tx, a.Key, a.NewKey, true)
+	return err
+}
+
+func (a *KeyRenameNXAction) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, RenameNXAction)
+}
+
+func (a *KeyRenameNXAction) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+type KeyCopyAction struct {
+	Source      string
+	Destination string
+	Replace     bool
+}
+
+func (a *KeyCopyAction) Write(tx *TX) (err error) {
+	_, err = KeyCopy(tx, a.Source, a.Destination, a.Replace)
+	return err
+}
+
+func (a *KeyCopyAction) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, CopyAction)
+}
+
+func (a *KeyCopyAction) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+type KeyPersistAction struct {
+	Key string
+}
+
+func (a *KeyPersistAction) Write(tx *TX) (err error) {
+	KeyPersist(tx, a.Key)
+	return nil
+}
+
+func (a *KeyPersistAction) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, PersistAction)
+}
+
+func (a *KeyPersistAction) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+// SelectAct switches the database the following actions of the record apply to
+type SelectAct struct {
+	Index int
+}
+
+func (a *SelectAct) Write(tx *TX) (err error) {
+	return tx.Select(a.Index)
+}
+
+func (a *SelectAct) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, SelectAction)
+}
+
+func (a *SelectAct) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+type KeyMoveAction struct {
+	Key string
+	DB  int
+}
+
+func (a *KeyMoveAction) Write(tx *TX) (err error) {
+	_, err = KeyMove(tx, a.Key, a.DB)
+	return err
+}
+
+func (a *KeyMoveAction) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, MoveAction)
+}
+
+func (a *KeyMoveAction) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+type SwapDBAct struct {
+	First  int
+	Second int
+}
+
+func (a *SwapDBAct) Write(tx *TX) (err error) {
+	return SwapDB(tx, a.First, a.Second)
+}
+
+func (a *SwapDBAct) GetActionBlock() (*ActionBlock, error) {
+	return GenerateActionBlock(a, SwapDBAction)
+}
+
+func (a *SwapDBAct) Deserialize(reader io.Reader) error {
+	return gob.NewDecoder(reader).Decode(a)
+}
+
+// FlushDBAct empties the database selected before it
+type FlushDBAct struct {
+}
+
+func (a *FlushDBAct) Write(tx *TX) (err error) {
+	FlushDB(tx)
+	return nil
+}
+
+// GetActionBlock leaves the data empty, gob refuses structs without fields
+func (a *FlushDBAct) GetActionBlock() (*ActionBlock, error) {
+	return &ActionBlock{Type: FlushDBAction}, nil
+}
+
+func (a *FlushDBAct) Deserialize(reader io.Reader) error {
+	return nil
+}
+
+type FlushAllAct struct {
+}
+
+func (a *FlushAllAct) Write(tx *TX) (err error) {
+	FlushAll(tx)
+	return nil
+}
+
+// GetActionBlock leaves the data empty like FlushDBAct
+func (a *FlushAllAct) GetActionBlock() (*ActionBlock, error) {
+	return &ActionBlock{Type: FlushAllAction}, nil
+}
+
+func (a *FlushAllAct) Deserialize(reader io.Reader) error {
+	return nil
+}
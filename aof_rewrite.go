@@ -0,0 +1,368 @@
+package polarisdb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/projectxpolaris/polarisdb/utils"
+)
+
+// A rewrite writes a new generation of segments into its own directory under the
+// aof path and then points the CURRENT file at it. Without a CURRENT file the
+// segments live directly in the aof path, that is generation 0.
+const (
+	currentFileName     = "CURRENT"
+	generationDirPrefix = "aof-"
+	// large collections are split into several actions, same as redis AOF_REWRITE_ITEMS_PER_CMD
+	rewriteItemsPerAction = 64
+)
+
+var ErrRewriteInProgress = errors.New("background append only file rewriting already in progress")
+
+// RewriteStatus reports the state of the aof rewrite
+type RewriteStatus struct {
+	InProgress  bool  `json:"in_progress"`
+	CurrentSize int64 `json:"current_size"`
+	BaseSize    int64 `json:"base_size"`
+	Rewrites    int64 `json:"rewrites"`
+	LastError   error `json:"-"`
+}
+
+func generationDirName(generation int) string {
+	return fmt.Sprintf("%s%d", generationDirPrefix, generation)
+}
+
+// currentSegmentDir returns the directory of the current generation named by the CURRENT file
+func currentSegmentDir(basePath string) (string, int, error) {
+	data, err := os.ReadFile(filepath.Join(basePath, currentFileName))
+	if os.IsNotExist(err) {
+		return basePath, 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	name := strings.TrimSpace(string(data))
+	generation, err := strconv.Atoi(strings.TrimPrefix(name, generationDirPrefix))
+	if !strings.HasPrefix(name, generationDirPrefix) || err != nil {
+		return "", 0, fmt.Errorf("invalid aof manifest %q", name)
+	}
+	return filepath.Join(basePath, name), generation, nil
+}
+
+// removeStaleGenerations removes what an interrupted rewrite or swap left behind
+func removeStaleGenerations(basePath string, generation int) error {
+	items, err := os.ReadDir(basePath)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		name := item.Name()
+		stale := false
+		switch {
+		case item.IsDir() && strings.HasPrefix(name, generationDirPrefix):
+			stale = name != generationDirName(generation)
+		case name == currentFileName+".tmp":
+			stale = true
+		case !item.IsDir() && strings.HasSuffix(name, ".tmp"):
+			// a segment migration that did not finish, the segment itself is untouched
+			_, err := strconv.Atoi(strings.TrimSuffix(name, ".tmp"))
+			stale = err == nil
+		case !item.IsDir() && generation > 0:
+			// segments of generation 0 that were not removed after the swap
+			_, err := strconv.Atoi(name)
+			stale = err == nil
+		}
+		if !stale {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(basePath, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// beginRewrite starts buffering appended records, the caller must make sure no
+// write can happen between taking the snapshot and calling it
+func (l *Log) beginRewrite() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.rewriteBuf != nil {
+		return ErrRewriteInProgress
+	}
+	l.rewriteBuf = make([][]byte, 0)
+	return nil
+}
+
+func (l *Log) abortRewrite(err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.rewriteBuf = nil
+	l.lastRewriteErr = err
+}
+
+// finishRewrite writes the snapshot records into a new generation, appends the records
+// buffered meanwhile and swaps the new generation in
+func (l *Log) finishRewrite(records [][]byte) error {
+	l.Lock()
+	generation := l.generation + 1
+	l.Unlock()
+	dir := filepath.Join(l.basePath, generationDirName(generation))
+	err := l.writeGeneration(dir, generation, records)
+	if err != nil {
+		os.RemoveAll(dir)
+		l.abortRewrite(err)
+	}
+	return err
+}
+
+func (l *Log) writeGeneration(dir string, generation int, records [][]byte) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	// the old generation is deleted after the swap, so every segment of the new one is synced
+	newLog := &Log{
+		basePath:       l.basePath,
+		path:           dir,
+		generation:     generation,
+		maxSegSize:     l.maxSegSize,
+		indexToSegFile: make(map[int]string),
+		fsyncPolicy:    FsyncAlways,
+	}
+	for _, record := range records {
+		if err := newLog.appendRecord(record); err != nil {
+			newLog.Close()
+			return err
+		}
+	}
+	l.Lock()
+	defer l.Unlock()
+	for _, record := range l.rewriteBuf {
+		if err := newLog.appendRecord(record); err != nil {
+			newLog.Close()
+			return err
+		}
+	}
+	if newLog.file == nil {
+		// keep an empty segment so the generation is never mistaken for a missing one
+		if err := newLog.openLastSegment(); err != nil {
+			return err
+		}
+	}
+	if err := newLog.syncLocked(); err != nil {
+		newLog.file.Close()
+		return err
+	}
+	tmpPath := filepath.Join(l.basePath, currentFileName+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(generationDirName(generation)+"\n"), 0644); err != nil {
+		newLog.file.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(l.basePath, currentFileName)); err != nil {
+		newLog.file.Close()
+		return err
+	}
+	if err := syncDir(l.basePath); err != nil {
+		log.Printf("aof: sync %s: %v", l.basePath, err)
+	}
+	// the new generation is live from here on
+	if l.file != nil {
+		l.file.Close()
+	}
+	oldPath := l.path
+	oldSegFiles := l.indexToSegFile
+	l.path = newLog.path
+	l.generation = generation
+	l.lastIndex = newLog.lastIndex
+	l.lastFilePath = newLog.lastFilePath
+	l.indexToSegFile = newLog.indexToSegFile
+	l.file = newLog.file
+	l.fileSize = newLog.fileSize
+	l.totalSize = newLog.totalSize
+	l.baseSize = newLog.totalSize
+	l.dirty = false
+	l.rewriteBuf = nil
+	l.rewrites++
+	l.lastRewriteErr = nil
+	if oldPath == l.basePath {
+		for _, segFile := range oldSegFiles {
+			os.Remove(segFile)
+		}
+	} else {
+		os.RemoveAll(oldPath)
+	}
+	return nil
+}
+
+func (l *Log) RewriteStatus() RewriteStatus {
+	l.Lock()
+	defer l.Unlock()
+	return RewriteStatus{
+		InProgress:  l.rewriteBuf != nil,
+		CurrentSize: l.totalSize,
+		BaseSize:    l.baseSize,
+		Rewrites:    l.rewrites,
+		LastError:   l.lastRewriteErr,
+	}
+}
+
+// RewriteAof compacts the aof into the fewest actions that rebuild the current data set
+func (db *PolarisDB) RewriteAof() error {
+	records, err := db.snapshotRecords()
+	if err != nil {
+		return err
+	}
+	return db.Log.finishRewrite(records)
+}
+
+// BackgroundRewriteAof starts RewriteAof in the background, writes go on while the new
+// segments are written and end up in both generations
+func (db *PolarisDB) BackgroundRewriteAof() error {
+	if !atomic.CompareAndSwapInt32(&db.aofRewriting, 0, 1) {
+		return ErrRewriteInProgress
+	}
+	db.goBackground(func() {
+		defer atomic.StoreInt32(&db.aofRewriting, 0)
+		if err := db.RewriteAof(); err != nil {
+			log.Printf("aof: background rewrite failed: %v", err)
+		}
+	})
+	return nil
+}
+
+// maybeRewriteAof starts a background rewrite once the aof has grown by
+// AofRewritePercentage since the last rewrite
+func (db *PolarisDB) maybeRewriteAof() {
+	if db.Config.AofRewritePercentage <= 0 || atomic.LoadInt32(&db.aofRewriting) == 1 {
+		return
+	}
+	total, base := db.Log.Size()
+	if total < db.Config.AofRewriteMinSize {
+		return
+	}
+	if base == 0 {
+		base = 1
+	}
+	if (total-base)*100/base >= db.Config.AofRewritePercentage {
+		db.BackgroundRewriteAof()
+	}
+}
+
+// snapshotRecords serializes the live keys, writes are blocked until the log buffers them
+func (db *PolarisDB) snapshotRecords() ([][]byte, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if err := db.Log.beginRewrite(); err != nil {
+		return nil, err
+	}
+	records := make([][]byte, 0, db.Keyspaces[0].Dict.Len())
+	now := time.Now().UnixMilli()
+	for index, ks := range db.Keyspaces {
+		for _, key := range ks.Dict.Keys() {
+			ent, isExist := ks.Dict.FindRaw(key)
+			if !isExist {
+				continue
+			}
+			ttl := ks.Sweeper.GetExpire(key)
+			if ttl != noExpire && ttl < now {
+				continue
+			}
+			writers, err := db.rewriteWriters(key, ent)
+			if err != nil {
+				db.Log.abortRewrite(err)
+				return nil, err
+			}
+			if ttl != noExpire {
+				writers = append(writers, &SetExAction{Key: key, TTL: ttl})
+			}
+			// a record starts in database 0, the keys of the others carry their index
+			if index != 0 {
+				writers = append([]DataWriter{&SelectAct{Index: index}}, writers...)
+			}
+			data, err := encodeWriters(writers)
+			if err != nil {
+				db.Log.abortRewrite(err)
+				return nil, err
+			}
+			records = append(records, encodeRecord(&Block{Data: data}))
+		}
+	}
+	return records, nil
+}
+
+// rewriteWriters returns the actions that recreate the value of one key
+func (db *PolarisDB) rewriteWriters(key string, ent *KeyEntity) ([]DataWriter, error) {
+	writers := make([]DataWriter, 0, 1)
+	switch obj := ent.Ptr.(type) {
+	case *StringStore:
+		data, err := obj.read([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, &StringAct{Key: key, Data: string(data)})
+	case *HashObject:
+		action := &HashHSetAction{Key: []byte(key)}
+		for field, value := range obj.GetAll() {
+			if len(action.Paris) == rewriteItemsPerAction {
+				writers = append(writers, action)
+				action = &HashHSetAction{Key: []byte(key)}
+			}
+			action.Paris = append(action.Paris, Paris{Field: []byte(field), Value: []byte(utils.ToString(value))})
+		}
+		writers = append(writers, action)
+	case *ListObject:
+		action := &ListLPushAction{Key: []byte(key)}
+		it := obj.Data.GetIterator()
+		for data := it.Next(); data != nil; data = it.Next() {
+			if len(action.Data) == rewriteItemsPerAction {
+				writers = append(writers, action)
+				action = &ListLPushAction{Key: []byte(key)}
+			}
+			action.Data = append(action.Data, data)
+		}
+		writers = append(writers, action)
+	case *SetObject:
+		action := &SetAddAction{Key: key}
+		for _, member := range obj.Data.Members() {
+			if len(action.Value) == rewriteItemsPerAction {
+				writers = append(writers, action)
+				action = &SetAddAction{Key: key}
+			}
+			action.Value = append(action.Value, member)
+		}
+		writers = append(writers, action)
+	case *ZsetObject:
+		action := &ZsetAddAction{Key: key}
+		members := obj.Data.ZRangeWithScores(0, -1)
+		for i := 0; i+1 < len(members); i += 2 {
+			if len(action.Pairs) == rewriteItemsPerAction {
+				writers = append(writers, action)
+				action = &ZsetAddAction{Key: key}
+			}
+			action.Pairs = append(action.Pairs, ZsetPair{Member: members[i].(string), Score: members[i+1].(float64)})
+		}
+		writers = append(writers, action)
+	default:
+		return nil, fmt.Errorf("aof rewrite: unknown type %T of key %s", ent.Ptr, key)
+	}
+	return writers, nil
+}
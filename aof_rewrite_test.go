@@ -0,0 +1,176 @@
+package polarisdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func reopenTestDB(t *testing.T, db *PolarisDB) *PolarisDB {
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := NewDB(&DBConfig{Path: db.Config.Path})
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return reopened
+}
+
+func TestPolarisDB_RewriteAof(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	err := db.Update(func(tx *TX) error {
+		if err := tx.SetString("counter", "0", false); err != nil {
+			return err
+		}
+		if err := tx.HSet("hash", Paris{Field: []byte("f"), Value: []byte("v")}); err != nil {
+			return err
+		}
+		if err := tx.LPush("list", []byte("a"), []byte("b"), []byte("c")); err != nil {
+			return err
+		}
+		if err := tx.SAdd("set", "a", int64(1)); err != nil {
+			return err
+		}
+		if err := tx.ZAdd("zset", ZsetPair{Member: "m", Score: 1.5}); err != nil {
+			return err
+		}
+		if err := tx.SetString("ttl", "v", false); err != nil {
+			return err
+		}
+		return tx.SetString("expired", "v", false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = db.Update(func(tx *TX) error { return tx.Incr("counter") }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ttl := time.Now().Add(time.Hour).UnixMilli()
+	db.Keyspaces[0].Sweeper.SetKeyExpire("ttl", ttl)
+	db.Keyspaces[0].Sweeper.SetKeyExpire("expired", time.Now().Add(-time.Second).UnixMilli())
+	// the rewrite keeps the order of the values, not just their number
+	expectList := func(db *PolarisDB, when string) {
+		db.View(func(tx *TX) error {
+			values, err := tx.LRange("list", 0, 2)
+			if got := fmt.Sprintf("%s", values); err != nil || got != "[a b c]" {
+				t.Fatalf("%s: expect list [a b c] got %s %v", when, got, err)
+			}
+			return nil
+		})
+		if values, err := db.Exec("lrange", "list", "0", "-1"); err != nil || fmt.Sprint(values) != "[c b a]" {
+			t.Fatalf("%s: expect lrange [c b a] got %v %v", when, values, err)
+		}
+	}
+	expectList(db, "before the rewrite")
+
+	before, _ := db.Log.Size()
+	if err = db.RewriteAof(); err != nil {
+		t.Fatal(err)
+	}
+	after, base := db.Log.Size()
+	if after >= before || after != base {
+		t.Fatalf("expect the log to shrink, before %d after %d base %d", before, after, base)
+	}
+	if _, err = os.Stat(filepath.Join("./tmp", "aof-1", "0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join("./tmp", "0")); !os.IsNotExist(err) {
+		t.Fatal("expect old segments to be removed")
+	}
+	expectList(db, "after the rewrite")
+
+	db = reopenTestDB(t, db)
+	expectList(db, "after reopening")
+	err = db.View(func(tx *TX) error {
+		if val, err := tx.Get("counter"); err != nil || val != "100" {
+			t.Fatalf("expect counter 100 got %s %v", val, err)
+		}
+		if val, err := tx.HGet("hash", "f"); err != nil || val != "v" {
+			t.Fatalf("expect hash field v got %s %v", val, err)
+		}
+		if n, err := tx.SCard("set"); err != nil || n != 2 {
+			t.Fatalf("expect set card 2 got %d %v", n, err)
+		}
+		if score, err := tx.ZScore("zset", "m"); err != nil || score != 1.5 {
+			t.Fatalf("expect score 1.5 got %v %v", score, err)
+		}
+		if exist, _ := tx.Exists("expired"); exist {
+			t.Fatal("expect expired key to be dropped")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Keyspaces[0].Sweeper.GetExpire("ttl") != ttl {
+		t.Fatalf("expect ttl %d got %d", ttl, db.Keyspaces[0].Sweeper.GetExpire("ttl"))
+	}
+}
+
+func TestPolarisDB_RewriteAofBuffersWrites(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	if err := db.Update(func(tx *TX) error { return tx.SetString("before", "1", false) }); err != nil {
+		t.Fatal(err)
+	}
+	records, err := db.snapshotRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.snapshotRecords(); err != ErrRewriteInProgress {
+		t.Fatalf("expect ErrRewriteInProgress got %v", err)
+	}
+	// written after the snapshot, only the rewrite buffer carries it into the new generation
+	if err = db.Update(func(tx *TX) error { return tx.SetString("during", "1", false) }); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Log.finishRewrite(records); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTestDB(t, db)
+	db.View(func(tx *TX) error {
+		for _, key := range []string{"before", "during"} {
+			if exist, _ := tx.Exists(key); !exist {
+				t.Fatalf("expect key %s after rewrite", key)
+			}
+		}
+		return nil
+	})
+}
+
+func TestLog_OpenRemovesStaleGenerations(t *testing.T) {
+	l := Log{}
+	if err := l.Open("./tmp"); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	if err := l.Append(&Block{Data: []byte("Hello")}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	// a rewrite that crashed before the swap
+	os.MkdirAll(filepath.Join("./tmp", "aof-1"), os.ModePerm)
+	os.WriteFile(filepath.Join("./tmp", "aof-1", "0"), []byte("partial"), 0644)
+	l = Log{}
+	if err := l.Open("./tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join("./tmp", "aof-1")); !os.IsNotExist(err) {
+		t.Fatal("expect unfinished generation to be removed")
+	}
+	if len(l.indexToSegFile) != 1 {
+		t.Fatalf("expect 1 segment got %d", len(l.indexToSegFile))
+	}
+}
@@ -1,8 +1,15 @@
 package polarisdb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLog_Open(t *testing.T) {
@@ -68,10 +75,359 @@ func TestLogIterator_Next(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	count := 0
 	for {
 		block := iter.Next()
 		if block == nil {
 			break
 		}
+		if string(block.Data) != fmt.Sprintf("Hello %d", count) {
+			t.Fatalf("unexpected block %s", block.Data)
+		}
+		count++
+	}
+	if iter.Err() != nil {
+		t.Fatal(iter.Err())
+	}
+	if count != 100 {
+		t.Fatalf("expect 100 blocks got %d", count)
+	}
+	if len(l.indexToSegFile) < 2 {
+		t.Fatal("segments not rolled over")
+	}
+}
+
+func TestLog_AppendOnly(t *testing.T) {
+	l := Log{}
+	err := l.Open("./tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	err = l.Append(&Block{Data: []byte("Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(l.lastFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(&Block{Data: []byte("World")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	data, err := os.ReadFile(l.lastFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first record must stay untouched
+	if int64(len(data)) != stat.Size()+recordHeaderSize+5 {
+		t.Fatalf("unexpected segment size %d", len(data))
+	}
+	// a torn record only fails itself
+	err = os.WriteFile(l.lastFilePath, data[:len(data)-2], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenSegment(l.lastFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	block, err := reader.Next()
+	if err != nil || string(block.Data) != "Hello" {
+		t.Fatal("first record must be readable")
+	}
+	if _, err = reader.Next(); !errors.Is(err, ErrTruncatedRecord) {
+		t.Fatalf("expect truncated record error got %v", err)
+	}
+}
+
+func TestLog_RecoverTornTail(t *testing.T) {
+	l := Log{}
+	err := l.Open("./tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for i := 0; i < 3; i++ {
+		err = l.Append(&Block{Data: []byte(fmt.Sprintf("Hello %d", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	data, _ := os.ReadFile(l.lastFilePath)
+	err = os.WriteFile(l.lastFilePath, data[:len(data)-3], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refuse := Log{refuseTornTail: true}
+	err = refuse.Open("./tmp")
+	var corruptErr *CorruptRecordError
+	if !errors.As(err, &corruptErr) || corruptErr.Segment != 0 || corruptErr.Offset != 2*int64(recordHeaderSize+7) {
+		t.Fatalf("expect corrupt record error got %v", err)
+	}
+	l2 := Log{}
+	err = l2.Open("./tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, _ := l2.NewLogIterator()
+	count := 0
+	for iter.Next() != nil {
+		count++
+	}
+	if count != 2 || iter.Err() != nil {
+		t.Fatalf("expect 2 records after truncation got %d %v", count, iter.Err())
+	}
+	// appending continues after the good records
+	err = l2.Append(&Block{Data: []byte("Hello 2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.Close()
+}
+
+func TestLog_RecoverZeroTail(t *testing.T) {
+	l := Log{maxSegSize: 1024}
+	err := l.Open("./tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for i := 0; i < 3; i++ {
+		if err = l.Append(&Block{Data: []byte(fmt.Sprintf("Hello %d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	data, _ := os.ReadFile(l.lastFilePath)
+	good := int64(len(data))
+	// a zeroed tail and a length no segment holds are both cut off
+	oversized := make([]byte, recordHeaderSize+16)
+	binary.BigEndian.PutUint32(oversized, 0xffffffff)
+	for _, tail := range [][]byte{make([]byte, 64), oversized} {
+		if err = os.WriteFile(l.lastFilePath, append(append([]byte{}, data...), tail...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l2 := Log{maxSegSize: 1024}
+		if err = l2.Open("./tmp"); err != nil {
+			t.Fatal(err)
+		}
+		l2.Close()
+		if stat, _ := os.Stat(l.lastFilePath); stat.Size() != good {
+			t.Fatalf("expect the tail to be truncated to %d got %d", good, stat.Size())
+		}
+	}
+	// zeros followed by data are not a tail
+	if err = os.WriteFile(l.lastFilePath, append(append(append([]byte{}, data...), make([]byte, 16)...), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l3 := Log{maxSegSize: 1024}
+	if err = l3.Open("./tmp"); !errors.Is(err, ErrEmptyRecord) {
+		t.Fatalf("expect an empty record error got %v", err)
+	}
+}
+
+func TestLog_CorruptMiddleRecord(t *testing.T) {
+	l := Log{}
+	err := l.Open("./tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for i := 0; i < 3; i++ {
+		err = l.Append(&Block{Data: []byte(fmt.Sprintf("Hello %d", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	data, _ := os.ReadFile(l.lastFilePath)
+	// flip a data byte of the second record
+	data[2*recordHeaderSize+7+1] ^= 0xff
+	err = os.WriteFile(l.lastFilePath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := Log{}
+	err = l2.Open("./tmp")
+	var corruptErr *CorruptRecordError
+	if !errors.As(err, &corruptErr) || !errors.Is(err, ErrChecksumMismatch) || corruptErr.Offset != int64(recordHeaderSize+7) {
+		t.Fatalf("expect checksum error at the second record got %v", err)
+	}
+}
+
+func TestLog_CorruptMiddleLength(t *testing.T) {
+	l := Log{}
+	err := l.Open("./tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for i := 0; i < 3; i++ {
+		err = l.Append(&Block{Data: []byte(fmt.Sprintf("Hello %d", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	data, _ := os.ReadFile(l.lastFilePath)
+	// the second length reaches past the end but the third record is still there
+	binary.BigEndian.PutUint32(data[recordHeaderSize+7:], 1000)
+	err = os.WriteFile(l.lastFilePath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := Log{}
+	err = l2.Open("./tmp")
+	var corruptErr *CorruptRecordError
+	if !errors.As(err, &corruptErr) || !errors.Is(err, ErrTruncatedRecord) || corruptErr.Offset != int64(recordHeaderSize+7) {
+		t.Fatalf("expect truncated record error at the second record got %v", err)
+	}
+	if stat, _ := os.Stat(l.lastFilePath); stat.Size() != int64(len(data)) {
+		t.Fatalf("expect the segment to be kept got %d bytes", stat.Size())
+	}
+}
+
+func TestLog_Sync(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", AppendFsync: FsyncAlways})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	if !db.AofFsyncStatus().LastFsync.IsZero() {
+		t.Fatal("nothing was written yet")
+	}
+	err = db.Update(func(tx *TX) error {
+		return tx.SetString("foo", "bar", false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := db.AofFsyncStatus()
+	if status.Policy != FsyncAlways || status.LastFsync.IsZero() || status.LastError != nil {
+		t.Fatalf("expect fsync on commit got %+v", status)
+	}
+	if !strings.Contains(db.Info("persistence"), "aof_last_fsync_status:ok") {
+		t.Fatal("fsync status missing from info")
+	}
+	db.Log.Close()
+}
+
+func TestLog_SyncEverySec(t *testing.T) {
+	l := Log{fsyncPolicy: FsyncEverySec}
+	err := l.Open("./tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	defer l.Close()
+	err = l.Append(&Block{Data: []byte("Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(1500 * time.Millisecond)
+	if l.FsyncStatus().LastFsync.IsZero() {
+		t.Fatal("background fsync did not run")
+	}
+}
+
+func TestLog_NewLogIteratorFrom(t *testing.T) {
+	l := Log{
+		maxSegSize: 1024,
+	}
+	if err := l.Open("./tmp"); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for i := 0; i < 100; i++ {
+		if err := l.Append(&Block{Data: []byte(fmt.Sprintf("Hello %d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pos, err := l.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 200; i++ {
+		if err = l.Append(&Block{Data: []byte(fmt.Sprintf("Hello %d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter, err := l.NewLogIteratorFrom(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 100
+	for block := iter.Next(); block != nil; block = iter.Next() {
+		if string(block.Data) != fmt.Sprintf("Hello %d", count) {
+			t.Fatalf("expect Hello %d got %s", count, block.Data)
+		}
+		count++
+	}
+	if count != 200 || iter.Err() != nil {
+		t.Fatalf("expect 100 records after the position got %d %v", count-100, iter.Err())
+	}
+	if _, err = l.NewLogIteratorFrom(LogPosition{Generation: 1}); err == nil {
+		t.Fatal("expect an error for a position of another generation")
+	}
+}
+
+func TestLog_MigrateLegacySegment(t *testing.T) {
+	defer cleanTestData()
+	if err := os.MkdirAll("./tmp", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	// the first format kept every block of a segment in one gob
+	seg := legacySegment{Index: 0}
+	for _, act := range []DataWriter{&StringAct{Key: "foo", Data: "bar"}, &StringAct{Key: "baz", Data: "qux"}} {
+		data, err := encodeWriters([]DataWriter{act})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg.Blocks = append(seg.Blocks, &Block{Data: data})
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&seg); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("./tmp/0", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		db := NewDB(&DBConfig{Path: "./tmp"})
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range map[string]string{"foo": "bar", "baz": "qux"} {
+			if got, _ := db.Exec("get", key); got != value {
+				t.Fatalf("expect %s=%s after the migration got %v", key, value, got)
+			}
+		}
+		db.Exec("set", "later", "v")
+		db.Close()
+	}
+}
+
+func TestLog_RefuseBadFirstRecord(t *testing.T) {
+	defer cleanTestData()
+	if err := os.MkdirAll("./tmp", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	garbage := []byte(strings.Repeat("not an aof segment", 20))
+	if err := os.WriteFile("./tmp/0", garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := Log{}
+	var corruptErr *CorruptRecordError
+	if err := l.Open("./tmp"); !errors.As(err, &corruptErr) || corruptErr.Offset != 0 {
+		t.Fatalf("expect a corrupt record error at offset 0 got %v", err)
+	}
+	if data, _ := os.ReadFile("./tmp/0"); len(data) != len(garbage) {
+		t.Fatalf("expect the segment to be left alone got %d bytes", len(data))
 	}
 }
@@ -3,11 +3,20 @@ package main
 import (
 	"context"
 	"github.com/projectxpolaris/polarisdb"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 	dbInst := polarisdb.NewDB(&polarisdb.DBConfig{})
-	dbInst.Open()
-	dbInst.RunServer()
-	<-context.Background().Done()
+	if err := dbInst.Open(); err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := dbInst.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
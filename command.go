@@ -0,0 +1,1524 @@
+package polarisdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/projectxpolaris/polarisdb/utils"
+)
+
+// reply types returned by command handlers, network front ends encode them
+// for their own protocol
+type (
+	// StatusReply is a simple status such as OK
+	StatusReply string
+	// SetReply is an unordered collection of members
+	SetReply []interface{}
+	// MapReply holds alternating keys and values
+	MapReply []interface{}
+)
+
+func (r MapReply) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(r)/2)
+	for i := 0; i+1 < len(r); i += 2 {
+		m[utils.ToString(r[i])] = r[i+1]
+	}
+	return json.Marshal(m)
+}
+
+var (
+	ErrSyntax         = errors.New("syntax error")
+	ErrInvalidCursor  = errors.New("invalid cursor")
+	ErrNotIntegerArg  = ErrNotInteger
+	ErrNotFloatArg    = errors.New("value is not a valid float")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrWrongArgCount  = errors.New("wrong number of arguments")
+	ErrInvalidExpire  = errors.New("invalid expire time")
+	ErrCommandPanic   = errors.New("command panicked")
+)
+
+type CommandHandler func(tx *TX, args []string) (interface{}, error)
+
+type Command struct {
+	Name string
+	// Arity counts the command name, negative means at least -Arity arguments
+	Arity    int
+	ReadOnly bool
+	Handler  CommandHandler
+}
+
+var commandTable = map[string]*Command{}
+
+func registerCommand(name string, arity int, readOnly bool, handler CommandHandler) {
+	commandTable[name] = &Command{Name: name, Arity: arity, ReadOnly: readOnly, Handler: handler}
+}
+
+// LookupCommand finds a command by its case insensitive name
+func LookupCommand(name string) (*Command, bool) {
+	cmd, ok := commandTable[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// CheckArity validates the argument count, args does not include the command name
+func (c *Command) CheckArity(args []string) error {
+	count := len(args) + 1
+	if (c.Arity > 0 && count != c.Arity) || (c.Arity < 0 && count < -c.Arity) {
+		return fmt.Errorf("%w for '%s' command", ErrWrongArgCount, c.Name)
+	}
+	return nil
+}
+
+// call runs the handler, a panic fails the command instead of the server and
+// drops the write set like any other error
+func (c *Command) call(tx *TX, args []string) (reply interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reply, err = nil, fmt.Errorf("%w: '%s': %v", ErrCommandPanic, c.Name, r)
+		}
+	}()
+	return c.Handler(tx, args)
+}
+
+// Exec runs a single command in its own transaction on database 0, read only
+// commands only take the read lock
+func (db *PolarisDB) Exec(name string, args ...string) (interface{}, error) {
+	return db.ExecDB(0, name, args...)
+}
+
+// ExecDB runs a single command in its own transaction on database index
+func (db *PolarisDB) ExecDB(index int, name string, args ...string) (interface{}, error) {
+	cmd, ok := LookupCommand(name)
+	if !ok {
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownCommand, name)
+	}
+	if err := cmd.CheckArity(args); err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	run := func(tx *TX) (err error) {
+		if err = tx.Select(index); err != nil {
+			return err
+		}
+		reply, err = cmd.call(tx, args)
+		return err
+	}
+	var err error
+	if cmd.ReadOnly {
+		err = db.View(run)
+	} else {
+		err = db.Update(run)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// BatchCommand is one entry of a batch, Args does not include the command name
+type BatchCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+type BatchResult struct {
+	Reply interface{}
+	Err   error
+}
+
+// ExecBatch runs the commands in order on database 0 and returns one result per
+// command, see ExecBatchDB
+func (db *PolarisDB) ExecBatch(commands []BatchCommand) []BatchResult {
+	return db.ExecBatchDB(0, commands)
+}
+
+// ExecBatchDB runs the commands in order starting on database index and returns
+// one result per command. Consecutive read only commands share a single read
+// transaction, every write command runs in its own transaction so that one
+// failure does not affect the others. SELECT changes the database of the
+// commands after it.
+func (db *PolarisDB) ExecBatchDB(index int, commands []BatchCommand) []BatchResult {
+	results := make([]BatchResult, len(commands))
+	for i := 0; i < len(commands); {
+		cmd, ok := LookupCommand(commands[i].Command)
+		if !ok {
+			results[i].Err = fmt.Errorf("%w '%s'", ErrUnknownCommand, commands[i].Command)
+			i++
+			continue
+		}
+		if !cmd.ReadOnly {
+			results[i].Reply, results[i].Err = db.ExecDB(index, commands[i].Command, commands[i].Args...)
+			i++
+			continue
+		}
+		// collect the run of read only commands
+		end := i + 1
+		for end < len(commands) {
+			next, ok := LookupCommand(commands[end].Command)
+			if !ok || !next.ReadOnly {
+				break
+			}
+			end++
+		}
+		start := i
+		db.View(func(tx *TX) error {
+			if err := tx.Select(index); err != nil {
+				for j := start; j < end; j++ {
+					results[j].Err = err
+				}
+				return nil
+			}
+			defer func() {
+				index = tx.DB()
+			}()
+			for j := start; j < end; j++ {
+				readCmd, _ := LookupCommand(commands[j].Command)
+				if err := readCmd.CheckArity(commands[j].Args); err != nil {
+					results[j].Err = err
+					continue
+				}
+				results[j].Reply, results[j].Err = readCmd.call(tx, commands[j].Args)
+			}
+			return nil
+		})
+		i = end
+	}
+	return results
+}
+
+func parseInt(arg string) (int64, error) {
+	val, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, ErrNotIntegerArg
+	}
+	return val, nil
+}
+
+func parseFloat(arg string) (float64, error) {
+	switch strings.ToLower(arg) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	val, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(val) {
+		return 0, ErrNotFloatArg
+	}
+	return val, nil
+}
+
+func parseDBIndex(arg string) (int, error) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, ErrNotIntegerArg
+	}
+	return index, nil
+}
+
+// parseFlushArgs accepts the ASYNC and SYNC modes of FLUSHDB and FLUSHALL, the
+// data is always dropped right away
+func parseFlushArgs(args []string) error {
+	if len(args) > 1 {
+		return ErrSyntax
+	}
+	if len(args) == 1 {
+		switch strings.ToLower(args[0]) {
+		case "async", "sync":
+		default:
+			return ErrSyntax
+		}
+	}
+	return nil
+}
+
+func toInterfaces(strs []string) []interface{} {
+	result := make([]interface{}, len(strs))
+	for i, str := range strs {
+		result[i] = str
+	}
+	return result
+}
+
+func toStrings(values []interface{}) []string {
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = utils.ToString(value)
+	}
+	return result
+}
+
+func bytesToStrings(values [][]byte) []string {
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = string(value)
+	}
+	return result
+}
+
+// scoreReply converts member score pairs, scores become doubles
+func scoreReply(vals []interface{}, withScores bool) []interface{} {
+	result := make([]interface{}, 0, len(vals))
+	for i, val := range vals {
+		if i%2 == 1 {
+			if withScores {
+				result = append(result, val)
+			}
+			continue
+		}
+		result = append(result, utils.ToString(val))
+	}
+	return result
+}
+
+// parseNumKeys reads the "numkeys key [key ...]" form used by the zset commands
+func parseNumKeys(args []string) ([]string, []string, error) {
+	if len(args) == 0 {
+		return nil, nil, ErrSyntax
+	}
+	count, err := parseInt(args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if count <= 0 || int(count) > len(args)-1 {
+		return nil, nil, ErrSyntax
+	}
+	return args[1 : 1+count], args[1+count:], nil
+}
+
+func parseWithScores(opts []string) (bool, error) {
+	if len(opts) == 0 {
+		return false, nil
+	}
+	if len(opts) == 1 && strings.EqualFold(opts[0], "withscores") {
+		return true, nil
+	}
+	return false, ErrSyntax
+}
+
+func init() {
+	registerKeyCommands()
+	registerStringCommands()
+	registerHashCommands()
+	registerListCommands()
+	registerSetCommands()
+	registerZsetCommands()
+	registerServerCommands()
+	registerPubSubCommands()
+}
+
+func registerKeyCommands() {
+	registerCommand("del", -2, false, func(tx *TX, args []string) (interface{}, error) {
+		count, err := tx.Del(args...)
+		return int64(count), err
+	})
+	registerCommand("unlink", -2, false, func(tx *TX, args []string) (interface{}, error) {
+		count, err := tx.Unlink(args...)
+		return int64(count), err
+	})
+	registerCommand("exists", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		count, err := tx.ExistsCount(args...)
+		return int64(count), err
+	})
+	registerCommand("type", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		keyType, err := tx.Type(args[0])
+		return StatusReply(keyType), err
+	})
+	registerCommand("rename", 3, false, func(tx *TX, args []string) (interface{}, error) {
+		if err := tx.Rename(args[0], args[1]); err != nil {
+			return nil, err
+		}
+		return StatusReply("OK"), nil
+	})
+	registerCommand("renamenx", 3, false, func(tx *TX, args []string) (interface{}, error) {
+		return tx.RenameNX(args[0], args[1])
+	})
+	registerCommand("expire", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		return cmdExpire(tx, "expire", args, 1000, false)
+	})
+	registerCommand("pexpire", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		return cmdExpire(tx, "pexpire", args, 1, false)
+	})
+	registerCommand("expireat", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		return cmdExpire(tx, "expireat", args, 1000, true)
+	})
+	registerCommand("pexpireat", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		return cmdExpire(tx, "pexpireat", args, 1, true)
+	})
+	registerCommand("persist", 2, false, func(tx *TX, args []string) (interface{}, error) {
+		return tx.Persist(args[0])
+	})
+	registerCommand("ttl", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.TTL(args[0])
+	})
+	registerCommand("pttl", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.PTTL(args[0])
+	})
+	registerCommand("expiretime", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.ExpireTimeSeconds(args[0])
+	})
+	registerCommand("pexpiretime", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.ExpireTime(args[0])
+	})
+	registerCommand("keys", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.Keys(args[0])
+	})
+	registerCommand("scan", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		cursor, options, err := parseScanArgs(args, true)
+		if err != nil {
+			return nil, err
+		}
+		next, keys, err := tx.Scan(cursor, options)
+		if err != nil {
+			return nil, err
+		}
+		return scanReply(next, keys), nil
+	})
+	registerCommand("copy", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		replace := false
+		for _, opt := range args[2:] {
+			if strings.ToLower(opt) != "replace" {
+				return nil, ErrSyntax
+			}
+			replace = true
+		}
+		return tx.Copy(args[0], args[1], replace)
+	})
+	registerCommand("memory", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		if strings.ToLower(args[0]) != "usage" {
+			return nil, ErrSyntax
+		}
+		// SAMPLES is accepted, every value is measured in full
+		if len(args) != 2 && !(len(args) == 4 && strings.ToLower(args[2]) == "samples") {
+			return nil, ErrSyntax
+		}
+		usage, err := tx.MemoryUsage(args[1])
+		if err != nil || usage == 0 {
+			return nil, err
+		}
+		return usage, nil
+	})
+	registerCommand("object", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		if strings.ToLower(args[0]) != "freq" {
+			return nil, ErrSyntax
+		}
+		freq, isExist := tx.ObjectFreq(args[1])
+		if !isExist {
+			return nil, nil
+		}
+		return freq, nil
+	})
+	registerCommand("move", 3, false, func(tx *TX, args []string) (interface{}, error) {
+		index, err := parseDBIndex(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return tx.Move(args[0], index)
+	})
+}
+
+// parseScanArgs parses cursor [MATCH pattern] [COUNT count] and with allowType [TYPE type]
+func parseScanArgs(args []string, allowType bool) (uint64, ScanOptions, error) {
+	options := ScanOptions{}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, options, ErrInvalidCursor
+	}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, options, ErrSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			options.Match = args[i+1]
+		case "count":
+			count, err := parseInt(args[i+1])
+			if err != nil {
+				return 0, options, err
+			}
+			if count < 1 {
+				return 0, options, ErrSyntax
+			}
+			options.Count = int(count)
+		case "type":
+			if !allowType {
+				return 0, options, ErrSyntax
+			}
+			options.Type = strings.ToLower(args[i+1])
+		default:
+			return 0, options, ErrSyntax
+		}
+	}
+	return cursor, options, nil
+}
+
+func scanReply(cursor uint64, items interface{}) interface{} {
+	return []interface{}{strconv.FormatUint(cursor, 10), items}
+}
+
+func registerStringCommands() {
+	registerCommand("get", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return nil, nil
+		}
+		return tx.Get(args[0])
+	})
+	registerCommand("set", -3, false, cmdSet)
+	registerCommand("append", 3, false, func(tx *TX, args []string) (interface{}, error) {
+		if err := tx.Append(args[0], args[1]); err != nil {
+			return nil, err
+		}
+		value, err := tx.Get(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(value)), nil
+	})
+	registerCommand("incr", 2, false, func(tx *TX, args []string) (interface{}, error) {
+		return stringCalculate(tx, args[0], 1)
+	})
+	registerCommand("decr", 2, false, func(tx *TX, args []string) (interface{}, error) {
+		return stringCalculate(tx, args[0], -1)
+	})
+	registerCommand("incrby", 3, false, func(tx *TX, args []string) (interface{}, error) {
+		by, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return stringCalculate(tx, args[0], by)
+	})
+	registerCommand("decrby", 3, false, func(tx *TX, args []string) (interface{}, error) {
+		by, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return stringCalculate(tx, args[0], -by)
+	})
+	registerCommand("getdel", 2, false, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return nil, nil
+		}
+		return tx.GetDel(args[0])
+	})
+	registerCommand("getex", -2, false, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return nil, nil
+		}
+		if len(args) == 1 {
+			return tx.Get(args[0])
+		}
+		if len(args) != 3 {
+			return nil, ErrSyntax
+		}
+		ttl, err := parseInt(args[2])
+		if err != nil {
+			return nil, err
+		}
+		var unit int64 = 1
+		opt := strings.ToLower(args[1])
+		switch opt {
+		case "ex", "exat":
+			unit = 1000
+		case "px", "pxat":
+		default:
+			return nil, ErrSyntax
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("%w in 'getex' command", ErrInvalidExpire)
+		}
+		at, err := expireDeadline(ttl, unit, opt == "exat" || opt == "pxat", "getex")
+		if err != nil {
+			return nil, err
+		}
+		return tx.GetExAt(args[0], at)
+	})
+	registerCommand("getrange", 4, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return "", nil
+		}
+		start, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseInt(args[2])
+		if err != nil {
+			return nil, err
+		}
+		// the range is inclusive on the wire and exclusive in TX.GetRange
+		if end == -1 {
+			end = math.MaxInt64
+		} else {
+			end++
+		}
+		return tx.GetRange(args[0], start, end)
+	})
+	registerCommand("lcs", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.Lcs(args[0], args[1])
+	})
+	registerCommand("mget", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		result := make([]interface{}, 0, len(args))
+		for _, key := range args {
+			if exist, _ := tx.Exists(key); !exist {
+				result = append(result, nil)
+				continue
+			}
+			value, err := tx.Get(key)
+			if errors.Is(err, ErrWrongType) {
+				// a key of another type reads as a missing one
+				result = append(result, nil)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+		return result, nil
+	})
+	registerCommand("mset", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		if len(args)%2 != 0 {
+			return nil, fmt.Errorf("%w for 'mset' command", ErrWrongArgCount)
+		}
+		if err := tx.MSet(args...); err != nil {
+			return nil, err
+		}
+		return StatusReply("OK"), nil
+	})
+}
+
+// cmdSet implements SET key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func cmdSet(tx *TX, args []string) (interface{}, error) {
+	key, value := args[0], args[1]
+	var nx, xx, get, keepTTL bool
+	var expire int64
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToLower(args[i])
+		switch opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "get":
+			get = true
+		case "keepttl":
+			keepTTL = true
+		case "ex", "px", "exat", "pxat":
+			if i+1 >= len(args) || expire != 0 {
+				return nil, ErrSyntax
+			}
+			i++
+			val, err := parseInt(args[i])
+			if err != nil {
+				return nil, err
+			}
+			if val <= 0 {
+				return nil, fmt.Errorf("%w in 'set' command", ErrInvalidExpire)
+			}
+			var unit int64 = 1
+			if opt == "ex" || opt == "exat" {
+				unit = 1000
+			}
+			at, err := expireDeadline(val, unit, opt == "exat" || opt == "pxat", "set")
+			if err != nil {
+				return nil, err
+			}
+			expire = at - time.Now().UnixMilli()
+			if expire <= 0 {
+				// already expired deadline
+				expire = 1
+			}
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if (nx && xx) || (keepTTL && expire != 0) {
+		return nil, ErrSyntax
+	}
+	exist, err := tx.Exists(key)
+	if err != nil {
+		return nil, err
+	}
+	var old interface{}
+	if get && exist {
+		old, err = tx.Get(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if (nx && exist) || (xx && !exist) {
+		if get {
+			return old, nil
+		}
+		return nil, nil
+	}
+	if err = tx.SetString(key, value, keepTTL); err != nil {
+		return nil, err
+	}
+	if expire > 0 {
+		if err = tx.SetExpire(key, expire); err != nil {
+			return nil, err
+		}
+	}
+	if get {
+		return old, nil
+	}
+	return StatusReply("OK"), nil
+}
+
+func stringCalculate(tx *TX, key string, by int64) (interface{}, error) {
+	if exist, _ := tx.Exists(key); !exist {
+		// a missing key counts as zero
+		if err := tx.SetString(key, "0", true); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.IncrBy(key, by); err != nil {
+		return nil, err
+	}
+	value, err := tx.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return parseInt(value)
+}
+
+// cmdExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT key time [NX | XX | GT | LT],
+// unit scales the time to milliseconds and absolute tells a unix time from a duration
+func cmdExpire(tx *TX, name string, args []string, unit int64, absolute bool) (interface{}, error) {
+	value, err := parseInt(args[1])
+	if err != nil {
+		return nil, err
+	}
+	options := ExpireOptions{}
+	for _, opt := range args[2:] {
+		switch strings.ToLower(opt) {
+		case "nx":
+			options.NX = true
+		case "xx":
+			options.XX = true
+		case "gt":
+			options.GT = true
+		case "lt":
+			options.LT = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	at, err := expireDeadline(value, unit, absolute, name)
+	if err != nil {
+		return nil, err
+	}
+	set, err := tx.ExpireAt(args[0], at, options)
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// expireDeadline turns the value of an expire argument in unit milliseconds into a
+// unix time in milliseconds, relative values count from now. Like redis it fails
+// when the deadline does not fit an int64.
+func expireDeadline(value int64, unit int64, absolute bool, name string) (int64, error) {
+	invalid := fmt.Errorf("%w in '%s' command", ErrInvalidExpire, name)
+	if value > math.MaxInt64/unit || value < math.MinInt64/unit {
+		return 0, invalid
+	}
+	at := value * unit
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if at > math.MaxInt64-now {
+			return 0, invalid
+		}
+		at += now
+	}
+	return at, nil
+}
+
+func registerHashCommands() {
+	registerCommand("hset", -4, false, func(tx *TX, args []string) (interface{}, error) {
+		if len(args)%2 != 1 {
+			return nil, fmt.Errorf("%w for 'hset' command", ErrWrongArgCount)
+		}
+		exist, _ := tx.Exists(args[0])
+		pairs := make([]Paris, 0, len(args)/2)
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			if exist {
+				hasField, err := tx.HExists(args[0], args[i])
+				if err != nil {
+					return nil, err
+				}
+				if !hasField {
+					added++
+				}
+			} else {
+				added++
+			}
+			pairs = append(pairs, Paris{Field: []byte(args[i]), Value: []byte(args[i+1])})
+		}
+		if err := tx.HSet(args[0], pairs...); err != nil {
+			return nil, err
+		}
+		return added, nil
+	})
+	registerCommand("hget", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return nil, nil
+		}
+		if hasField, err := tx.HExists(args[0], args[1]); err != nil || !hasField {
+			return nil, err
+		}
+		return tx.HGet(args[0], args[1])
+	})
+	registerCommand("hscan", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		cursor, options, err := parseScanArgs(args[1:], false)
+		if err != nil {
+			return nil, err
+		}
+		next, pairs, err := tx.HScan(args[0], cursor, options)
+		if err != nil {
+			return nil, err
+		}
+		return scanReply(next, pairs), nil
+	})
+	registerCommand("hgetall", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return MapReply{}, nil
+		}
+		values, err := tx.HGetAll(args[0])
+		if err != nil {
+			return nil, err
+		}
+		reply := make(MapReply, 0, len(values)*2)
+		for field, value := range values {
+			reply = append(reply, field, value)
+		}
+		return reply, nil
+	})
+	registerCommand("hexists", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return false, nil
+		}
+		return tx.HExists(args[0], args[1])
+	})
+	registerCommand("hdel", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return int64(0), nil
+		}
+		var removed int64
+		for _, field := range args[1:] {
+			hasField, err := tx.HExists(args[0], field)
+			if err != nil {
+				return nil, err
+			}
+			if hasField {
+				removed++
+			}
+		}
+		if err := tx.HDel(args[0], args[1:]...); err != nil {
+			return nil, err
+		}
+		return removed, nil
+	})
+	registerCommand("hincrby", 4, false, func(tx *TX, args []string) (interface{}, error) {
+		by, err := parseInt(args[2])
+		if err != nil {
+			return nil, err
+		}
+		exist, _ := tx.Exists(args[0])
+		hasField, err := tx.HExists(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		if !exist || !hasField {
+			// a missing field counts as zero
+			if err = tx.HSet(args[0], Paris{Field: []byte(args[1]), Value: []byte("0")}); err != nil {
+				return nil, err
+			}
+		}
+		if err = tx.HIncrBy(args[0], args[1], by); err != nil {
+			return nil, err
+		}
+		value, err := tx.HGet(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		return parseInt(value)
+	})
+	registerCommand("hkeys", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return []string{}, nil
+		}
+		return tx.HKeys(args[0])
+	})
+	registerCommand("hvals", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return []string{}, nil
+		}
+		return tx.HVals(args[0])
+	})
+	registerCommand("hlen", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return int64(0), nil
+		}
+		return tx.HLen(args[0])
+	})
+}
+
+func registerListCommands() {
+	registerCommand("lpush", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		values := make([][]byte, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			values = append(values, []byte(arg))
+		}
+		if err := tx.LPush(args[0], values...); err != nil {
+			return nil, err
+		}
+		length, err := tx.LLen(args[0])
+		return int64(length), err
+	})
+	registerCommand("lpop", -2, false, func(tx *TX, args []string) (interface{}, error) {
+		if len(args) > 2 {
+			return nil, ErrSyntax
+		}
+		count := int64(1)
+		if len(args) == 2 {
+			var err error
+			if count, err = parseInt(args[1]); err != nil || count < 0 {
+				return nil, ErrNotIntegerArg
+			}
+		}
+		length, err := listLength(tx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			if len(args) == 2 {
+				return []string(nil), nil
+			}
+			return nil, nil
+		}
+		if count > int64(length) {
+			count = int64(length)
+		}
+		values, err := tx.LPop(args[0], int(count))
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 {
+			return string(values[0]), nil
+		}
+		return bytesToStrings(values), nil
+	})
+	registerCommand("lindex", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		index, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		length, err := listLength(tx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 {
+			index += int64(length)
+		}
+		if index < 0 || index >= int64(length) {
+			return nil, nil
+		}
+		value, err := tx.LIndex(args[0], headIndex(length, int(index)))
+		if err != nil {
+			return nil, err
+		}
+		return string(value), nil
+	})
+	registerCommand("llen", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return int64(0), nil
+		}
+		length, err := tx.LLen(args[0])
+		return int64(length), err
+	})
+	registerCommand("lrange", 4, true, func(tx *TX, args []string) (interface{}, error) {
+		start, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		stop, err := parseInt(args[2])
+		if err != nil {
+			return nil, err
+		}
+		length, err := listLength(tx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if start < 0 {
+			start += int64(length)
+		}
+		if stop < 0 {
+			stop += int64(length)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= int64(length) {
+			stop = int64(length) - 1
+		}
+		if length == 0 || start > stop || start >= int64(length) {
+			return []string{}, nil
+		}
+		values, err := tx.LRange(args[0], headIndex(length, int(stop)), headIndex(length, int(start)))
+		if err != nil {
+			return nil, err
+		}
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+		return bytesToStrings(values), nil
+	})
+}
+
+// headIndex maps a redis list index to the stored list, it keeps the head of the list
+// at its end: LPUSH appends and LPOP takes the last value
+func headIndex(length int, index int) int {
+	return length - 1 - index
+}
+
+// listLength returns the length of a list, 0 for a missing key
+func listLength(tx *TX, key string) (int, error) {
+	if exist, _ := tx.Exists(key); !exist {
+		return 0, nil
+	}
+	return tx.LLen(key)
+}
+
+func registerSetCommands() {
+	registerCommand("sadd", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		exist, _ := tx.Exists(args[0])
+		var added int64
+		seen := make(map[string]bool, len(args)-1)
+		for _, member := range args[1:] {
+			if seen[member] {
+				continue
+			}
+			seen[member] = true
+			if exist {
+				isMember, err := tx.SIsMember(args[0], member)
+				if err != nil {
+					return nil, err
+				}
+				if isMember {
+					continue
+				}
+			}
+			added++
+		}
+		if err := tx.SAdd(args[0], toInterfaces(args[1:])...); err != nil {
+			return nil, err
+		}
+		return added, nil
+	})
+	registerCommand("srem", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return int64(0), nil
+		}
+		members := make([]interface{}, 0, len(args)-1)
+		for _, member := range args[1:] {
+			isMember, err := tx.SIsMember(args[0], member)
+			if err != nil {
+				return nil, err
+			}
+			if isMember {
+				members = append(members, member)
+			}
+		}
+		if len(members) == 0 {
+			return int64(0), nil
+		}
+		if err := tx.SRem(args[0], members...); err != nil {
+			return nil, err
+		}
+		return int64(len(members)), nil
+	})
+	registerCommand("sismember", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return false, nil
+		}
+		return tx.SIsMember(args[0], args[1])
+	})
+	registerCommand("smismember", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		result := make([]interface{}, 0, len(args)-1)
+		exist, _ := tx.Exists(args[0])
+		for _, member := range args[1:] {
+			isMember := false
+			if exist {
+				var err error
+				if isMember, err = tx.SIsMember(args[0], member); err != nil {
+					return nil, err
+				}
+			}
+			result = append(result, isMember)
+		}
+		return result, nil
+	})
+	registerCommand("scard", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return int64(0), nil
+		}
+		size, err := tx.SCard(args[0])
+		return int64(size), err
+	})
+	registerCommand("sdiff", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		members, err := tx.SDiff(args[0], args[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		return SetReply(toInterfaces(toStrings(members))), nil
+	})
+	registerCommand("sinter", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		members, err := tx.SInter(args...)
+		if err != nil {
+			return nil, err
+		}
+		return SetReply(toInterfaces(toStrings(members))), nil
+	})
+	registerCommand("sunion", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		members, err := tx.SUnion(args...)
+		if err != nil {
+			return nil, err
+		}
+		return SetReply(toInterfaces(toStrings(members))), nil
+	})
+	registerCommand("sscan", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		cursor, options, err := parseScanArgs(args[1:], false)
+		if err != nil {
+			return nil, err
+		}
+		next, members, err := tx.SScan(args[0], cursor, options)
+		if err != nil {
+			return nil, err
+		}
+		return scanReply(next, toStrings(members)), nil
+	})
+	registerCommand("smembers", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return SetReply{}, nil
+		}
+		members, err := tx.SMembers(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return SetReply(toInterfaces(toStrings(members))), nil
+	})
+	registerCommand("spop", -2, false, func(tx *TX, args []string) (interface{}, error) {
+		count := int64(1)
+		if len(args) == 2 {
+			var err error
+			if count, err = parseInt(args[1]); err != nil || count < 0 {
+				return nil, ErrNotIntegerArg
+			}
+		} else if len(args) > 2 {
+			return nil, ErrSyntax
+		}
+		if exist, _ := tx.Exists(args[0]); !exist {
+			if len(args) == 2 {
+				return SetReply{}, nil
+			}
+			return nil, nil
+		}
+		members, err := tx.SPop(args[0], int(count))
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 {
+			if len(members) == 0 {
+				return nil, nil
+			}
+			return utils.ToString(members[0]), nil
+		}
+		return SetReply(toInterfaces(toStrings(members))), nil
+	})
+	registerCommand("srandmember", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		count := int64(1)
+		if len(args) == 2 {
+			var err error
+			if count, err = parseInt(args[1]); err != nil || count < 0 {
+				return nil, ErrNotIntegerArg
+			}
+		} else if len(args) > 2 {
+			return nil, ErrSyntax
+		}
+		if exist, _ := tx.Exists(args[0]); !exist {
+			if len(args) == 2 {
+				return []string{}, nil
+			}
+			return nil, nil
+		}
+		members, err := tx.SRandMember(args[0], int(count))
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 {
+			if len(members) == 0 {
+				return nil, nil
+			}
+			return utils.ToString(members[0]), nil
+		}
+		return toStrings(members), nil
+	})
+}
+
+func registerZsetCommands() {
+	registerCommand("zadd", -4, false, func(tx *TX, args []string) (interface{}, error) {
+		if len(args)%2 != 1 {
+			return nil, ErrSyntax
+		}
+		exist, _ := tx.Exists(args[0])
+		pairs := make([]ZsetPair, 0, len(args)/2)
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			score, err := parseFloat(args[i])
+			if err != nil {
+				return nil, err
+			}
+			if !exist {
+				added++
+			} else if rank, err := tx.ZRank(args[0], args[i+1]); err != nil {
+				return nil, err
+			} else if rank < 0 {
+				added++
+			}
+			pairs = append(pairs, ZsetPair{Member: args[i+1], Score: score})
+		}
+		if err := tx.ZAdd(args[0], pairs...); err != nil {
+			return nil, err
+		}
+		return added, nil
+	})
+	registerCommand("zrem", -3, false, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return int64(0), nil
+		}
+		members := make([]string, 0, len(args)-1)
+		for _, member := range args[1:] {
+			rank, err := tx.ZRank(args[0], member)
+			if err != nil {
+				return nil, err
+			}
+			if rank >= 0 {
+				members = append(members, member)
+			}
+		}
+		if len(members) == 0 {
+			return int64(0), nil
+		}
+		if err := tx.ZRem(args[0], members...); err != nil {
+			return nil, err
+		}
+		return int64(len(members)), nil
+	})
+	registerCommand("zcard", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return int64(0), nil
+		}
+		card, err := tx.ZCard(args[0])
+		return int64(card), err
+	})
+	registerCommand("zscan", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		cursor, options, err := parseScanArgs(args[1:], false)
+		if err != nil {
+			return nil, err
+		}
+		next, pairs, err := tx.ZScan(args[0], cursor, options)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]string, 0, len(pairs)*2)
+		for _, pair := range pairs {
+			items = append(items, pair.Member, utils.ToString(pair.Score))
+		}
+		return scanReply(next, items), nil
+	})
+	registerCommand("zscore", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return nil, nil
+		}
+		rank, err := tx.ZRank(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		if rank < 0 {
+			return nil, nil
+		}
+		return tx.ZScore(args[0], args[1])
+	})
+	registerCommand("zmscore", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		exist, _ := tx.Exists(args[0])
+		result := make([]interface{}, 0, len(args)-1)
+		for _, member := range args[1:] {
+			if !exist {
+				result = append(result, nil)
+				continue
+			}
+			rank, err := tx.ZRank(args[0], member)
+			if err != nil {
+				return nil, err
+			}
+			if rank < 0 {
+				result = append(result, nil)
+				continue
+			}
+			score, err := tx.ZScore(args[0], member)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, score)
+		}
+		return result, nil
+	})
+	registerCommand("zrank", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return nil, nil
+		}
+		rank, err := tx.ZRank(args[0], args[1])
+		if err != nil || rank < 0 {
+			return nil, err
+		}
+		return rank, nil
+	})
+	registerCommand("zincrby", 4, false, func(tx *TX, args []string) (interface{}, error) {
+		increment, err := parseFloat(args[1])
+		if err != nil {
+			return nil, err
+		}
+		exist, _ := tx.Exists(args[0])
+		if exist {
+			rank, err := tx.ZRank(args[0], args[2])
+			if err != nil {
+				return nil, err
+			}
+			exist = rank >= 0
+		}
+		if !exist {
+			// a missing member starts from zero
+			if err = tx.ZAdd(args[0], ZsetPair{Member: args[2], Score: increment}); err != nil {
+				return nil, err
+			}
+			return increment, nil
+		}
+		return tx.ZIncrBy(args[0], increment, args[2])
+	})
+	registerCommand("zrange", -4, true, func(tx *TX, args []string) (interface{}, error) {
+		start, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		stop, err := parseInt(args[2])
+		if err != nil {
+			return nil, err
+		}
+		withScores, err := parseWithScores(args[3:])
+		if err != nil {
+			return nil, err
+		}
+		if exist, _ := tx.Exists(args[0]); !exist {
+			return []interface{}{}, nil
+		}
+		vals, err := tx.ZRangeWithScores(args[0], int(start), int(stop))
+		if err != nil {
+			return nil, err
+		}
+		return scoreReply(vals, withScores), nil
+	})
+	registerCommand("zdiff", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		keys, opts, err := parseNumKeys(args)
+		if err != nil {
+			return nil, err
+		}
+		withScores, err := parseWithScores(opts)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := tx.ZDiff(keys[0], keys[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		return scoreReply(vals, withScores), nil
+	})
+	registerCommand("zinter", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		keys, opts, err := parseNumKeys(args)
+		if err != nil {
+			return nil, err
+		}
+		withScores, err := parseWithScores(opts)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := tx.ZInter(keys...)
+		if err != nil {
+			return nil, err
+		}
+		return scoreReply(vals, withScores), nil
+	})
+	registerCommand("zunion", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		keys, opts, err := parseNumKeys(args)
+		if err != nil {
+			return nil, err
+		}
+		withScores, err := parseWithScores(opts)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := tx.ZUnion(keys...)
+		if err != nil {
+			return nil, err
+		}
+		return scoreReply(vals, withScores), nil
+	})
+	registerCommand("zdiffstore", -4, false, func(tx *TX, args []string) (interface{}, error) {
+		keys, opts, err := parseNumKeys(args[1:])
+		if err != nil || len(opts) != 0 {
+			return nil, ErrSyntax
+		}
+		count, err := tx.ZDiffStore(args[0], keys[0], keys[1:]...)
+		return int64(count), err
+	})
+	registerCommand("zinterstore", -4, false, func(tx *TX, args []string) (interface{}, error) {
+		keys, opts, err := parseNumKeys(args[1:])
+		if err != nil || len(opts) != 0 {
+			return nil, ErrSyntax
+		}
+		count, err := tx.ZInterStore(args[0], keys...)
+		return int64(count), err
+	})
+	registerCommand("zunionstore", -4, false, func(tx *TX, args []string) (interface{}, error) {
+		keys, opts, err := parseNumKeys(args[1:])
+		if err != nil || len(opts) != 0 {
+			return nil, ErrSyntax
+		}
+		count, err := tx.ZUnionStore(args[0], keys...)
+		return int64(count), err
+	})
+	registerCommand("zintercard", -3, true, func(tx *TX, args []string) (interface{}, error) {
+		keys, opts, err := parseNumKeys(args)
+		if err != nil || len(opts) != 0 {
+			return nil, ErrSyntax
+		}
+		count, err := tx.ZInterCard(keys...)
+		return int64(count), err
+	})
+}
+
+func registerServerCommands() {
+	registerCommand("select", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		index, err := parseDBIndex(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.Select(index); err != nil {
+			return nil, err
+		}
+		return StatusReply("OK"), nil
+	})
+	registerCommand("swapdb", 3, false, func(tx *TX, args []string) (interface{}, error) {
+		first, err := parseDBIndex(args[0])
+		if err != nil {
+			return nil, err
+		}
+		second, err := parseDBIndex(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.SwapDB(first, second); err != nil {
+			return nil, err
+		}
+		return StatusReply("OK"), nil
+	})
+	registerCommand("flushdb", -1, false, func(tx *TX, args []string) (interface{}, error) {
+		if err := parseFlushArgs(args); err != nil {
+			return nil, err
+		}
+		if err := tx.FlushDB(); err != nil {
+			return nil, err
+		}
+		return StatusReply("OK"), nil
+	})
+	registerCommand("flushall", -1, false, func(tx *TX, args []string) (interface{}, error) {
+		if err := parseFlushArgs(args); err != nil {
+			return nil, err
+		}
+		if err := tx.FlushAll(); err != nil {
+			return nil, err
+		}
+		return StatusReply("OK"), nil
+	})
+	registerCommand("info", -1, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.db.Info(args...), nil
+	})
+	registerCommand("debug", 2, true, func(tx *TX, args []string) (interface{}, error) {
+		if strings.ToLower(args[0]) != "nextexpire" {
+			return nil, ErrSyntax
+		}
+		key, deadline, isExist := tx.NextExpire()
+		if !isExist {
+			return nil, nil
+		}
+		return []interface{}{key, deadline}, nil
+	})
+	registerCommand("bgrewriteaof", 1, true, func(tx *TX, args []string) (interface{}, error) {
+		if err := tx.db.BackgroundRewriteAof(); err != nil {
+			return nil, err
+		}
+		return StatusReply("Background append only file rewriting started"), nil
+	})
+	registerCommand("save", 1, true, func(tx *TX, args []string) (interface{}, error) {
+		if err := tx.db.save(false); err != nil {
+			return nil, err
+		}
+		return StatusReply("OK"), nil
+	})
+	registerCommand("bgsave", 1, true, func(tx *TX, args []string) (interface{}, error) {
+		if err := tx.db.save(true); err != nil {
+			return nil, err
+		}
+		return StatusReply("Background saving started"), nil
+	})
+	registerCommand("lastsave", 1, true, func(tx *TX, args []string) (interface{}, error) {
+		return tx.db.SnapshotStatus().LastSave.Unix(), nil
+	})
+}
+
+func registerPubSubCommands() {
+	registerCommand("publish", 3, true, func(tx *TX, args []string) (interface{}, error) {
+		return int64(tx.db.Publish(args[0], args[1])), nil
+	})
+	registerCommand("pubsub", -2, true, func(tx *TX, args []string) (interface{}, error) {
+		switch strings.ToLower(args[0]) {
+		case "channels":
+			if len(args) > 2 {
+				return nil, fmt.Errorf("%w for 'pubsub|channels' command", ErrWrongArgCount)
+			}
+			pattern := ""
+			if len(args) == 2 {
+				pattern = args[1]
+			}
+			return tx.db.PubSubChannels(pattern), nil
+		case "numsub":
+			counts := tx.db.PubSubNumSub(args[1:]...)
+			reply := make(MapReply, 0, len(counts)*2)
+			for i, count := range counts {
+				reply = append(reply, args[i+1], int64(count))
+			}
+			return reply, nil
+		case "numpat":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%w for 'pubsub|numpat' command", ErrWrongArgCount)
+			}
+			return int64(tx.db.PubSubNumPat()), nil
+		}
+		return nil, fmt.Errorf("unknown subcommand '%s'", args[0])
+	})
+}
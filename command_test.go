@@ -0,0 +1,286 @@
+package polarisdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolarisDB_ExecBatch(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	results := db.ExecBatch([]BatchCommand{
+		{Command: "set", Args: []string{"foo", "bar"}},
+		{Command: "get", Args: []string{"foo"}},
+		{Command: "get", Args: []string{}},
+		{Command: "nope"},
+		{Command: "incr", Args: []string{"foo"}},
+		{Command: "get", Args: []string{"foo"}},
+	})
+	if len(results) != 6 {
+		t.Fatalf("expect 6 results got %d", len(results))
+	}
+	if results[0].Err != nil || results[0].Reply != StatusReply("OK") {
+		t.Fatalf("unexpected set result %v %v", results[0].Reply, results[0].Err)
+	}
+	if results[1].Reply != "bar" {
+		t.Fatalf("unexpected get result %v", results[1].Reply)
+	}
+	if results[2].Err == nil || results[3].Err == nil || results[4].Err == nil {
+		t.Fatal("expect errors for bad commands")
+	}
+	if results[5].Reply != "bar" {
+		t.Fatalf("failed command must not affect later ones, got %v", results[5].Reply)
+	}
+}
+
+func TestPolarisDB_ExecMulti(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	db.Exec("set", "foo", "1")
+	db.Exec("set", "ttl", "1", "px", "20")
+	watched := db.Watch("foo", "missing")
+	results, err := db.ExecMulti(watched, []BatchCommand{
+		{Command: "incr", Args: []string{"foo"}},
+		{Command: "set", Args: []string{"str", "x"}},
+		{Command: "incr", Args: []string{"str"}},
+		{Command: "get", Args: []string{"foo"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Reply != int64(2) || results[2].Err == nil || results[3].Reply != "2" {
+		t.Fatalf("unexpected exec results %+v", results)
+	}
+	// the exec above wrote foo
+	if _, err = db.ExecMulti(watched, []BatchCommand{{Command: "set", Args: []string{"foo", "3"}}}); err != ErrWatchedKeyChanged {
+		t.Fatalf("expect watched key changed got %v", err)
+	}
+	watched = db.Watch("ttl")
+	time.Sleep(30 * time.Millisecond)
+	if _, err = db.ExecMulti(watched, []BatchCommand{{Command: "set", Args: []string{"foo", "3"}}}); err != ErrWatchedKeyChanged {
+		t.Fatalf("expect expired key to abort got %v", err)
+	}
+	if val, _ := db.Exec("get", "foo"); val != "2" {
+		t.Fatalf("expect aborted exec not to write, got %v", val)
+	}
+}
+
+func TestCommands_GetRange(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	if _, err = db.Exec("set", "foo", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	// out of range indexes are clamped like redis does
+	cases := [][3]string{
+		{"0", "-1", "Hello"}, {"1", "3", "ell"}, {"-3", "-1", "llo"}, {"-100", "-1", "Hello"},
+		{"0", "-100", ""}, {"-100", "-100", ""}, {"3", "1", ""}, {"10", "20", ""}, {"0", "100", "Hello"},
+	}
+	for _, c := range cases {
+		val, err := db.Exec("getrange", "foo", c[0], c[1])
+		if err != nil {
+			t.Fatalf("getrange %s %s: %v", c[0], c[1], err)
+		}
+		if val != c[2] {
+			t.Fatalf("getrange %s %s: expect %q got %q", c[0], c[1], c[2], val)
+		}
+	}
+}
+
+func TestCommands_ExpireDeadlines(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for _, key := range []string{"getex", "pexpireat", "expire"} {
+		if _, err = db.Exec("set", key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// non positive relative ttls and ones that overflow are rejected
+	invalid := [][]string{
+		{"getex", "getex", "ex", "0"}, {"getex", "getex", "px", "-5"}, {"getex", "getex", "exat", "0"},
+		{"getex", "getex", "ex", "9223372036854775"}, {"expire", "expire", "9223372036854775807"},
+		{"pexpire", "expire", "9223372036854775807"}, {"set", "expire", "v", "ex", "9223372036854775"},
+	}
+	for _, call := range invalid {
+		if _, err = db.Exec(call[0], call[1:]...); !errors.Is(err, ErrInvalidExpire) {
+			t.Fatalf("%v: expect invalid expire got %v", call, err)
+		}
+	}
+	if ttl, _ := db.Exec("pttl", "getex"); ttl != TTLNoExpire {
+		t.Fatalf("expect a rejected getex to keep the key persistent got %v", ttl)
+	}
+	// a deadline that passed deletes the key, -1 must not read as no ttl
+	if val, err := db.Exec("getex", "getex", "exat", "1"); err != nil || val != "v" {
+		t.Fatalf("expect getex to return the value got %v %v", val, err)
+	}
+	if set, err := db.Exec("pexpireat", "pexpireat", "-1"); err != nil || set != true {
+		t.Fatalf("expect pexpireat to apply got %v %v", set, err)
+	}
+	if set, err := db.Exec("expire", "expire", "-10"); err != nil || set != true {
+		t.Fatalf("expect expire to apply got %v %v", set, err)
+	}
+	if count, _ := db.Exec("exists", "getex", "pexpireat", "expire"); count != int64(0) {
+		t.Fatalf("expect the keys to be deleted got %v", count)
+	}
+}
+
+func TestCommands_RedisSemantics(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	db.Exec("sadd", "s", "a")
+	db.Exec("zadd", "z", "1", "a")
+	db.Exec("set", "str", "abc")
+	db.Exec("set", "dst", "old")
+	// a missing key counts as an empty value
+	cases := []struct {
+		call   []string
+		expect string
+	}{
+		{[]string{"sdiff", "s", "nokey"}, "[a]"},
+		{[]string{"sinter", "s", "nokey"}, "[]"},
+		{[]string{"sunion", "nokey", "s"}, "[a]"},
+		{[]string{"zdiff", "2", "z", "nokey"}, "[a]"},
+		{[]string{"zinter", "2", "z", "nokey"}, "[]"},
+		{[]string{"zunion", "2", "nokey", "z"}, "[a]"},
+		{[]string{"zintercard", "2", "z", "nokey"}, "0"},
+		{[]string{"zinterstore", "dst", "2", "z", "nokey"}, "0"},
+		{[]string{"exists", "dst"}, "0"},
+		{[]string{"lcs", "str", "nokey"}, ""},
+		// LPUSH puts the values at the head one after another
+		{[]string{"lpush", "list", "a", "b", "c", "d"}, "4"},
+		{[]string{"lrange", "list", "0", "-1"}, "[d c b a]"},
+		{[]string{"lrange", "list", "1", "100"}, "[c b a]"},
+		{[]string{"lindex", "list", "0"}, "d"},
+		{[]string{"lindex", "list", "-1"}, "a"},
+		{[]string{"lpop", "list", "2"}, "[d c]"},
+		{[]string{"lrange", "list", "0", "-1"}, "[b a]"},
+	}
+	for _, c := range cases {
+		reply, err := db.Exec(c.call[0], c.call[1:]...)
+		if err != nil {
+			t.Fatalf("%v: %v", c.call, err)
+		}
+		if got := fmt.Sprint(reply); got != c.expect {
+			t.Fatalf("%v: expect %s got %s", c.call, c.expect, got)
+		}
+	}
+}
+
+func TestCommands_Panic(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	registerCommand("panic", 2, false, func(tx *TX, args []string) (interface{}, error) {
+		if err := tx.SetString(args[0], "x", false); err != nil {
+			return nil, err
+		}
+		panic("boom")
+	})
+	defer delete(commandTable, "panic")
+	if _, err = db.Exec("panic", "foo"); !errors.Is(err, ErrCommandPanic) {
+		t.Fatalf("expect command panic error got %v", err)
+	}
+	// the lock is released and the write set dropped
+	if exist, _ := db.Exec("exists", "foo"); exist != int64(0) {
+		t.Fatalf("expect the panicked write to be dropped got %v", exist)
+	}
+}
+
+// wrongTypeCommands lists a call of every typed command, $ is replaced by the key
+var wrongTypeCommands = map[string][][]string{
+	TypeString: {
+		{"get", "$"}, {"append", "$", "x"}, {"incr", "$"}, {"decr", "$"}, {"incrby", "$", "1"},
+		{"decrby", "$", "1"}, {"getdel", "$"}, {"getex", "$"}, {"getrange", "$", "0", "1"}, {"lcs", "$", "$"},
+	},
+	TypeHash: {
+		{"hset", "$", "f", "v"}, {"hget", "$", "f"}, {"hscan", "$", "0"}, {"hgetall", "$"}, {"hexists", "$", "f"},
+		{"hdel", "$", "f"}, {"hincrby", "$", "f", "1"}, {"hkeys", "$"}, {"hvals", "$"}, {"hlen", "$"},
+	},
+	TypeList: {
+		{"lpush", "$", "a"}, {"lpop", "$"}, {"lindex", "$", "0"}, {"llen", "$"}, {"lrange", "$", "0", "-1"},
+	},
+	TypeSet: {
+		{"sadd", "$", "a"}, {"srem", "$", "a"}, {"sismember", "$", "a"}, {"smismember", "$", "a"}, {"scard", "$"},
+		{"sdiff", "$"}, {"sinter", "$"}, {"sunion", "$"}, {"sscan", "$", "0"}, {"smembers", "$"}, {"spop", "$"},
+		{"srandmember", "$"},
+	},
+	TypeZset: {
+		{"zadd", "$", "1", "a"}, {"zrem", "$", "a"}, {"zcard", "$"}, {"zscan", "$", "0"}, {"zscore", "$", "a"},
+		{"zmscore", "$", "a"}, {"zrank", "$", "a"}, {"zincrby", "$", "1", "a"}, {"zrange", "$", "0", "-1"},
+		{"zdiff", "1", "$"}, {"zinter", "1", "$"}, {"zunion", "1", "$"}, {"zdiffstore", "dst", "1", "$"},
+		{"zinterstore", "dst", "1", "$"}, {"zunionstore", "dst", "1", "$"}, {"zintercard", "1", "$"},
+	},
+}
+
+func TestCommands_WrongType(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	keys := map[string]string{TypeString: "str", TypeHash: "hash", TypeList: "list", TypeSet: "set", TypeZset: "zset"}
+	for owner, calls := range wrongTypeCommands {
+		for keyType, key := range keys {
+			if keyType == owner {
+				continue
+			}
+			for _, call := range calls {
+				args := make([]string, 0, len(call)-1)
+				for _, arg := range call[1:] {
+					args = append(args, strings.ReplaceAll(arg, "$", key))
+				}
+				if _, err := db.Exec(call[0], args...); !errors.Is(err, ErrWrongType) {
+					t.Fatalf("%s on a %s: expect ErrWrongType got %v", call[0], keyType, err)
+				}
+			}
+			if got, _ := db.Exec("type", key); got != StatusReply(keyType) {
+				t.Fatalf("expect %s to keep its %s value got %v", key, keyType, got)
+			}
+		}
+	}
+	// SET and MSET replace a value of any type, MGET reads it as missing
+	if _, err := db.Exec("set", "hash", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("mset", "list", "v"); err != nil {
+		t.Fatal(err)
+	}
+	values, err := db.Exec("mget", "hash", "list", "set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != "[v v <nil>]" {
+		t.Fatalf("unexpected mget result %v", values)
+	}
+}
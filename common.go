@@ -1,6 +1,6 @@
 package polarisdb
 
-func SetExpire(db *PolarisDB, key string, ttl int64) error {
-	db.Sweeper.SetKeyExpire(key, ttl)
+func SetExpire(tx *TX, key string, ttl int64) error {
+	tx.setExpire(key, ttl)
 	return nil
 }
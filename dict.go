@@ -2,33 +2,69 @@ package polarisdb
 
 import (
 	"github.com/projectxpolaris/polarisdb/dict"
+	"github.com/projectxpolaris/polarisdb/radix"
 	"sync"
+	"sync/atomic"
 )
 
+// indexValue marks a key in the index, the radix tree treats nil data as absent
+var indexValue = []byte{}
+
 type Object interface {
 }
 type KeyEntity struct {
 	Ptr Object
 	LRU float64
+	// Freq is the logarithmic access counter the LFU policies evict by, FreqTime is
+	// the minute it was last decayed in, see LRUClock.TouchLFU
+	Freq     uint8
+	FreqTime uint16
+	// Version changes on every committed write to the key, WATCH compares it
+	Version uint64
+	// Memory is the approximate bytes of the key and its value, set when the key is added
+	Memory int64
 }
 
 type KeyDict struct {
 	sync.RWMutex
 	Data *dict.Dict[*KeyEntity]
-	db   *PolarisDB
+	// Index keeps the keys in order for KEYS and range lookups
+	Index *radix.RadixTree
+	space *Keyspace
+	// approximate bytes of all keys, see entityMemory
+	used int64
 }
 
 func NewKeyDict() *KeyDict {
 	return &KeyDict{
-		Data: dict.NewDict[*KeyEntity](),
+		Data:  dict.NewDict[*KeyEntity](),
+		Index: radix.NewTree(),
+	}
+}
+
+func (d *KeyDict) remove(key string) {
+	if value, isExist := d.Data.Find(key); isExist {
+		d.used -= value.Memory
 	}
+	d.Data.Delete(key)
+	d.Index.Delete([]byte(key))
 }
 
 func (d *KeyDict) Add(key string, value *KeyEntity) {
 	d.Lock()
 	defer d.Unlock()
-	value.LRU = d.db.Clock.GetTime()
-	d.db.Sweeper.TryRemoveExpire(key)
+	value.LRU = d.space.db.Clock.GetTime()
+	if value.Freq == 0 && value.FreqTime == 0 {
+		d.space.db.Clock.InitLFU(value)
+	}
+	d.space.Sweeper.TryRemoveExpire(key)
+	if old, isExist := d.Data.Find(key); isExist {
+		d.used -= old.Memory
+	} else {
+		d.Index.Set([]byte(key), indexValue)
+	}
+	value.Memory = entityMemory(key, value)
+	d.used += value.Memory
 	d.Data.Add(key, value)
 }
 func (d *KeyDict) FindRaw(key string) (*KeyEntity, bool) {
@@ -41,24 +77,54 @@ func (d *KeyDict) Find(key string) (*KeyEntity, bool) {
 	d.Lock()
 	defer d.Unlock()
 	// check if it expire
-	isExpire := d.db.Sweeper.isExpire(key)
+	isExpire := d.space.Sweeper.isExpire(key)
 	if isExpire {
-		d.db.Sweeper.TryRemoveExpire(key)
+		// lazy expire
+		d.removeExpired(key)
 		return nil, false
 	}
 	value, isExist := d.Data.Find(key)
 	if isExist {
-		value.LRU = d.db.Clock.GetTime()
+		value.LRU = d.space.db.Clock.GetTime()
+		d.space.db.Clock.TouchLFU(value)
 	}
 	return value, isExist
 }
 
+// Expire removes key when its ttl passed, it returns whether a key was removed. The active
+// expire cycle uses it.
+func (d *KeyDict) Expire(key string) bool {
+	d.Lock()
+	defer d.Unlock()
+	if !d.space.Sweeper.isExpire(key) {
+		return false
+	}
+	return d.removeExpired(key)
+}
+
+// removeExpired removes key together with its ttl and string value, it returns false
+// when only a ttl was left. The caller holds the lock.
+func (d *KeyDict) removeExpired(key string) bool {
+	d.space.Sweeper.TryRemoveExpire(key)
+	value, isExist := d.Data.Find(key)
+	if !isExist {
+		return false
+	}
+	if store, ok := value.Ptr.(*StringStore); ok {
+		store.delete([]byte(key))
+	}
+	d.remove(key)
+	atomic.AddInt64(&d.space.db.expiredKeys, 1)
+	d.space.db.notifySpace(d.space, NotifyExpired, "expired", key)
+	return true
+}
+
 func (d *KeyDict) Delete(keys ...string) {
 	d.Lock()
 	defer d.Unlock()
 	for _, key := range keys {
-		d.db.Sweeper.TryRemoveExpire(key)
-		d.Data.Delete(key)
+		d.space.Sweeper.TryRemoveExpire(key)
+		d.remove(key)
 	}
 }
 
@@ -75,27 +141,79 @@ func (d *KeyDict) RandomRemoveKey(count int) {
 		if key == "" {
 			break
 		}
-		d.Data.Delete(key)
+		d.remove(key)
 		cur++
 	}
 }
+
+// MemoryUsage returns the approximate bytes of all keys and their values
+func (d *KeyDict) MemoryUsage() int64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.used
+}
+
+// recalculateMemory measures every key again, values that were changed in place
+// (by the aof replay) are out of date until then
+func (d *KeyDict) recalculateMemory() {
+	d.Lock()
+	defer d.Unlock()
+	d.used = 0
+	d.Data.Range(func(key string, value *KeyEntity) bool {
+		value.Memory = entityMemory(key, value)
+		d.used += value.Memory
+		return true
+	})
+}
+
 func (d *KeyDict) Len() int {
+	d.RLock()
+	defer d.RUnlock()
 	return d.Data.Len()
 }
 func (d *KeyDict) Keys() []string {
+	d.RLock()
+	defer d.RUnlock()
 	return d.Data.Keys()
 }
 
+// Scan calls fn for the keys of one bucket and returns the next cursor, see dict.Dict.Scan
+func (d *KeyDict) Scan(cursor uint64, fn func(key string)) uint64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.Data.Scan(cursor, func(key string, _ *KeyEntity) {
+		fn(key)
+	})
+}
+
+// MatchKeys returns the keys matching the glob pattern in lexicographic order
+func (d *KeyDict) MatchKeys(pattern string) []string {
+	d.RLock()
+	defer d.RUnlock()
+	keys := make([]string, 0)
+	d.Index.WalkMatch(pattern, func(key []byte, _ []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	return keys
+}
+
+// RangeKeys returns up to count keys in [start, end) in lexicographic order, an
+// empty end has no upper bound and a count <= 0 no limit
+func (d *KeyDict) RangeKeys(start string, end string, count int) []string {
+	d.RLock()
+	defer d.RUnlock()
+	keys := make([]string, 0)
+	d.Index.WalkRange([]byte(start), []byte(end), func(key []byte, _ []byte) bool {
+		keys = append(keys, string(key))
+		return count <= 0 || len(keys) < count
+	})
+	return keys
+}
+
 // random sample key
 func (d *KeyDict) SampleKeys(count int) []string {
 	d.Lock()
 	defer d.Unlock()
-	keys := make([]string, 0, count)
-	for key := range d.Data.Data {
-		keys = append(keys, key)
-		if len(keys) >= count {
-			break
-		}
-	}
-	return keys
+	return d.Data.SampleKeys(count)
 }
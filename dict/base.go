@@ -1,51 +1,300 @@
 package dict
 
+import (
+	"math/bits"
+	"math/rand"
+	"unsafe"
+)
+
+// minBuckets is the size of an empty table, the table never shrinks below it
+const minBuckets = 4
+
+// rehashEmptyVisits bounds the empty buckets a rehash step skips, so a step of a
+// sparse table stays short
+const rehashEmptyVisits = 10
+
+type entry[T interface{}] struct {
+	key   string
+	value T
+	next  *entry[T]
+}
+
+// Dict is a chained hash table with a power of two number of buckets. It grows
+// when it holds more entries than buckets and shrinks below an eighth. A resize
+// is incremental like in redis: the entries move to the new table a bucket at a
+// time on every Add and Delete, lookups search both tables meanwhile. Scan walks
+// it with a cursor that stays valid across the resizes.
 type Dict[T interface{}] struct {
-	Data map[string]T
+	// tables[1] is the resize target, nil when no resize runs
+	tables [2][]*entry[T]
+	// rehashIndex is the next bucket of tables[0] to move
+	rehashIndex int
+	size        int
 }
 
 func NewDict[T interface{}]() *Dict[T] {
 	return &Dict[T]{
-		Data: make(map[string]T),
+		tables: [2][]*entry[T]{make([]*entry[T], minBuckets)},
+	}
+}
+
+// HashString is the 64 bit FNV-1a hash of s
+func HashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func mask[T interface{}](buckets []*entry[T]) uint64 {
+	return uint64(len(buckets) - 1)
+}
+
+func (d *Dict[T]) rehashing() bool {
+	return d.tables[1] != nil
+}
+
+func (d *Dict[T]) findEntry(key string) *entry[T] {
+	hash := HashString(key)
+	for _, buckets := range d.tables {
+		if buckets == nil {
+			break
+		}
+		for e := buckets[hash&mask(buckets)]; e != nil; e = e.next {
+			if e.key == key {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// resize starts moving the entries to a table of n buckets
+func (d *Dict[T]) resize(n int) {
+	d.tables[1] = make([]*entry[T], n)
+	d.rehashIndex = 0
+}
+
+// rehashStep moves the next non empty bucket to the new table and finishes the
+// resize once tables[0] is empty
+func (d *Dict[T]) rehashStep() {
+	from, to := d.tables[0], d.tables[1]
+	for visits := 0; d.rehashIndex < len(from) && visits < rehashEmptyVisits; visits++ {
+		e := from[d.rehashIndex]
+		from[d.rehashIndex] = nil
+		d.rehashIndex++
+		if e == nil {
+			continue
+		}
+		for e != nil {
+			next := e.next
+			index := HashString(e.key) & mask(to)
+			e.next = to[index]
+			to[index] = e
+			e = next
+		}
+		break
+	}
+	if d.rehashIndex == len(from) {
+		d.tables = [2][]*entry[T]{to}
+		d.rehashIndex = 0
 	}
 }
 
 func (d *Dict[T]) Add(key string, value T) {
-	d.Data[key] = value
+	if d.rehashing() {
+		d.rehashStep()
+	}
+	if e := d.findEntry(key); e != nil {
+		e.value = value
+		return
+	}
+	// new entries go to the table the resize fills
+	buckets := d.tables[0]
+	if d.rehashing() {
+		buckets = d.tables[1]
+	}
+	index := HashString(key) & mask(buckets)
+	buckets[index] = &entry[T]{key: key, value: value, next: buckets[index]}
+	d.size++
+	if !d.rehashing() && d.size > len(d.tables[0]) {
+		d.resize(len(d.tables[0]) * 2)
+	}
 }
 func (d *Dict[T]) AddOrFind(key string, value T) T {
-	if _, ok := d.Data[key]; !ok {
-		d.Data[key] = value
+	if e := d.findEntry(key); e != nil {
+		return e.value
 	}
-	return d.Data[key]
+	d.Add(key, value)
+	return value
 }
 func (d *Dict[T]) Replace(key string, value T) {
-	d.Data[key] = value
+	d.Add(key, value)
 }
 func (d *Dict[T]) Delete(key string) {
-	delete(d.Data, key)
+	if d.rehashing() {
+		d.rehashStep()
+	}
+	hash := HashString(key)
+	for _, buckets := range d.tables {
+		if buckets == nil {
+			return
+		}
+		index := hash & mask(buckets)
+		for prev, e := (*entry[T])(nil), buckets[index]; e != nil; prev, e = e, e.next {
+			if e.key != key {
+				continue
+			}
+			if prev == nil {
+				buckets[index] = e.next
+			} else {
+				prev.next = e.next
+			}
+			d.size--
+			if !d.rehashing() && len(d.tables[0]) > minBuckets && d.size < len(d.tables[0])/8 {
+				// straight to the fitting size, a delete only moves a bucket of the resize
+				n := minBuckets
+				for n < d.size {
+					n *= 2
+				}
+				d.resize(n)
+			}
+			return
+		}
+	}
 }
 
 func (d *Dict[T]) Find(key string) (T, bool) {
-	value, ok := d.Data[key]
-	return value, ok
+	if e := d.findEntry(key); e != nil {
+		return e.value, true
+	}
+	var zero T
+	return zero, false
+}
+
+// bucketCount is the number of buckets of both tables, bucket indexes them in order
+func (d *Dict[T]) bucketCount() int {
+	return len(d.tables[0]) + len(d.tables[1])
 }
 
+func (d *Dict[T]) bucket(i int) *entry[T] {
+	if i < len(d.tables[0]) {
+		return d.tables[0][i]
+	}
+	return d.tables[1][i-len(d.tables[0])]
+}
+
+// RandomKey returns a key from a random bucket, an empty string when the dict is empty
 func (d *Dict[T]) RandomKey() string {
-	for key := range d.Data {
-		return key
+	if d.size == 0 {
+		return ""
+	}
+	count := d.bucketCount()
+	start := rand.Intn(count)
+	for i := 0; i < count; i++ {
+		if e := d.bucket((start + i) % count); e != nil {
+			return e.key
+		}
 	}
 	return ""
 }
 
+// SampleKeys returns up to count keys of consecutive buckets starting at a random one
+func (d *Dict[T]) SampleKeys(count int) []string {
+	keys := make([]string, 0, count)
+	if d.size == 0 {
+		return keys
+	}
+	buckets := d.bucketCount()
+	start := rand.Intn(buckets)
+	for i := 0; i < buckets && len(keys) < count; i++ {
+		for e := d.bucket((start + i) % buckets); e != nil && len(keys) < count; e = e.next {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
 func (d *Dict[T]) Len() int {
-	return len(d.Data)
+	return d.size
 }
 
 func (d *Dict[T]) Keys() []string {
-	keys := make([]string, 0, len(d.Data))
-	for key := range d.Data {
+	keys := make([]string, 0, d.size)
+	d.Range(func(key string, _ T) bool {
 		keys = append(keys, key)
-	}
+		return true
+	})
 	return keys
 }
+
+// MemoryUsage returns the approximate bytes used by the table and its keys,
+// valueSize adds what a value holds outside of its entry, nil counts nothing
+func (d *Dict[T]) MemoryUsage(valueSize func(value T) int) int {
+	var e entry[T]
+	size := int(unsafe.Sizeof(*d)) + d.bucketCount()*int(unsafe.Sizeof(&e))
+	for i := 0; i < d.bucketCount(); i++ {
+		for e := d.bucket(i); e != nil; e = e.next {
+			size += int(unsafe.Sizeof(*e)) + len(e.key)
+			if valueSize != nil {
+				size += valueSize(e.value)
+			}
+		}
+	}
+	return size
+}
+
+// Range calls fn for every entry until it returns false, the dict must not change meanwhile
+func (d *Dict[T]) Range(fn func(key string, value T) bool) {
+	for i := 0; i < d.bucketCount(); i++ {
+		for e := d.bucket(i); e != nil; e = e.next {
+			if !fn(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// Scan calls fn for the entries of one bucket and returns the cursor of the next
+// call, 0 when the scan is complete. Start with cursor 0. The cursor counts with
+// its bits reversed, like the redis SCAN, so every entry that stays in the dict
+// for the whole scan is returned at least once even when the table is resized
+// between the calls. During a resize the bucket of the smaller table is returned
+// with every bucket of the larger one it expands to. Entries may be returned more
+// than once.
+func (d *Dict[T]) Scan(cursor uint64, fn func(key string, value T)) uint64 {
+	small, large := d.tables[0], d.tables[1]
+	if large == nil {
+		for e := small[cursor&mask(small)]; e != nil; e = e.next {
+			fn(e.key, e.value)
+		}
+		return nextCursor(cursor, mask(small))
+	}
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	smallMask, largeMask := mask(small), mask(large)
+	for e := small[cursor&smallMask]; e != nil; e = e.next {
+		fn(e.key, e.value)
+	}
+	for {
+		for e := large[cursor&largeMask]; e != nil; e = e.next {
+			fn(e.key, e.value)
+		}
+		cursor = nextCursor(cursor, largeMask)
+		// stop once the bits the smaller mask does not cover wrapped around
+		if cursor&(smallMask^largeMask) == 0 {
+			return cursor
+		}
+	}
+}
+
+// nextCursor increments the reversed cursor, the bits above the mask are set so the carry passes them
+func nextCursor(cursor uint64, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
@@ -0,0 +1,129 @@
+package dict
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDict_AddFindDelete(t *testing.T) {
+	d := NewDict[int]()
+	for i := 0; i < 1000; i++ {
+		d.Add(fmt.Sprintf("key%d", i), i)
+	}
+	d.Add("key1", -1)
+	if d.Len() != 1000 {
+		t.Fatalf("expect 1000 entries got %d", d.Len())
+	}
+	if value, ok := d.Find("key1"); !ok || value != -1 {
+		t.Fatalf("expect replaced value got %d %v", value, ok)
+	}
+	for i := 0; i < 990; i++ {
+		d.Delete(fmt.Sprintf("key%d", i))
+	}
+	if d.Len() != 10 || len(d.Keys()) != 10 {
+		t.Fatalf("expect 10 entries got %d", d.Len())
+	}
+	// the shrink may still be moving buckets, the table it fills is the small one
+	target := d.tables[0]
+	if d.rehashing() {
+		target = d.tables[1]
+	}
+	if len(target) >= 1024 {
+		t.Fatalf("expect the table to shrink, %d buckets", len(target))
+	}
+	if _, ok := d.Find("key0"); ok {
+		t.Fatal("expect key0 to be deleted")
+	}
+}
+
+func TestDict_IncrementalResize(t *testing.T) {
+	d := NewDict[int]()
+	resizing := false
+	for i := 0; i < 5000; i++ {
+		d.Add(fmt.Sprintf("key%d", i), i)
+		if !d.rehashing() {
+			continue
+		}
+		resizing = true
+		// a step moves a single bucket, both tables are searched meanwhile
+		if d.rehashIndex > len(d.tables[0]) {
+			t.Fatalf("rehash index %d past %d buckets", d.rehashIndex, len(d.tables[0]))
+		}
+		for j := 0; j <= i; j += 97 {
+			if value, ok := d.Find(fmt.Sprintf("key%d", j)); !ok || value != j {
+				t.Fatalf("key%d lost during the resize at %d", j, i)
+			}
+		}
+	}
+	if !resizing {
+		t.Fatal("expect a resize to run over several adds")
+	}
+	count := 0
+	d.Range(func(string, int) bool {
+		count++
+		return true
+	})
+	if count != 5000 || d.Len() != 5000 {
+		t.Fatalf("expect 5000 entries got %d ranged %d", d.Len(), count)
+	}
+	seen := make(map[string]bool)
+	for cursor := d.Scan(0, func(key string, _ int) { seen[key] = true }); cursor != 0; {
+		cursor = d.Scan(cursor, func(key string, _ int) { seen[key] = true })
+	}
+	if len(seen) != 5000 {
+		t.Fatalf("expect the scan to return 5000 keys got %d", len(seen))
+	}
+}
+
+func TestDict_ScanWhileResizing(t *testing.T) {
+	d := NewDict[int]()
+	for i := 0; i < 100; i++ {
+		d.Add(fmt.Sprintf("stable%d", i), i)
+	}
+	seen := make(map[string]bool)
+	cursor := uint64(0)
+	step := 0
+	for {
+		cursor = d.Scan(cursor, func(key string, _ int) {
+			seen[key] = true
+		})
+		// grow the table during the first half of the scan and shrink it afterwards
+		step++
+		if step < 20 {
+			for i := 0; i < 50; i++ {
+				d.Add(fmt.Sprintf("tmp%d_%d", step, i), i)
+			}
+		} else {
+			for _, key := range d.Keys() {
+				if key[0] == 't' {
+					d.Delete(key)
+				}
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if !seen[fmt.Sprintf("stable%d", i)] {
+			t.Fatalf("stable%d was not returned", i)
+		}
+	}
+}
+
+func TestDict_MemoryUsage(t *testing.T) {
+	d := NewDict[string]()
+	empty := d.MemoryUsage(nil)
+	d.Add("key", "value")
+	withoutValues := d.MemoryUsage(nil)
+	if withoutValues <= empty+len("key") {
+		t.Fatalf("expect the entry and its key to be counted, %d after %d", withoutValues, empty)
+	}
+	if withValues := d.MemoryUsage(func(value string) int { return len(value) }); withValues != withoutValues+len("value") {
+		t.Fatalf("expect the value to be counted, %d after %d", withValues, withoutValues)
+	}
+	d.Delete("key")
+	if usage := d.MemoryUsage(nil); usage != empty {
+		t.Fatalf("expect %d after the delete got %d", empty, usage)
+	}
+}
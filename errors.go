@@ -0,0 +1,17 @@
+package polarisdb
+
+import "errors"
+
+// errors returned by the data operations, check them with errors.Is
+var (
+	ErrKeyNotFound    = errors.New("key not exist")
+	ErrKeyExists      = errors.New("key already exist")
+	ErrFieldNotFound  = errors.New("field not exist")
+	ErrListEmpty      = errors.New("list is empty")
+	ErrOutOfRange     = errors.New("index out of range")
+	ErrNotInteger     = errors.New("value is not an integer or out of range")
+	ErrReadOnly       = errors.New("view transaction is read only")
+	ErrInvalidDBIndex = errors.New("DB index is out of range")
+	// ErrWrongType is returned by every operation on a key that holds another type of value
+	ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
@@ -0,0 +1,255 @@
+package polarisdb
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// EvictionPoolSize is the number of candidates a keyspace keeps between evictions
+const EvictionPoolSize = 16
+
+// a sample of tried keys does not prove there are no others, sample a few times
+const evictionAttempts = 3
+
+// evictionEntry is a key the pool may evict, the higher the score the sooner
+type evictionEntry struct {
+	key   string
+	score float64
+}
+
+// evictionPool keeps the best eviction candidates of a keyspace across samples like
+// the evictionPoolEntry of Redis, so every sample improves on the last ones instead
+// of starting over. The entries are ordered by ascending score. It is only used under
+// the db write lock.
+type evictionPool struct {
+	entries []evictionEntry
+}
+
+func newEvictionPool() *evictionPool {
+	return &evictionPool{entries: make([]evictionEntry, 0, EvictionPoolSize)}
+}
+
+// insert adds key unless the pool is full of better candidates, a key already in the pool gets the new score
+func (p *evictionPool) insert(key string, score float64) {
+	for i, entry := range p.entries {
+		if entry.key == key {
+			p.entries = append(p.entries[:i], p.entries[i+1:]...)
+			break
+		}
+	}
+	if len(p.entries) == EvictionPoolSize {
+		if score <= p.entries[0].score {
+			return
+		}
+		p.entries = append(p.entries[:0], p.entries[1:]...)
+	}
+	pos := sort.Search(len(p.entries), func(i int) bool { return p.entries[i].score > score })
+	p.entries = append(p.entries, evictionEntry{})
+	copy(p.entries[pos+1:], p.entries[pos:])
+	p.entries[pos] = evictionEntry{key: key, score: score}
+}
+
+// best returns the candidate with the highest score
+func (p *evictionPool) best() (evictionEntry, bool) {
+	if len(p.entries) == 0 {
+		return evictionEntry{}, false
+	}
+	return p.entries[len(p.entries)-1], true
+}
+
+// pop removes the candidate with the highest score
+func (p *evictionPool) pop() {
+	if len(p.entries) > 0 {
+		p.entries = p.entries[:len(p.entries)-1]
+	}
+}
+
+// isVolatilePolicy tells whether policy only evicts keys with a ttl
+func isVolatilePolicy(policy string) bool {
+	switch policy {
+	case EvictVolRandom, EvictVolLRU, EvictVolLFU, EvictVolTTL:
+		return true
+	}
+	return false
+}
+
+// evictionScore rates key under policy, the higher the score the sooner it is evicted
+func evictionScore(ks *Keyspace, policy string, key string, ent *KeyEntity) float64 {
+	switch policy {
+	case EvictAllKeyLFU, EvictVolLFU:
+		return float64(255 - ks.db.Clock.LFUCount(ent))
+	case EvictVolTTL:
+		// the sooner it expires the higher
+		return -float64(ks.Sweeper.GetExpire(key))
+	default:
+		return ks.db.Clock.GetLruNow(ent.LRU)
+	}
+}
+
+// keyspaceIndex returns the index of ks, -1 when a swap or flush replaced it
+func (db *PolarisDB) keyspaceIndex(ks *Keyspace) int {
+	for index, current := range db.Keyspaces {
+		if current == ks {
+			return index
+		}
+	}
+	return -1
+}
+
+// sampleEvictionKeys samples keys of ks policy may evict
+func (db *PolarisDB) sampleEvictionKeys(ks *Keyspace, policy string) []string {
+	if isVolatilePolicy(policy) {
+		return ks.Sweeper.Store.SampleKeys(db.Config.MaxMemorySamples)
+	}
+	return ks.Dict.SampleKeys(db.Config.MaxMemorySamples)
+}
+
+// evictable returns the entity of key when policy may evict it and it was not tried yet
+func (db *PolarisDB) evictable(ks *Keyspace, policy string, key string, tried map[*Keyspace]map[string]bool) (*KeyEntity, bool) {
+	if tried[ks][key] {
+		return nil, false
+	}
+	ent, isExist := ks.Dict.FindRaw(key)
+	if !isExist || (isVolatilePolicy(policy) && ks.Sweeper.GetExpire(key) == noExpire) {
+		return nil, false
+	}
+	return ent, true
+}
+
+// evictKeys evicts keys of spaces under policy until done reports the target is
+// reached for the keys evicted and the bytes they freed so far, the keys of keep are
+// never evicted. The evicted keys are logged as one record of deletes. It returns
+// ErrOOM when it runs out of keys before the target. The caller holds the db lock.
+func (db *PolarisDB) evictKeys(spaces []*Keyspace, policy string, keep map[*Keyspace]map[string]bool, done func(evicted int, freed int64) bool) error {
+	tx := db.newTX()
+	// kept keys count as tried so no candidate search returns them
+	tried := make(map[*Keyspace]map[string]bool)
+	for ks, keys := range keep {
+		tried[ks] = make(map[string]bool, len(keys))
+		for key := range keys {
+			tried[ks][key] = true
+		}
+	}
+	var err error
+	evicted := 0
+	var freed int64
+	for !done(evicted, freed) {
+		ks, key := db.evictionCandidate(spaces, policy, tried)
+		if key == "" {
+			err = ErrOOM
+			break
+		}
+		if tried[ks] == nil {
+			tried[ks] = make(map[string]bool)
+		}
+		tried[ks][key] = true
+		index := db.keyspaceIndex(ks)
+		if index < 0 {
+			continue
+		}
+		ent, isExist := ks.Dict.FindRaw(key)
+		tx.Select(index)
+		if !isExist || KeyDelete(tx, key) == 0 {
+			// it expired meanwhile
+			continue
+		}
+		tx.log(&KeyDelAction{Keys: []string{key}})
+		tx.notify(NotifyEvicted, "evicted", key)
+		freed += ent.Memory
+		evicted++
+	}
+	if len(tx.Writers) == 0 {
+		return err
+	}
+	data, encodeErr := encodeWriters(tx.Writers)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if appendErr := db.appendLog(data); appendErr != nil {
+		return appendErr
+	}
+	tx.commit()
+	atomic.AddInt64(&db.changes, int64(len(tx.Writers)))
+	atomic.AddInt64(&db.evictedKeys, int64(evicted))
+	db.notifier.publish(tx.events...)
+	return err
+}
+
+// evictionCandidate returns the next key of spaces to evict under policy, the tried
+// keys are skipped. It returns an empty key when no database has one.
+func (db *PolarisDB) evictionCandidate(spaces []*Keyspace, policy string, tried map[*Keyspace]map[string]bool) (*Keyspace, string) {
+	switch policy {
+	case EvictAllKeyRandom, EvictVolRandom:
+		return db.randomCandidate(spaces, policy, tried)
+	}
+	for attempt := 0; attempt < evictionAttempts; attempt++ {
+		for _, ks := range spaces {
+			for _, key := range db.sampleEvictionKeys(ks, policy) {
+				if ent, ok := db.evictable(ks, policy, key, tried); ok {
+					ks.pool.insert(key, evictionScore(ks, policy, key, ent))
+				}
+			}
+		}
+		// the best candidate of all pools, so every database gives up its coldest keys first
+		for {
+			var best *Keyspace
+			var entry evictionEntry
+			for _, ks := range spaces {
+				if candidate, ok := ks.pool.best(); ok && (best == nil || candidate.score > entry.score) {
+					best, entry = ks, candidate
+				}
+			}
+			if best == nil {
+				break
+			}
+			best.pool.pop()
+			// it may be gone or lost its ttl since it was sampled
+			if _, ok := db.evictable(best, policy, entry.key, tried); ok {
+				return best, entry.key
+			}
+		}
+	}
+	return nil, ""
+}
+
+// randomCandidate picks a random sampled key, it rotates through spaces so they all give up keys
+func (db *PolarisDB) randomCandidate(spaces []*Keyspace, policy string, tried map[*Keyspace]map[string]bool) (*Keyspace, string) {
+	for i := 0; i < len(spaces); i++ {
+		index := (db.evictCursor + i) % len(spaces)
+		ks := spaces[index]
+		candidates := make([]string, 0, db.Config.MaxMemorySamples)
+		for attempt := 0; attempt < evictionAttempts && len(candidates) == 0; attempt++ {
+			for _, key := range db.sampleEvictionKeys(ks, policy) {
+				if !tried[ks][key] {
+					candidates = append(candidates, key)
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		db.evictCursor = index + 1
+		return ks, candidates[rand.Intn(len(candidates))]
+	}
+	return nil, ""
+}
+
+// evictCount evicts count keys of ks under policy, the periodic eviction uses it
+// when MaxMemory does not set a target
+func (ks *Keyspace) evictCount(policy string, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	db := ks.db
+	db.Lock()
+	defer db.Unlock()
+	err := db.evictKeys([]*Keyspace{ks}, policy, nil, func(evicted int, _ int64) bool {
+		return evicted >= count
+	})
+	if err == ErrOOM {
+		// fewer keys than the count
+		return nil
+	}
+	return err
+}
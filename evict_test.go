@@ -0,0 +1,59 @@
+package polarisdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEvictionPool(t *testing.T) {
+	pool := newEvictionPool()
+	for i := 0; i < EvictionPoolSize*2; i++ {
+		pool.insert(fmt.Sprintf("key:%d", i), float64(i%EvictionPoolSize*2+i/EvictionPoolSize))
+	}
+	// a key already in the pool is not kept twice
+	pool.insert("key:31", 31)
+	if len(pool.entries) != EvictionPoolSize {
+		t.Fatalf("expect a full pool got %d entries", len(pool.entries))
+	}
+	for i := EvictionPoolSize*2 - 1; i >= EvictionPoolSize; i-- {
+		entry, ok := pool.best()
+		if !ok || entry.score != float64(i) {
+			t.Fatalf("expect score %d got %v %v", i, entry, ok)
+		}
+		pool.pop()
+	}
+	if _, ok := pool.best(); ok {
+		t.Fatal("expect the worse candidates to be dropped")
+	}
+}
+
+func TestTTLKeySweeper(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for i := 0; i < 20; i++ {
+		db.Exec("set", fmt.Sprintf("volatile:%d", i), "v")
+		db.Exec("expire", fmt.Sprintf("volatile:%d", i), fmt.Sprintf("%d", 3600+i))
+		db.Exec("set", fmt.Sprintf("persistent:%d", i), "v")
+	}
+	for i := 0; i < 10; i++ {
+		TTLKeySweeper(db.Keyspaces[0])
+	}
+	if keys := db.Keyspaces[0].Dict.Len(); keys != 30 {
+		t.Fatalf("expect 10 keys to be evicted got %d left", keys)
+	}
+	if expires := db.Keyspaces[0].Sweeper.Store.Len(); expires != 10 {
+		t.Fatalf("expect only keys with a ttl to be evicted got %d left", expires)
+	}
+	// the pool keeps the soonest to expire of every sample, the last one is never picked
+	if reply, _ := db.Exec("exists", "volatile:19"); reply != int64(1) {
+		t.Fatal("expect the key with the longest ttl to survive")
+	}
+	// the evictions are logged
+	db = reopenTestDB(t, db)
+	if keys := db.Keyspaces[0].Dict.Len(); keys != 30 {
+		t.Fatalf("expect 30 keys after the replay got %d", keys)
+	}
+}
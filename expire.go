@@ -0,0 +1,84 @@
+package polarisdb
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultActiveExpireKeysPerLoop is the number of expired keys a round removes when the config does not set it
+	DefaultActiveExpireKeysPerLoop = 20
+	// DefaultActiveExpireCycleTime is the time (ms) one cycle may take when the config does not set it
+	DefaultActiveExpireCycleTime = 25
+)
+
+// expireStats are the counters of the active expire cycle INFO reports
+type expireStats struct {
+	// running average of the percentage of the keys with a ttl that a cycle found expired, stored as float64 bits
+	stalePerc uint64
+	// cycles that stopped because they ran out of time
+	timeCapReached int64
+}
+
+// StalePercentage returns the running average of the percentage of keys with a ttl that were expired
+func (s *expireStats) StalePercentage() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.stalePerc))
+}
+
+// record adds the result of a cycle to the running average, the sweepers of the
+// keyspaces record concurrently
+func (s *expireStats) record(volatile int, expired int) {
+	if volatile == 0 {
+		return
+	}
+	current := float64(expired) / float64(volatile) * 100
+	for {
+		old := atomic.LoadUint64(&s.stalePerc)
+		average := current*0.05 + math.Float64frombits(old)*0.95
+		if atomic.CompareAndSwapUint64(&s.stalePerc, old, math.Float64bits(average)) {
+			return
+		}
+	}
+}
+
+// activeExpireCycle removes expired keys in rounds that take them from the deadline
+// index, until none is left or the cycle runs out of time. The keys it removed over
+// the keys with a ttl it started with is the stale percentage of the cycle.
+func (s *Sweeper) activeExpireCycle() {
+	config := s.space.db.Config
+	budget := time.Duration(config.ActiveExpireCycleTime) * time.Millisecond
+	start := time.Now()
+	volatile, expired := s.Store.Len(), 0
+	defer func() {
+		s.space.db.expireStats.record(volatile, expired)
+	}()
+	for {
+		found, removed := s.expireRound(config.ActiveExpireKeysPerLoop)
+		expired += removed
+		if found < config.ActiveExpireKeysPerLoop {
+			return
+		}
+		if time.Since(start) > budget {
+			atomic.AddInt64(&s.space.db.expireStats.timeCapReached, 1)
+			return
+		}
+	}
+}
+
+// expireRound removes up to count keys whose ttl passed, it returns the number of
+// expired ttls it found and of keys it removed. It holds the db lock so transactions
+// do not see keys go away halfway through.
+func (s *Sweeper) expireRound(count int) (found int, expired int) {
+	db := s.space.db
+	db.Lock()
+	defer db.Unlock()
+	keys := s.Store.Expired(time.Now().UnixMilli(), count)
+	for _, key := range keys {
+		// a ttl left behind by a key that is gone is dropped as well
+		if s.space.Dict.Expire(key) {
+			expired++
+		}
+	}
+	return len(keys), expired
+}
@@ -0,0 +1,107 @@
+package polarisdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweeper_ActiveExpireCycle(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for i := 0; i < 200; i++ {
+		db.Exec("set", fmt.Sprintf("short:%d", i), "v")
+		db.Exec("pexpire", fmt.Sprintf("short:%d", i), "1")
+	}
+	for i := 0; i < 20; i++ {
+		db.Exec("set", fmt.Sprintf("long:%d", i), "v")
+		db.Exec("expire", fmt.Sprintf("long:%d", i), "3600")
+		db.Exec("set", fmt.Sprintf("persistent:%d", i), "v")
+	}
+	<-time.After(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		space := db.Keyspaces[0]
+		// a cycle may stop at its time budget, a few cycles get all of them
+		for i := 0; i < 100 && space.Dict.Len() > 40; i++ {
+			space.Sweeper.sweep()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the expire cycle not to block")
+	}
+	if keys := db.Keyspaces[0].Dict.Len(); keys != 40 {
+		t.Fatalf("expect only the live keys to be left got %d", keys)
+	}
+	if expires := db.Keyspaces[0].Sweeper.Store.Len(); expires != 20 {
+		t.Fatalf("expect the ttls of the expired keys to be gone got %d", expires)
+	}
+	info := db.Info("stats")
+	if !strings.Contains(info, "expired_keys:200\r\n") {
+		t.Fatalf("expect 200 expired keys got %q", info)
+	}
+	if db.expireStats.StalePercentage() <= 0 || strings.Contains(info, "expired_stale_perc:0.00\r\n") {
+		t.Fatalf("expect a stale percentage got %q", info)
+	}
+}
+
+func TestSweeperStore_Deadlines(t *testing.T) {
+	store := NewSweeperStore()
+	for i := 0; i < 100; i++ {
+		store.set(fmt.Sprintf("key:%d", i), int64(1000+(i*37)%100))
+	}
+	store.set("key:50", 10)
+	store.remove("key:0")
+	if key, deadline, ok := store.NextDeadline(); !ok || key != "key:50" || deadline != 10 {
+		t.Fatalf("expect key:50 to expire first got %s %d %v", key, deadline, ok)
+	}
+	// deadlines 10 and 1001..1009 are before 1010, key:0 with 1000 is gone
+	if keys := store.Expired(1010, 100); len(keys) != 10 {
+		t.Fatalf("expect 10 expired keys got %v", keys)
+	}
+	if keys := store.Expired(1010, 3); len(keys) != 3 {
+		t.Fatalf("expect the limit to be kept got %v", keys)
+	}
+	for len(store.deadlines) > 0 {
+		key, deadline, _ := store.NextDeadline()
+		for _, entity := range store.deadlines {
+			if entity.TTL < deadline {
+				t.Fatalf("expect %s to be the first deadline, %s has %d", key, entity.key, entity.TTL)
+			}
+		}
+		store.remove(key)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("expect the map and the index to agree got %d", store.Len())
+	}
+}
+
+func TestCommands_DebugNextExpire(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	if reply, err := db.Exec("debug", "nextexpire"); reply != nil || err != nil {
+		t.Fatalf("expect nil without ttls got %v %v", reply, err)
+	}
+	db.Exec("set", "late", "v")
+	db.Exec("pexpireat", "late", "9000000000000")
+	db.Exec("set", "soon", "v")
+	db.Exec("pexpireat", "soon", "8000000000000")
+	reply, err := db.Exec("debug", "nextexpire")
+	if err != nil || fmt.Sprint(reply) != "[soon 8000000000000]" {
+		t.Fatalf("expect soon to expire first got %v %v", reply, err)
+	}
+	db.Exec("persist", "soon")
+	if info := db.Info("stats"); !strings.Contains(info, "next_expire_deadline:9000000000000\r\n") {
+		t.Fatalf("expect the deadline of late got %q", info)
+	}
+}
@@ -2,8 +2,9 @@ module github.com/projectxpolaris/polarisdb
 
 go 1.18
 
+require github.com/allentom/haruka v0.0.0-20220727070012-8da0b79e04c3
+
 require (
-	github.com/allentom/haruka v0.0.0-20220727070012-8da0b79e04c3 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/rs/cors v1.8.2 // indirect
 	github.com/sirupsen/logrus v1.9.0 // indirect
@@ -0,0 +1,145 @@
+package polarisdb
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// infoSection renders one INFO section as "field:value" lines
+type infoSection func(db *PolarisDB) [][2]string
+
+var infoSections = []struct {
+	name   string
+	render infoSection
+}{
+	{"memory", memoryInfo},
+	{"persistence", persistenceInfo},
+	{"stats", statsInfo},
+	{"keyspace", keyspaceInfo},
+}
+
+// Info returns the INFO text for the given sections, all sections when none is given
+func (db *PolarisDB) Info(sections ...string) string {
+	wanted := make(map[string]bool)
+	for _, section := range sections {
+		wanted[strings.ToLower(section)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["everything"] || wanted["default"]
+	var builder strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, field := range section.render(db) {
+			builder.WriteString(fmt.Sprintf("%s:%s\r\n", field[0], field[1]))
+		}
+	}
+	return builder.String()
+}
+
+// AofFsyncStatus reports the fsync policy, the last successful fsync and fsync failures
+func (db *PolarisDB) AofFsyncStatus() FsyncStatus {
+	return db.Log.FsyncStatus()
+}
+
+func persistenceInfo(db *PolarisDB) [][2]string {
+	snapshot := db.SnapshotStatus()
+	saveInProgress, saveStatus, lastSave := "0", "ok", int64(-1)
+	if snapshot.InProgress {
+		saveInProgress = "1"
+	}
+	if snapshot.LastError != nil {
+		saveStatus = "err"
+	}
+	if !snapshot.LastSave.IsZero() {
+		lastSave = snapshot.LastSave.Unix()
+	}
+	status := db.AofFsyncStatus()
+	lastFsync := int64(-1)
+	if !status.LastFsync.IsZero() {
+		lastFsync = status.LastFsync.Unix()
+	}
+	fsyncStatus := "ok"
+	if status.LastError != nil {
+		fsyncStatus = "err"
+	}
+	fields := [][2]string{
+		{"rdb_changes_since_last_save", fmt.Sprintf("%d", snapshot.ChangesSinceSave)},
+		{"rdb_bgsave_in_progress", saveInProgress},
+		{"rdb_last_save_time", fmt.Sprintf("%d", lastSave)},
+		{"rdb_last_bgsave_status", saveStatus},
+		{"aof_fsync_policy", status.Policy},
+		{"aof_last_fsync_time", fmt.Sprintf("%d", lastFsync)},
+		{"aof_last_fsync_status", fsyncStatus},
+		{"aof_fsync_errors", fmt.Sprintf("%d", status.TotalErrors)},
+	}
+	if status.LastError != nil {
+		fields = append(fields, [2]string{"aof_last_fsync_error", status.LastError.Error()})
+	}
+	rewrite := db.Log.RewriteStatus()
+	rewriteInProgress, rewriteStatus := "0", "ok"
+	if rewrite.InProgress {
+		rewriteInProgress = "1"
+	}
+	if rewrite.LastError != nil {
+		rewriteStatus = "err"
+	}
+	fields = append(fields,
+		[2]string{"aof_rewrite_in_progress", rewriteInProgress},
+		[2]string{"aof_rewrites", fmt.Sprintf("%d", rewrite.Rewrites)},
+		[2]string{"aof_last_bgrewrite_status", rewriteStatus},
+		[2]string{"aof_current_size", fmt.Sprintf("%d", rewrite.CurrentSize)},
+		[2]string{"aof_base_size", fmt.Sprintf("%d", rewrite.BaseSize)},
+	)
+	return fields
+}
+
+func memoryInfo(db *PolarisDB) [][2]string {
+	return [][2]string{
+		{"used_memory", fmt.Sprintf("%d", db.UsedMemory())},
+		{"maxmemory", fmt.Sprintf("%d", db.Config.MaxMemory)},
+		{"maxmemory_policy", db.Config.EvicterPolicy},
+	}
+}
+
+func statsInfo(db *PolarisDB) [][2]string {
+	return [][2]string{
+		{"expired_keys", fmt.Sprintf("%d", atomic.LoadInt64(&db.expiredKeys))},
+		{"expired_stale_perc", fmt.Sprintf("%.2f", db.expireStats.StalePercentage())},
+		{"expired_time_cap_reached_count", fmt.Sprintf("%d", atomic.LoadInt64(&db.expireStats.timeCapReached))},
+		{"next_expire_deadline", fmt.Sprintf("%d", db.nextExpireDeadline())},
+		{"evicted_keys", fmt.Sprintf("%d", atomic.LoadInt64(&db.evictedKeys))},
+		{"pubsub_channels", fmt.Sprintf("%d", len(db.PubSubChannels("")))},
+		{"pubsub_patterns", fmt.Sprintf("%d", db.PubSubNumPat())},
+		{"client_output_buffer_limit_disconnections", fmt.Sprintf("%d", atomic.LoadInt64(&db.pubsub.disconnections))},
+	}
+}
+
+// nextExpireDeadline returns the first deadline (unix ms) of all databases, -1 when no key has a ttl
+func (db *PolarisDB) nextExpireDeadline() int64 {
+	next := noExpire
+	for _, ks := range db.Keyspaces {
+		if _, deadline, isExist := ks.Sweeper.Store.NextDeadline(); isExist && (next == noExpire || deadline < next) {
+			next = deadline
+		}
+	}
+	return next
+}
+
+// keyspaceInfo lists the databases that have keys, the caller holds the db lock
+func keyspaceInfo(db *PolarisDB) [][2]string {
+	fields := make([][2]string, 0)
+	for index, ks := range db.Keyspaces {
+		keys := ks.Dict.Len()
+		if keys == 0 {
+			continue
+		}
+		fields = append(fields, [2]string{fmt.Sprintf("db%d", index), fmt.Sprintf("keys=%d,expires=%d", keys, ks.Sweeper.Store.Len())})
+	}
+	return fields
+}
@@ -0,0 +1,62 @@
+package polarisdb
+
+import "context"
+
+// DefaultDatabases is the number of numbered databases when the config does not set it
+const DefaultDatabases = 16
+
+// Keyspace is one numbered database, it has its own keys, ttls and string values
+type Keyspace struct {
+	Dict        *KeyDict
+	Sweeper     *Sweeper
+	StringStore *StringStore
+	db          *PolarisDB
+	// eviction candidates kept between evictions
+	pool *evictionPool
+	// stops the sweeper once the keyspace is flushed away
+	stopSweeper context.CancelFunc
+}
+
+func newKeyspace(db *PolarisDB) *Keyspace {
+	ks := &Keyspace{
+		Dict:        NewKeyDict(),
+		StringStore: NewStore(),
+		db:          db,
+		pool:        newEvictionPool(),
+	}
+	ks.Dict.space = ks
+	ks.Sweeper = NewSweeper(ks)
+	return ks
+}
+
+// Keyspace returns the database with the given index, nil when it is out of range
+func (db *PolarisDB) Keyspace(index int) *Keyspace {
+	if index < 0 || index >= len(db.Keyspaces) {
+		return nil
+	}
+	return db.Keyspaces[index]
+}
+
+// SwapDB exchanges the contents of two databases, the selected database keeps its index
+func SwapDB(tx *TX, first int, second int) error {
+	spaces := tx.keyspaces()
+	if first < 0 || first >= len(spaces) || second < 0 || second >= len(spaces) {
+		return ErrInvalidDBIndex
+	}
+	a, b := spaces[first], spaces[second]
+	tx.replaceKeyspace(first, b)
+	tx.replaceKeyspace(second, a)
+	return nil
+}
+
+// FlushDB removes every key of the selected database
+func FlushDB(tx *TX) {
+	tx.replaceKeyspace(tx.index, newKeyspace(tx.db))
+}
+
+// FlushAll removes every key of every database
+func FlushAll(tx *TX) {
+	for index := range tx.keyspaces() {
+		tx.replaceKeyspace(index, newKeyspace(tx.db))
+	}
+}
@@ -0,0 +1,206 @@
+package polarisdb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// getIn reads key from database index, "" when it is missing
+func getIn(t *testing.T, db *PolarisDB, index int, key string) string {
+	var value string
+	err := db.View(func(tx *TX) error {
+		if err := tx.Select(index); err != nil {
+			return err
+		}
+		var err error
+		value, err = tx.Get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestTX_Select(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", Databases: 4})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	err := db.Update(func(tx *TX) error {
+		for index := 0; index < 3; index++ {
+			if err := tx.Select(index); err != nil {
+				return err
+			}
+			if err := tx.SetString("key", string(rune('a'+index)), false); err != nil {
+				return err
+			}
+		}
+		return tx.Select(4)
+	})
+	if !errors.Is(err, ErrInvalidDBIndex) {
+		t.Fatalf("expect ErrInvalidDBIndex got %v", err)
+	}
+	if value := getIn(t, db, 0, "key"); value != "" {
+		t.Fatalf("expect the failed transaction to be dropped got %q", value)
+	}
+	err = db.Update(func(tx *TX) error {
+		for index := 0; index < 3; index++ {
+			tx.Select(index)
+			if err := tx.SetString("key", string(rune('a'+index)), false); err != nil {
+				return err
+			}
+		}
+		return tx.SetExpire("key", 60000)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, current := range []*PolarisDB{db, reopenTestDB(t, db)} {
+		for index, expect := range []string{"a", "b", "c", ""} {
+			if value := getIn(t, current, index, "key"); value != expect {
+				t.Fatalf("expect %q in db %d got %q", expect, index, value)
+			}
+		}
+		if current.Keyspaces[2].Sweeper.GetExpire("key") == noExpire || current.Keyspaces[0].Sweeper.GetExpire("key") != noExpire {
+			t.Fatal("expect only db 2 to have a ttl")
+		}
+	}
+}
+
+func TestTX_MoveSwapFlush(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", Databases: 4})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for _, args := range [][]string{
+		{"set", "str", "v"},
+		{"sadd", "set", "a", "b"},
+		{"set", "gone", "v"},
+	} {
+		if _, err := db.Exec(args[0], args[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecDB(1, "set", "taken", "1"); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Update(func(tx *TX) error {
+		if moved, err := tx.Move("str", 1); err != nil || !moved {
+			t.Fatalf("expect str to move got %v %v", moved, err)
+		}
+		if moved, _ := tx.Move("missing", 1); moved {
+			t.Fatal("expect a missing key not to move")
+		}
+		if _, err := tx.Move("set", 0); !errors.Is(err, ErrSameObjects) {
+			t.Fatalf("expect ErrSameObjects got %v", err)
+		}
+		if moved, err := tx.Move("set", 2); err != nil || !moved {
+			t.Fatalf("expect set to move got %v %v", moved, err)
+		}
+		if exists, _ := tx.Exists("str"); exists {
+			t.Fatal("expect str to be gone from db 0")
+		}
+		// db 3 gets the old db 1, the selected db 0 is emptied
+		if err := tx.SwapDB(1, 3); err != nil {
+			return err
+		}
+		if err := tx.FlushDB(); err != nil {
+			return err
+		}
+		tx.Select(3)
+		value, err := tx.Get("str")
+		if err != nil || value != "v" {
+			t.Fatalf("expect the moved value in db 3 got %q %v", value, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *PolarisDB) {
+		if value := getIn(t, db, 0, "gone"); value != "" {
+			t.Fatalf("expect db 0 to be flushed got %q", value)
+		}
+		if value := getIn(t, db, 1, "taken"); value != "" {
+			t.Fatalf("expect db 1 to be swapped away got %q", value)
+		}
+		if value := getIn(t, db, 3, "taken"); value != "1" {
+			t.Fatalf("expect taken in db 3 got %q", value)
+		}
+		members, err := db.ExecDB(2, "smembers", "set")
+		if err != nil || len(members.(SetReply)) != 2 {
+			t.Fatalf("expect the moved set in db 2 got %v %v", members, err)
+		}
+	}
+	check(db)
+	db = reopenTestDB(t, db)
+	check(db)
+	if err = db.RewriteAof(); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTestDB(t, db)
+	check(db)
+	if err = db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTestDB(t, db)
+	check(db)
+
+	if info, _ := db.Exec("info", "keyspace"); !strings.Contains(info.(string), "db3:keys=2,expires=0") {
+		t.Fatalf("expect db3 in the keyspace info got %q", info)
+	}
+	if _, err = db.Exec("flushall"); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTestDB(t, db)
+	if value := getIn(t, db, 3, "taken"); value != "" {
+		t.Fatalf("expect flushall to empty db 3 got %q", value)
+	}
+}
+
+func TestCommands_Select(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", Databases: 2})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	results := db.ExecBatchDB(1, []BatchCommand{
+		{Command: "set", Args: []string{"foo", "1"}},
+		{Command: "select", Args: []string{"0"}},
+		{Command: "get", Args: []string{"foo"}},
+		{Command: "set", Args: []string{"foo", "0"}},
+		{Command: "select", Args: []string{"2"}},
+	})
+	if results[2].Reply != nil {
+		t.Fatalf("expect foo to be missing in db 0 got %v", results[2].Reply)
+	}
+	if !errors.Is(results[4].Err, ErrInvalidDBIndex) {
+		t.Fatalf("expect ErrInvalidDBIndex got %v", results[4].Err)
+	}
+	if value := getIn(t, db, 1, "foo"); value != "1" {
+		t.Fatalf("expect 1 in db 1 got %q", value)
+	}
+	if value := getIn(t, db, 0, "foo"); value != "0" {
+		t.Fatalf("expect 0 in db 0 got %q", value)
+	}
+	watched, err := db.WatchDB(1, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("set", "foo", "changed")
+	if _, err = db.ExecMultiDB(1, watched, []BatchCommand{{Command: "set", Args: []string{"foo", "2"}}}); err != nil {
+		t.Fatalf("expect a write to another db not to touch the watch got %v", err)
+	}
+	watched, _ = db.WatchDB(1, "foo")
+	db.ExecDB(1, "set", "foo", "changed")
+	if _, err = db.ExecMultiDB(0, watched, nil); err != ErrWatchedKeyChanged {
+		t.Fatalf("expect ErrWatchedKeyChanged got %v", err)
+	}
+}
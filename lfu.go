@@ -0,0 +1,71 @@
+package polarisdb
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// LFUInitVal is the counter of a new key, so it is not evicted before it had a chance to be read
+	LFUInitVal uint8 = 5
+	// DefaultLfuLogFactor is the log factor of the access counter when the config does not set it
+	DefaultLfuLogFactor = 10
+	// DefaultLfuDecayTime is the minutes without access that take one from the counter when the config does not set it
+	DefaultLfuDecayTime = 1
+)
+
+// lfuMinutes returns the current time in minutes, it wraps like the 16 bits it is stored in
+func lfuMinutes() uint16 {
+	return uint16(time.Now().Unix() / 60)
+}
+
+// lfuElapsed returns the minutes since ldt, it takes a single wrap into account
+func lfuElapsed(ldt uint16) int64 {
+	now := lfuMinutes()
+	if now >= ldt {
+		return int64(now - ldt)
+	}
+	return 65535 - int64(ldt) + int64(now)
+}
+
+// lfuLogIncr increments counter with a probability that falls the higher it is, a
+// key needs about factor*(counter-LFUInitVal) accesses to take it one step further
+func lfuLogIncr(counter uint8, factor int) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	baseval := float64(0)
+	if counter > LFUInitVal {
+		baseval = float64(counter - LFUInitVal)
+	}
+	if rand.Float64() < 1.0/(baseval*float64(factor)+1) {
+		counter++
+	}
+	return counter
+}
+
+// LFUCount returns the access counter of ent after the decay for the minutes it was
+// not accessed, ent is not changed
+func (c *LRUClock) LFUCount(ent *KeyEntity) uint8 {
+	decay := c.db.Config.LfuDecayTime
+	if decay <= 0 {
+		return ent.Freq
+	}
+	periods := lfuElapsed(ent.FreqTime) / int64(decay)
+	if periods >= int64(ent.Freq) {
+		return 0
+	}
+	return ent.Freq - uint8(periods)
+}
+
+// TouchLFU decays the access counter of ent and counts one access
+func (c *LRUClock) TouchLFU(ent *KeyEntity) {
+	ent.Freq = lfuLogIncr(c.LFUCount(ent), c.db.Config.LfuLogFactor)
+	ent.FreqTime = lfuMinutes()
+}
+
+// InitLFU gives a new key its initial counter
+func (c *LRUClock) InitLFU(ent *KeyEntity) {
+	ent.Freq = LFUInitVal
+	ent.FreqTime = lfuMinutes()
+}
@@ -0,0 +1,119 @@
+package polarisdb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrClosed refuses writes to a closed database
+var ErrClosed = errors.New("database is closed")
+
+// closeTimeout is how long Close waits for the http requests in flight
+const closeTimeout = 5 * time.Second
+
+// startBackground starts the sweepers of every database, Close stops them
+func (db *PolarisDB) startBackground() {
+	db.background, db.stopBackground = context.WithCancel(context.Background())
+	for _, ks := range db.Keyspaces {
+		db.startSweeper(ks)
+	}
+}
+
+// startSweeper runs the sweeper of ks until ks is flushed away or the database closes
+func (db *PolarisDB) startSweeper(ks *Keyspace) {
+	if db.background == nil || ks.stopSweeper != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(db.background)
+	ks.stopSweeper = cancel
+	db.goBackground(func() {
+		ks.Sweeper.run(ctx)
+	})
+}
+
+// replaceSweepers stops the sweepers of the databases a swap or flush dropped and
+// starts the ones of the databases it installed, the caller holds the db lock
+func (db *PolarisDB) replaceSweepers(old []*Keyspace) {
+	installed := make(map[*Keyspace]bool)
+	for _, ks := range db.Keyspaces {
+		installed[ks] = true
+		db.startSweeper(ks)
+	}
+	for _, ks := range old {
+		if !installed[ks] && ks.stopSweeper != nil {
+			ks.stopSweeper()
+		}
+	}
+}
+
+// goBackground runs fn in a goroutine Close waits for
+func (db *PolarisDB) goBackground(fn func()) {
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		fn()
+	}()
+}
+
+// Run serves the opened database over http and resp until ctx is done or a server
+// fails, then closes it
+func (db *PolarisDB) Run(ctx context.Context) error {
+	if db.background == nil {
+		return errors.New("database is not open")
+	}
+	err := db.RunServer()
+	if err == nil {
+		select {
+		case <-ctx.Done():
+		case err = <-db.serveErr:
+		}
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops the servers, closes the subscriptions, stops the sweepers and the
+// snapshot loop, waits for them and for background saves and rewrites to finish, then
+// flushes and closes the aof. Calling it again does nothing.
+func (db *PolarisDB) Close() error {
+	db.closeOnce.Do(func() {
+		var errs []error
+		db.RLock()
+		httpServer, respServer := db.httpServer, db.respServer
+		db.RUnlock()
+		if httpServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+			errs = append(errs, httpServer.Shutdown(ctx))
+			cancel()
+		}
+		if respServer != nil {
+			errs = append(errs, respServer.Close())
+		}
+		db.pubsub.close()
+		db.notifier.close()
+		// refuse writes from now on, the aof is closed below
+		db.Lock()
+		db.closed = true
+		db.background = nil
+		db.Unlock()
+		if db.stopBackground != nil {
+			db.stopBackground()
+		}
+		if db.stopSnapshot != nil {
+			close(db.stopSnapshot)
+		}
+		db.wg.Wait()
+		if db.Log != nil {
+			errs = append(errs, db.Log.Close())
+		}
+		for _, err := range errs {
+			if err != nil && db.closeErr == nil {
+				db.closeErr = err
+			}
+		}
+	})
+	return db.closeErr
+}
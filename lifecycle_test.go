@@ -0,0 +1,103 @@
+package polarisdb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPolarisDB_Close(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", SweeperInterval: 10})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	db.Exec("set", "key", "v")
+	db.Exec("pexpire", "key", "1")
+	// the sweeper runs without anything reading the key
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Keyspaces[0].Dict.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the sweeper to expire the key")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	// the flushed keyspace gets a sweeper of its own
+	old := db.Keyspaces[0]
+	if _, err := db.Exec("flushdb"); err != nil {
+		t.Fatal(err)
+	}
+	if db.Keyspaces[0].stopSweeper == nil {
+		t.Fatal("expect a sweeper for the new keyspace")
+	}
+	db.Exec("set", "kept", "v")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("set", "foo", "bar"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("expect a second close to do nothing got %v", err)
+	}
+	if old.Sweeper.space != old {
+		t.Fatal("expect the old keyspace to be left alone")
+	}
+	db = NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value := getIn(t, db, 0, "kept"); value != "v" {
+		t.Fatalf("expect the write before close to be on disk got %q", value)
+	}
+}
+
+func TestPolarisDB_Run(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", Host: "127.0.0.1", Port: "0", RespPort: "0"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- db.Run(ctx)
+	}()
+	var addr string
+	for i := 0; i < 100 && addr == ""; i++ {
+		<-time.After(10 * time.Millisecond)
+		db.RLock()
+		if db.respServer != nil && db.respServer.listener != nil {
+			addr = db.respServer.Addr().String()
+		}
+		db.RUnlock()
+	}
+	if addr == "" {
+		t.Fatal("expect the resp server to listen")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cancel()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expect Run to return once the context is done")
+	}
+	// the open connection was closed by the server
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect the connection to be closed")
+	}
+	if err = db.Run(context.Background()); err == nil {
+		t.Fatal("expect a closed database not to run")
+	}
+}
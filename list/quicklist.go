@@ -1,5 +1,7 @@
 package list
 
+import "unsafe"
+
 type QuickList struct {
 	head *Node
 }
@@ -107,7 +109,7 @@ func (q *QuickList) DeleteAt(index int) {
 	for ; cur != nil; cur = cur.next {
 		targetZipList = cur.Decode()
 		targetElmCount := targetZipList.Count()
-		if count+targetElmCount >= index {
+		if count+targetElmCount > index {
 			break
 		}
 		count += targetElmCount
@@ -122,7 +124,7 @@ func (q *QuickList) Index(index int) []byte {
 	for ; cur != nil; cur = cur.next {
 		targetZipList = cur.Decode()
 		targetElmCount := targetZipList.Count()
-		if count+targetElmCount >= index {
+		if count+targetElmCount > index {
 			break
 		}
 		count += targetElmCount
@@ -191,3 +193,65 @@ func (it *QuickListIterator) Next() []byte {
 	}
 	return nextEntry.data
 }
+
+// MemoryUsage returns the approximate bytes used by the nodes and their ziplists
+func (q *QuickList) MemoryUsage() int {
+	size := int(unsafe.Sizeof(*q))
+	if q.head == nil {
+		return size
+	}
+	cur := q.head
+	for {
+		size += int(unsafe.Sizeof(*cur)) + len(cur.zl)
+		cur = cur.next
+		if cur == nil || cur == q.head {
+			return size
+		}
+	}
+}
+
+// Ziplists returns the encoded ziplist of every node from head to tail
+func (q *QuickList) Ziplists() [][]byte {
+	zls := make([][]byte, 0)
+	if q.head == nil {
+		return zls
+	}
+	cur := q.head
+	for {
+		zls = append(zls, cur.zl)
+		cur = cur.next
+		if cur == nil || cur == q.head {
+			return zls
+		}
+	}
+}
+
+// NewQuickListFromZiplists rebuilds a quicklist from the output of Ziplists
+func NewQuickListFromZiplists(zls [][]byte) *QuickList {
+	q := NewQuickList()
+	for _, zl := range zls {
+		node := &Node{zl: zl}
+		if q.head == nil {
+			node.next = node
+			node.prev = node
+			q.head = node
+			continue
+		}
+		tail := q.head.prev
+		node.prev = tail
+		node.next = q.head
+		tail.next = node
+		q.head.prev = node
+	}
+	return q
+}
+
+// Clone returns a deep copy of the quicklist
+func (q *QuickList) Clone() *QuickList {
+	zls := q.Ziplists()
+	copies := make([][]byte, len(zls))
+	for i, zl := range zls {
+		copies[i] = append([]byte(nil), zl...)
+	}
+	return NewQuickListFromZiplists(copies)
+}
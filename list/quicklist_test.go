@@ -116,3 +116,25 @@ func TestQuickListIterator_Next(t *testing.T) {
 		curEntry = iter.Next()
 	}
 }
+
+func TestNewQuickListFromZiplists(t *testing.T) {
+	ql := NewQuickList()
+	MaxZiplistSize = 5 * (len("data_00") + 16)
+	for i := 0; i < 20; i++ {
+		ql.InsertAt(ql.Len(), []byte(fmt.Sprintf("data_%02d", i)))
+	}
+	zls := ql.Ziplists()
+	if len(zls) < 2 {
+		t.Fatalf("expect several nodes got %d", len(zls))
+	}
+	restored := NewQuickListFromZiplists(zls)
+	if restored.Len() != 20 {
+		t.Fatalf("expect 20 elements got %d", restored.Len())
+	}
+	expect := ql.Range(0, 19)
+	for i, data := range restored.Range(0, 19) {
+		if string(data) != string(expect[i]) {
+			t.Fatalf("unexpected element %d: %s", i, data)
+		}
+	}
+}
@@ -127,10 +127,6 @@ func (z *ziplistEntry) Delete(pos int) {
 	for i := 0; i < pos+1; i++ {
 		targetEntry = iter.Next()
 	}
-	// decode data to delete
-	entry := Newzlentry(z.entry[iter.offset : iter.offset+16])
-	entry.DecodeHeader()
-	entry.data = z.entry[iter.offset+16 : iter.offset+16+entry.len]
 	// adjust
 	newData := make([]byte, 0)
 	offset := iter.offset
@@ -0,0 +1,162 @@
+package polarisdb
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/projectxpolaris/polarisdb/radix"
+	"github.com/projectxpolaris/polarisdb/utils"
+)
+
+// ErrOOM refuses a write that would take the used memory over MaxMemory when
+// eviction cannot make room for it
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+// DefaultMaxMemorySamples is the number of keys an eviction samples when the config does not set it
+const DefaultMaxMemorySamples = 5
+
+// keyOverhead is what every key costs besides its name and value: the entity,
+// its slot in the key dict and its node in the key index
+var keyOverhead = int64(unsafe.Sizeof(KeyEntity{})) + 4*int64(unsafe.Sizeof(uintptr(0))) + int64(unsafe.Sizeof(radix.Node{}))
+
+// entityMemory returns the approximate bytes key and its value use
+func entityMemory(key string, ent *KeyEntity) int64 {
+	// the name is held by the key dict and the key index
+	size := keyOverhead + 2*int64(len(key))
+	switch obj := ent.Ptr.(type) {
+	case *StringStore:
+		value, _ := obj.read([]byte(key))
+		size += int64(unsafe.Sizeof(radix.Node{})) + int64(len(key)+len(value))
+	case *HashObject:
+		size += int64(obj.Data.MemoryUsage(utils.ValueSize))
+	case *ListObject:
+		size += int64(obj.Data.MemoryUsage())
+	case *SetObject:
+		size += int64(obj.Data.MemoryUsage())
+	case *ZsetObject:
+		size += int64(obj.Data.MemoryUsage())
+	}
+	return size
+}
+
+// UsedMemory returns the approximate bytes of the keys and values of every database
+func (db *PolarisDB) UsedMemory() int64 {
+	var used int64
+	for _, ks := range db.Keyspaces {
+		used += ks.Dict.MemoryUsage()
+	}
+	return used
+}
+
+// KeyMemoryUsage returns the approximate bytes key and its value use, 0 when it is missing
+func KeyMemoryUsage(tx *TX, key string) int64 {
+	ent, isExist := tx.lookup(key, false)
+	if !isExist {
+		return 0
+	}
+	return entityMemory(key, ent)
+}
+
+// memoryGrowth returns how much the used memory changes when the transaction commits
+func (t *TX) memoryGrowth() int64 {
+	var growth int64
+	installed := make(map[*Keyspace]bool)
+	for _, ks := range t.keyspaces() {
+		installed[ks] = true
+	}
+	for ks, set := range t.sets {
+		if !installed[ks] {
+			continue
+		}
+		for key, ent := range set.dirty {
+			if ent != nil {
+				growth += entityMemory(key, ent)
+			}
+			if old, isExist := ks.Dict.FindRaw(key); isExist {
+				growth -= old.Memory
+			}
+		}
+	}
+	// flushed keyspaces free everything they held
+	for _, ks := range t.db.Keyspaces {
+		if !installed[ks] {
+			growth -= ks.Dict.MemoryUsage()
+		}
+	}
+	return growth
+}
+
+// writtenKeys returns the keys the transaction writes, by keyspace
+func (t *TX) writtenKeys() map[*Keyspace]map[string]bool {
+	written := make(map[*Keyspace]map[string]bool, len(t.sets))
+	for ks, set := range t.sets {
+		keys := make(map[string]bool, len(set.dirty)+len(set.expires))
+		for key := range set.dirty {
+			keys[key] = true
+		}
+		for key := range set.expires {
+			keys[key] = true
+		}
+		written[ks] = keys
+	}
+	return written
+}
+
+// writtenMemory returns the memory of the keys the transaction leaves behind, the
+// eviction after it never frees them
+func (t *TX) writtenMemory() int64 {
+	var memory int64
+	installed := make(map[*Keyspace]bool)
+	for _, ks := range t.keyspaces() {
+		installed[ks] = true
+	}
+	for ks, set := range t.sets {
+		if !installed[ks] {
+			continue
+		}
+		for key, ent := range set.dirty {
+			if ent != nil {
+				memory += entityMemory(key, ent)
+			}
+		}
+	}
+	return memory
+}
+
+// checkMemory refuses a transaction that takes the used memory over MaxMemory when
+// nothing can be evicted afterwards, writes that free memory always pass
+func (db *PolarisDB) checkMemory(tx *TX) error {
+	if db.Config.MaxMemory <= 0 {
+		return nil
+	}
+	used := db.UsedMemory()
+	growth := tx.memoryGrowth()
+	if growth <= 0 || used+growth <= db.Config.MaxMemory {
+		return nil
+	}
+	// the eviction after the last write could not get below the limit either
+	if db.Config.EvicterPolicy == EvictNoEviction || used > db.Config.MaxMemory {
+		return ErrOOM
+	}
+	// evicting every other key would not make room for what it writes
+	if tx.writtenMemory() > db.Config.MaxMemory {
+		return ErrOOM
+	}
+	return nil
+}
+
+// freeMemory evicts keys under the eviction policy until the used memory is at
+// most MaxMemory, the keys of keep stay. The evicted keys are logged as one record
+// of deletes. The caller holds the db lock.
+func (db *PolarisDB) freeMemory(keep map[*Keyspace]map[string]bool) error {
+	if db.Config.MaxMemory <= 0 || db.Config.EvicterPolicy == EvictNoEviction {
+		return nil
+	}
+	over := db.UsedMemory() - db.Config.MaxMemory
+	if over <= 0 {
+		return nil
+	}
+	return db.evictKeys(db.Keyspaces, db.Config.EvicterPolicy, keep, func(_ int, freed int64) bool {
+		return freed >= over
+	})
+}
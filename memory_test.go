@@ -0,0 +1,236 @@
+package polarisdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKeyDict_MemoryAccounting(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	commands := [][]string{
+		{"set", "str", strings.Repeat("v", 100)},
+		{"hset", "hash", "f1", "v1", "f2", "v2"},
+		{"lpush", "list", "a", "b", "c"},
+		{"sadd", "intset", "1", "2", "3"},
+		{"sadd", "set", "a", "b"},
+		{"zadd", "zset", "1", "a", "2", "b"},
+	}
+	var last int64
+	for _, args := range commands {
+		if _, err := db.Exec(args[0], args[1:]...); err != nil {
+			t.Fatal(err)
+		}
+		used := db.UsedMemory()
+		if used <= last {
+			t.Fatalf("expect %s to use memory, %d after %d", args[0], used, last)
+		}
+		usage, err := db.Exec("memory", "usage", args[1])
+		if err != nil || usage.(int64) <= 0 {
+			t.Fatalf("expect the memory usage of %s got %v %v", args[1], usage, err)
+		}
+		last = used
+	}
+	if usage, _ := db.Exec("memory", "usage", "str"); usage.(int64) < 100 {
+		t.Fatalf("expect the string value to be counted got %v", usage)
+	}
+	// growing a value in place is measured at commit
+	db.Exec("lpush", "list", strings.Repeat("x", 1000))
+	if used := db.UsedMemory(); used < last+1000 {
+		t.Fatalf("expect the list to grow by 1000 got %d after %d", used, last)
+	}
+	// the replay measures the values it changed in place once it is done, skiplist
+	// levels are random so the sizes only stay close
+	used := db.UsedMemory()
+	db = reopenTestDB(t, db)
+	if reopened := db.UsedMemory(); reopened < used*9/10 || reopened > used*11/10 {
+		t.Fatalf("expect about %d after the replay got %d", used, reopened)
+	}
+	if _, err := db.Exec("flushall"); err != nil {
+		t.Fatal(err)
+	}
+	if used := db.UsedMemory(); used != 0 {
+		t.Fatalf("expect no memory after flushall got %d", used)
+	}
+}
+
+func TestPolarisDB_MaxMemoryNoEviction(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", MaxMemory: 4096})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	var err error
+	i := 0
+	for ; i < 1000 && err == nil; i++ {
+		_, err = db.Exec("set", fmt.Sprintf("key:%d", i), strings.Repeat("v", 100))
+	}
+	if !errors.Is(err, ErrOOM) {
+		t.Fatalf("expect ErrOOM got %v", err)
+	}
+	if used := db.UsedMemory(); used > db.Config.MaxMemory {
+		t.Fatalf("expect the refused write not to be applied, used %d", used)
+	}
+	if reply, _ := db.Exec("exists", fmt.Sprintf("key:%d", i-1)); reply != int64(0) {
+		t.Fatalf("expect the refused key to be missing got %v", reply)
+	}
+	// writes that free memory pass
+	if _, err = db.Exec("del", "key:0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("set", "key:0", "v"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolarisDB_MaxMemoryEviction(t *testing.T) {
+	for _, policy := range []string{EvictAllKeyRandom, EvictAllKeyLRU, EvictVolRandom, EvictVolLRU, EvictVolTTL} {
+		t.Run(policy, func(t *testing.T) {
+			db := NewDB(&DBConfig{Path: "./tmp", MaxMemory: 8192, EvicterPolicy: policy, Databases: 2})
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer cleanTestData()
+			for i := 0; i < 200; i++ {
+				_, err := db.ExecDB(i%2, "set", fmt.Sprintf("key:%d", i), strings.Repeat("v", 100))
+				if err == nil && isVolatilePolicy(policy) {
+					_, err = db.ExecDB(i%2, "expire", fmt.Sprintf("key:%d", i), "3600")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if used := db.UsedMemory(); used > db.Config.MaxMemory {
+					t.Fatalf("expect the used memory to stay below the limit got %d", used)
+				}
+			}
+			info := db.Info("stats")
+			if strings.Contains(info, "evicted_keys:0\r\n") {
+				t.Fatalf("expect evicted keys got %q", info)
+			}
+			// the evictions are logged, evicted keys stay gone after a restart
+			used := db.UsedMemory()
+			db = reopenTestDB(t, db)
+			if reopened := db.UsedMemory(); reopened != used {
+				t.Fatalf("expect %d after the replay got %d", used, reopened)
+			}
+		})
+	}
+}
+
+func TestPolarisDB_MaxMemoryKeepsWrittenKeys(t *testing.T) {
+	for _, policy := range []string{EvictAllKeyRandom, EvictAllKeyLRU, EvictAllKeyLFU} {
+		t.Run(policy, func(t *testing.T) {
+			db := NewDB(&DBConfig{Path: "./tmp", MaxMemory: 20000, EvicterPolicy: policy})
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer cleanTestData()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("key:%d", i)
+				if _, err := db.Exec("set", key, strings.Repeat("v", 100)); err != nil {
+					t.Fatal(err)
+				}
+				if reply, _ := db.Exec("exists", key); reply != int64(1) {
+					t.Fatalf("expect %s to stay after its write", key)
+				}
+			}
+			// a write that does not fit even alone is refused
+			if _, err := db.Exec("set", "huge", strings.Repeat("v", 50*1024)); !errors.Is(err, ErrOOM) {
+				t.Fatalf("expect ErrOOM got %v", err)
+			}
+			if reply, _ := db.Exec("exists", "huge"); reply != int64(0) {
+				t.Fatal("expect the refused key to be missing")
+			}
+		})
+	}
+}
+
+func TestPolarisDB_MaxMemoryVolatileWithoutTTL(t *testing.T) {
+	for _, policy := range []string{EvictVolRandom, EvictVolLRU, EvictVolLFU, EvictVolTTL} {
+		t.Run(policy, func(t *testing.T) {
+			db := NewDB(&DBConfig{Path: "./tmp", MaxMemory: 4096, EvicterPolicy: policy})
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer cleanTestData()
+			var err error
+			for i := 0; i < 1000 && err == nil; i++ {
+				_, err = db.Exec("set", fmt.Sprintf("key:%d", i), strings.Repeat("v", 100))
+			}
+			// nothing can be evicted, the write after the one that went over is refused
+			if !errors.Is(err, ErrOOM) {
+				t.Fatalf("expect ErrOOM got %v", err)
+			}
+		})
+	}
+}
+
+func TestLRUClock_LFUCounter(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	db.Exec("set", "key", "v")
+	if freq, err := db.Exec("object", "freq", "key"); err != nil || freq != int64(LFUInitVal) {
+		t.Fatalf("expect the initial counter got %v %v", freq, err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Exec("get", "key")
+	}
+	freq, _ := db.Exec("object", "freq", "key")
+	if freq.(int64) <= int64(LFUInitVal) || freq.(int64) >= 255 {
+		t.Fatalf("expect the counter to grow logarithmically got %v", freq)
+	}
+	// a write keeps the counter of the key it replaces
+	db.Exec("set", "key", "other")
+	if again, _ := db.Exec("object", "freq", "key"); again.(int64) < freq.(int64) {
+		t.Fatalf("expect the counter to be kept got %v after %v", again, freq)
+	}
+	if freq, _ = db.Exec("object", "freq", "missing"); freq != nil {
+		t.Fatalf("expect nil for a missing key got %v", freq)
+	}
+	ent, _ := db.Keyspaces[0].Dict.FindRaw("key")
+	ent.FreqTime -= 3
+	if decayed := db.Clock.LFUCount(ent); decayed != ent.Freq-3 {
+		t.Fatalf("expect 3 minutes to take 3 from %d got %d", ent.Freq, decayed)
+	}
+}
+
+func TestPolarisDB_MaxMemoryLFU(t *testing.T) {
+	for _, policy := range []string{EvictAllKeyLFU, EvictVolLFU} {
+		t.Run(policy, func(t *testing.T) {
+			db := NewDB(&DBConfig{Path: "./tmp", MaxMemory: 8192, EvicterPolicy: policy})
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer cleanTestData()
+			db.Exec("set", "hot", strings.Repeat("v", 100))
+			db.Exec("expire", "hot", "3600")
+			for i := 0; i < 200; i++ {
+				db.Exec("get", "hot")
+			}
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key:%d", i)
+				if _, err := db.Exec("set", key, strings.Repeat("v", 100)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := db.Exec("expire", key, "3600"); err != nil {
+					t.Fatal(err)
+				}
+				db.Exec("get", "hot")
+			}
+			if used := db.UsedMemory(); used > db.Config.MaxMemory {
+				t.Fatalf("expect the used memory to stay below the limit got %d", used)
+			}
+			if reply, _ := db.Exec("exists", "hot"); reply != int64(1) {
+				t.Fatal("expect the frequently read key to survive")
+			}
+		})
+	}
+}
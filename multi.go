@@ -0,0 +1,96 @@
+package polarisdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrWatchedKeyChanged aborts EXEC, a watched key was written or expired since WATCH
+	ErrWatchedKeyChanged = errors.New("watched key changed")
+	ErrExecAbort         = errors.New("EXECABORT Transaction discarded because of previous errors")
+)
+
+// WatchedKey is the state of a key when WATCH ran, EXEC only runs while it is unchanged
+type WatchedKey struct {
+	DB      int    `json:"db"`
+	Key     string `json:"key"`
+	Exists  bool   `json:"exists"`
+	Version uint64 `json:"version"`
+}
+
+func (t *TX) watchKey(key string) WatchedKey {
+	ent, isExist := t.lookup(key, false)
+	if !isExist {
+		return WatchedKey{DB: t.index, Key: key}
+	}
+	return WatchedKey{DB: t.index, Key: key, Exists: true, Version: ent.Version}
+}
+
+// Watch returns the current state of keys of database 0 for a later ExecMulti
+func (db *PolarisDB) Watch(keys ...string) []WatchedKey {
+	watched, _ := db.WatchDB(0, keys...)
+	return watched
+}
+
+// WatchDB returns the current state of keys of database index for a later ExecMulti
+func (db *PolarisDB) WatchDB(index int, keys ...string) ([]WatchedKey, error) {
+	watched := make([]WatchedKey, 0, len(keys))
+	err := db.View(func(tx *TX) error {
+		if err := tx.Select(index); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			watched = append(watched, tx.watchKey(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return watched, nil
+}
+
+// ExecMulti runs the queued commands in a single transaction on database 0, see ExecMultiDB
+func (db *PolarisDB) ExecMulti(watched []WatchedKey, commands []BatchCommand) ([]BatchResult, error) {
+	return db.ExecMultiDB(0, watched, commands)
+}
+
+// ExecMultiDB runs the queued commands in a single transaction starting on
+// database index. It fails with ErrWatchedKeyChanged before running anything
+// when a watched key changed. Like EXEC a command error does not stop the
+// remaining commands, it is returned in its result.
+func (db *PolarisDB) ExecMultiDB(index int, watched []WatchedKey, commands []BatchCommand) ([]BatchResult, error) {
+	for _, command := range commands {
+		cmd, ok := LookupCommand(command.Command)
+		if !ok {
+			return nil, fmt.Errorf("%w '%s'", ErrUnknownCommand, command.Command)
+		}
+		if err := cmd.CheckArity(command.Args); err != nil {
+			return nil, err
+		}
+	}
+	results := make([]BatchResult, len(commands))
+	err := db.Update(func(tx *TX) error {
+		for _, watch := range watched {
+			if err := tx.Select(watch.DB); err != nil {
+				return err
+			}
+			if tx.watchKey(watch.Key) != watch {
+				return ErrWatchedKeyChanged
+			}
+		}
+		if err := tx.Select(index); err != nil {
+			return err
+		}
+		for i, command := range commands {
+			cmd, _ := LookupCommand(command.Command)
+			results[i].Reply, results[i].Err = cmd.call(tx, command.Args)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
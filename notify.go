@@ -0,0 +1,211 @@
+package polarisdb
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// classes of keyspace events, NotifyKeyspaceEvents picks them with the letters of
+// notify-keyspace-events in Redis
+const (
+	NotifyKeyspace = 1 << iota // K, events on __keyspace@<db>__:<key>
+	NotifyKeyevent             // E, events on __keyevent@<db>__:<event>
+	NotifyGeneric              // g, del, expire, rename, ...
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZset                 // z
+	NotifyExpired              // x
+	NotifyEvicted              // e
+	// A is an alias for g$lshzxe
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash | NotifyZset | NotifyExpired | NotifyEvicted
+)
+
+// DefaultNotifyBuffer is the number of events a subscription buffers when the subscriber does not say
+const DefaultNotifyBuffer = 1024
+
+// ParseNotifyClasses turns the letters of notify-keyspace-events into classes, an
+// empty string disables the notifications
+func ParseNotifyClasses(classes string) (int, error) {
+	flags := 0
+	for _, c := range classes {
+		switch c {
+		case 'K':
+			flags |= NotifyKeyspace
+		case 'E':
+			flags |= NotifyKeyevent
+		case 'g':
+			flags |= NotifyGeneric
+		case '$':
+			flags |= NotifyString
+		case 'l':
+			flags |= NotifyList
+		case 's':
+			flags |= NotifySet
+		case 'h':
+			flags |= NotifyHash
+		case 'z':
+			flags |= NotifyZset
+		case 'x':
+			flags |= NotifyExpired
+		case 'e':
+			flags |= NotifyEvicted
+		case 'A':
+			flags |= NotifyAll
+		default:
+			return 0, fmt.Errorf("invalid keyspace event class %q", c)
+		}
+	}
+	return flags, nil
+}
+
+// KeyspaceEvent is a change to a key
+type KeyspaceEvent struct {
+	DB    int    `json:"db"`
+	Key   string `json:"key"`
+	Event string `json:"event"`
+}
+
+// KeyspaceChannel returns the channel Redis publishes the event on for the key
+func (e KeyspaceEvent) KeyspaceChannel() string {
+	return "__keyspace@" + strconv.Itoa(e.DB) + "__:" + e.Key
+}
+
+// KeyeventChannel returns the channel Redis publishes the key on for the event
+func (e KeyspaceEvent) KeyeventChannel() string {
+	return "__keyevent@" + strconv.Itoa(e.DB) + "__:" + e.Event
+}
+
+// KeyspaceSubscription receives the keyspace events from SubscribeKeyspace. Events
+// that do not fit the buffer are dropped, the writers never wait for a subscriber.
+type KeyspaceSubscription struct {
+	// C delivers the events, it is closed by Close
+	C        <-chan KeyspaceEvent
+	ch       chan KeyspaceEvent
+	notifier *notifier
+	dropped  int64
+}
+
+// Dropped returns the number of events that did not fit the buffer
+func (s *KeyspaceSubscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close stops the subscription and closes C
+func (s *KeyspaceSubscription) Close() {
+	s.notifier.Lock()
+	defer s.notifier.Unlock()
+	if _, ok := s.notifier.subs[s]; ok {
+		delete(s.notifier.subs, s)
+		close(s.ch)
+	}
+}
+
+// notifier hands the keyspace events to the subscriptions and publishes them on the
+// keyspace and keyevent channels K and E enable
+type notifier struct {
+	sync.Mutex
+	flags  int
+	subs   map[*KeyspaceSubscription]struct{}
+	pubsub *pubsub
+	// set by Close of the db, later subscriptions start closed
+	closed bool
+}
+
+func newNotifier(hub *pubsub) *notifier {
+	return &notifier{subs: make(map[*KeyspaceSubscription]struct{}), pubsub: hub}
+}
+
+// enabled tells whether events of class are published
+func (n *notifier) enabled(class int) bool {
+	return n.flags&class != 0 && n.flags&(NotifyKeyspace|NotifyKeyevent) != 0
+}
+
+func (n *notifier) publish(events ...KeyspaceEvent) {
+	if len(events) == 0 {
+		return
+	}
+	for _, event := range events {
+		if n.flags&NotifyKeyspace != 0 {
+			n.pubsub.publish(event.KeyspaceChannel(), event.Event)
+		}
+		if n.flags&NotifyKeyevent != 0 {
+			n.pubsub.publish(event.KeyeventChannel(), event.Key)
+		}
+	}
+	n.Lock()
+	defer n.Unlock()
+	for sub := range n.subs {
+		for _, event := range events {
+			select {
+			case sub.ch <- event:
+			default:
+				atomic.AddInt64(&sub.dropped, 1)
+			}
+		}
+	}
+}
+
+// close closes every subscription, the database is closing
+func (n *notifier) close() {
+	n.Lock()
+	defer n.Unlock()
+	n.closed = true
+	for sub := range n.subs {
+		delete(n.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// SubscribeKeyspace returns a subscription to the keyspace events NotifyKeyspaceEvents
+// enables, buffer is the number of events it holds for a slow reader. Close of the
+// database closes it.
+func (db *PolarisDB) SubscribeKeyspace(buffer int) *KeyspaceSubscription {
+	if buffer <= 0 {
+		buffer = DefaultNotifyBuffer
+	}
+	ch := make(chan KeyspaceEvent, buffer)
+	sub := &KeyspaceSubscription{C: ch, ch: ch, notifier: db.notifier}
+	db.notifier.Lock()
+	defer db.notifier.Unlock()
+	if db.notifier.closed {
+		close(ch)
+		return sub
+	}
+	db.notifier.subs[sub] = struct{}{}
+	return sub
+}
+
+// notifySpace publishes an event of a key of ks right away, for changes made outside
+// of a transaction. The caller holds the db lock.
+func (db *PolarisDB) notifySpace(ks *Keyspace, class int, event string, key string) {
+	if !db.notifier.enabled(class) {
+		return
+	}
+	if index := db.keyspaceIndex(ks); index >= 0 {
+		db.notifier.publish(KeyspaceEvent{DB: index, Key: key, Event: event})
+	}
+}
+
+// notify records an event of a key of the selected database, it is published once
+// the transaction commits
+func (t *TX) notify(class int, event string, key string) {
+	t.notifyDB(t.index, class, event, key)
+}
+
+func (t *TX) notifyDB(index int, class int, event string, key string) {
+	if t.direct || !t.db.notifier.enabled(class) {
+		return
+	}
+	t.events = append(t.events, KeyspaceEvent{DB: index, Key: key, Event: event})
+}
+
+// notifyRemoved records a del event when a change left key empty and removed it
+func (t *TX) notifyRemoved(key string) {
+	if _, isExist := t.lookup(key, false); !isExist {
+		t.notify(NotifyGeneric, "del", key)
+	}
+}
@@ -0,0 +1,143 @@
+package polarisdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collectEvents reads the events that are already published
+func collectEvents(sub *KeyspaceSubscription) []string {
+	events := make([]string, 0)
+	for {
+		select {
+		case event := <-sub.C:
+			events = append(events, fmt.Sprintf("%d:%s:%s", event.DB, event.Event, event.Key))
+		case <-time.After(20 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+func TestPolarisDB_KeyspaceNotifications(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", NotifyKeyspaceEvents: "KEA"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	sub := db.SubscribeKeyspace(0)
+	defer sub.Close()
+	for _, args := range [][]string{
+		{"set", "str", "v"},
+		{"set", "counter", "1"},
+		{"incr", "counter"},
+		{"hset", "hash", "f", "v"},
+		{"hdel", "hash", "f"},
+		{"lpush", "list", "a"},
+		{"sadd", "set", "a"},
+		{"zadd", "zset", "1", "a"},
+		{"rename", "str", "renamed"},
+		{"expire", "renamed", "100"},
+		{"del", "renamed", "missing"},
+		{"move", "set", "1"},
+	} {
+		if _, err := db.Exec(args[0], args[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []string{
+		"0:set:str", "0:set:counter", "0:incrby:counter", "0:hset:hash", "0:hdel:hash", "0:lpush:list",
+		"0:sadd:set", "0:zadd:zset", "0:rename_from:str", "0:rename_to:renamed", "0:expire:renamed",
+		"0:del:renamed", "0:move_from:set", "1:move_to:set",
+	}
+	if events := collectEvents(sub); strings.Join(events, ",") != strings.Join(expect, ",") {
+		t.Fatalf("expect %v got %v", expect, events)
+	}
+	// a failed transaction publishes nothing
+	db.Update(func(tx *TX) error {
+		tx.SetString("dropped", "v", false)
+		return errors.New("abort")
+	})
+	db.Exec("set", "short", "v")
+	db.Exec("pexpire", "short", "1")
+	expect = []string{"0:set:short", "0:expire:short"}
+	if events := collectEvents(sub); strings.Join(events, ",") != strings.Join(expect, ",") {
+		t.Fatalf("expect %v got %v", expect, events)
+	}
+	// the sweeper removes the key once its ttl passed
+	select {
+	case event := <-sub.C:
+		if event.Event != "expired" || event.Key != "short" {
+			t.Fatalf("expect the expired event got %v", event)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expect the key to expire")
+	}
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Fatal("expect a closed subscription to close its channel")
+	}
+}
+
+func TestPolarisDB_KeyspaceNotificationClasses(t *testing.T) {
+	if err := NewDB(&DBConfig{Path: "./tmp", NotifyKeyspaceEvents: "Kq"}).Open(); err == nil {
+		t.Fatal("expect an invalid class to be refused")
+	}
+	cleanTestData()
+	db := NewDB(&DBConfig{Path: "./tmp", NotifyKeyspaceEvents: "Kge", MaxMemory: 4096, EvicterPolicy: EvictAllKeyRandom})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	sub := db.SubscribeKeyspace(2)
+	defer sub.Close()
+	db.Exec("set", "key", "v")
+	db.Exec("del", "key")
+	if events := collectEvents(sub); strings.Join(events, ",") != "0:del:key" {
+		t.Fatalf("expect only the generic event got %v", events)
+	}
+	for i := 0; i < 100; i++ {
+		db.Exec("set", fmt.Sprintf("key:%d", i), strings.Repeat("v", 100))
+	}
+	events := collectEvents(sub)
+	if len(events) != 2 || !strings.Contains(events[0], ":evicted:") {
+		t.Fatalf("expect evicted events up to the buffer got %v", events)
+	}
+	if sub.Dropped() == 0 {
+		t.Fatal("expect the events over the buffer to be dropped")
+	}
+}
+
+func TestPolarisDB_CloseEndsKeyspaceSubscriptions(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", NotifyKeyspaceEvents: "KA"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	sub := db.SubscribeKeyspace(0)
+	db.Exec("set", "foo", "bar")
+	done := make(chan int)
+	go func() {
+		count := 0
+		for range sub.C {
+			count++
+		}
+		done <- count
+	}()
+	db.Close()
+	select {
+	case count := <-done:
+		if count != 1 {
+			t.Fatalf("expect the buffered event before the end got %d", count)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expect Close to end the subscription")
+	}
+	// closing it again and subscribing afterwards do not block
+	sub.Close()
+	if _, ok := <-db.SubscribeKeyspace(0).C; ok {
+		t.Fatal("expect a subscription after Close to be closed")
+	}
+}
@@ -1,13 +1,13 @@
 package polarisdb
 
 import (
-	"errors"
+	"github.com/projectxpolaris/polarisdb/dict"
 	"github.com/projectxpolaris/polarisdb/utils"
 	"strconv"
 )
 
 type HashObject struct {
-	Data map[string]interface{}
+	Data *dict.Dict[interface{}]
 }
 type Paris struct {
 	Field []byte
@@ -16,83 +16,117 @@ type Paris struct {
 
 func NewHashObject() *HashObject {
 	return &HashObject{
-		Data: make(map[string]interface{}),
+		Data: dict.NewDict[interface{}](),
 	}
 }
 func (h *HashObject) Set(field string, value interface{}) {
-	h.Data[field] = value
+	h.Data.Add(field, value)
 }
 
 func (h *HashObject) Get(field string) (interface{}, bool) {
-	v, ok := h.Data[field]
-	return v, ok
+	return h.Data.Find(field)
 }
 func (h *HashObject) GetAll() map[string]interface{} {
-	return h.Data
+	all := make(map[string]interface{}, h.Data.Len())
+	h.Data.Range(func(field string, value interface{}) bool {
+		all[field] = value
+		return true
+	})
+	return all
 }
 func (h *HashObject) Delete(field string) {
-	delete(h.Data, field)
+	h.Data.Delete(field)
 }
 func (h *HashObject) Keys() []string {
-	var keys []string
-	for k := range h.Data {
-		keys = append(keys, k)
-	}
-	return keys
+	return h.Data.Keys()
 }
 func (h *HashObject) Values() []interface{} {
 	var values []interface{}
-	for _, v := range h.Data {
-		values = append(values, v)
-	}
+	h.Data.Range(func(_ string, value interface{}) bool {
+		values = append(values, value)
+		return true
+	})
 	return values
 }
 func (h *HashObject) Len() int {
-	return len(h.Data)
+	return h.Data.Len()
 }
 
-func SetHashField(db *PolarisDB, key string, paris ...Paris) error {
-	ent, isExist := db.Dict.Find(key)
-	if !isExist {
-		ent = &KeyEntity{
-			Ptr: NewHashObject(),
-		}
-		db.Dict.Add(key, ent)
+// Clone returns a copy of the hash, the values are never changed in place and are shared
+func (h *HashObject) Clone() *HashObject {
+	clone := NewHashObject()
+	h.Data.Range(func(field string, value interface{}) bool {
+		clone.Data.Add(field, value)
+		return true
+	})
+	return clone
+}
+
+func SetHashField(tx *TX, key string, paris ...Paris) error {
+	hashObj, err := findOrCreate(tx, key, NewHashObject)
+	if err != nil {
+		return err
 	}
-	hashObj := ent.Ptr.(*HashObject)
 	for _, pair := range paris {
 		hashObj.Set(string(pair.Field), pair.Value)
 	}
 	return nil
 }
-func HashFieldCalculation(db *PolarisDB, key string, field string, addValue int64) (uint64, error) {
-	ent, isExist := db.Dict.Find(key)
+func HashFieldCalculation(tx *TX, key string, field string, addValue int64) (uint64, error) {
+	hashObj, isExist, err := findTypedForWrite[*HashObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	hashObj := ent.Ptr.(*HashObject)
 	v, isFieldExist := hashObj.Get(field)
 	if !isFieldExist {
-		return 0, errors.New("field not exist")
+		return 0, ErrFieldNotFound
 	}
 	valStr := utils.ToString(v)
 	val, err := strconv.ParseInt(valStr, 10, 64)
 	if err != nil {
-		return 0, err
+		return 0, ErrNotInteger
 	}
 	newVal := val + addValue
 	hashObj.Set(field, newVal)
 	return uint64(newVal), nil
 }
 
-func HashDeleteFields(db *PolarisDB, key string, fields ...string) error {
-	ent, isExist := db.Dict.Find(key)
+func HashDeleteFields(tx *TX, key string, fields ...string) error {
+	hashObj, isExist, err := findTypedForWrite[*HashObject](tx, key)
+	if err != nil {
+		return err
+	}
 	if !isExist {
-		return errors.New("key not exist")
+		return ErrKeyNotFound
 	}
-	hashObj := ent.Ptr.(*HashObject)
 	for _, field := range fields {
 		hashObj.Delete(field)
 	}
 	return nil
 }
+
+// HashScan returns field value pairs of the next steps of a hash scan, a missing key is an empty hash
+func HashScan(tx *TX, key string, cursor uint64, options ScanOptions) (uint64, []interface{}, error) {
+	hashObj, isExist, err := findTyped[*HashObject](tx, key)
+	if err != nil {
+		return 0, []interface{}{}, err
+	}
+	if !isExist {
+		return 0, []interface{}{}, nil
+	}
+	pairs := make([]interface{}, 0, options.count()*2)
+	cursor = scanSteps(cursor, options.count(), func(cursor uint64) (uint64, int) {
+		found := 0
+		cursor = hashObj.Data.Scan(cursor, func(field string, value interface{}) {
+			found++
+			if options.match(field) {
+				pairs = append(pairs, field, utils.ToString(value))
+			}
+		})
+		return cursor, found
+	})
+	return cursor, pairs, nil
+}
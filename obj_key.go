@@ -0,0 +1,359 @@
+package polarisdb
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/projectxpolaris/polarisdb/utils"
+)
+
+var (
+	ErrSameObjects = errors.New("source and destination objects are the same")
+	ErrExpireNX    = errors.New("NX and XX, GT or LT options at the same time are not compatible")
+	ErrExpireGTLT  = errors.New("GT and LT options at the same time are not compatible")
+)
+
+// ttl replies for a missing key and for a key without a ttl, like redis
+const (
+	TTLNoKey    int64 = -2
+	TTLNoExpire int64 = -1
+)
+
+// ExpireOptions are the conditions of EXPIRE: NX sets only a missing ttl, XX only
+// replaces one, GT and LT only move it later or earlier. A key without a ttl has
+// an infinite one for GT and LT.
+type ExpireOptions struct {
+	NX bool
+	XX bool
+	GT bool
+	LT bool
+}
+
+func (o *ExpireOptions) validate() error {
+	if o.NX && (o.XX || o.GT || o.LT) {
+		return ErrExpireNX
+	}
+	if o.GT && o.LT {
+		return ErrExpireGTLT
+	}
+	return nil
+}
+
+// allow reports whether the deadline at may replace the current ttl
+func (o *ExpireOptions) allow(current int64, at int64) bool {
+	hasTTL := current != noExpire
+	switch {
+	case o.NX && hasTTL:
+		return false
+	case o.XX && !hasTTL:
+		return false
+	case o.GT && (!hasTTL || at <= current):
+		return false
+	case o.LT && hasTTL && at >= current:
+		return false
+	}
+	return true
+}
+
+// DefaultScanCount is the COUNT of a scan that does not give one
+const DefaultScanCount = 10
+
+// ScanOptions are the MATCH, COUNT and TYPE arguments of the SCAN family, TYPE only applies to SCAN
+type ScanOptions struct {
+	Match string
+	Count int
+	Type  string
+}
+
+func (o *ScanOptions) count() int {
+	if o.Count <= 0 {
+		return DefaultScanCount
+	}
+	return o.Count
+}
+
+func (o *ScanOptions) match(str string) bool {
+	return o.Match == "" || utils.GlobMatch(o.Match, str)
+}
+
+// scanSteps advances the cursor until count elements were collected or the scan is
+// complete. A sparse table stops after count*10 buckets so every call is bounded.
+func scanSteps(cursor uint64, count int, step func(cursor uint64) (uint64, int)) uint64 {
+	found := 0
+	for i := 0; i < count*10; i++ {
+		var n int
+		cursor, n = step(cursor)
+		found += n
+		if cursor == 0 || found >= count {
+			break
+		}
+	}
+	return cursor
+}
+
+// key types as reported by TYPE
+const (
+	TypeNone   = "none"
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZset   = "zset"
+)
+
+func KeyDelete(tx *TX, keys ...string) int {
+	count := 0
+	for _, key := range keys {
+		if _, isExist := tx.find(key); !isExist {
+			continue
+		}
+		tx.delete(key)
+		count++
+	}
+	return count
+}
+
+func KeyExists(tx *TX, keys ...string) int {
+	count := 0
+	for _, key := range keys {
+		if _, isExist := tx.lookup(key, false); isExist {
+			count++
+		}
+	}
+	return count
+}
+
+func KeyType(tx *TX, key string) string {
+	ent, isExist := tx.find(key)
+	if !isExist {
+		return TypeNone
+	}
+	switch ent.Ptr.(type) {
+	case *StringStore:
+		return TypeString
+	case *HashObject:
+		return TypeHash
+	case *ListObject:
+		return TypeList
+	case *SetObject:
+		return TypeSet
+	case *ZsetObject:
+		return TypeZset
+	}
+	return TypeNone
+}
+
+// KeyCopy copies the value and the ttl of src to dst, it returns false when dst
+// exists and replace is not set
+func KeyCopy(tx *TX, src string, dst string, replace bool) (bool, error) {
+	if src == dst {
+		return false, ErrSameObjects
+	}
+	ent, isExist := tx.find(src)
+	if !isExist {
+		return false, nil
+	}
+	if _, dstExist := tx.find(dst); dstExist {
+		if !replace {
+			return false, nil
+		}
+		// drop the old value first, the copy of a string value is written under dst
+		tx.delete(dst)
+	}
+	ttl := tx.ttl(src)
+	clone, ok := tx.copyEntity(src, ent, dst)
+	if !ok {
+		return false, ErrKeyNotFound
+	}
+	tx.add(dst, clone)
+	if ttl != noExpire {
+		tx.setExpire(dst, ttl)
+	}
+	return true, nil
+}
+
+// KeyRename moves key to newKey together with its ttl, with nx it returns false
+// instead of overwriting an existing newKey
+func KeyRename(tx *TX, key string, newKey string, nx bool) (bool, error) {
+	if _, isExist := tx.find(key); !isExist {
+		return false, ErrKeyNotFound
+	}
+	if key == newKey {
+		return !nx, nil
+	}
+	if _, dstExist := tx.find(newKey); dstExist && nx {
+		return false, nil
+	}
+	if _, err := KeyCopy(tx, key, newKey, true); err != nil {
+		return false, err
+	}
+	tx.delete(key)
+	return true, nil
+}
+
+// KeyMove moves key with its ttl from the selected database to database index, it
+// returns false when key is missing or index already has it
+func KeyMove(tx *TX, key string, index int) (bool, error) {
+	src := tx.index
+	if index == src {
+		return false, ErrSameObjects
+	}
+	if index < 0 || index >= len(tx.keyspaces()) {
+		return false, ErrInvalidDBIndex
+	}
+	ent, isExist := tx.find(key)
+	if !isExist {
+		return false, nil
+	}
+	ttl := tx.ttl(key)
+	tx.Select(index)
+	defer tx.Select(src)
+	if _, dstExist := tx.find(key); dstExist {
+		return false, nil
+	}
+	// the copy of a string value goes to the string store of the destination
+	clone, ok := tx.copyEntity(key, ent, key)
+	if !ok {
+		return false, ErrKeyNotFound
+	}
+	tx.add(key, clone)
+	if ttl != noExpire {
+		tx.setExpire(key, ttl)
+	}
+	tx.Select(src)
+	tx.delete(key)
+	return true, nil
+}
+
+// KeyScan returns the keys of the next steps of a keyspace scan and the cursor of the next call
+func KeyScan(tx *TX, cursor uint64, options ScanOptions) (uint64, []string) {
+	candidates := make([]string, 0, options.count())
+	cursor = scanSteps(cursor, options.count(), func(cursor uint64) (uint64, int) {
+		before := len(candidates)
+		cursor = tx.ks.Dict.Scan(cursor, func(key string) {
+			candidates = append(candidates, key)
+		})
+		return cursor, len(candidates) - before
+	})
+	keys := make([]string, 0, len(candidates))
+	for _, key := range candidates {
+		if !options.match(key) {
+			continue
+		}
+		if _, isExist := tx.lookup(key, false); !isExist {
+			continue
+		}
+		if options.Type != "" && KeyType(tx, key) != options.Type {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return cursor, keys
+}
+
+// KeyKeys returns the keys matching the glob pattern in lexicographic order, a
+// pattern with a literal head only walks the keys starting with it
+func KeyKeys(tx *TX, pattern string) []string {
+	keys := make([]string, 0)
+	for _, key := range tx.ks.Dict.MatchKeys(pattern) {
+		if _, ok := tx.dirty[key]; ok {
+			continue
+		}
+		if _, isExist := tx.lookup(key, false); isExist {
+			keys = append(keys, key)
+		}
+	}
+	for key := range tx.dirty {
+		if !utils.GlobMatch(pattern, key) {
+			continue
+		}
+		if _, isExist := tx.lookup(key, false); isExist {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// KeyRange returns up to count keys in [start, end) in lexicographic order, an
+// empty end has no upper bound and a count <= 0 no limit. Pass the last key
+// followed by a zero byte as the next start to page through a range.
+func KeyRange(tx *TX, start string, end string, count int) []string {
+	keys := make([]string, 0)
+	from := start
+	for {
+		batch := tx.ks.Dict.RangeKeys(from, end, count)
+		for _, key := range batch {
+			if _, ok := tx.dirty[key]; ok {
+				continue
+			}
+			if _, isExist := tx.lookup(key, false); isExist {
+				keys = append(keys, key)
+			}
+		}
+		// expired keys are skipped, so read on until count live keys were found
+		if count <= 0 || len(batch) < count || len(keys) >= count {
+			break
+		}
+		from = batch[len(batch)-1] + "\x00"
+	}
+	for key := range tx.dirty {
+		if key < start || (end != "" && key >= end) {
+			continue
+		}
+		if _, isExist := tx.lookup(key, false); isExist {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if count > 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// KeyExpireAt sets the deadline of key to the unix time at in milliseconds when
+// the options allow it, a deadline in the past expires the key at once
+func KeyExpireAt(tx *TX, key string, at int64, options ExpireOptions) (bool, error) {
+	allowed, err := keyExpireAllowed(tx, key, at, options)
+	if err != nil || !allowed {
+		return false, err
+	}
+	tx.setExpire(key, at)
+	return true, nil
+}
+
+// keyExpireAllowed reports whether key exists and the deadline at meets the conditions of options
+func keyExpireAllowed(tx *TX, key string, at int64, options ExpireOptions) (bool, error) {
+	if err := options.validate(); err != nil {
+		return false, err
+	}
+	if _, isExist := tx.lookup(key, false); !isExist {
+		return false, nil
+	}
+	return options.allow(tx.ttl(key), at), nil
+}
+
+// KeyPersist removes the ttl of key, it returns false when the key is missing or has none
+func KeyPersist(tx *TX, key string) bool {
+	if _, isExist := tx.lookup(key, false); !isExist {
+		return false
+	}
+	if tx.ttl(key) == noExpire {
+		return false
+	}
+	tx.setExpire(key, noExpire)
+	return true
+}
+
+// KeyExpireTime returns the deadline of key as unix time in milliseconds, or
+// TTLNoKey and TTLNoExpire
+func KeyExpireTime(tx *TX, key string) int64 {
+	if _, isExist := tx.lookup(key, false); !isExist {
+		return TTLNoKey
+	}
+	if ttl := tx.ttl(key); ttl != noExpire {
+		return ttl
+	}
+	return TTLNoExpire
+}
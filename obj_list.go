@@ -1,7 +1,6 @@
 package polarisdb
 
 import (
-	"errors"
 	"github.com/projectxpolaris/polarisdb/list"
 )
 
@@ -15,29 +14,27 @@ func NewListObject() *ListObject {
 	}
 }
 
-func ListPush(db *PolarisDB, key string, data ...[]byte) (*KeyEntity, error) {
-	ent, isExist := db.Dict.Find(key)
-	if !isExist {
-		ent = &KeyEntity{
-			Ptr: NewListObject(),
-		}
-		db.Dict.Add(key, ent)
+func ListPush(tx *TX, key string, data ...[]byte) error {
+	listObj, err := findOrCreate(tx, key, NewListObject)
+	if err != nil {
+		return err
 	}
-	listObj := ent.Ptr.(*ListObject)
 	for _, d := range data {
 		listObj.Data.InsertAt(listObj.Data.Len(), d)
 	}
-	return ent, nil
+	return nil
 }
 
-func ListPop(db *PolarisDB, key string, count int) ([][]byte, error) {
-	ent, isExist := db.Dict.Find(key)
+func ListPop(tx *TX, key string, count int) ([][]byte, error) {
+	listObj, isExist, err := findTypedForWrite[*ListObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	listObj := ent.Ptr.(*ListObject)
 	if listObj.Data.Len() == 0 {
-		return nil, errors.New("list is empty")
+		return nil, ErrListEmpty
 	}
 	out := make([][]byte, 0, count)
 	for i := 0; i < count; i++ {
@@ -47,49 +44,50 @@ func ListPop(db *PolarisDB, key string, count int) ([][]byte, error) {
 	return out, nil
 }
 
-func ListIndex(db *PolarisDB, key string, index int) ([]byte, error) {
-	ent, isExist := db.Dict.Find(key)
+func ListIndex(tx *TX, key string, index int) ([]byte, error) {
+	listObj, isExist, err := findTyped[*ListObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	listObj := ent.Ptr.(*ListObject)
 	if listObj.Data.Len() == 0 {
-		return nil, errors.New("list is empty")
+		return nil, ErrListEmpty
 	}
 	return listObj.Data.Index(index), nil
 }
-func ListLen(db *PolarisDB, key string) (int, error) {
-	ent, isExist := db.Dict.Find(key)
+func ListLen(tx *TX, key string) (int, error) {
+	listObj, isExist, err := findTyped[*ListObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	listObj := ent.Ptr.(*ListObject)
 	return listObj.Data.Len(), nil
 }
 
-func ListRange(db *PolarisDB, key string, start, stop int) ([][]byte, error) {
-	ent, isExist := db.Dict.Find(key)
+func ListRange(tx *TX, key string, start, stop int) ([][]byte, error) {
+	listObj, isExist, err := findTyped[*ListObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	listObj := ent.Ptr.(*ListObject)
 	if listObj.Data.Len() == 0 {
-		return nil, errors.New("list is empty")
+		return nil, ErrListEmpty
 	}
 	return listObj.Data.Range(start, stop), nil
 }
-func ListInsert(db *PolarisDB, key string, index int, data []byte) error {
-	ent, isExist := db.Dict.Find(key)
-	if !isExist {
-		// create new
-		ent = &KeyEntity{
-			Ptr: NewListObject(),
-		}
-		db.Dict.Add(key, ent)
+func ListInsert(tx *TX, key string, index int, data []byte) error {
+	listObj, err := findOrCreate(tx, key, NewListObject)
+	if err != nil {
+		return err
 	}
-	listObj := ent.Ptr.(*ListObject)
 	if listObj.Data.Len() < index || index < 0 {
-		return errors.New("index out of range")
+		return ErrOutOfRange
 	}
 	listObj.Data.InsertAt(index, data)
 
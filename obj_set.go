@@ -1,8 +1,8 @@
 package polarisdb
 
 import (
-	"errors"
 	"github.com/projectxpolaris/polarisdb/set"
+	"github.com/projectxpolaris/polarisdb/utils"
 )
 
 type SetObject struct {
@@ -15,124 +15,152 @@ func NewSetObject() *SetObject {
 	}
 }
 
-func SetAdd(db *PolarisDB, key string, members ...interface{}) (*KeyEntity, error) {
-	ent, isExist := db.Dict.Find(key)
-	if !isExist {
-		ent = &KeyEntity{
-			Ptr: NewSetObject(),
-		}
-		db.Dict.Add(key, ent)
+func SetAdd(tx *TX, key string, members ...interface{}) error {
+	setObj, err := findOrCreate(tx, key, NewSetObject)
+	if err != nil {
+		return err
 	}
-	setObj := ent.Ptr.(*SetObject)
 	for _, member := range members {
 		setObj.Data.Add(member)
 	}
-	return ent, nil
+	return nil
 }
 
-func SetRemove(db *PolarisDB, key string, members ...interface{}) (*KeyEntity, error) {
-	ent, isExist := db.Dict.Find(key)
+func SetRemove(tx *TX, key string, members ...interface{}) error {
+	setObj, isExist, err := findTypedForWrite[*SetObject](tx, key)
+	if err != nil {
+		return err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return ErrKeyNotFound
 	}
-	setObj := ent.Ptr.(*SetObject)
 	for _, member := range members {
 		err := setObj.Data.Remove(member)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return ent, nil
+	return nil
 }
 
-func SetIsMember(db *PolarisDB, key string, member interface{}) (bool, error) {
-	ent, isExist := db.Dict.Find(key)
+func SetIsMember(tx *TX, key string, member interface{}) (bool, error) {
+	setObj, isExist, err := findTyped[*SetObject](tx, key)
+	if err != nil {
+		return false, err
+	}
 	if !isExist {
-		return false, errors.New("key not exist")
+		return false, ErrKeyNotFound
 	}
-	setObj := ent.Ptr.(*SetObject)
 	return setObj.Data.Contains(member)
 }
 
-func SetSize(db *PolarisDB, key string) (int, error) {
-	ent, isExist := db.Dict.Find(key)
+func SetSize(tx *TX, key string) (int, error) {
+	setObj, isExist, err := findTyped[*SetObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	setObj := ent.Ptr.(*SetObject)
 	return setObj.Data.Len(), nil
 }
-func SetDiff(db *PolarisDB, key string, keys ...string) ([]interface{}, error) {
-	ent, isExist := db.Dict.Find(key)
-	if !isExist {
-		return nil, errors.New("key not exist")
-	}
-	setObj := ent.Ptr.(*SetObject)
-	otherSets := make([]*set.Set, 0)
-	for _, key := range keys {
-		ent, isExist := db.Dict.Find(key)
-		if !isExist {
-			return nil, errors.New("key not exist")
-		}
-		setObj := ent.Ptr.(*SetObject)
-		otherSets = append(otherSets, setObj.Data)
+func SetDiff(tx *TX, key string, keys ...string) ([]interface{}, error) {
+	sets, err := readSets(tx, append([]string{key}, keys...))
+	if err != nil {
+		return nil, err
 	}
-	return set.Diff(setObj.Data, otherSets...), nil
+	return set.Diff(sets[0], sets[1:]...), nil
 }
 
-func SetInter(db *PolarisDB, keys ...string) ([]interface{}, error) {
-	sets := make([]*set.Set, 0)
-	for _, key := range keys {
-		ent, isExist := db.Dict.Find(key)
-		if !isExist {
-			return nil, errors.New("key not exist")
-		}
-		setObj := ent.Ptr.(*SetObject)
-		sets = append(sets, setObj.Data)
+func SetInter(tx *TX, keys ...string) ([]interface{}, error) {
+	sets, err := readSets(tx, keys)
+	if err != nil {
+		return nil, err
 	}
 	return set.Intersection(sets...), nil
 }
 
 // SetUnion returns the members of the set resulting from the union of all the given sets.
-func SetUnion(db *PolarisDB, keys ...string) ([]interface{}, error) {
-	sets := make([]*set.Set, 0)
+func SetUnion(tx *TX, keys ...string) ([]interface{}, error) {
+	sets, err := readSets(tx, keys)
+	if err != nil {
+		return nil, err
+	}
+	return set.Union(sets...), nil
+}
+
+// readSets returns the sets of keys, a missing key is an empty set like in redis
+func readSets(tx *TX, keys []string) ([]*set.Set, error) {
+	sets := make([]*set.Set, 0, len(keys))
 	for _, key := range keys {
-		ent, isExist := db.Dict.Find(key)
+		setObj, isExist, err := findTyped[*SetObject](tx, key)
+		if err != nil {
+			return nil, err
+		}
 		if !isExist {
-			return nil, errors.New("key not exist")
+			sets = append(sets, set.NewSet())
+			continue
 		}
-		setObj := ent.Ptr.(*SetObject)
 		sets = append(sets, setObj.Data)
 	}
-	return set.Union(sets...), nil
+	return sets, nil
 }
 
 // SetMembers returns all members of the set value stored at key.
-func SetMembers(db *PolarisDB, key string) ([]interface{}, error) {
-	ent, isExist := db.Dict.Find(key)
+func SetMembers(tx *TX, key string) ([]interface{}, error) {
+	setObj, isExist, err := findTyped[*SetObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	setObj := ent.Ptr.(*SetObject)
 	return setObj.Data.Members(), nil
 }
 
 // SetPop removes and returns one or more random elements from the set value stored at key.
-func SetPop(db *PolarisDB, key string, count int) ([]interface{}, error) {
-	ent, isExist := db.Dict.Find(key)
+func SetPop(tx *TX, key string, count int) ([]interface{}, error) {
+	setObj, isExist, err := findTypedForWrite[*SetObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	setObj := ent.Ptr.(*SetObject)
 	return setObj.Data.Pop(count)
 }
 
 // SetRandomMember returns one or more random elements from the set value stored at key.
-func SetRandomMember(db *PolarisDB, key string, count int) ([]interface{}, error) {
-	ent, isExist := db.Dict.Find(key)
+func SetRandomMember(tx *TX, key string, count int) ([]interface{}, error) {
+	setObj, isExist, err := findTyped[*SetObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	setObj := ent.Ptr.(*SetObject)
 	return setObj.Data.RandomMembers(count), nil
 }
+
+// SetScan returns the members of the next steps of a set scan, a missing key is an empty set
+func SetScan(tx *TX, key string, cursor uint64, options ScanOptions) (uint64, []interface{}, error) {
+	setObj, isExist, err := findTyped[*SetObject](tx, key)
+	if err != nil {
+		return 0, []interface{}{}, err
+	}
+	if !isExist {
+		return 0, []interface{}{}, nil
+	}
+	members := make([]interface{}, 0, options.count())
+	cursor = scanSteps(cursor, options.count(), func(cursor uint64) (uint64, int) {
+		found := 0
+		cursor = setObj.Data.Scan(cursor, func(member interface{}) {
+			found++
+			if options.match(utils.ToString(member)) {
+				members = append(members, member)
+			}
+		})
+		return cursor, found
+	})
+	return cursor, members, nil
+}
@@ -1,78 +1,77 @@
 package polarisdb
 
 import (
-	"errors"
 	"fmt"
 	"strconv"
 )
 
-func WriteStringToStore(db *PolarisDB, key []byte, value []byte, keepTTL bool) {
-	obj, isExist := db.Dict.Find(string(key))
-	if !isExist {
-		obj = &KeyEntity{
-			Ptr: db.StringStore,
-		}
-		db.Dict.Add(string(key), obj)
+// WriteStringToStore sets key to value, a key of another type is replaced like SET does
+func WriteStringToStore(tx *TX, key []byte, value []byte, keepTTL bool) {
+	if _, _, err := findTyped[*StringStore](tx, string(key)); err != nil {
+		tx.delete(string(key))
 	}
-	obj.Ptr.(*StringStore).write(key, value)
+	store, _ := findOrCreate(tx, string(key), tx.stringStore)
+	store.write(key, value)
 	if !keepTTL {
-		db.Sweeper.TryRemoveExpire(string(key))
+		tx.setExpire(string(key), noExpire)
 	}
 }
 
-func AppendStringToStore(db *PolarisDB, key []byte, value []byte) ([]byte, error) {
-	obj, isExist := db.Dict.Find(string(key))
-	if !isExist {
-		obj = &KeyEntity{
-			Ptr: db.StringStore,
-		}
-		db.Dict.Add(string(key), obj)
+func AppendStringToStore(tx *TX, key []byte, value []byte) ([]byte, error) {
+	store, err := findOrCreate(tx, string(key), tx.stringStore)
+	if err != nil {
+		return nil, err
 	}
-	oldData, err := obj.Ptr.(*StringStore).read(key)
+	oldData, err := store.read(key)
 	if err != nil {
 		return nil, err
 	}
 	newData := append(oldData, value...)
-	obj.Ptr.(*StringStore).write(key, newData)
+	store.write(key, newData)
 	return newData, nil
 }
 
-func StringCalculate(db *PolarisDB, key []byte, value int64) (string, error) {
-	obj, isExist := db.Dict.Find(string(key))
-	if !isExist {
-		obj = &KeyEntity{
-			Ptr: db.StringStore,
-		}
-		db.Dict.Add(string(key), obj)
+func StringCalculate(tx *TX, key []byte, value int64) (string, error) {
+	store, err := findOrCreate(tx, string(key), tx.stringStore)
+	if err != nil {
+		return "", err
 	}
-	oldData, err := obj.Ptr.(*StringStore).read(key)
+	oldData, err := store.read(key)
 	if err != nil {
 		return "", err
 	}
 	// convert to int64
 	oldValue, err := strconv.ParseInt(string(oldData), 10, 64)
 	if err != nil {
-		return "", err
+		return "", ErrNotInteger
 	}
 	newValue := oldValue + value
 	strValue := fmt.Sprintf("%d", newValue)
-	obj.Ptr.(*StringStore).write(key, []byte(strValue))
+	store.write(key, []byte(strValue))
 	return strValue, nil
 }
 
-func StringGetDel(db *PolarisDB, key []byte) (string, error) {
-	obj, isExist := db.Dict.Find(string(key))
-	if !isExist {
-		return "", errors.New("key not exist")
+// StringRead returns the value of a string key
+func StringRead(tx *TX, key string) ([]byte, bool, error) {
+	store, isExist, err := findTyped[*StringStore](tx, key)
+	if err != nil || !isExist {
+		return nil, isExist, err
 	}
-	val, err := obj.Ptr.(*StringStore).read(key)
+	val, err := store.read([]byte(key))
 	if err != nil {
-		return "", err
+		return nil, false, err
 	}
-	err = obj.Ptr.(*StringStore).delete(key)
+	return val, true, nil
+}
+
+func StringGetDel(tx *TX, key []byte) (string, error) {
+	val, isExist, err := StringRead(tx, string(key))
 	if err != nil {
 		return "", err
 	}
-	db.Dict.Delete(string(key))
+	if !isExist {
+		return "", ErrKeyNotFound
+	}
+	tx.delete(string(key))
 	return string(val), nil
 }
@@ -0,0 +1,40 @@
+package polarisdb
+
+// findTyped returns the value of key as T, it fails with ErrWrongType when key holds another type
+func findTyped[T Object](tx *TX, key string) (T, bool, error) {
+	var zero T
+	ent, isExist := tx.find(key)
+	if !isExist {
+		return zero, false, nil
+	}
+	obj, ok := ent.Ptr.(T)
+	if !ok {
+		return zero, false, ErrWrongType
+	}
+	return obj, true, nil
+}
+
+// findTypedForWrite is findTyped for a value the transaction changes, the type is
+// checked before the value is copied into the write set
+func findTypedForWrite[T Object](tx *TX, key string) (T, bool, error) {
+	var zero T
+	if _, isExist, err := findTyped[T](tx, key); err != nil || !isExist {
+		return zero, isExist, err
+	}
+	ent, isExist := tx.findForWrite(key)
+	if !isExist {
+		return zero, false, nil
+	}
+	return ent.Ptr.(T), true, nil
+}
+
+// findOrCreate returns the value of key for writing, a missing key gets the value of create
+func findOrCreate[T Object](tx *TX, key string, create func() T) (T, error) {
+	obj, isExist, err := findTypedForWrite[T](tx, key)
+	if err != nil || isExist {
+		return obj, err
+	}
+	obj = create()
+	tx.add(key, &KeyEntity{Ptr: obj})
+	return obj, nil
+}
@@ -1,7 +1,6 @@
 package polarisdb
 
 import (
-	"errors"
 	"github.com/projectxpolaris/polarisdb/skiplist"
 )
 
@@ -19,167 +18,201 @@ func NewZsetObject() *ZsetObject {
 	}
 }
 
-func ZsetAdd(db *PolarisDB, key string, pairs ...ZsetPair) (*KeyEntity, error) {
-	ent, isExist := db.Dict.Find(key)
-	if !isExist {
-		ent = &KeyEntity{
-			Ptr: NewZsetObject(),
-		}
-		db.Dict.Add(key, ent)
+func ZsetAdd(tx *TX, key string, pairs ...ZsetPair) error {
+	zsetObj, err := findOrCreate(tx, key, NewZsetObject)
+	if err != nil {
+		return err
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 
 	for _, pair := range pairs {
 		zsetObj.Data.Add(pair.Score, pair.Member, nil)
 	}
-	return ent, nil
+	return nil
 }
 
-func ZsetRemove(db *PolarisDB, key string, members ...string) (*KeyEntity, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZsetRemove(tx *TX, key string, members ...string) error {
+	zsetObj, isExist, err := findTypedForWrite[*ZsetObject](tx, key)
+	if err != nil {
+		return err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	for _, member := range members {
 		zsetObj.Data.ZRem(member)
 	}
-	return ent, nil
+	return nil
 }
-func ZsetCard(db *PolarisDB, key string) (int, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZsetCard(tx *TX, key string) (int, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	return zsetObj.Data.ZCard(), nil
 }
-func ZsetScore(db *PolarisDB, key string, member string) (float64, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZsetScore(tx *TX, key string, member string) (float64, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	_, score := zsetObj.Data.ZScore(member)
 	return score, nil
 }
 
-func ZsetRank(db *PolarisDB, key string, member string) (int64, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZsetRank(tx *TX, key string, member string) (int64, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	return zsetObj.Data.ZRank(member), nil
 }
 
-func ZsetRange(db *PolarisDB, key string, start int, stop int) ([]interface{}, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZsetRange(tx *TX, key string, start int, stop int) ([]interface{}, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	vals := zsetObj.Data.ZRange(start, stop)
 	return vals, nil
 }
-func ZsetRangeWithScores(db *PolarisDB, key string, start int, stop int) ([]interface{}, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZsetRangeWithScores(tx *TX, key string, start int, stop int) ([]interface{}, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	vals := zsetObj.Data.ZRangeWithScores(start, stop)
 	return vals, nil
 }
-func Zdiff(db *PolarisDB, keys ...string) (*skiplist.Zset, error) {
-	sets := make([]*skiplist.Zset, 0)
+func Zdiff(tx *TX, keys ...string) (*skiplist.Zset, error) {
+	sets, err := readZsets(tx, keys)
+	if err != nil {
+		return nil, err
+	}
+	resultZset := skiplist.ZsetDiff(sets[0], sets[1:]...)
+	return resultZset, nil
+}
+
+// readZsets returns the sorted sets of keys, a missing key is an empty one like in redis
+func readZsets(tx *TX, keys []string) ([]*skiplist.Zset, error) {
+	sets := make([]*skiplist.Zset, 0, len(keys))
 	for _, key := range keys {
-		ent, isExist := db.Dict.Find(key)
+		zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+		if err != nil {
+			return nil, err
+		}
 		if !isExist {
-			return nil, errors.New("key not exist")
+			sets = append(sets, skiplist.NewZset())
+			continue
 		}
-		zsetObj := ent.Ptr.(*ZsetObject)
 		sets = append(sets, zsetObj.Data)
 	}
-	resultZset := skiplist.ZsetDiff(sets[0], sets[1:]...)
-	return resultZset, nil
+	return sets, nil
 }
-func ZdiffWithResult(db *PolarisDB, keys ...string) ([]interface{}, error) {
-	resultSet, err := Zdiff(db, keys...)
+
+func ZdiffWithResult(tx *TX, keys ...string) ([]interface{}, error) {
+	resultSet, err := Zdiff(tx, keys...)
 	if err != nil {
 		return nil, err
 	}
 	return resultSet.ZRangeWithScores(0, -1), nil
 }
-func ZInter(db *PolarisDB, keys ...string) (*skiplist.Zset, error) {
-	sets := make([]*skiplist.Zset, 0)
-	for _, key := range keys {
-		ent, isExist := db.Dict.Find(key)
-		if !isExist {
-			return nil, errors.New("key not exist")
-		}
-		zsetObj := ent.Ptr.(*ZsetObject)
-		sets = append(sets, zsetObj.Data)
+func ZInter(tx *TX, keys ...string) (*skiplist.Zset, error) {
+	sets, err := readZsets(tx, keys)
+	if err != nil {
+		return nil, err
 	}
 	resultZset := skiplist.ZsetInter(sets...)
 	return resultZset, nil
 }
 
-func ZInterWithResult(db *PolarisDB, keys ...string) ([]interface{}, error) {
-	resultSet, err := ZInter(db, keys...)
+func ZInterWithResult(tx *TX, keys ...string) ([]interface{}, error) {
+	resultSet, err := ZInter(tx, keys...)
 	if err != nil {
 		return nil, err
 	}
 	return resultSet.ZRangeWithScores(0, -1), nil
 }
-func ZUnion(db *PolarisDB, keys ...string) (*skiplist.Zset, error) {
-	sets := make([]*skiplist.Zset, 0)
-	for _, key := range keys {
-		ent, isExist := db.Dict.Find(key)
-		if !isExist {
-			return nil, errors.New("key not exist")
-		}
-		zsetObj := ent.Ptr.(*ZsetObject)
-		sets = append(sets, zsetObj.Data)
+func ZUnion(tx *TX, keys ...string) (*skiplist.Zset, error) {
+	sets, err := readZsets(tx, keys)
+	if err != nil {
+		return nil, err
 	}
 	resultZset := skiplist.ZsetUnion(sets...)
 	return resultZset, nil
 }
-func ZUnionWithResult(db *PolarisDB, keys ...string) ([]interface{}, error) {
-	resultSet, err := ZUnion(db, keys...)
+func ZUnionWithResult(tx *TX, keys ...string) ([]interface{}, error) {
+	resultSet, err := ZUnion(tx, keys...)
 	if err != nil {
 		return nil, err
 	}
 	return resultSet.ZRangeWithScores(0, -1), nil
 }
 
-func ZIncrBy(db *PolarisDB, key string, increment float64, member string) (float64, error) {
-	ent, isExist := db.Dict.Find(key)
-	if !isExist {
-		ent = &KeyEntity{
-			Ptr: NewZsetObject(),
-		}
-		db.Dict.Add(key, ent)
+func ZIncrBy(tx *TX, key string, increment float64, member string) (float64, error) {
+	zsetObj, err := findOrCreate(tx, key, NewZsetObject)
+	if err != nil {
+		return 0, err
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	return zsetObj.Data.ZIncrBy(increment, member), nil
 }
 
-func ZScore(db *PolarisDB, key string, member string) (float64, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZScore(tx *TX, key string, member string) (float64, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	_, score := zsetObj.Data.ZScore(member)
 	return score, nil
 }
 
-func ZRank(db *PolarisDB, key string, member string) (int64, error) {
-	ent, isExist := db.Dict.Find(key)
+func ZRank(tx *TX, key string, member string) (int64, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	zsetObj := ent.Ptr.(*ZsetObject)
 	return zsetObj.Data.ZRank(member), nil
 }
+
+// ZsetScan returns member score pairs of the next steps of a sorted set scan, a missing key is an empty set
+func ZsetScan(tx *TX, key string, cursor uint64, options ScanOptions) (uint64, []ZsetPair, error) {
+	zsetObj, isExist, err := findTyped[*ZsetObject](tx, key)
+	if err != nil {
+		return 0, []ZsetPair{}, err
+	}
+	if !isExist {
+		return 0, []ZsetPair{}, nil
+	}
+	pairs := make([]ZsetPair, 0, options.count())
+	cursor = scanSteps(cursor, options.count(), func(cursor uint64) (uint64, int) {
+		found := 0
+		cursor = zsetObj.Data.Scan(cursor, func(member string, score float64) {
+			found++
+			if options.match(member) {
+				pairs = append(pairs, ZsetPair{Member: member, Score: score})
+			}
+		})
+		return cursor, found
+	})
+	return cursor, pairs, nil
+}
@@ -2,24 +2,57 @@ package polarisdb
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"sync/atomic"
 )
 
 type PolarisDB struct {
 	sync.RWMutex
-	Log         *Log
-	Dict        *KeyDict
-	Sweeper     *Sweeper
-	StringStore *StringStore
-	Config      *DBConfig
-	Clock       *LRUClock
-	httpServer  *HttpServer
+	Log *Log
+	// Keyspaces are the numbered databases, SWAPDB and FLUSHDB replace entries under the write lock
+	Keyspaces  []*Keyspace
+	Config     *DBConfig
+	Clock      *LRUClock
+	httpServer *HttpServer
+	respServer *RespServer
+	// set while a background aof rewrite runs
+	aofRewriting int32
+	// number of applied write actions, snapshots compare it to tell whether anything changed
+	changes      int64
+	snapshot     snapshotState
+	stopSnapshot chan struct{}
+	// last version handed to a committed key, only changed under the write lock
+	version uint64
+	// database the next eviction samples first
+	evictCursor int
+	// number of keys removed to stay below MaxMemory
+	evictedKeys int64
+	// number of keys removed because their ttl passed
+	expiredKeys int64
+	expireStats expireStats
+	// background is cancelled by Close, the sweepers run until then
+	background     context.Context
+	stopBackground context.CancelFunc
+	// goroutines Close waits for
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+	closed    bool
+	// errors of the servers RunServer started
+	serveErr chan error
+	notifier *notifier
+	pubsub   *pubsub
 }
 
 type DBConfig struct {
 	Host               string  `json:"host"`
 	Port               string  `json:"port"`
+	RespPort           string  `json:"resp_port"`
+	HttpIdleTimeout    int64   `json:"http_idle_timeout"`
 	LruClockResolution float64 `json:"lru_clock_resolution"`
 	Path               string  `json:"aof_path"`
 	SweeperInterval    int64   `json:"sweeper_interval"`
@@ -27,6 +60,36 @@ type DBConfig struct {
 	LruSampleFactor    float64 `json:"lru_sample_factor"`
 	EvicterInterval    int64   `json:"evicter_interval"`
 	EvicterPolicy      string  `json:"evicter_policy"`
+	AppendFsync        string  `json:"append_fsync"`
+	// refuse to start when the last AOF segment ends with a torn record instead of truncating it
+	AofRefuseTornTail bool `json:"aof_refuse_torn_tail"`
+	// rewrite the AOF in the background once it grew by this percentage since the last rewrite, negative disables it
+	AofRewritePercentage int64 `json:"aof_rewrite_percentage"`
+	AofRewriteMinSize    int64 `json:"aof_rewrite_min_size"`
+	// snapshot file name inside the aof path
+	SnapshotFile string `json:"snapshot_file"`
+	// take a background snapshot this often (ms) when there were writes, negative disables it
+	SnapshotInterval int64 `json:"snapshot_interval"`
+	// number of databases SELECT can choose from
+	Databases int `json:"databases"`
+	// limit in bytes for the approximate memory of the keys and values, 0 is no limit.
+	// Writes over it evict keys under EvicterPolicy or fail with ErrOOM under noeviction.
+	MaxMemory int64 `json:"maxmemory"`
+	// keys an eviction samples to pick one
+	MaxMemorySamples int `json:"maxmemory_samples"`
+	// the higher the factor, the more accesses the LFU counter needs to grow
+	LfuLogFactor int `json:"lfu_log_factor"`
+	// minutes without access that take one from the LFU counter, negative never decays it
+	LfuDecayTime int `json:"lfu_decay_time"`
+	// expired keys a round of the active expire cycle removes before it checks the time
+	ActiveExpireKeysPerLoop int `json:"active_expire_keys_per_loop"`
+	// time (ms) one active expire cycle may take
+	ActiveExpireCycleTime int64 `json:"active_expire_cycle_time"`
+	// classes of keyspace events to publish in the letters of notify-keyspace-events,
+	// for example "KEA" for all of them, empty disables them
+	NotifyKeyspaceEvents string `json:"notify_keyspace_events"`
+	// messages a pub/sub subscriber may fall behind before it is disconnected
+	PubSubBufferLimit int `json:"pubsub_buffer_limit"`
 }
 
 func NewDB(config *DBConfig) *PolarisDB {
@@ -36,6 +99,12 @@ func NewDB(config *DBConfig) *PolarisDB {
 	if config.Port == "" {
 		config.Port = "8222"
 	}
+	if config.RespPort == "" {
+		config.RespPort = "6379"
+	}
+	if config.HttpIdleTimeout == 0 {
+		config.HttpIdleTimeout = 120000
+	}
 	if config.LruClockResolution == 0 {
 		config.LruClockResolution = 0.01
 	}
@@ -57,36 +126,119 @@ func NewDB(config *DBConfig) *PolarisDB {
 	if config.EvicterPolicy == "" {
 		config.EvicterPolicy = EvictNoEviction
 	}
-	return &PolarisDB{
-		Config: config,
-		Dict:   NewKeyDict(),
+	if config.AppendFsync == "" {
+		config.AppendFsync = FsyncEverySec
+	}
+	if config.AofRewritePercentage == 0 {
+		config.AofRewritePercentage = 100
+	}
+	if config.AofRewriteMinSize == 0 {
+		config.AofRewriteMinSize = 64 * 1024 * 1024 // 64MB
+	}
+	if config.SnapshotFile == "" {
+		config.SnapshotFile = "dump.pdb"
+	}
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = 3600000
+	}
+	if config.MaxMemorySamples <= 0 {
+		config.MaxMemorySamples = DefaultMaxMemorySamples
+	}
+	if config.LfuLogFactor <= 0 {
+		config.LfuLogFactor = DefaultLfuLogFactor
+	}
+	if config.LfuDecayTime == 0 {
+		config.LfuDecayTime = DefaultLfuDecayTime
+	}
+	if config.ActiveExpireKeysPerLoop <= 0 {
+		config.ActiveExpireKeysPerLoop = DefaultActiveExpireKeysPerLoop
+	}
+	if config.ActiveExpireCycleTime <= 0 {
+		config.ActiveExpireCycleTime = DefaultActiveExpireCycleTime
+	}
+	if config.PubSubBufferLimit <= 0 {
+		config.PubSubBufferLimit = DefaultPubSubBufferLimit
+	}
+	if config.Databases <= 0 {
+		config.Databases = DefaultDatabases
+	}
+	db := &PolarisDB{
+		Config:    config,
+		Keyspaces: make([]*Keyspace, config.Databases),
+		pubsub:    newPubSub(),
+	}
+	db.notifier = newNotifier(db.pubsub)
+	for i := range db.Keyspaces {
+		db.Keyspaces[i] = newKeyspace(db)
 	}
+	return db
 }
-func (db *PolarisDB) RunServer() {
-	db.httpServer = NewHttpServer(db)
-	addr := db.Config.Host + ":" + db.Config.Port
-	go db.httpServer.run(addr)
+
+// RunServer serves the database over http and resp in the background, Close stops the servers
+func (db *PolarisDB) RunServer() error {
+	httpServer := NewHttpServer(db)
+	if err := httpServer.Listen(db.Config.Host + ":" + db.Config.Port); err != nil {
+		return err
+	}
+	respServer := NewRespServer(db)
+	if err := respServer.Listen(db.Config.Host + ":" + db.Config.RespPort); err != nil {
+		httpServer.listener.Close()
+		return err
+	}
+	serveErr := make(chan error, 2)
+	db.Lock()
+	db.httpServer, db.respServer, db.serveErr = httpServer, respServer, serveErr
+	db.Unlock()
+	db.goBackground(func() {
+		if err := httpServer.Serve(); err != nil {
+			serveErr <- err
+		}
+	})
+	db.goBackground(func() {
+		if err := respServer.Serve(); err != nil {
+			serveErr <- err
+		}
+	})
+	return nil
 }
+
 func (db *PolarisDB) Open() error {
-	db.Dict.db = db
 	if db.Config == nil {
 		return errors.New("no config")
 	}
-	db.Sweeper = NewSweeper(db)
-	// init store
-	stringStore := NewStore()
-	db.StringStore = stringStore
 	// init clock
 	db.Clock = &LRUClock{db: db}
-	db.Log = &Log{}
-	err := db.Log.Open(db.Config.Path)
+	switch db.Config.AppendFsync {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return errors.New("invalid append fsync policy")
+	}
+	flags, err := ParseNotifyClasses(db.Config.NotifyKeyspaceEvents)
+	if err != nil {
+		return err
+	}
+	db.notifier.flags = flags
+	db.Log = &Log{fsyncPolicy: db.Config.AppendFsync, refuseTornTail: db.Config.AofRefuseTornTail}
+	if err = db.Log.Open(db.Config.Path); err != nil {
+		return err
+	}
+	// a snapshot saves replaying the records written before it
+	pos, err := db.loadSnapshot()
 	if err != nil {
 		return err
 	}
-	iter, err := db.Log.NewLogIterator()
+	var iter *LogIterator
+	if pos != nil {
+		iter, err = db.Log.NewLogIteratorFrom(*pos)
+	} else {
+		iter, err = db.Log.NewLogIterator()
+	}
 	if err != nil {
 		return err
 	}
+	// replayed actions write straight to the stores
+	replayTx := db.newTX()
+	replayTx.direct = true
 	for {
 		block := iter.Next()
 		if block == nil {
@@ -95,110 +247,92 @@ func (db *PolarisDB) Open() error {
 		actionBlock := ActionBlock{}
 		err = actionBlock.Deserialize(bytes.NewBuffer(block.Data))
 		if err != nil {
+			return iter.Corrupt(fmt.Errorf("%w: %v", ErrBadRecord, err))
+		}
+		// every record starts in database 0, a SelectAct moves it to another one
+		if err = replayTx.Select(0); err != nil {
 			return err
 		}
-		switch actionBlock.Type {
-		case SetStringAction:
-			stringAct := StringAct{}
-			err = stringAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = stringAct.Write(db)
-			if err != nil {
-				return err
-			}
-		case SetExpireAction:
-			expireAct := ExpireAct{}
-			err = expireAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = expireAct.Write(db)
-		case GetDelAction:
-			getDelAct := StringDelAction{}
-			err = getDelAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = getDelAct.Write(db)
-		case GetExAction:
-			getExAct := SetExAction{}
-			err = getExAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = getExAct.Write(db)
-		case HSetAction:
-			hsetAct := HashHSetAction{}
-			err = hsetAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = hsetAct.Write(db)
-		case HDelAction:
-			hdelAct := HashHDelAction{}
-			err = hdelAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = hdelAct.Write(db)
-		case LPushAction:
-			lpushAct := ListLPushAction{}
-			err = lpushAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = lpushAct.Write(db)
-		case LPopAction:
-			lpopAct := ListLPopAction{}
-			err = lpopAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = lpopAct.Write(db)
-		case LInsertAction:
-			linsertAct := ListInsertAction{}
-			err = linsertAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = linsertAct.Write(db)
-		case SAddAction:
-			saddAct := SetAddAction{}
-			err = saddAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = saddAct.Write(db)
-		case SRemAction:
-			sremAct := SetRemAction{}
-			err = sremAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = sremAct.Write(db)
-		case ZAddAction:
-			zaddAct := ZsetAddAction{}
-			err = zaddAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = zaddAct.Write(db)
-		case ZRemAction:
-			zremAct := ZsetRemAction{}
-			err = zremAct.Deserialize(bytes.NewBuffer(actionBlock.Data))
-			err = zremAct.Write(db)
+		if err = applyActionBlock(replayTx, &actionBlock); err != nil {
+			return err
 		}
 	}
-	//go db.Sweeper.run(context.Background())
+	if err = iter.Err(); err != nil {
+		return err
+	}
+	// the replay changes values in place
+	for _, ks := range db.Keyspaces {
+		ks.Dict.recalculateMemory()
+	}
+	if db.Config.SnapshotInterval > 0 && db.stopSnapshot == nil {
+		db.stopSnapshot = make(chan struct{})
+		stop := db.stopSnapshot
+		db.goBackground(func() {
+			db.snapshotLoop(stop)
+		})
+	}
+	db.startBackground()
 	return nil
 }
 
 func (db *PolarisDB) Update(trf func(tx *TX) error) error {
 	db.Lock()
 	defer db.Unlock()
-	tx := &TX{Writers: []DataWriter{}, db: db}
+	if db.closed {
+		return ErrClosed
+	}
+	tx := db.newTX()
 	err := trf(tx)
 	if err != nil {
+		// the write set is dropped, nothing has been applied
 		return err
 	}
-	blocks := make([]*ActionBlock, 0)
-	for _, dataWriter := range tx.Writers {
-		err = dataWriter.Write(db)
-		if err != nil {
-			return err
-		}
-		block, err := dataWriter.GetActionBlock()
-		if err != nil {
-			return err
-		}
-		blocks = append(blocks, block)
+	if len(tx.Writers) == 0 {
+		tx.commit()
+		return nil
 	}
-	for _, block := range blocks {
-		data, err := block.Serialize()
-		if err != nil {
-			return err
-		}
-		err = db.Log.Append(&Block{data})
+	if err = db.checkMemory(tx); err != nil {
+		return err
+	}
+	// the whole transaction is one record, it is logged before anything is applied
+	data, err := encodeWriters(tx.Writers)
+	if err != nil {
+		return err
+	}
+	if err = db.appendLog(data); err != nil {
+		return err
+	}
+	tx.commit()
+	atomic.AddInt64(&db.changes, int64(len(tx.Writers)))
+	db.notifier.publish(tx.events...)
+	// evicted keys are logged after the write, the replay reads what the write read.
+	// The keys it wrote stay, the caller is told they are stored.
+	if err = db.freeMemory(tx.writtenKeys()); err != nil && !errors.Is(err, ErrOOM) {
+		log.Printf("evict: %v", err)
 	}
+	db.maybeRewriteAof()
 	return nil
 }
 
+// appendLog appends a record of writes, under appendfsync always it is on disk before
+// the caller applies them. A failed fsync leaves nothing applied and nothing to replay.
+func (db *PolarisDB) appendLog(data []byte) error {
+	if db.Config.AppendFsync == FsyncAlways {
+		return db.Log.AppendSync(&Block{Data: data})
+	}
+	return db.Log.Append(&Block{Data: data})
+}
+
 func (db *PolarisDB) View(trf func(tx *TX) error) error {
 	db.RLock()
 	defer db.RUnlock()
-	tx := &TX{Writers: []DataWriter{}, db: db}
+	tx := db.newTX()
 	err := trf(tx)
 	if err != nil {
 		return err
 	}
 	if len(tx.Writers) != 0 {
-		return errors.New("view transaction is read only")
+		return ErrReadOnly
 	}
 	return nil
 }
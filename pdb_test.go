@@ -2,7 +2,9 @@ package polarisdb
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"os"
 	"testing"
 )
 
@@ -49,6 +51,264 @@ func TestPolarisDB_View(t *testing.T) {
 		return
 	}
 }
+
+func TestPolarisDB_UpdateRollback(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+
+	err = db.Update(func(tx *TX) error {
+		if err := tx.SetString("foo", "bar", false); err != nil {
+			return err
+		}
+		return tx.LPush("list", []byte("a"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	abort := errors.New("abort")
+	err = db.Update(func(tx *TX) error {
+		tx.SetString("foo", "changed", false)
+		tx.SetString("new", "v", false)
+		tx.LPush("list", []byte("b"))
+		tx.GetDel("foo")
+		return abort
+	})
+	if err != abort {
+		t.Fatalf("expect abort error got %v", err)
+	}
+	check := func(db *PolarisDB) {
+		db.View(func(tx *TX) error {
+			if val, err := tx.Get("foo"); err != nil || val != "bar" {
+				t.Fatalf("expect foo=bar got %s %v", val, err)
+			}
+			if exist, _ := tx.Exists("new"); exist {
+				t.Fatal("expect new not to exist")
+			}
+			if listLen, err := tx.LLen("list"); err != nil || listLen != 1 {
+				t.Fatalf("expect list len 1 got %d %v", listLen, err)
+			}
+			return nil
+		})
+	}
+	check(db)
+	check(reopenTestDB(t, db))
+}
+
+func TestPolarisDB_UpdateReadYourWrites(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+
+	err = db.Update(func(tx *TX) error {
+		tx.SetString("foo", "bar", false)
+		if val, err := tx.Get("foo"); err != nil || val != "bar" {
+			return fmt.Errorf("expect foo=bar got %s %v", val, err)
+		}
+		tx.LPush("list", []byte("a"), []byte("b"))
+		if listLen, err := tx.LLen("list"); err != nil || listLen != 2 {
+			return fmt.Errorf("expect list len 2 got %d %v", listLen, err)
+		}
+		// the write set is invisible to other readers until commit
+		if _, isExist := db.Keyspaces[0].Dict.Data.Find("foo"); isExist {
+			return errors.New("expect foo not to be visible before commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *TX) error {
+		if listLen, err := tx.LLen("list"); err != nil || listLen != 2 {
+			t.Fatalf("expect list len 2 got %d %v", listLen, err)
+		}
+		return nil
+	})
+}
+
+func TestPolarisDB_UpdateTornBatch(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+
+	if err = db.Update(func(tx *TX) error { return tx.SetString("first", "v", false) }); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *TX) error {
+		if err := tx.SetString("foo", "bar", false); err != nil {
+			return err
+		}
+		if err := tx.HSet("hash", Paris{Field: []byte("f"), Value: []byte("v")}); err != nil {
+			return err
+		}
+		return tx.SAdd("set", "a")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := db.Log.lastFilePath
+	db.Log.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash in the middle of the transaction record
+	if err = os.WriteFile(path, data[:len(data)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	db = NewDB(&DBConfig{Path: "./tmp"})
+	if err = db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *TX) error {
+		if exist, _ := tx.Exists("first"); !exist {
+			t.Fatal("expect the first transaction to be replayed")
+		}
+		for _, key := range []string{"foo", "hash", "set"} {
+			if exist, _ := tx.Exists(key); exist {
+				t.Fatalf("expect %s of the torn transaction to be dropped", key)
+			}
+		}
+		return nil
+	})
+}
+
+func TestPolarisDB_OpenUndecodableRecord(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	if err := db.Update(func(tx *TX) error { return tx.SetString("first", "v", false) }); err != nil {
+		t.Fatal(err)
+	}
+	pos, _ := db.Log.Position()
+	// the record is intact but holds no action block
+	if err := db.Log.Append(&Block{Data: []byte{0xff}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	err := NewDB(&DBConfig{Path: "./tmp"}).Open()
+	var corruptErr *CorruptRecordError
+	if !errors.As(err, &corruptErr) || !errors.Is(err, ErrBadRecord) || corruptErr.Segment != pos.Segment || corruptErr.Offset != pos.Offset {
+		t.Fatalf("expect a corrupt record error at %+v got %v", pos, err)
+	}
+}
+
+func TestPolarisDB_UpdateAofError(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+
+	if err = db.Update(func(tx *TX) error { return tx.SetString("foo", "bar", false) }); err != nil {
+		t.Fatal(err)
+	}
+	// writes to the closed segment file fail
+	db.Log.file.Close()
+	err = db.Update(func(tx *TX) error { return tx.SetString("foo", "changed", false) })
+	if err == nil {
+		t.Fatal("expect the aof error to fail the update")
+	}
+	db.View(func(tx *TX) error {
+		if val, _ := tx.Get("foo"); val != "bar" {
+			t.Fatalf("expect foo=bar got %s", val)
+		}
+		return nil
+	})
+}
+
+func TestPolarisDB_UpdateFsyncError(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", AppendFsync: FsyncAlways, NotifyKeyspaceEvents: "KA"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	if err := db.Update(func(tx *TX) error { return tx.SetString("foo", "bar", false) }); err != nil {
+		t.Fatal(err)
+	}
+	sub := db.SubscribeKeyspace(0)
+	defer sub.Close()
+	db.Log.syncFile = func(*os.File) error {
+		return errors.New("fsync failed")
+	}
+	err := db.Update(func(tx *TX) error { return tx.SetString("foo", "changed", false) })
+	db.Log.syncFile = nil
+	if err == nil {
+		t.Fatal("expect the fsync error to fail the update")
+	}
+	db.View(func(tx *TX) error {
+		if val, _ := tx.Get("foo"); val != "bar" {
+			t.Fatalf("expect foo=bar got %s", val)
+		}
+		return nil
+	})
+	if len(sub.C) != 0 {
+		t.Fatal("expect a failed write not to be published")
+	}
+	// the failed record is gone from the aof, the writes after it still go in
+	if err = db.Update(func(tx *TX) error { return tx.SetString("next", "v", false) }); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	reopened := NewDB(&DBConfig{Path: "./tmp"})
+	if err = reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	reopened.View(func(tx *TX) error {
+		if val, _ := tx.Get("foo"); val != "bar" {
+			t.Fatalf("expect foo=bar after reopen got %s", val)
+		}
+		if val, _ := tx.Get("next"); val != "v" {
+			t.Fatalf("expect next=v after reopen got %s", val)
+		}
+		return nil
+	})
+}
+
+func TestPolarisDB_UpdateFsyncErrorNotRemoved(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", AppendFsync: FsyncAlways})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	// writes to a pipe succeed, an fsync and a truncate of it fail
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	segment := db.Log.file
+	db.Log.file = writer
+	err = db.Update(func(tx *TX) error { return tx.SetString("foo", "bar", false) })
+	db.Log.file = segment
+	writer.Close()
+	if err == nil {
+		t.Fatal("expect the fsync error to fail the update")
+	}
+	// a record that may come back on the next open stops the writes
+	if err = db.Update(func(tx *TX) error { return tx.SetString("foo", "bar", false) }); err == nil {
+		t.Fatal("expect the log to refuse writes")
+	}
+	db.Close()
+}
+
 func randomKeyAndValue(n int) string {
 	b := make([]byte, n)
 	if _, err := rand.Read(b); err != nil {
@@ -0,0 +1,304 @@
+package polarisdb
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/projectxpolaris/polarisdb/utils"
+)
+
+// DefaultPubSubBufferLimit is the number of messages a subscriber may fall behind when the config does not set it
+const DefaultPubSubBufferLimit = 1024
+
+// ErrSlowSubscriber disconnects a subscriber whose output buffer is full
+var ErrSlowSubscriber = errors.New("subscriber output buffer limit reached")
+
+// Message is a message a subscription received
+type Message struct {
+	// Pattern is the pattern the channel matched, empty for a channel subscription
+	Pattern string `json:"pattern,omitempty"`
+	Channel string `json:"channel"`
+	Payload string `json:"payload"`
+}
+
+// Subscription receives the messages published to its channels and patterns. A
+// subscriber that falls more than the buffer limit behind is disconnected: C is
+// closed and Err returns ErrSlowSubscriber, publishers never wait for it.
+type Subscription struct {
+	// C delivers the messages, it is closed by Close or a disconnect
+	C        <-chan Message
+	ch       chan Message
+	hub      *pubsub
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	closed   bool
+	err      error
+}
+
+// Subscribe adds channels to the subscription and returns the number of channels
+// and patterns it has after each one
+func (s *Subscription) Subscribe(channels ...string) []int {
+	return s.hub.subscribe(s, false, channels)
+}
+
+// PSubscribe adds glob patterns to the subscription and returns the number of
+// channels and patterns it has after each one
+func (s *Subscription) PSubscribe(patterns ...string) []int {
+	return s.hub.subscribe(s, true, patterns)
+}
+
+// Unsubscribe removes channels from the subscription, all of them when none is
+// given. It returns the removed channels with the count left after each one.
+func (s *Subscription) Unsubscribe(channels ...string) ([]string, []int) {
+	return s.hub.unsubscribe(s, false, channels)
+}
+
+// PUnsubscribe removes patterns from the subscription, all of them when none is
+// given. It returns the removed patterns with the count left after each one.
+func (s *Subscription) PUnsubscribe(patterns ...string) ([]string, []int) {
+	return s.hub.unsubscribe(s, true, patterns)
+}
+
+// Count returns the number of channels and patterns of the subscription
+func (s *Subscription) Count() int {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+// Err returns why the subscription was disconnected, nil while it runs or after Close
+func (s *Subscription) Err() error {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	return s.err
+}
+
+// Close removes every channel and pattern and closes C
+func (s *Subscription) Close() {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	s.hub.disconnect(s, nil)
+}
+
+// pubsub routes the published messages to the subscriptions
+type pubsub struct {
+	sync.Mutex
+	channels map[string]map[*Subscription]struct{}
+	patterns map[string]map[*Subscription]struct{}
+	// subscriptions still open, Close of the db disconnects them
+	subs map[*Subscription]struct{}
+	// subscribers disconnected for a full buffer
+	disconnections int64
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*Subscription]struct{}),
+		patterns: make(map[string]map[*Subscription]struct{}),
+		subs:     make(map[*Subscription]struct{}),
+	}
+}
+
+func (h *pubsub) subscribe(s *Subscription, pattern bool, names []string) []int {
+	h.Lock()
+	defer h.Unlock()
+	index, own := h.channels, s.channels
+	if pattern {
+		index, own = h.patterns, s.patterns
+	}
+	counts := make([]int, 0, len(names))
+	for _, name := range names {
+		if !s.closed {
+			if _, ok := own[name]; !ok {
+				own[name] = struct{}{}
+				if index[name] == nil {
+					index[name] = make(map[*Subscription]struct{})
+				}
+				index[name][s] = struct{}{}
+			}
+		}
+		counts = append(counts, len(s.channels)+len(s.patterns))
+	}
+	return counts
+}
+
+func (h *pubsub) unsubscribe(s *Subscription, pattern bool, names []string) ([]string, []int) {
+	h.Lock()
+	defer h.Unlock()
+	index, own := h.channels, s.channels
+	if pattern {
+		index, own = h.patterns, s.patterns
+	}
+	if len(names) == 0 {
+		names = sortedNames(own)
+	}
+	counts := make([]int, 0, len(names))
+	for _, name := range names {
+		if _, ok := own[name]; ok {
+			delete(own, name)
+			h.remove(index, name, s)
+		}
+		counts = append(counts, len(s.channels)+len(s.patterns))
+	}
+	return names, counts
+}
+
+// remove drops s from the subscribers of name, the caller holds the lock
+func (h *pubsub) remove(index map[string]map[*Subscription]struct{}, name string, s *Subscription) {
+	delete(index[name], s)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+}
+
+// disconnect removes every channel and pattern of s and closes C with err as the
+// reason, the caller holds the lock
+func (h *pubsub) disconnect(s *Subscription, err error) {
+	if s.closed {
+		return
+	}
+	for name := range s.channels {
+		h.remove(h.channels, name, s)
+	}
+	for name := range s.patterns {
+		h.remove(h.patterns, name, s)
+	}
+	s.channels = map[string]struct{}{}
+	s.patterns = map[string]struct{}{}
+	delete(h.subs, s)
+	s.closed = true
+	s.err = err
+	close(s.ch)
+}
+
+// publish delivers payload to the subscribers of channel and of the patterns it
+// matches, it returns the number of messages delivered
+func (h *pubsub) publish(channel string, payload string) int {
+	h.Lock()
+	defer h.Unlock()
+	receivers := 0
+	for s := range h.channels[channel] {
+		if h.deliver(s, Message{Channel: channel, Payload: payload}) {
+			receivers++
+		}
+	}
+	for pattern, subs := range h.patterns {
+		if !utils.GlobMatch(pattern, channel) {
+			continue
+		}
+		for s := range subs {
+			if h.deliver(s, Message{Pattern: pattern, Channel: channel, Payload: payload}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// deliver hands msg to s, a subscriber with a full buffer is disconnected
+func (h *pubsub) deliver(s *Subscription, msg Message) bool {
+	if s.closed {
+		// a disconnect earlier in this publish
+		return false
+	}
+	select {
+	case s.ch <- msg:
+		return true
+	default:
+		atomic.AddInt64(&h.disconnections, 1)
+		h.disconnect(s, ErrSlowSubscriber)
+		return false
+	}
+}
+
+// close disconnects every subscription, the database is closing
+func (h *pubsub) close() {
+	h.Lock()
+	defer h.Unlock()
+	for s := range h.subs {
+		h.disconnect(s, ErrClosed)
+	}
+}
+
+func sortedNames(names map[string]struct{}) []string {
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// NewSubscription returns a subscription without channels, buffer is the number of
+// messages it may fall behind before it is disconnected, PubSubBufferLimit when <= 0
+func (db *PolarisDB) NewSubscription(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = db.Config.PubSubBufferLimit
+	}
+	ch := make(chan Message, buffer)
+	s := &Subscription{
+		C:        ch,
+		ch:       ch,
+		hub:      db.pubsub,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+	db.pubsub.Lock()
+	db.pubsub.subs[s] = struct{}{}
+	db.pubsub.Unlock()
+	return s
+}
+
+// Subscribe returns a subscription to channels
+func (db *PolarisDB) Subscribe(channels ...string) *Subscription {
+	s := db.NewSubscription(0)
+	s.Subscribe(channels...)
+	return s
+}
+
+// PSubscribe returns a subscription to the channels matching the glob patterns
+func (db *PolarisDB) PSubscribe(patterns ...string) *Subscription {
+	s := db.NewSubscription(0)
+	s.PSubscribe(patterns...)
+	return s
+}
+
+// Publish sends payload to the subscribers of channel and returns how many received it
+func (db *PolarisDB) Publish(channel string, payload string) int {
+	return db.pubsub.publish(channel, payload)
+}
+
+// PubSubChannels returns the channels with subscribers, only the ones matching
+// pattern unless it is empty
+func (db *PolarisDB) PubSubChannels(pattern string) []string {
+	db.pubsub.Lock()
+	defer db.pubsub.Unlock()
+	channels := make([]string, 0)
+	for channel := range db.pubsub.channels {
+		if pattern == "" || utils.GlobMatch(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// PubSubNumSub returns the number of subscribers of each channel, patterns are not counted
+func (db *PolarisDB) PubSubNumSub(channels ...string) []int {
+	db.pubsub.Lock()
+	defer db.pubsub.Unlock()
+	counts := make([]int, 0, len(channels))
+	for _, channel := range channels {
+		counts = append(counts, len(db.pubsub.channels[channel]))
+	}
+	return counts
+}
+
+// PubSubNumPat returns the number of patterns with subscribers
+func (db *PolarisDB) PubSubNumPat() int {
+	db.pubsub.Lock()
+	defer db.pubsub.Unlock()
+	return len(db.pubsub.patterns)
+}
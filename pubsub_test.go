@@ -0,0 +1,128 @@
+package polarisdb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolarisDB_PubSub(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	sub := db.Subscribe("news", "sports")
+	defer sub.Close()
+	if counts := sub.PSubscribe("news.*", "news.*"); !reflect.DeepEqual(counts, []int{3, 3}) {
+		t.Fatalf("expect a pattern to count once got %v", counts)
+	}
+	other := db.PSubscribe("n*")
+	defer other.Close()
+	if receivers := db.Publish("news", "hello"); receivers != 2 {
+		t.Fatalf("expect 2 receivers got %d", receivers)
+	}
+	if receivers := db.Publish("news.tech", "go"); receivers != 2 {
+		t.Fatalf("expect 2 receivers got %d", receivers)
+	}
+	if receivers, _ := db.Exec("publish", "weather", "sunny"); receivers != int64(0) {
+		t.Fatalf("expect no receiver got %v", receivers)
+	}
+	expect := []Message{
+		{Channel: "news", Payload: "hello"},
+		{Pattern: "news.*", Channel: "news.tech", Payload: "go"},
+	}
+	for _, msg := range expect {
+		if got := <-sub.C; got != msg {
+			t.Fatalf("expect %v got %v", msg, got)
+		}
+	}
+	if got := <-other.C; got != (Message{Pattern: "n*", Channel: "news", Payload: "hello"}) {
+		t.Fatalf("unexpected pattern message %v", got)
+	}
+
+	channels, _ := db.Exec("pubsub", "channels")
+	if !reflect.DeepEqual(channels, []string{"news", "sports"}) {
+		t.Fatalf("unexpected channels %v", channels)
+	}
+	channels, _ = db.Exec("pubsub", "channels", "s*")
+	if !reflect.DeepEqual(channels, []string{"sports"}) {
+		t.Fatalf("unexpected matching channels %v", channels)
+	}
+	numsub, _ := db.Exec("pubsub", "numsub", "news", "missing")
+	if !reflect.DeepEqual(numsub, MapReply{"news", int64(1), "missing", int64(0)}) {
+		t.Fatalf("unexpected numsub %v", numsub)
+	}
+	if numpat, _ := db.Exec("pubsub", "numpat"); numpat != int64(2) {
+		t.Fatalf("expect 2 patterns got %v", numpat)
+	}
+
+	removed, counts := sub.Unsubscribe()
+	if !reflect.DeepEqual(removed, []string{"news", "sports"}) || !reflect.DeepEqual(counts, []int{2, 1}) {
+		t.Fatalf("unexpected unsubscribe %v %v", removed, counts)
+	}
+	if receivers := db.Publish("sports", "goal"); receivers != 0 {
+		t.Fatalf("expect no receiver after unsubscribe got %d", receivers)
+	}
+	sub.Close()
+	if _, ok := <-sub.C; ok || sub.Err() != nil {
+		t.Fatal("expect a closed subscription to close its channel without an error")
+	}
+	if numpat, _ := db.Exec("pubsub", "numpat"); numpat != int64(1) {
+		t.Fatalf("expect the closed patterns to be gone got %v", numpat)
+	}
+	db.Close()
+	for range other.C {
+	}
+	if other.Err() != ErrClosed {
+		t.Fatal("expect closing the database to disconnect the subscribers")
+	}
+}
+
+func TestPolarisDB_PubSubSlowSubscriber(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", PubSubBufferLimit: 2})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	slow := db.Subscribe("news")
+	fast := db.Subscribe("news")
+	defer fast.Close()
+	for i := 0; i < 3; i++ {
+		db.Publish("news", "hello")
+		<-fast.C
+	}
+	// the buffered messages are still delivered, then the channel closes
+	count := 0
+	for range slow.C {
+		count++
+	}
+	if count != 2 || slow.Err() != ErrSlowSubscriber {
+		t.Fatalf("expect a disconnect after 2 messages got %d %v", count, slow.Err())
+	}
+	if numsub := db.PubSubNumSub("news"); numsub[0] != 1 {
+		t.Fatalf("expect the slow subscriber to be removed got %v", numsub)
+	}
+	if !strings.Contains(db.Info("stats"), "client_output_buffer_limit_disconnections:1\r\n") {
+		t.Fatalf("expect the disconnect in the stats got %s", db.Info("stats"))
+	}
+}
+
+func TestPolarisDB_PubSubKeyspaceChannels(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", NotifyKeyspaceEvents: "K$"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	sub := db.PSubscribe("__key*__:*")
+	defer sub.Close()
+	db.ExecDB(1, "set", "foo", "bar")
+	db.Exec("del", "foo")
+	if got := <-sub.C; got != (Message{Pattern: "__key*__:*", Channel: "__keyspace@1__:foo", Payload: "set"}) {
+		t.Fatalf("unexpected keyspace message %v", got)
+	}
+	// E is not enabled and del is not a string event
+	if receivers := db.Publish("probe", ""); receivers != 0 || len(sub.C) != 0 {
+		t.Fatalf("expect no other message got %d", len(sub.C))
+	}
+}
@@ -2,7 +2,8 @@ package radix
 
 import (
 	"bytes"
-	"errors"
+	"sort"
+
 	"github.com/projectxpolaris/polarisdb/utils"
 )
 
@@ -26,6 +27,27 @@ func (n *Node) FindChild(key []byte) *Node {
 	}
 	return nil
 }
+
+// addChild inserts child keeping the children ordered by their first byte, the
+// children of a node never share the first byte so this is the key order
+func (n *Node) addChild(child *Node) {
+	index := sort.Search(len(n.Children), func(i int) bool {
+		return n.Children[i].Value[0] >= child.Value[0]
+	})
+	n.Children = append(n.Children, nil)
+	copy(n.Children[index+1:], n.Children[index:])
+	n.Children[index] = child
+}
+
+func (n *Node) removeChild(child *Node) {
+	for i, c := range n.Children {
+		if c == child {
+			n.Children = append(n.Children[:i], n.Children[i+1:]...)
+			return
+		}
+	}
+}
+
 func NewTree() *RadixTree {
 	return &RadixTree{Root: &Node{
 		Value:    nil,
@@ -52,13 +74,10 @@ func (t *RadixTree) walk(parent *Node, key []byte, data []byte) {
 			break
 		}
 		prefix := utils.FindLargestPrefix(child.Value, key)
-		// not self
-		if !bytes.Equal(key, prefix) {
-			// must longest
-			if len(prefix) > len(largestPrefix) {
-				targetNode = child
-				largestPrefix = prefix
-			}
+		// must longest
+		if len(prefix) > len(largestPrefix) {
+			targetNode = child
+			largestPrefix = prefix
 		}
 	}
 	// not found child
@@ -67,7 +86,7 @@ func (t *RadixTree) walk(parent *Node, key []byte, data []byte) {
 			Value:    key,
 			Children: make([]*Node, 0),
 		}
-		parent.Children = append(parent.Children, targetNode)
+		parent.addChild(targetNode)
 		targetNode.Data = data
 		return
 	}
@@ -86,10 +105,7 @@ func (t *RadixTree) walk(parent *Node, key []byte, data []byte) {
 	targetNode.Children = []*Node{newChild}
 	targetNode.Value = largestPrefix
 	targetNode.Data = nil
-	key = key[len(largestPrefix):]
-	if len(key) > 0 {
-		t.walk(targetNode, key, data)
-	}
+	t.walk(targetNode, key[len(largestPrefix):], data)
 }
 func (t *RadixTree) walkGet(parent *Node, key []byte) ([]byte, error) {
 	if len(key) == 0 {
@@ -128,27 +144,28 @@ func walkDelete(current *Node, key []byte) error {
 			break
 		}
 	}
-	if current == nil {
-		return errors.New("not found")
+	if targetNode == nil {
+		return nil
 	}
 
 	err := walkDelete(targetNode, key)
 	if err != nil {
 		return err
 	}
-	// remove empty data leaf
-	//if targetNode.IsLeaf() && targetNode.Data == nil {
-	//	if len(current.Children) == 1 {
-	//		current.Children = []*Node{}
-	//		return nil
-	//	}
-	//	for i, child := range current.Children {
-	//		if child == targetNode {
-	//			current.Children = append(current.Children[:i], current.Children[i+1:]...)
-	//			break
-	//		}
-	//	}
-	//}
+	if targetNode.Data != nil {
+		return nil
+	}
+	// remove empty data leaf and merge a node left with a single child into it
+	switch len(targetNode.Children) {
+	case 0:
+		current.removeChild(targetNode)
+	case 1:
+		child := targetNode.Children[0]
+		value := make([]byte, 0, len(targetNode.Value)+len(child.Value))
+		targetNode.Value = append(append(value, targetNode.Value...), child.Value...)
+		targetNode.Children = child.Children
+		targetNode.Data = child.Data
+	}
 	return nil
 }
 
@@ -156,19 +173,95 @@ func (t *RadixTree) Delete(key []byte) error {
 	return walkDelete(t.Root, key)
 }
 
+// Walk calls hitFunc for every key in lexicographic order, the key must not be
+// kept after the call
 func (t *RadixTree) Walk(hitFunc func(key []byte, value []byte)) {
-	t.walkTree(t.Root, []byte{}, hitFunc)
+	t.walkTree(t.Root, []byte{}, func(key []byte, value []byte) bool {
+		hitFunc(key, value)
+		return true
+	})
 }
-func (t *RadixTree) walkTree(parent *Node, key []byte, hitFunc func(key []byte, value []byte)) {
+
+// walkTree visits the subtree of parent in key order until hitFunc returns false
+func (t *RadixTree) walkTree(parent *Node, key []byte, hitFunc func(key []byte, value []byte) bool) bool {
 	if len(parent.Value) > 0 {
-		key = append(key, parent.Value...)
+		// the three index slice keeps siblings from sharing the backing array
+		key = append(key[:len(key):len(key)], parent.Value...)
+	}
+	if parent.Data != nil && !hitFunc(key, parent.Data) {
+		return false
 	}
-	if parent.Data != nil {
-		hitFunc(key, parent.Data)
+	for _, child := range parent.Children {
+		if !t.walkTree(child, key, hitFunc) {
+			return false
+		}
 	}
-	if !parent.IsLeaf() {
+	return true
+}
+
+// WalkPrefix calls hitFunc in key order for the keys starting with prefix until it returns false
+func (t *RadixTree) WalkPrefix(prefix []byte, hitFunc func(key []byte, value []byte) bool) {
+	parent := t.Root
+	key := []byte{}
+	for len(prefix) > 0 {
+		var targetNode *Node
 		for _, child := range parent.Children {
-			t.walkTree(child, key, hitFunc)
+			if utils.IsPrefix(child.Value, prefix) || utils.IsPrefix(prefix, child.Value) {
+				targetNode = child
+				break
+			}
+		}
+		if targetNode == nil {
+			return
+		}
+		if len(targetNode.Value) >= len(prefix) {
+			// the prefix ends inside this node, its whole subtree matches
+			t.walkTree(targetNode, key, hitFunc)
+			return
+		}
+		key = append(key, targetNode.Value...)
+		prefix = prefix[len(targetNode.Value):]
+		parent = targetNode
+	}
+	t.walkTree(parent, key[:len(key)-len(parent.Value)], hitFunc)
+}
+
+// WalkMatch calls hitFunc in key order for the keys matching the glob pattern, see
+// utils.GlobMatch. The literal head of the pattern limits the walk to its subtree.
+func (t *RadixTree) WalkMatch(pattern string, hitFunc func(key []byte, value []byte) bool) {
+	t.WalkPrefix([]byte(utils.GlobPrefix(pattern)), func(key []byte, value []byte) bool {
+		if !utils.GlobMatch(pattern, string(key)) {
+			return true
+		}
+		return hitFunc(key, value)
+	})
+}
+
+// WalkRange calls hitFunc in key order for the keys in [start, end) until it returns
+// false, an empty end has no upper bound
+func (t *RadixTree) WalkRange(start []byte, end []byte, hitFunc func(key []byte, value []byte) bool) {
+	t.walkRange(t.Root, []byte{}, start, end, hitFunc)
+}
+
+func (t *RadixTree) walkRange(parent *Node, key []byte, start []byte, end []byte, hitFunc func(key []byte, value []byte) bool) bool {
+	if len(parent.Value) > 0 {
+		key = append(key[:len(key):len(key)], parent.Value...)
+	}
+	if len(end) > 0 && bytes.Compare(key, end) >= 0 {
+		// every key below starts with key, so the rest of the walk is past end
+		return false
+	}
+	if bytes.Compare(key, start) < 0 && !bytes.HasPrefix(start, key) {
+		// key differs from start at a smaller byte, the whole subtree is before start
+		return true
+	}
+	if parent.Data != nil && bytes.Compare(key, start) >= 0 && !hitFunc(key, parent.Data) {
+		return false
+	}
+	for _, child := range parent.Children {
+		if !t.walkRange(child, key, start, end, hitFunc) {
+			return false
 		}
 	}
+	return true
 }
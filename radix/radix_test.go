@@ -91,3 +91,121 @@ func TestRewrite(t *testing.T) {
 		t.Fatal("rewrite failed")
 	}
 }
+
+func TestRadixTree_SetPrefixOfExisting(t *testing.T) {
+	tree := NewTree()
+	tree.Set([]byte("foo2"), []byte("bar2"))
+	tree.Set([]byte("foo"), []byte("bar"))
+	tree.Set([]byte("fo"), []byte("ba"))
+	for key, expect := range map[string]string{"foo2": "bar2", "foo": "bar", "fo": "ba"} {
+		val, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, []byte(expect)) {
+			t.Fatalf("expect %s=%s got %s", key, expect, val)
+		}
+	}
+	if val, _ := tree.Get([]byte("f")); val != nil {
+		t.Fatalf("expect no value for f got %s", val)
+	}
+}
+
+func collectKeys(walk func(hitFunc func(key []byte, value []byte) bool)) []string {
+	keys := make([]string, 0)
+	walk(func(key []byte, _ []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	return keys
+}
+
+func newOrderTestTree() *RadixTree {
+	tree := NewTree()
+	for _, key := range []string{"user:2", "user:10", "session:a", "user:1", "user", "users", "admin", "user:1:name"} {
+		tree.Set([]byte(key), []byte("v"))
+	}
+	return tree
+}
+
+func TestRadixTree_WalkOrder(t *testing.T) {
+	tree := newOrderTestTree()
+	keys := make([]string, 0)
+	tree.Walk(func(key []byte, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	expect := "[admin session:a user user:1 user:10 user:1:name user:2 users]"
+	if fmt.Sprint(keys) != expect {
+		t.Fatalf("expect %s got %v", expect, keys)
+	}
+}
+
+func TestRadixTree_WalkPrefix(t *testing.T) {
+	tree := newOrderTestTree()
+	cases := map[string]string{
+		"":        "[admin session:a user user:1 user:10 user:1:name user:2 users]",
+		"user:1":  "[user:1 user:10 user:1:name]",
+		"use":     "[user user:1 user:10 user:1:name user:2 users]",
+		"user:":   "[user:1 user:10 user:1:name user:2]",
+		"missing": "[]",
+		"user:3":  "[]",
+	}
+	for prefix, expect := range cases {
+		keys := collectKeys(func(hitFunc func(key []byte, value []byte) bool) {
+			tree.WalkPrefix([]byte(prefix), hitFunc)
+		})
+		if fmt.Sprint(keys) != expect {
+			t.Fatalf("prefix %q expect %s got %v", prefix, expect, keys)
+		}
+	}
+	keys := collectKeys(func(hitFunc func(key []byte, value []byte) bool) {
+		tree.WalkMatch("user:?", hitFunc)
+	})
+	if fmt.Sprint(keys) != "[user:1 user:2]" {
+		t.Fatalf("expect [user:1 user:2] got %v", keys)
+	}
+}
+
+func TestRadixTree_WalkRange(t *testing.T) {
+	tree := newOrderTestTree()
+	cases := []struct {
+		start  string
+		end    string
+		expect string
+	}{
+		{"", "", "[admin session:a user user:1 user:10 user:1:name user:2 users]"},
+		{"session", "user:1:", "[session:a user user:1 user:10]"},
+		{"user:1", "user:2", "[user:1 user:10 user:1:name]"},
+		{"user:11", "", "[user:1:name user:2 users]"},
+		{"v", "", "[]"},
+	}
+	for _, c := range cases {
+		keys := collectKeys(func(hitFunc func(key []byte, value []byte) bool) {
+			tree.WalkRange([]byte(c.start), []byte(c.end), hitFunc)
+		})
+		if fmt.Sprint(keys) != c.expect {
+			t.Fatalf("range [%q, %q) expect %s got %v", c.start, c.end, c.expect, keys)
+		}
+	}
+}
+
+func TestRadixTree_DeletePrunes(t *testing.T) {
+	tree := newOrderTestTree()
+	for _, key := range []string{"user:1:name", "user:10", "user:1", "missing", "user:3"} {
+		if err := tree.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := collectKeys(func(hitFunc func(key []byte, value []byte) bool) {
+		tree.WalkPrefix(nil, hitFunc)
+	})
+	if fmt.Sprint(keys) != "[admin session:a user user:2 users]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	for _, key := range []string{"admin", "session:a", "user", "user:2", "users"} {
+		tree.Delete([]byte(key))
+	}
+	if len(tree.Root.Children) != 0 {
+		t.Fatalf("expect an empty root got %d children", len(tree.Root.Children))
+	}
+}
@@ -0,0 +1,299 @@
+package polarisdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RESP protocol versions
+const (
+	RespProtocol2 = 2
+	RespProtocol3 = 3
+)
+
+var (
+	maxRespBulkLen  int64 = 512 * 1024 * 1024 // 512MB
+	maxRespArrayLen int64 = 1024 * 1024
+)
+
+const (
+	// bulk strings up to this size are allocated up front, larger ones grow as their bytes arrive
+	respBulkChunk = 64 * 1024
+	// arguments allocated up front, a longer array grows as its elements arrive
+	respPreallocArgs = 1024
+)
+
+var ErrRespProtocol = errors.New("protocol error")
+
+// RespReader reads client requests, either RESP arrays of bulk strings or inline commands.
+type RespReader struct {
+	rd *bufio.Reader
+}
+
+func NewRespReader(rd io.Reader) *RespReader {
+	return &RespReader{rd: bufio.NewReader(rd)}
+}
+
+// Buffered returns the number of bytes that can be read without touching the connection.
+func (r *RespReader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+func (r *RespReader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrRespProtocol
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		// inline commands may be terminated with \n only
+		return line[:len(line)-1], nil
+	}
+	return line[:len(line)-2], nil
+}
+
+func (r *RespReader) readInt(prefix byte) (int64, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != prefix {
+		return 0, ErrRespProtocol
+	}
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil {
+		return 0, ErrRespProtocol
+	}
+	return n, nil
+}
+
+// ReadCommand returns the next command with its arguments, the first element is the command name.
+func (r *RespReader) ReadCommand() ([]string, error) {
+	first, err := r.rd.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '*' {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(string(line)), nil
+	}
+	count, err := r.readInt('*')
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 || count > maxRespArrayLen {
+		return nil, ErrRespProtocol
+	}
+	// the headers are not trusted with an allocation, a client has to send the bytes
+	args := make([]string, 0, minInt64(count, respPreallocArgs))
+	for i := int64(0); i < count; i++ {
+		size, err := r.readInt('$')
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 || size > maxRespBulkLen {
+			return nil, ErrRespProtocol
+		}
+		arg, err := r.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads the size bytes of a bulk string and the CRLF after them
+func (r *RespReader) readBulk(size int64) (string, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(minInt64(size, respBulkChunk)))
+	if _, err := io.CopyN(&buf, r.rd, size); err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(r.rd, crlf); err != nil {
+		return "", err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return "", ErrRespProtocol
+	}
+	return buf.String(), nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// RespWriter encodes replies for the negotiated protocol version.
+// RESP3 only types fall back to their RESP2 equivalent when Protocol is 2.
+type RespWriter struct {
+	wr       *bufio.Writer
+	Protocol int
+}
+
+func NewRespWriter(wr io.Writer) *RespWriter {
+	return &RespWriter{wr: bufio.NewWriter(wr), Protocol: RespProtocol2}
+}
+
+func (w *RespWriter) Flush() error {
+	return w.wr.Flush()
+}
+
+func (w *RespWriter) writeHeader(prefix byte, n int64) {
+	w.wr.WriteByte(prefix)
+	w.wr.WriteString(strconv.FormatInt(n, 10))
+	w.wr.WriteString("\r\n")
+}
+
+func (w *RespWriter) WriteStatus(status string) {
+	w.wr.WriteByte('+')
+	w.wr.WriteString(status)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *RespWriter) WriteError(msg string) {
+	w.wr.WriteByte('-')
+	w.wr.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+	w.wr.WriteString("\r\n")
+}
+
+func (w *RespWriter) WriteInt(n int64) {
+	w.writeHeader(':', n)
+}
+
+func (w *RespWriter) WriteBulk(data string) {
+	w.writeHeader('$', int64(len(data)))
+	w.wr.WriteString(data)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *RespWriter) WriteNull() {
+	if w.Protocol == RespProtocol3 {
+		w.wr.WriteString("_\r\n")
+		return
+	}
+	w.wr.WriteString("$-1\r\n")
+}
+
+func (w *RespWriter) WriteNullArray() {
+	if w.Protocol == RespProtocol3 {
+		w.wr.WriteString("_\r\n")
+		return
+	}
+	w.wr.WriteString("*-1\r\n")
+}
+
+func (w *RespWriter) WriteDouble(f float64) {
+	var str string
+	switch {
+	case math.IsInf(f, 1):
+		str = "inf"
+	case math.IsInf(f, -1):
+		str = "-inf"
+	default:
+		str = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if w.Protocol == RespProtocol3 {
+		w.wr.WriteByte(',')
+		w.wr.WriteString(str)
+		w.wr.WriteString("\r\n")
+		return
+	}
+	w.WriteBulk(str)
+}
+
+func (w *RespWriter) WriteArrayHeader(n int) {
+	w.writeHeader('*', int64(n))
+}
+
+func (w *RespWriter) WriteSetHeader(n int) {
+	if w.Protocol == RespProtocol3 {
+		w.writeHeader('~', int64(n))
+		return
+	}
+	w.writeHeader('*', int64(n))
+}
+
+// WriteMapHeader writes the header of a map with n key value pairs
+func (w *RespWriter) WriteMapHeader(n int) {
+	if w.Protocol == RespProtocol3 {
+		w.writeHeader('%', int64(n))
+		return
+	}
+	w.writeHeader('*', int64(n*2))
+}
+
+func (w *RespWriter) WritePushHeader(n int) {
+	if w.Protocol == RespProtocol3 {
+		w.writeHeader('>', int64(n))
+		return
+	}
+	w.writeHeader('*', int64(n))
+}
+
+// WriteReply encodes a command reply value, see command.go for the reply types.
+func (w *RespWriter) WriteReply(reply interface{}) {
+	switch val := reply.(type) {
+	case nil:
+		w.WriteNull()
+	case StatusReply:
+		w.WriteStatus(string(val))
+	case error:
+		w.WriteError(val.Error())
+	case string:
+		w.WriteBulk(val)
+	case []byte:
+		w.WriteBulk(string(val))
+	case int:
+		w.WriteInt(int64(val))
+	case int64:
+		w.WriteInt(val)
+	case bool:
+		if val {
+			w.WriteInt(1)
+		} else {
+			w.WriteInt(0)
+		}
+	case float64:
+		w.WriteDouble(val)
+	case []string:
+		w.WriteArrayHeader(len(val))
+		for _, item := range val {
+			w.WriteBulk(item)
+		}
+	case []interface{}:
+		w.WriteArrayHeader(len(val))
+		for _, item := range val {
+			w.WriteReply(item)
+		}
+	case SetReply:
+		w.WriteSetHeader(len(val))
+		for _, item := range val {
+			w.WriteReply(item)
+		}
+	case MapReply:
+		w.WriteMapHeader(len(val) / 2)
+		for _, item := range val {
+			w.WriteReply(item)
+		}
+	default:
+		w.WriteBulk(fmt.Sprintf("%v", val))
+	}
+}
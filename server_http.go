@@ -1,24 +1,34 @@
 package polarisdb
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/allentom/haruka"
 	"github.com/projectxpolaris/polarisdb/utils"
+	"net"
+	"net/http"
 	"time"
 )
 
 type HttpServer struct {
 	Database *PolarisDB
 	Api      *haruka.Engine
+	server   *http.Server
+	listener net.Listener
+	// closed when the server shuts down, streaming responses end then
+	closing chan struct{}
 }
 
 func NewHttpServer(Database *PolarisDB) *HttpServer {
 	api := haruka.NewEngine()
-
-	return &HttpServer{
+	server := &HttpServer{
 		Database: Database,
 		Api:      api,
+		closing:  make(chan struct{}),
 	}
+	server.InitHandler()
+	return server
 }
 
 type StringRequestBody struct {
@@ -69,12 +79,374 @@ type ZSetRequestBody struct {
 	Stop      int        `json:"stop"`
 	WithScore bool       `json:"withScore"`
 }
+type KeyRequestBody struct {
+	Key     string   `json:"key"`
+	Keys    []string `json:"keys"`
+	NewKey  string   `json:"newKey"`
+	Replace bool     `json:"replace"`
+}
+type MoveRequestBody struct {
+	Key string `json:"key"`
+	DB  int    `json:"db"`
+}
+type SwapDBRequestBody struct {
+	First  int `json:"first"`
+	Second int `json:"second"`
+}
+type KeysRequestBody struct {
+	Pattern string `json:"pattern"`
+}
+
+type ScanRequestBody struct {
+	Key    string `json:"key"`
+	Cursor uint64 `json:"cursor"`
+	Match  string `json:"match"`
+	Count  int    `json:"count"`
+	Type   string `json:"type"`
+}
+
+func (b *ScanRequestBody) options() ScanOptions {
+	return ScanOptions{Match: b.Match, Count: b.Count, Type: b.Type}
+}
+
+// keyList returns Keys together with Key when it is set
+func (b *KeyRequestBody) keyList() []string {
+	if b.Key == "" {
+		return b.Keys
+	}
+	return append(b.Keys, b.Key)
+}
+
 type RequestBody struct {
 	Key    string `json:"key"`
 	Expire int64  `json:"expire"`
 }
+type ExpireRequestBody struct {
+	Key    string `json:"key"`
+	Expire int64  `json:"expire"`
+	AT     int64  `json:"at"`
+	NX     bool   `json:"nx"`
+	XX     bool   `json:"xx"`
+	GT     bool   `json:"gt"`
+	LT     bool   `json:"lt"`
+}
+
+func (b *ExpireRequestBody) options() ExpireOptions {
+	return ExpireOptions{NX: b.NX, XX: b.XX, GT: b.GT, LT: b.LT}
+}
+
+type BatchRequestBody struct {
+	Commands []BatchCommand `json:"commands"`
+}
+type WatchRequestBody struct {
+	Keys []string `json:"keys"`
+}
+
+// ExecRequestBody runs the commands atomically, Watch is the output of /watch
+type ExecRequestBody struct {
+	Watch    []WatchedKey   `json:"watch"`
+	Commands []BatchCommand `json:"commands"`
+}
+
+// requestDB returns the database a request works on, chosen with the db query parameter
+func requestDB(context *haruka.Context) (int, error) {
+	value := context.GetQueryString("db")
+	if value == "" {
+		return 0, nil
+	}
+	return parseDBIndex(value)
+}
+
+// update runs trf in a write transaction on the database of the request
+func (server *HttpServer) update(context *haruka.Context, trf func(tx *TX) error) error {
+	index, err := requestDB(context)
+	if err != nil {
+		return err
+	}
+	return server.Database.Update(func(tx *TX) error {
+		if err := tx.Select(index); err != nil {
+			return err
+		}
+		return trf(tx)
+	})
+}
+
+// view runs trf in a read transaction on the database of the request
+func (server *HttpServer) view(context *haruka.Context, trf func(tx *TX) error) error {
+	index, err := requestDB(context)
+	if err != nil {
+		return err
+	}
+	return server.Database.View(func(tx *TX) error {
+		if err := tx.Select(index); err != nil {
+			return err
+		}
+		return trf(tx)
+	})
+}
 
 func (server *HttpServer) InitHandler() {
+	server.Api.Router.POST("/action/del", func(context *haruka.Context) {
+		var err error
+		var requestBody KeyRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var count int
+		err = server.update(context, func(tx *TX) error {
+			count, err = tx.Del(requestBody.keyList()...)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, count)
+	})
+	server.Api.Router.POST("/action/unlink", func(context *haruka.Context) {
+		var err error
+		var requestBody KeyRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var count int
+		err = server.update(context, func(tx *TX) error {
+			count, err = tx.Unlink(requestBody.keyList()...)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, count)
+	})
+	server.Api.Router.POST("/action/exists", func(context *haruka.Context) {
+		var err error
+		var requestBody KeyRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var count int
+		err = server.view(context, func(tx *TX) error {
+			count, err = tx.ExistsCount(requestBody.keyList()...)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, count)
+	})
+	server.Api.Router.POST("/action/type", func(context *haruka.Context) {
+		var err error
+		var requestBody KeyRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var keyType string
+		err = server.view(context, func(tx *TX) error {
+			keyType, err = tx.Type(requestBody.Key)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, keyType)
+	})
+	server.Api.Router.POST("/action/rename", func(context *haruka.Context) {
+		var err error
+		var requestBody KeyRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		err = server.update(context, func(tx *TX) error {
+			return tx.Rename(requestBody.Key, requestBody.NewKey)
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, nil)
+	})
+	server.Api.Router.POST("/action/renamenx", func(context *haruka.Context) {
+		var err error
+		var requestBody KeyRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var renamed bool
+		err = server.update(context, func(tx *TX) error {
+			renamed, err = tx.RenameNX(requestBody.Key, requestBody.NewKey)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, renamed)
+	})
+	server.Api.Router.POST("/action/copy", func(context *haruka.Context) {
+		var err error
+		var requestBody KeyRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var copied bool
+		err = server.update(context, func(tx *TX) error {
+			copied, err = tx.Copy(requestBody.Key, requestBody.NewKey, requestBody.Replace)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, copied)
+	})
+	server.Api.Router.POST("/action/move", func(context *haruka.Context) {
+		var err error
+		var requestBody MoveRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var moved bool
+		err = server.update(context, func(tx *TX) error {
+			moved, err = tx.Move(requestBody.Key, requestBody.DB)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, moved)
+	})
+	server.Api.Router.POST("/action/swapdb", func(context *haruka.Context) {
+		var requestBody SwapDBRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		err := server.Database.Update(func(tx *TX) error {
+			return tx.SwapDB(requestBody.First, requestBody.Second)
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, nil)
+	})
+	server.Api.Router.POST("/action/flushdb", func(context *haruka.Context) {
+		err := server.update(context, func(tx *TX) error {
+			return tx.FlushDB()
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, nil)
+	})
+	server.Api.Router.POST("/action/flushall", func(context *haruka.Context) {
+		err := server.Database.Update(func(tx *TX) error {
+			return tx.FlushAll()
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, nil)
+	})
+	server.Api.Router.POST("/action/keys", func(context *haruka.Context) {
+		var err error
+		var requestBody KeysRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var keys []string
+		err = server.view(context, func(tx *TX) error {
+			keys, err = tx.Keys(requestBody.Pattern)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, keys)
+	})
+	server.Api.Router.POST("/action/scan", func(context *haruka.Context) {
+		var err error
+		var requestBody ScanRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var cursor uint64
+		var keys []string
+		err = server.view(context, func(tx *TX) error {
+			cursor, keys, err = tx.Scan(requestBody.Cursor, requestBody.options())
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, haruka.JSON{"cursor": cursor, "keys": keys})
+	})
+	server.Api.Router.POST("/action/hscan", func(context *haruka.Context) {
+		var err error
+		var requestBody ScanRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var cursor uint64
+		var pairs []interface{}
+		err = server.view(context, func(tx *TX) error {
+			cursor, pairs, err = tx.HScan(requestBody.Key, requestBody.Cursor, requestBody.options())
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		fields := make(map[string]interface{}, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			fields[utils.ToString(pairs[i])] = pairs[i+1]
+		}
+		MakeSuccessResponse(context, haruka.JSON{"cursor": cursor, "fields": fields})
+	})
+	server.Api.Router.POST("/action/sscan", func(context *haruka.Context) {
+		var err error
+		var requestBody ScanRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var cursor uint64
+		var members []interface{}
+		err = server.view(context, func(tx *TX) error {
+			cursor, members, err = tx.SScan(requestBody.Key, requestBody.Cursor, requestBody.options())
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, haruka.JSON{"cursor": cursor, "members": toStrings(members)})
+	})
+	server.Api.Router.POST("/action/zscan", func(context *haruka.Context) {
+		var err error
+		var requestBody ScanRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var cursor uint64
+		var pairs []ZsetPair
+		err = server.view(context, func(tx *TX) error {
+			cursor, pairs, err = tx.ZScan(requestBody.Key, requestBody.Cursor, requestBody.options())
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, haruka.JSON{"cursor": cursor, "pairs": pairs})
+	})
 	server.Api.Router.POST("/action/get", func(context *haruka.Context) {
 		var err error
 		var requestBody StringRequestBody
@@ -82,7 +454,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value string
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.Get(requestBody.Key)
 			if err != nil {
 				return err
@@ -101,14 +473,14 @@ func (server *HttpServer) InitHandler() {
 		if !ParseJSONOrErrorResponse(context, &requestBody) {
 			return
 		}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			if requestBody.NX {
 				isExist, err := tx.Exists(requestBody.Key)
 				if err != nil {
 					return err
 				}
 				if isExist {
-					return errors.New("key already exist")
+					return ErrKeyExists
 				}
 			}
 			if requestBody.XX {
@@ -117,7 +489,7 @@ func (server *HttpServer) InitHandler() {
 					return err
 				}
 				if !isExist {
-					return errors.New("key not exist")
+					return ErrKeyNotFound
 				}
 			}
 			err = tx.SetString(requestBody.Key, requestBody.Value, requestBody.KeepTTL)
@@ -154,22 +526,122 @@ func (server *HttpServer) InitHandler() {
 	})
 	server.Api.Router.POST("/action/expire", func(context *haruka.Context) {
 		var err error
-		var requestBody RequestBody
+		var requestBody ExpireRequestBody
 		if !ParseJSONOrErrorResponse(context, &requestBody) {
 			return
 		}
-		err = server.Database.Update(func(tx *TX) error {
-			err = tx.SetExpire(requestBody.Key, requestBody.Expire)
-			if err != nil {
-				return err
-			}
-			return nil
+		var set bool
+		err = server.update(context, func(tx *TX) error {
+			set, err = tx.Expire(requestBody.Key, requestBody.Expire, requestBody.options())
+			return err
 		})
 		if err != nil {
 			RaiseErrorResponse(err, context)
 			return
 		}
-		MakeSuccessResponse(context, nil)
+		MakeSuccessResponse(context, set)
+	})
+	server.Api.Router.POST("/action/expireat", func(context *haruka.Context) {
+		var err error
+		var requestBody ExpireRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var set bool
+		err = server.update(context, func(tx *TX) error {
+			set, err = tx.ExpireAt(requestBody.Key, requestBody.AT, requestBody.options())
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, set)
+	})
+	server.Api.Router.POST("/action/persist", func(context *haruka.Context) {
+		var err error
+		var requestBody ExpireRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var removed bool
+		err = server.update(context, func(tx *TX) error {
+			removed, err = tx.Persist(requestBody.Key)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, removed)
+	})
+	server.Api.Router.POST("/action/ttl", func(context *haruka.Context) {
+		var err error
+		var requestBody ExpireRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var value int64
+		err = server.view(context, func(tx *TX) error {
+			value, err = tx.TTL(requestBody.Key)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, value)
+	})
+	server.Api.Router.POST("/action/pttl", func(context *haruka.Context) {
+		var err error
+		var requestBody ExpireRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var value int64
+		err = server.view(context, func(tx *TX) error {
+			value, err = tx.PTTL(requestBody.Key)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, value)
+	})
+	server.Api.Router.POST("/action/expiretime", func(context *haruka.Context) {
+		var err error
+		var requestBody ExpireRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var value int64
+		err = server.view(context, func(tx *TX) error {
+			value, err = tx.ExpireTimeSeconds(requestBody.Key)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, value)
+	})
+	server.Api.Router.POST("/action/pexpiretime", func(context *haruka.Context) {
+		var err error
+		var requestBody ExpireRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		var value int64
+		err = server.view(context, func(tx *TX) error {
+			value, err = tx.ExpireTime(requestBody.Key)
+			return err
+		})
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, value)
 	})
 	server.Api.Router.POST("/action/append", func(context *haruka.Context) {
 		var err error
@@ -177,7 +649,7 @@ func (server *HttpServer) InitHandler() {
 		if !ParseJSONOrErrorResponse(context, &requestBody) {
 			return
 		}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 
 			err = tx.Append(requestBody.Key, requestBody.Value)
 			if err != nil {
@@ -198,7 +670,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int64
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.Decr(requestBody.Key)
 			if err != nil {
 				return err
@@ -218,7 +690,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int64
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.DecrBy(requestBody.Key, requestBody.NumVal)
 			if err != nil {
 				return err
@@ -238,7 +710,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int64
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.Incr(requestBody.Key)
 			if err != nil {
 				return err
@@ -258,7 +730,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int64
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.IncrBy(requestBody.Key, requestBody.NumVal)
 			if err != nil {
 				return err
@@ -278,7 +750,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.GetDel(requestBody.Key)
 			if err != nil {
 				return err
@@ -298,7 +770,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.GetEx(requestBody.Key, requestBody.Expire)
 			if err != nil {
 				return err
@@ -318,7 +790,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.GetRange(requestBody.Key, requestBody.Start, requestBody.End)
 			if err != nil {
 				return err
@@ -338,7 +810,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var values []string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			values, err = tx.MGet(requestBody.Keys...)
 			if err != nil {
 				return err
@@ -358,7 +830,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.HGet(requestBody.Key, requestBody.Field)
 			if err != nil {
 				return err
@@ -378,7 +850,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			pairs := make([]Paris, 0)
 			for k, s := range requestBody.Pairs {
 				pairs = append(pairs, Paris{Field: []byte(k), Value: []byte(s)})
@@ -402,7 +874,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.HDel(requestBody.Key, requestBody.Field)
 			if err != nil {
 				return err
@@ -422,7 +894,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value map[string]string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.HGetAll(requestBody.Key)
 			if err != nil {
 				return err
@@ -442,7 +914,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.HKeys(requestBody.Key)
 			if err != nil {
 				return err
@@ -462,7 +934,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []string
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.HVals(requestBody.Key)
 			if err != nil {
 				return err
@@ -482,7 +954,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value bool
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.HExists(requestBody.Key, requestBody.Field)
 			if err != nil {
 				return err
@@ -502,7 +974,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int64
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.HLen(requestBody.Key)
 			if err != nil {
 				return err
@@ -522,7 +994,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.HIncrBy(requestBody.Key, requestBody.Field, requestBody.Num)
 			if err != nil {
 				return err
@@ -542,7 +1014,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			rawVal := make([][]byte, len(requestBody.Values))
 			for i, v := range requestBody.Values {
 				rawVal[i] = []byte(v)
@@ -566,7 +1038,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value [][]byte
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.LPop(requestBody.Key, requestBody.Count)
 			if err != nil {
 				return err
@@ -590,7 +1062,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []byte
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.LIndex(requestBody.Key, requestBody.Index)
 			if err != nil {
 				return err
@@ -610,7 +1082,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.LLen(requestBody.Key)
 			if err != nil {
 				return err
@@ -629,7 +1101,7 @@ func (server *HttpServer) InitHandler() {
 		if !ParseJSONOrErrorResponse(context, &requestBody) {
 			return
 		}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			if requestBody.Pivot == "AFTER" {
 				requestBody.Index += 1
 			}
@@ -652,7 +1124,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value [][]byte
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.LRange(requestBody.Key, requestBody.Start, requestBody.End)
 			if err != nil {
 				return err
@@ -676,7 +1148,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			rawValues := make([]interface{}, 0)
 			for _, v := range requestBody.Values {
 				rawValues = append(rawValues, v)
@@ -700,7 +1172,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			rawValues := make([]interface{}, 0)
 			for _, v := range requestBody.Values {
 				rawValues = append(rawValues, v)
@@ -724,7 +1196,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.SDiff(requestBody.Key, requestBody.Values...)
 			if err != nil {
 				return err
@@ -748,7 +1220,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			keys := append([]string{requestBody.Key}, requestBody.Values...)
 			value, err = tx.SInter(keys...)
 			if err != nil {
@@ -773,7 +1245,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			keys := append([]string{requestBody.Key}, requestBody.Values...)
 			value, err = tx.SUnion(keys...)
 			if err != nil {
@@ -798,7 +1270,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value bool
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.SIsMember(requestBody.Key, requestBody.Value)
 			if err != nil {
 				return err
@@ -818,7 +1290,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []bool
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			rawValues := make([]interface{}, 0)
 			for _, v := range requestBody.Values {
 				rawValues = append(rawValues, v)
@@ -842,7 +1314,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.SCard(requestBody.Key)
 			if err != nil {
 				return err
@@ -862,7 +1334,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.SMembers(requestBody.Key)
 			if err != nil {
 				return err
@@ -886,7 +1358,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.SPop(requestBody.Key, requestBody.Count)
 			if err != nil {
 				return err
@@ -911,7 +1383,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.SRandMember(requestBody.Key, requestBody.Count)
 			if err != nil {
 				return err
@@ -935,7 +1407,7 @@ func (server *HttpServer) InitHandler() {
 		if !ParseJSONOrErrorResponse(context, &requestBody) {
 			return
 		}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.ZAdd(requestBody.Key, requestBody.Pairs...)
 			if err != nil {
 				return err
@@ -954,7 +1426,7 @@ func (server *HttpServer) InitHandler() {
 		if !ParseJSONOrErrorResponse(context, &requestBody) {
 			return
 		}
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			err = tx.ZRem(requestBody.Key, requestBody.Members...)
 			if err != nil {
 				return err
@@ -974,7 +1446,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.ZCard(requestBody.Key)
 			if err != nil {
 				return err
@@ -994,7 +1466,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value float64
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.ZScore(requestBody.Key, requestBody.Member)
 			if err != nil {
 				return err
@@ -1014,7 +1486,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []float64
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			for _, member := range requestBody.Members {
 				score, err := tx.ZScore(requestBody.Key, member)
 				if err != nil {
@@ -1037,7 +1509,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.ZDiff(requestBody.Key, requestBody.Others...)
 			if err != nil {
 				return err
@@ -1061,7 +1533,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.ZDiffStore(requestBody.StoreKey, requestBody.Key, requestBody.Others...)
 			if err != nil {
 				return err
@@ -1081,7 +1553,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.ZDiffCard(requestBody.Key, requestBody.Others...)
 			if err != nil {
 				return err
@@ -1101,7 +1573,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.ZInter(requestBody.Others...)
 			if err != nil {
 				return err
@@ -1125,7 +1597,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.ZInterStore(requestBody.StoreKey, requestBody.Others...)
 			if err != nil {
 				return err
@@ -1145,7 +1617,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.ZInterCard(requestBody.Others...)
 			if err != nil {
 				return err
@@ -1165,7 +1637,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.ZUnion(requestBody.Others...)
 			if err != nil {
 				return err
@@ -1189,7 +1661,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.Update(func(tx *TX) error {
+		err = server.update(context, func(tx *TX) error {
 			value, err = tx.ZUnionStore(requestBody.StoreKey, requestBody.Others...)
 			if err != nil {
 				return err
@@ -1209,7 +1681,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value int
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			value, err = tx.ZUnionCard(requestBody.Others...)
 			if err != nil {
 				return err
@@ -1229,7 +1701,7 @@ func (server *HttpServer) InitHandler() {
 			return
 		}
 		var value []interface{}
-		err = server.Database.View(func(tx *TX) error {
+		err = server.view(context, func(tx *TX) error {
 			if requestBody.WithScore {
 				value, err = tx.ZRangeWithScores(requestBody.Key, requestBody.Start, requestBody.Stop)
 			} else {
@@ -1253,24 +1725,143 @@ func (server *HttpServer) InitHandler() {
 	server.Api.Router.POST("/action/ping", func(context *haruka.Context) {
 		MakeSuccessResponse(context, nil)
 	})
-
+	server.Api.Router.POST("/command", func(context *haruka.Context) {
+		var requestBody BatchCommand
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		index, err := requestDB(context)
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		value, err := server.Database.ExecDB(index, requestBody.Command, requestBody.Args...)
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, value)
+	})
+	server.Api.Router.POST("/batch", func(context *haruka.Context) {
+		var requestBody BatchRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		index, err := requestDB(context)
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		results := server.Database.ExecBatchDB(index, requestBody.Commands)
+		MakeSuccessResponse(context, batchResultsJSON(results))
+	})
+	server.Api.Router.POST("/watch", func(context *haruka.Context) {
+		var requestBody WatchRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		index, err := requestDB(context)
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		watched, err := server.Database.WatchDB(index, requestBody.Keys...)
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, watched)
+	})
+	server.Api.Router.POST("/exec", func(context *haruka.Context) {
+		var requestBody ExecRequestBody
+		if !ParseJSONOrErrorResponse(context, &requestBody) {
+			return
+		}
+		index, err := requestDB(context)
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		results, err := server.Database.ExecMultiDB(index, requestBody.Watch, requestBody.Commands)
+		if errors.Is(err, ErrWatchedKeyChanged) {
+			// like EXEC over resp an aborted transaction is a null reply, not an error
+			MakeSuccessResponse(context, nil)
+			return
+		}
+		if err != nil {
+			RaiseErrorResponse(err, context)
+			return
+		}
+		MakeSuccessResponse(context, batchResultsJSON(results))
+	})
+	server.Api.Router.GET("/notifications", server.handleNotifications)
+	server.Api.Router.POST("/publish", server.handlePublish)
+	server.Api.Router.GET("/subscribe", server.handleSubscribe)
+}
+func batchResultsJSON(results []BatchResult) []haruka.JSON {
+	data := make([]haruka.JSON, 0, len(results))
+	for _, result := range results {
+		if result.Err != nil {
+			code, _ := ErrorCode(result.Err)
+			data = append(data, haruka.JSON{"success": false, "code": code, "error": result.Err.Error()})
+			continue
+		}
+		data = append(data, haruka.JSON{"success": true, "data": result.Reply})
+	}
+	return data
 }
 func (a *HttpServer) run(addr string) error {
-	err := a.Database.Open()
-	if err != nil {
+	if err := a.Listen(addr); err != nil {
 		return err
 	}
-	go a.Api.RunAndListen(addr)
+	return a.Serve()
+}
+
+// Listen opens the listener Serve accepts requests on
+func (a *HttpServer) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	a.listener = listener
+	a.server = &http.Server{
+		Addr:    addr,
+		Handler: a.Api.Router.HandlerRouter,
+		// keep idle connections open so clients can pipeline requests on them
+		IdleTimeout: time.Duration(a.Database.Config.HttpIdleTimeout) * time.Millisecond,
+	}
+	a.server.RegisterOnShutdown(func() {
+		close(a.closing)
+	})
 	return nil
 }
+
+// Serve handles requests until Shutdown
+func (a *HttpServer) Serve() error {
+	err := a.server.Serve(a.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and waits for the ones in flight until ctx is done
+func (a *HttpServer) Shutdown(ctx context.Context) error {
+	if a.server == nil {
+		return nil
+	}
+	err := a.server.Shutdown(ctx)
+	// Serve may not have taken over the listener yet
+	a.listener.Close()
+	return err
+}
 func RaiseErrorResponse(err error, ctx *haruka.Context) {
+	code, status := ErrorCode(err)
 	ctx.JSONWithStatus(haruka.JSON{
 		"success": false,
+		"code":    code,
 		"error":   err.Error(),
-	}, 200)
+	}, status)
 }
 func MakeSuccessResponse(ctx *haruka.Context, data interface{}) {
 	ctx.JSON(haruka.JSON{
@@ -1281,7 +1872,7 @@ func MakeSuccessResponse(ctx *haruka.Context, data interface{}) {
 func ParseJSONOrErrorResponse(ctx *haruka.Context, data interface{}) bool {
 	err := ctx.ParseJson(data)
 	if err != nil {
-		RaiseErrorResponse(err, ctx)
+		RaiseErrorResponse(fmt.Errorf("%w: %v", ErrInvalidRequest, err), ctx)
 		return false
 	}
 	return true
@@ -0,0 +1,105 @@
+package polarisdb
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrInvalidRequest is the code of a request body that cannot be parsed
+var ErrInvalidRequest = errors.New("invalid request")
+
+// stable error codes of the http responses
+const (
+	CodeKeyNotFound       = "KEY_NOT_FOUND"
+	CodeKeyExists         = "KEY_EXISTS"
+	CodeFieldNotFound     = "FIELD_NOT_FOUND"
+	CodeListEmpty         = "LIST_EMPTY"
+	CodeWrongType         = "WRONGTYPE"
+	CodeNotInteger        = "NOT_INTEGER"
+	CodeNotFloat          = "NOT_FLOAT"
+	CodeOutOfRange        = "OUT_OF_RANGE"
+	CodeInvalidDBIndex    = "INVALID_DB_INDEX"
+	CodeReadOnly          = "READ_ONLY"
+	CodeSyntax            = "SYNTAX"
+	CodeWrongArgCount     = "WRONG_ARG_COUNT"
+	CodeUnknownCommand    = "UNKNOWN_COMMAND"
+	CodeInvalidRequest    = "INVALID_REQUEST"
+	CodeWatchedKeyChanged = "WATCHED_KEY_CHANGED"
+	CodeExecAbort         = "EXECABORT"
+	CodeBusy              = "BUSY"
+	CodeOOM               = "OOM"
+	CodeSlowSubscriber    = "SLOW_SUBSCRIBER"
+	CodeClosed            = "CLOSED"
+	CodeInternal          = "INTERNAL"
+)
+
+type errorCode struct {
+	err    error
+	code   string
+	status int
+}
+
+// errorCodes maps the sentinel errors to their code and http status, the first match wins
+var errorCodes = []errorCode{
+	{ErrKeyNotFound, CodeKeyNotFound, http.StatusNotFound},
+	{ErrFieldNotFound, CodeFieldNotFound, http.StatusNotFound},
+	{ErrListEmpty, CodeListEmpty, http.StatusNotFound},
+	{ErrKeyExists, CodeKeyExists, http.StatusConflict},
+	{ErrWrongType, CodeWrongType, http.StatusConflict},
+	{ErrNotInteger, CodeNotInteger, http.StatusBadRequest},
+	{ErrNotFloatArg, CodeNotFloat, http.StatusBadRequest},
+	{ErrOutOfRange, CodeOutOfRange, http.StatusBadRequest},
+	{ErrInvalidDBIndex, CodeInvalidDBIndex, http.StatusBadRequest},
+	{ErrReadOnly, CodeReadOnly, http.StatusBadRequest},
+	{ErrSyntax, CodeSyntax, http.StatusBadRequest},
+	{ErrInvalidCursor, CodeSyntax, http.StatusBadRequest},
+	{ErrInvalidExpire, CodeSyntax, http.StatusBadRequest},
+	{ErrExpireNX, CodeSyntax, http.StatusBadRequest},
+	{ErrExpireGTLT, CodeSyntax, http.StatusBadRequest},
+	{ErrSameObjects, CodeSyntax, http.StatusBadRequest},
+	{ErrWrongArgCount, CodeWrongArgCount, http.StatusBadRequest},
+	{ErrUnknownCommand, CodeUnknownCommand, http.StatusBadRequest},
+	{ErrInvalidRequest, CodeInvalidRequest, http.StatusBadRequest},
+	{ErrWatchedKeyChanged, CodeWatchedKeyChanged, http.StatusConflict},
+	{ErrExecAbort, CodeExecAbort, http.StatusBadRequest},
+	{ErrSaveInProgress, CodeBusy, http.StatusConflict},
+	{ErrRewriteInProgress, CodeBusy, http.StatusConflict},
+	{ErrOOM, CodeOOM, http.StatusInsufficientStorage},
+	{ErrSlowSubscriber, CodeSlowSubscriber, http.StatusTooManyRequests},
+	{ErrClosed, CodeClosed, http.StatusServiceUnavailable},
+}
+
+// ErrorCode returns the code and the http status of err, errors without a code are internal
+func ErrorCode(err error) (string, int) {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code, c.status
+		}
+	}
+	return CodeInternal, http.StatusInternalServerError
+}
+
+// CodeError is an error read back from a response, it matches the sentinel of
+// its code with errors.Is
+type CodeError struct {
+	Code    string
+	Message string
+}
+
+func (e *CodeError) Error() string {
+	return e.Message
+}
+
+func (e *CodeError) Is(target error) bool {
+	for _, c := range errorCodes {
+		if c.err == target && c.code == e.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorFromCode turns the code and error of a failed response back into an error
+func ErrorFromCode(code string, message string) error {
+	return &CodeError{Code: code, Message: message}
+}
@@ -0,0 +1,66 @@
+package polarisdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/allentom/haruka"
+)
+
+// startEventStream sends the headers of a server-sent event stream, it answers with
+// an error when the response cannot be streamed
+func startEventStream(context *haruka.Context) (http.Flusher, bool) {
+	flusher, ok := context.Writer.(http.Flusher)
+	if !ok {
+		RaiseErrorResponse(errors.New("streaming is not supported"), context)
+		return nil, false
+	}
+	header := context.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	context.Writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, true
+}
+
+// writeEvent sends data as json in a server-sent event named event
+func writeEvent(context *haruka.Context, flusher http.Flusher, event string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(context.Writer, "event: %s\ndata: %s\n\n", event, raw); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// handleNotifications streams the keyspace events as server-sent events, one json
+// KeyspaceEvent per message, until the client goes away or the server shuts down
+func (server *HttpServer) handleNotifications(context *haruka.Context) {
+	sub := server.Database.SubscribeKeyspace(0)
+	defer sub.Close()
+	flusher, ok := startEventStream(context)
+	if !ok {
+		return
+	}
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := writeEvent(context, flusher, event.Event, event); err != nil {
+				return
+			}
+		case <-context.Request.Context().Done():
+			return
+		case <-server.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package polarisdb
+
+import (
+	"github.com/allentom/haruka"
+)
+
+type PublishRequestBody struct {
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+}
+
+// handlePublish publishes a message and answers with the number of subscribers that received it
+func (server *HttpServer) handlePublish(context *haruka.Context) {
+	var requestBody PublishRequestBody
+	if !ParseJSONOrErrorResponse(context, &requestBody) {
+		return
+	}
+	MakeSuccessResponse(context, server.Database.Publish(requestBody.Channel, requestBody.Message))
+}
+
+// handleSubscribe streams the messages of the channel and pattern query parameters as
+// server-sent events, one json Message per "message" event. A client that falls
+// behind the buffer limit gets an "error" event with the SLOW_SUBSCRIBER code and is
+// disconnected.
+func (server *HttpServer) handleSubscribe(context *haruka.Context) {
+	query := context.Request.URL.Query()
+	channels, patterns := query["channel"], query["pattern"]
+	if len(channels) == 0 && len(patterns) == 0 {
+		RaiseErrorResponse(ErrInvalidRequest, context)
+		return
+	}
+	sub := server.Database.NewSubscription(0)
+	defer sub.Close()
+	sub.Subscribe(channels...)
+	sub.PSubscribe(patterns...)
+	flusher, ok := startEventStream(context)
+	if !ok {
+		return
+	}
+	for {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				if err := sub.Err(); err != nil {
+					code, _ := ErrorCode(err)
+					writeEvent(context, flusher, "error", haruka.JSON{"code": code, "error": err.Error()})
+				}
+				return
+			}
+			if err := writeEvent(context, flusher, "message", msg); err != nil {
+				return
+			}
+		case <-context.Request.Context().Done():
+			return
+		case <-server.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package polarisdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpServer_Pipeline(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	server := httptest.NewServer(NewHttpServer(db).Api.Router.HandlerRouter)
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bodies := []string{
+		`{"command":"set","args":["foo","bar"]}`,
+		`{"command":"get","args":["foo"]}`,
+	}
+	// write both requests before reading any response
+	var payload strings.Builder
+	for _, body := range bodies {
+		req, _ := http.NewRequest("POST", "http://"+server.Listener.Addr().String()+"/command", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Write(&payload)
+	}
+	conn.Write([]byte(payload.String()))
+	reader := bufio.NewReader(conn)
+	expects := []interface{}{"OK", "bar"}
+	for _, expect := range expects {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result["data"] != expect {
+			t.Fatalf("expect %v got %v", expect, result)
+		}
+	}
+}
+
+func TestHttpServer_Batch(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	server := httptest.NewServer(NewHttpServer(db).Api.Router.HandlerRouter)
+	defer server.Close()
+	body := `{"commands":[{"command":"sadd","args":["set","a","b"]},{"command":"scard","args":["set"]},{"command":"hget","args":[]}]}`
+	resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Data []struct {
+			Success bool        `json:"success"`
+			Data    interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Data) != 3 || !result.Data[0].Success || result.Data[1].Data != float64(2) || result.Data[2].Success {
+		t.Fatalf("unexpected batch result %+v", result)
+	}
+}
+
+func TestHttpServer_WrongType(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	server := httptest.NewServer(NewHttpServer(db).Api.Router.HandlerRouter)
+	defer server.Close()
+	db.Exec("set", "foo", "bar")
+	resp, err := http.Post(server.URL+"/command", "application/json", strings.NewReader(`{"command":"hget","args":["foo","f"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusConflict || result["success"] != false || result["code"] != CodeWrongType {
+		t.Fatalf("expect a WRONGTYPE error got %d %v", resp.StatusCode, result)
+	}
+}
+
+func TestHttpServer_ErrorCodes(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	server := httptest.NewServer(NewHttpServer(db).Api.Router.HandlerRouter)
+	defer server.Close()
+	db.Exec("set", "foo", "bar")
+	db.Exec("hset", "hash", "f", "v")
+	type errorCase struct {
+		path   string
+		body   string
+		status int
+		code   string
+		err    error
+	}
+	cases := []errorCase{
+		{"/action/get", `{"key":"missing"}`, http.StatusNotFound, CodeKeyNotFound, ErrKeyNotFound},
+		{"/action/hget", `{"key":"hash","field":"missing"}`, http.StatusNotFound, CodeFieldNotFound, ErrFieldNotFound},
+		{"/command", `{"command":"incr","args":["foo"]}`, http.StatusBadRequest, CodeNotInteger, ErrNotInteger},
+		{"/command", `{"command":"nope"}`, http.StatusBadRequest, CodeUnknownCommand, ErrUnknownCommand},
+		{"/command", `{"command":"get"}`, http.StatusBadRequest, CodeWrongArgCount, ErrWrongArgCount},
+		{"/action/rename", `{"key":"missing","newKey":"other"}`, http.StatusNotFound, CodeKeyNotFound, ErrKeyNotFound},
+		{"/action/get", `{"key":`, http.StatusBadRequest, CodeInvalidRequest, ErrInvalidRequest},
+		{"/action/get?db=99", `{"key":"foo"}`, http.StatusBadRequest, CodeInvalidDBIndex, ErrInvalidDBIndex},
+	}
+	check := func(c errorCase) {
+		resp, err := http.Post(server.URL+c.path, "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Success bool   `json:"success"`
+			Code    string `json:"code"`
+			Error   string `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status || result.Success || result.Code != c.code {
+			t.Fatalf("%s %s: expect %d %s got %d %+v", c.path, c.body, c.status, c.code, resp.StatusCode, result)
+		}
+		// a client maps the code back to the sentinel error
+		if !errors.Is(ErrorFromCode(result.Code, result.Error), c.err) {
+			t.Fatalf("%s: expect the code %s to match %v", c.path, result.Code, c.err)
+		}
+	}
+	for _, c := range cases {
+		check(c)
+	}
+	// a closed database is unavailable
+	db.Close()
+	check(errorCase{"/command", `{"command":"set","args":["foo","v"]}`, http.StatusServiceUnavailable, CodeClosed, ErrClosed})
+}
+
+func TestHttpServer_SelectDB(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	server := httptest.NewServer(NewHttpServer(db).Api.Router.HandlerRouter)
+	defer server.Close()
+	db.ExecDB(1, "set", "foo", "one")
+	for _, c := range []struct {
+		path   string
+		body   string
+		expect interface{}
+	}{
+		{"/action/get?db=1", `{"key":"foo"}`, "one"},
+		{"/command?db=1", `{"command":"get","args":["foo"]}`, "one"},
+		{"/command", `{"command":"exists","args":["foo"]}`, 0.0},
+		{"/action/move?db=1", `{"key":"foo","db":0}`, true},
+		{"/action/get", `{"key":"foo"}`, "one"},
+	} {
+		resp, err := http.Post(server.URL+c.path, "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result["data"] != c.expect {
+			t.Fatalf("%s: expect %v got %v", c.path, c.expect, result)
+		}
+	}
+}
+
+func TestHttpServer_Notifications(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", NotifyKeyspaceEvents: "KA"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	server := httptest.NewServer(NewHttpServer(db).Api.Router.HandlerRouter)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expect an event stream got %s", resp.Header.Get("Content-Type"))
+	}
+	// the subscription is in place once the headers are sent
+	if _, err = db.Exec("set", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	lines := make([]string, 0, 2)
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: set" {
+		t.Fatalf("expect the set event got %s", lines[0])
+	}
+	var event KeyspaceEvent
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event != (KeyspaceEvent{DB: 0, Key: "foo", Event: "set"}) {
+		t.Fatalf("unexpected event %v", event)
+	}
+}
+
+func TestHttpServer_Subscribe(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	server := httptest.NewServer(NewHttpServer(db).Api.Router.HandlerRouter)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect a subscribe without channels to fail got %d", resp.StatusCode)
+	}
+	resp, err = http.Get(server.URL + "/subscribe?channel=news&pattern=n*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	published, err := http.Post(server.URL+"/publish", "application/json", strings.NewReader(`{"channel":"news","message":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Data int `json:"data"`
+	}
+	json.NewDecoder(published.Body).Decode(&body)
+	published.Body.Close()
+	if body.Data != 2 {
+		t.Fatalf("expect 2 receivers got %d", body.Data)
+	}
+	reader := bufio.NewReader(resp.Body)
+	expect := []Message{
+		{Channel: "news", Payload: "hello"},
+		{Pattern: "n*", Channel: "news", Payload: "hello"},
+	}
+	for _, msg := range expect {
+		lines := make([]string, 0, 2)
+		for len(lines) < 2 {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		var got Message
+		if err = json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &got); err != nil {
+			t.Fatal(err)
+		}
+		if lines[0] != "event: message" || got != msg {
+			t.Fatalf("expect %v got %s %v", msg, lines[0], got)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package polarisdb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RespServer serves the Redis serialization protocol so that stock redis clients can talk to the database
+type RespServer struct {
+	Database *PolarisDB
+	listener net.Listener
+	sync.Mutex
+	conns  map[*RespConn]struct{}
+	nextID int64
+	// connection handlers Close waits for
+	handlers sync.WaitGroup
+	closed   bool
+}
+
+// RespConn holds the per connection state
+type RespConn struct {
+	ID     int64
+	Name   string
+	conn   net.Conn
+	reader *RespReader
+	writer *RespWriter
+	server *RespServer
+	closed bool
+	// database selected with SELECT
+	db int
+	// MULTI state, commands are queued until EXEC
+	multi    bool
+	queued   []BatchCommand
+	queueErr bool
+	watched  []WatchedKey
+	// pub/sub state, see server_resp_pubsub.go. The forwarder writes messages between
+	// commands, writeMu guards the writer.
+	writeMu   sync.Mutex
+	sub       *Subscription
+	forwarded chan struct{}
+}
+
+func NewRespServer(database *PolarisDB) *RespServer {
+	return &RespServer{
+		Database: database,
+		conns:    make(map[*RespConn]struct{}),
+	}
+}
+
+func (s *RespServer) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	return nil
+}
+
+func (s *RespServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until the listener is closed
+func (s *RespServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *RespServer) run(addr string) error {
+	if err := s.Listen(addr); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Close stops accepting connections, closes the open ones and waits for their handlers
+func (s *RespServer) Close() error {
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	s.Unlock()
+	s.handlers.Wait()
+	return err
+}
+
+func (s *RespServer) handleConn(conn net.Conn) {
+	c := &RespConn{
+		ID:     atomic.AddInt64(&s.nextID, 1),
+		conn:   conn,
+		reader: NewRespReader(conn),
+		writer: NewRespWriter(conn),
+		server: s,
+	}
+	s.Lock()
+	if s.closed {
+		// accepted while Close ran
+		s.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.conns, c)
+		s.Unlock()
+		conn.Close()
+		c.closeSubscription()
+	}()
+	for !c.closed {
+		args, err := c.reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrRespProtocol) {
+				c.writeMu.Lock()
+				c.writer.WriteError("ERR Protocol error")
+				c.writer.Flush()
+				c.writeMu.Unlock()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.writeMu.Lock()
+		c.handleCommand(args)
+		// flush once the pipelined commands in the read buffer are answered
+		if c.reader.Buffered() == 0 || c.closed {
+			err = c.writer.Flush()
+		}
+		c.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *RespConn) handleCommand(args []string) {
+	defer func() {
+		// one bad command must not take the connection and the server down
+		if r := recover(); r != nil {
+			c.writer.WriteError(fmt.Sprintf("ERR %v", r))
+		}
+	}()
+	name := strings.ToLower(args[0])
+	if c.multi {
+		switch name {
+		case "exec", "discard", "multi", "watch", "quit":
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe":
+			c.queueErr = true
+			c.writer.WriteError("ERR Command not allowed inside a transaction")
+			return
+		default:
+			c.queueCommand(name, args)
+			return
+		}
+	}
+	if c.subscribed() {
+		switch name {
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "ping", "quit":
+		default:
+			c.writer.WriteError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", name))
+			return
+		}
+	}
+	switch name {
+	case "ping":
+		if len(args) > 2 {
+			c.writeError(fmt.Errorf("%w for 'ping' command", ErrWrongArgCount))
+			return
+		}
+		if c.subscribed() {
+			// a subscribed RESP2 client only reads arrays
+			pong := ""
+			if len(args) == 2 {
+				pong = args[1]
+			}
+			c.writer.WriteReply([]interface{}{"pong", pong})
+			return
+		}
+		if len(args) == 2 {
+			c.writer.WriteBulk(args[1])
+			return
+		}
+		c.writer.WriteStatus("PONG")
+	case "echo":
+		if len(args) != 2 {
+			c.writeError(fmt.Errorf("%w for 'echo' command", ErrWrongArgCount))
+			return
+		}
+		c.writer.WriteBulk(args[1])
+	case "hello":
+		c.hello(args[1:])
+	case "quit":
+		c.writer.WriteStatus("OK")
+		c.closed = true
+	case "client":
+		c.client(args[1:])
+	case "command":
+		// clients only use it for introspection, an empty reply is enough
+		c.writer.WriteArrayHeader(0)
+	case "multi":
+		if c.multi {
+			c.writer.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		c.multi = true
+		c.writer.WriteStatus("OK")
+	case "exec":
+		c.exec()
+	case "discard":
+		if !c.multi {
+			c.writer.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		c.resetMulti()
+		c.writer.WriteStatus("OK")
+	case "watch":
+		if c.multi {
+			c.writer.WriteError("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		if len(args) < 2 {
+			c.writeError(fmt.Errorf("%w for 'watch' command", ErrWrongArgCount))
+			return
+		}
+		watched, err := c.server.Database.WatchDB(c.db, args[1:]...)
+		if err != nil {
+			c.writeError(err)
+			return
+		}
+		c.watched = append(c.watched, watched...)
+		c.writer.WriteStatus("OK")
+	case "unwatch":
+		c.watched = nil
+		c.writer.WriteStatus("OK")
+	case "subscribe", "psubscribe":
+		if len(args) < 2 {
+			c.writeError(fmt.Errorf("%w for '%s' command", ErrWrongArgCount, name))
+			return
+		}
+		c.subscribe(name, args[1:])
+	case "unsubscribe", "punsubscribe":
+		c.unsubscribe(name, args[1:])
+	case "select":
+		if len(args) != 2 {
+			c.writeError(fmt.Errorf("%w for 'select' command", ErrWrongArgCount))
+			return
+		}
+		index, err := parseDBIndex(args[1])
+		if err == nil && c.server.Database.Keyspace(index) == nil {
+			err = ErrInvalidDBIndex
+		}
+		if err != nil {
+			c.writeError(err)
+			return
+		}
+		c.db = index
+		c.writer.WriteStatus("OK")
+	default:
+		cmd, ok := LookupCommand(name)
+		if !ok {
+			c.writer.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+			return
+		}
+		if err := cmd.CheckArity(args[1:]); err != nil {
+			c.writeError(err)
+			return
+		}
+		reply, err := c.server.Database.ExecDB(c.db, name, args[1:]...)
+		if err != nil {
+			c.writeError(err)
+			return
+		}
+		c.writer.WriteReply(reply)
+	}
+}
+
+// queueCommand checks a command issued after MULTI, a bad one makes EXEC fail
+func (c *RespConn) queueCommand(name string, args []string) {
+	cmd, ok := LookupCommand(name)
+	if !ok {
+		c.queueErr = true
+		c.writer.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if err := cmd.CheckArity(args[1:]); err != nil {
+		c.queueErr = true
+		c.writeError(err)
+		return
+	}
+	c.queued = append(c.queued, BatchCommand{Command: name, Args: args[1:]})
+	c.writer.WriteStatus("QUEUED")
+}
+
+func (c *RespConn) exec() {
+	if !c.multi {
+		c.writer.WriteError("ERR EXEC without MULTI")
+		return
+	}
+	queued, watched, queueErr := c.queued, c.watched, c.queueErr
+	c.resetMulti()
+	if queueErr {
+		c.writer.WriteError(ErrExecAbort.Error())
+		return
+	}
+	results, err := c.server.Database.ExecMultiDB(c.db, watched, queued)
+	if errors.Is(err, ErrWatchedKeyChanged) {
+		c.writer.WriteNullArray()
+		return
+	}
+	if err != nil {
+		c.writeError(err)
+		return
+	}
+	c.writer.WriteArrayHeader(len(results))
+	for i, result := range results {
+		if result.Err == nil && queued[i].Command == "select" {
+			// a SELECT inside MULTI stays in effect after EXEC
+			c.db, _ = parseDBIndex(queued[i].Args[0])
+		}
+		if result.Err != nil {
+			c.writeError(result.Err)
+			continue
+		}
+		c.writer.WriteReply(result.Reply)
+	}
+}
+
+// resetMulti leaves MULTI, EXEC and DISCARD also forget the watched keys
+func (c *RespConn) resetMulti() {
+	c.multi = false
+	c.queued = nil
+	c.queueErr = false
+	c.watched = nil
+}
+
+func (c *RespConn) writeError(err error) {
+	// WRONGTYPE and OOM carry their own error code
+	if errors.Is(err, ErrWrongType) || errors.Is(err, ErrOOM) {
+		c.writer.WriteError(err.Error())
+		return
+	}
+	c.writer.WriteError("ERR " + err.Error())
+}
+
+// hello implements HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (c *RespConn) hello(args []string) {
+	protocol := c.writer.Protocol
+	if len(args) > 0 {
+		switch args[0] {
+		case "2":
+			protocol = RespProtocol2
+		case "3":
+			protocol = RespProtocol3
+		default:
+			c.writer.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		for i := 1; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "auth":
+				// no authentication yet, accept any credentials
+				i += 2
+			case "setname":
+				if i+1 < len(args) {
+					c.Name = args[i+1]
+				}
+				i++
+			default:
+				c.writeError(ErrSyntax)
+				return
+			}
+		}
+	}
+	c.writer.Protocol = protocol
+	c.writer.WriteReply(MapReply{
+		"server", "polarisdb",
+		"version", "1.0.0",
+		"proto", int64(protocol),
+		"id", c.ID,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	})
+}
+
+func (c *RespConn) client(args []string) {
+	if len(args) == 0 {
+		c.writeError(fmt.Errorf("%w for 'client' command", ErrWrongArgCount))
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "setname":
+		if len(args) != 2 {
+			c.writeError(ErrSyntax)
+			return
+		}
+		c.Name = args[1]
+		c.writer.WriteStatus("OK")
+	case "getname":
+		if c.Name == "" {
+			c.writer.WriteNull()
+			return
+		}
+		c.writer.WriteBulk(c.Name)
+	case "id":
+		c.writer.WriteInt(c.ID)
+	case "setinfo":
+		c.writer.WriteStatus("OK")
+	default:
+		c.writer.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+	}
+}
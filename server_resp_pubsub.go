@@ -0,0 +1,92 @@
+package polarisdb
+
+// subscribed tells whether the connection is in the subscribed state of RESP2, where
+// only the pub/sub commands, PING and QUIT are accepted. RESP3 clients tell the
+// pushed messages from replies and may run any command.
+func (c *RespConn) subscribed() bool {
+	return c.writer.Protocol != RespProtocol3 && c.sub != nil && c.sub.Count() > 0
+}
+
+// subscribe implements SUBSCRIBE and PSUBSCRIBE, the first one starts forwarding the
+// messages to the client
+func (c *RespConn) subscribe(name string, names []string) {
+	if c.sub == nil {
+		c.sub = c.server.Database.NewSubscription(0)
+		c.forwarded = make(chan struct{})
+		go c.forward(c.sub)
+	}
+	var counts []int
+	if name == "psubscribe" {
+		counts = c.sub.PSubscribe(names...)
+	} else {
+		counts = c.sub.Subscribe(names...)
+	}
+	for i, count := range counts {
+		c.writePush(name, names[i], int64(count))
+	}
+}
+
+// unsubscribe implements UNSUBSCRIBE and PUNSUBSCRIBE, without names they remove
+// every channel or pattern
+func (c *RespConn) unsubscribe(name string, names []string) {
+	var removed []string
+	var counts []int
+	if c.sub != nil {
+		if name == "punsubscribe" {
+			removed, counts = c.sub.PUnsubscribe(names...)
+		} else {
+			removed, counts = c.sub.Unsubscribe(names...)
+		}
+	} else {
+		removed = names
+		counts = make([]int, len(names))
+	}
+	if len(removed) == 0 {
+		// nothing to remove, the client still expects one reply
+		c.writePush(name, nil, 0)
+		return
+	}
+	for i, count := range counts {
+		c.writePush(name, removed[i], int64(count))
+	}
+}
+
+// writePush writes a pub/sub reply or message, a push for RESP3 and an array for RESP2
+func (c *RespConn) writePush(items ...interface{}) {
+	c.writer.WritePushHeader(len(items))
+	for _, item := range items {
+		c.writer.WriteReply(item)
+	}
+}
+
+// forward writes the messages of sub until it is closed. A subscriber that fell
+// behind the buffer limit, or that the closing database dropped, is disconnected.
+func (c *RespConn) forward(sub *Subscription) {
+	defer close(c.forwarded)
+	for msg := range sub.C {
+		c.writeMu.Lock()
+		if msg.Pattern != "" {
+			c.writePush("pmessage", msg.Pattern, msg.Channel, msg.Payload)
+		} else {
+			c.writePush("message", msg.Channel, msg.Payload)
+		}
+		err := c.writer.Flush()
+		c.writeMu.Unlock()
+		if err != nil {
+			// the reader notices the broken connection, sub is closed once it returns
+			c.conn.Close()
+		}
+	}
+	if sub.Err() != nil {
+		c.conn.Close()
+	}
+}
+
+// closeSubscription stops forwarding once the connection is gone
+func (c *RespConn) closeSubscription() {
+	if c.sub == nil {
+		return
+	}
+	c.sub.Close()
+	<-c.forwarded
+}
@@ -0,0 +1,330 @@
+package polarisdb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRespReader_ReadCommand(t *testing.T) {
+	reader := NewRespReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\nPING hello\r\n"))
+	args, err := reader.ReadCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args, " ") != "SET foo bar" {
+		t.Fatalf("unexpected args %v", args)
+	}
+	args, err = reader.ReadCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args, " ") != "PING hello" {
+		t.Fatalf("unexpected inline args %v", args)
+	}
+}
+
+func TestRespReader_DeclaredSizes(t *testing.T) {
+	// headers that declare the largest array and bulk string, followed by a few bytes
+	input := "*1048576\r\n$536870912\r\nabc"
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := NewRespReader(strings.NewReader(input)).ReadCommand()
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect an unexpected eof got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Fatalf("expect the declared sizes not to be allocated got %d bytes", allocated)
+	}
+	args, err := NewRespReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$100000\r\n" + strings.Repeat("k", 100000) + "\r\n")).ReadCommand()
+	if err != nil || len(args) != 2 || len(args[1]) != 100000 {
+		t.Fatalf("expect a large bulk string to be read got %v", err)
+	}
+	if _, err = NewRespReader(strings.NewReader("*1\r\n$3\r\nGETxx")).ReadCommand(); err != ErrRespProtocol {
+		t.Fatalf("expect a protocol error without the crlf got %v", err)
+	}
+}
+
+func TestRespWriter_WriteReply(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewRespWriter(&buf)
+	writer.WriteReply(MapReply{"foo", 1.5})
+	writer.WriteReply(SetReply{"a"})
+	writer.WriteReply(nil)
+	writer.Flush()
+	if buf.String() != "*2\r\n$3\r\nfoo\r\n$3\r\n1.5\r\n*1\r\n$1\r\na\r\n$-1\r\n" {
+		t.Fatalf("unexpected resp2 output %q", buf.String())
+	}
+	buf.Reset()
+	writer.Protocol = RespProtocol3
+	writer.WriteReply(MapReply{"foo", 1.5})
+	writer.WriteReply(SetReply{"a"})
+	writer.WriteReply(nil)
+	writer.Flush()
+	if buf.String() != "%1\r\n$3\r\nfoo\r\n,1.5\r\n~1\r\n$1\r\na\r\n_\r\n" {
+		t.Fatalf("unexpected resp3 output %q", buf.String())
+	}
+}
+
+func newTestRespServer(t *testing.T) (*PolarisDB, *RespServer) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	server := NewRespServer(db)
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	return db, server
+}
+
+func TestRespServer_Commands(t *testing.T) {
+	_, server := newTestRespServer(t)
+	defer cleanTestData()
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// pipeline all commands in one write
+	conn.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n" +
+		"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n" +
+		"*1\r\n$7\r\nUNKNOWN\r\n"))
+	reader := bufio.NewReader(conn)
+	expects := []string{"+OK", "$3", "bar", ":1", "$-1", "-ERR unknown command 'UNKNOWN'"}
+	for _, expect := range expects {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimRight(line, "\r\n") != expect {
+			t.Fatalf("expect %q got %q", expect, line)
+		}
+	}
+}
+
+func TestRespServer_CommandPanic(t *testing.T) {
+	_, server := newTestRespServer(t)
+	defer cleanTestData()
+	defer server.Close()
+	registerCommand("panic", 1, true, func(tx *TX, args []string) (interface{}, error) {
+		panic("boom")
+	})
+	defer delete(commandTable, "panic")
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("*1\r\n$5\r\nPANIC\r\n*1\r\n$4\r\nPING\r\n"))
+	reader := bufio.NewReader(conn)
+	expects := []string{"-ERR command panicked: 'panic': boom", "+PONG"}
+	for _, expect := range expects {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimRight(line, "\r\n") != expect {
+			t.Fatalf("expect %q got %q", expect, line)
+		}
+	}
+}
+
+func TestRespServer_Hello3(t *testing.T) {
+	_, server := newTestRespServer(t)
+	defer cleanTestData()
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("HELLO 3\r\nHSET h f v\r\nHGETALL h\r\n"))
+	reader := bufio.NewReader(conn)
+	line, _ := reader.ReadString('\n')
+	if line != "%7\r\n" {
+		t.Fatalf("expect map header got %q", line)
+	}
+	// skip the 14 hello fields, modules is an empty array
+	for i := 0; i < 25; i++ {
+		reader.ReadString('\n')
+	}
+	line, _ = reader.ReadString('\n')
+	if line != ":1\r\n" {
+		t.Fatalf("expect hset reply got %q", line)
+	}
+	line, _ = reader.ReadString('\n')
+	if line != "%1\r\n" {
+		t.Fatalf("expect hgetall map got %q", line)
+	}
+}
+
+func TestRespServer_MultiExec(t *testing.T) {
+	db, server := newTestRespServer(t)
+	defer cleanTestData()
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	expectLines := func(expects ...string) {
+		for _, expect := range expects {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			// a trailing * only matches the prefix
+			if line != expect && !(strings.HasSuffix(expect, "*") && strings.HasPrefix(line, strings.TrimSuffix(expect, "*"))) {
+				t.Fatalf("expect %q got %q", expect, line)
+			}
+		}
+	}
+	conn.Write([]byte("MULTI\r\nSET foo bar\r\nINCR foo\r\nGET foo\r\nEXEC\r\n"))
+	expectLines("+OK", "+QUEUED", "+QUEUED", "+QUEUED",
+		"*3", "+OK", "-ERR *", "$3", "bar")
+
+	conn.Write([]byte("MULTI\r\nSET foo baz\r\nNOPE\r\nEXEC\r\nGET foo\r\n"))
+	expectLines("+OK", "+QUEUED", "-ERR unknown command 'NOPE'",
+		"-EXECABORT Transaction discarded because of previous errors", "$3", "bar")
+
+	conn.Write([]byte("WATCH foo\r\n"))
+	expectLines("+OK")
+	db.Exec("set", "foo", "changed")
+	conn.Write([]byte("MULTI\r\nSET foo baz\r\nEXEC\r\nGET foo\r\n"))
+	expectLines("+OK", "+QUEUED", "*-1", "$7", "changed")
+
+	conn.Write([]byte("WATCH foo\r\nMULTI\r\nSET foo baz\r\nEXEC\r\nDISCARD\r\n"))
+	expectLines("+OK", "+OK", "+QUEUED", "*1", "+OK", "-ERR DISCARD without MULTI")
+
+	conn.Write([]byte("HGET foo f\r\n"))
+	expectLines("-WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestRespServer_Select(t *testing.T) {
+	db, server := newTestRespServer(t)
+	defer cleanTestData()
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	other, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	conn.Write([]byte("SELECT 1\r\nSET foo one\r\nSELECT 16\r\nMULTI\r\nSELECT 2\r\nEXEC\r\nSET foo two\r\n"))
+	other.Write([]byte("GET foo\r\n"))
+	reader := bufio.NewReader(conn)
+	for _, expect := range []string{"+OK", "+OK", "-ERR DB index is out of range", "+OK", "+QUEUED", "*1", "+OK", "+OK"} {
+		line, _ := reader.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") != expect {
+			t.Fatalf("expect %q got %q", expect, line)
+		}
+	}
+	// every connection starts in database 0
+	line, _ := bufio.NewReader(other).ReadString('\n')
+	if line != "$-1\r\n" {
+		t.Fatalf("expect nil in db 0 got %q", line)
+	}
+	if value, _ := db.ExecDB(1, "get", "foo"); value != "one" {
+		t.Fatalf("expect one in db 1 got %v", value)
+	}
+	if value, _ := db.ExecDB(2, "get", "foo"); value != "two" {
+		t.Fatalf("expect two in db 2 got %v", value)
+	}
+}
+
+func TestRespServer_PubSub(t *testing.T) {
+	db, server := newTestRespServer(t)
+	defer cleanTestData()
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	expectLines := func(expects ...string) {
+		for _, expect := range expects {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line = strings.TrimRight(line, "\r\n"); line != expect {
+				t.Fatalf("expect %q got %q", expect, line)
+			}
+		}
+	}
+	conn.Write([]byte("MULTI\r\nSUBSCRIBE news\r\nDISCARD\r\n"))
+	expectLines("+OK", "-ERR Command not allowed inside a transaction", "+OK")
+
+	conn.Write([]byte("SUBSCRIBE news\r\nPSUBSCRIBE n*\r\nGET foo\r\nPING\r\n"))
+	expectLines("*3", "$9", "subscribe", "$4", "news", ":1",
+		"*3", "$10", "psubscribe", "$2", "n*", ":2",
+		"-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+		"*2", "$4", "pong", "$0", "")
+	if receivers, _ := db.Exec("publish", "news", "hello"); receivers != int64(2) {
+		t.Fatalf("expect 2 receivers got %v", receivers)
+	}
+	expectLines("*3", "$7", "message", "$4", "news", "$5", "hello",
+		"*4", "$8", "pmessage", "$2", "n*", "$4", "news", "$5", "hello")
+
+	conn.Write([]byte("UNSUBSCRIBE\r\nPUNSUBSCRIBE\r\nUNSUBSCRIBE\r\nGET foo\r\n"))
+	expectLines("*3", "$11", "unsubscribe", "$4", "news", ":1",
+		"*3", "$12", "punsubscribe", "$2", "n*", ":0",
+		"*3", "$11", "unsubscribe", "$-1", ":0",
+		"$-1")
+	if numsub := db.PubSubNumSub("news"); numsub[0] != 0 {
+		t.Fatalf("expect no subscriber left got %v", numsub)
+	}
+}
+
+func TestRespServer_PubSubSlowSubscriber(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp", PubSubBufferLimit: 1})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	server := NewRespServer(db)
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("SUBSCRIBE news\r\n"))
+	for i := 0; i < 6; i++ {
+		reader.ReadString('\n')
+	}
+	// the client does not read, once its socket buffers fill the subscriber falls behind
+	payload := strings.Repeat("x", 64*1024)
+	for i := 0; i < 1000 && db.PubSubNumSub("news")[0] > 0; i++ {
+		db.Publish("news", payload)
+	}
+	if db.PubSubNumSub("news")[0] != 0 {
+		t.Fatal("expect the slow subscriber to be disconnected")
+	}
+	// the server closes the connection once the buffered messages are gone
+	if _, err = io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,62 +1,87 @@
 package set
 
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/projectxpolaris/polarisdb/dict"
+)
+
 // ExistElement for set hash element
 type ExistElement struct{}
 
+// HashSet keeps its members in a dict, the key is memberKey of the member
 type HashSet struct {
-	contents map[interface{}]ExistElement
+	contents *dict.Dict[interface{}]
+}
+
+// memberKey encodes a member with its type so that int64(1) and "1" stay different members
+func memberKey(i interface{}) string {
+	switch v := i.(type) {
+	case string:
+		return "s" + v
+	case int64:
+		return "i" + strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprintf("%T:%v", i, i)
+	}
 }
 
 func (h *HashSet) RandMember() interface{} {
 	if h.Len() == 0 {
 		return nil
 	}
-	for k := range h.contents {
-		return k
-	}
-	return nil
+	member, _ := h.contents.Find(h.contents.RandomKey())
+	return member
 }
 
 func (h *HashSet) Pop() interface{} {
 	if h.Len() == 0 {
 		return nil
 	}
-	for k, _ := range h.contents {
-		delete(h.contents, k)
-		return k
-	}
-	return nil
+	key := h.contents.RandomKey()
+	member, _ := h.contents.Find(key)
+	h.contents.Delete(key)
+	return member
 }
 
 func (h *HashSet) All() []interface{} {
-	result := make([]interface{}, 0)
-	for k := range h.contents {
-		result = append(result, k)
-	}
+	result := make([]interface{}, 0, h.Len())
+	h.contents.Range(func(_ string, member interface{}) bool {
+		result = append(result, member)
+		return true
+	})
 	return result
 }
 
 func (h *HashSet) Len() int {
-	return len(h.contents)
+	return h.contents.Len()
 }
 
 func (h *HashSet) Add(i interface{}) error {
-	h.contents[i] = ExistElement{}
+	h.contents.Add(memberKey(i), i)
 	return nil
 }
 
 func (h *HashSet) Remove(i interface{}) error {
-	delete(h.contents, i)
+	h.contents.Delete(memberKey(i))
 	return nil
 }
 
 func (h *HashSet) Contains(i interface{}) (bool, error) {
-	_, ok := h.contents[i]
+	_, ok := h.contents.Find(memberKey(i))
 	return ok, nil
 }
 
+// Scan returns the members of one bucket and the cursor of the next call, see dict.Dict.Scan
+func (h *HashSet) Scan(cursor uint64, fn func(member interface{})) uint64 {
+	return h.contents.Scan(cursor, func(_ string, member interface{}) {
+		fn(member)
+	})
+}
+
 func NewHashSet() *HashSet {
 	return &HashSet{
-		contents: make(map[interface{}]ExistElement),
+		contents: dict.NewDict[interface{}](),
 	}
 }
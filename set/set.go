@@ -2,6 +2,9 @@ package set
 
 import (
 	"sort"
+	"unsafe"
+
+	"github.com/projectxpolaris/polarisdb/utils"
 )
 
 type Store interface {
@@ -250,3 +253,63 @@ func (s *Set) Members() []interface{} {
 	store := s.GetStore()
 	return store.All()
 }
+
+// IsIntSet reports whether the set is encoded as an intset
+// MemoryUsage returns the approximate bytes used by the set and its members
+func (s *Set) MemoryUsage() int {
+	size := int(unsafe.Sizeof(*s))
+	if s.intSet != nil {
+		size += int(unsafe.Sizeof(*s.intSet)) + len(s.intSet.contents)*int(unsafe.Sizeof(int64(0)))
+	}
+	if s.hashSet != nil {
+		size += int(unsafe.Sizeof(*s.hashSet)) + s.hashSet.contents.MemoryUsage(utils.ValueSize)
+	}
+	return size
+}
+
+func (s *Set) IsIntSet() bool {
+	return s.intSet != nil
+}
+
+// NewIntSetFrom returns a set encoded as an intset holding the sorted contents
+func NewIntSetFrom(contents []int64) *Set {
+	return &Set{
+		intSet: &IntSet{contents: contents},
+	}
+}
+
+// NewHashSetFrom returns a set encoded as a hashset holding the members
+func NewHashSetFrom(members []interface{}) *Set {
+	hashSet := NewHashSet()
+	for _, member := range members {
+		hashSet.Add(member)
+	}
+	return &Set{
+		hashSet: hashSet,
+	}
+}
+
+// Clone returns a copy of the set with the same encoding
+func (s *Set) Clone() *Set {
+	if s.hashSet != nil {
+		return NewHashSetFrom(s.hashSet.All())
+	}
+	if s.intSet != nil {
+		return NewIntSetFrom(append([]int64(nil), s.intSet.contents...))
+	}
+	return NewSet()
+}
+
+// Scan returns the members of one step and the cursor of the next call, 0 when the
+// scan is complete. An intset is small and returns all members at once.
+func (s *Set) Scan(cursor uint64, fn func(member interface{})) uint64 {
+	if s.hashSet != nil {
+		return s.hashSet.Scan(cursor, fn)
+	}
+	if s.intSet != nil {
+		for _, v := range s.intSet.contents {
+			fn(v)
+		}
+	}
+	return 0
+}
@@ -136,3 +136,22 @@ func TestSet_Intersection(t *testing.T) {
 	}
 
 }
+
+func TestSet_Clone(t *testing.T) {
+	intset := NewSet()
+	for i := 0; i < 10; i++ {
+		intset.Add(i)
+	}
+	clone := intset.Clone()
+	clone.Add(100)
+	if intset.Len() != 10 || clone.Len() != 11 || !clone.IsIntSet() {
+		t.Errorf("unexpected clone len %d source len %d", clone.Len(), intset.Len())
+	}
+	hashset := NewSet()
+	hashset.Add("a")
+	clone = hashset.Clone()
+	clone.Remove("a")
+	if ok, _ := hashset.Contains("a"); !ok || clone.Len() != 0 {
+		t.Errorf("clone shares members with its source")
+	}
+}
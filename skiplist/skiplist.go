@@ -5,9 +5,12 @@
 package skiplist
 
 import (
+	"github.com/projectxpolaris/polarisdb/dict"
+	"github.com/projectxpolaris/polarisdb/utils"
 	"math"
 	"math/rand"
 	"sort"
+	"unsafe"
 )
 
 const (
@@ -87,7 +90,7 @@ type (
 	}
 
 	Zset struct {
-		dict map[string]*zskiplistNode
+		dict *dict.Dict[*zskiplistNode]
 		zsl  *zskiplist
 	}
 )
@@ -329,7 +332,7 @@ func (z *Zset) getNodeByRank(rank int64, reverse bool) (string, float64) {
 		return "", math.MinInt64
 	}
 
-	node := z.dict[n.member]
+	node, _ := z.dict.Find(n.member)
 	if node == nil {
 		return "", math.MinInt64
 	}
@@ -393,16 +396,17 @@ func (z *Zset) findRange(start, stop int64, reverse bool, withScores bool) (val
 
 func NewZset() *Zset {
 	return &Zset{
-		dict: make(map[string]*zskiplistNode),
+		dict: dict.NewDict[*zskiplistNode](),
 		zsl:  newZSkipList(),
 	}
 }
 
 func (z *Zset) IsExists(key string) bool {
-	return z.dict[key] != nil
+	_, exist := z.dict.Find(key)
+	return exist
 }
 func (z *Zset) Add(score float64, member string, value interface{}) (val int) {
-	v, exist := z.dict[member]
+	v, exist := z.dict.Find(member)
 	var node *zskiplistNode
 	if exist {
 		val = 0
@@ -419,14 +423,14 @@ func (z *Zset) Add(score float64, member string, value interface{}) (val int) {
 		node = z.zsl.insert(score, member, value)
 	}
 	if node != nil {
-		z.dict[member] = node
+		z.dict.Add(member, node)
 	}
 	return
 }
 
 // ZScore returns the score of member in the sorted set at key.
 func (z *Zset) ZScore(member string) (ok bool, score float64) {
-	node, exist := z.dict[member]
+	node, exist := z.dict.Find(member)
 	if !exist {
 		return
 	}
@@ -435,13 +439,13 @@ func (z *Zset) ZScore(member string) (ok bool, score float64) {
 
 // ZCard returns the sorted set cardinality (number of elements) of the sorted set stored at key.
 func (z *Zset) ZCard() int {
-	return len(z.dict)
+	return z.dict.Len()
 }
 
 // ZRank returns the rank of member in the sorted set stored at key, with the scores ordered from low to high.
 // The rank (or index) is 0-based, which means that the member with the lowest score has rank 0.
 func (z *Zset) ZRank(member string) int64 {
-	v, exist := z.dict[member]
+	v, exist := z.dict.Find(member)
 	if !exist {
 		return -1
 	}
@@ -456,7 +460,7 @@ func (z *Zset) ZRank(member string) int64 {
 // The rank (or index) is 0-based, which means that the member with the highest score has rank 0.
 func (z *Zset) ZRevRank(member string) int64 {
 
-	v, exist := z.dict[member]
+	v, exist := z.dict.Find(member)
 	if !exist {
 		return -1
 	}
@@ -471,7 +475,7 @@ func (z *Zset) ZRevRank(member string) int64 {
 // If key does not exist, a new sorted set with the specified member as its sole member is created.
 func (z *Zset) ZIncrBy(increment float64, member string) float64 {
 	var memberExists bool
-	node, memberExists := z.dict[member]
+	node, memberExists := z.dict.Find(member)
 	if memberExists {
 		increment += node.score
 		z.Add(increment, member, node.value)
@@ -482,10 +486,10 @@ func (z *Zset) ZIncrBy(increment float64, member string) float64 {
 // ZRem removes the specified members from the sorted set stored at key. Non existing members are ignored.
 // An error is returned when key exists and does not hold a sorted set.
 func (z *Zset) ZRem(member string) bool {
-	v, exist := z.dict[member]
+	v, exist := z.dict.Find(member)
 	if exist {
 		z.zsl.delete(v.score, member)
-		delete(z.dict, member)
+		z.dict.Delete(member)
 		return true
 	}
 
@@ -761,10 +765,10 @@ func ZsetDiff(targetSet *Zset, otherSets ...*Zset) *Zset {
 			return otherSets[i].ZCard() < otherSets[j].ZCard()
 		})
 		//O(N*M)
-		for targetMember, targetNode := range targetSet.dict {
+		targetSet.dict.Range(func(targetMember string, targetNode *zskiplistNode) bool {
 			existFlag := true
 			for _, otherSet := range otherSets {
-				if _, ok := otherSet.dict[targetMember]; !ok {
+				if _, ok := otherSet.dict.Find(targetMember); !ok {
 					existFlag = false
 					break
 				}
@@ -772,14 +776,12 @@ func ZsetDiff(targetSet *Zset, otherSets ...*Zset) *Zset {
 			if !existFlag {
 				resultSet.Add(targetNode.score, targetMember, nil)
 			}
-		}
+			return true
+		})
 	} else {
-		targetSetKeys := make([]string, 0)
-		for key, _ := range targetSet.dict {
-			targetSetKeys = append(targetSetKeys, key)
-		}
+		targetSetKeys := targetSet.dict.Keys()
 		for _, otherSet := range otherSets {
-			for otherMember := range otherSet.dict {
+			for _, otherMember := range otherSet.dict.Keys() {
 				for i, targetMember := range targetSetKeys {
 					if targetMember == otherMember {
 						targetSetKeys = append(targetSetKeys[:i], targetSetKeys[i+1:]...)
@@ -789,7 +791,8 @@ func ZsetDiff(targetSet *Zset, otherSets ...*Zset) *Zset {
 			}
 		}
 		for _, targetMember := range targetSetKeys {
-			resultSet.Add(targetSet.dict[targetMember].score, targetMember, nil)
+			node, _ := targetSet.dict.Find(targetMember)
+			resultSet.Add(node.score, targetMember, nil)
 		}
 	}
 	return resultSet
@@ -800,34 +803,64 @@ func ZsetInter(sets ...*Zset) *Zset {
 	sort.Slice(sets, func(i, j int) bool {
 		return sets[i].ZCard() < sets[j].ZCard()
 	})
-	for targetMember, targetNode := range sets[0].dict {
+	sets[0].dict.Range(func(targetMember string, targetNode *zskiplistNode) bool {
 		existFlag := true
 		scoreAns := targetNode.score
 		for _, otherSet := range sets[1:] {
-			if _, ok := otherSet.dict[targetMember]; !ok {
+			if node, ok := otherSet.dict.Find(targetMember); !ok {
 				existFlag = false
 				break
 			} else {
-				scoreAns += otherSet.dict[targetMember].score
+				scoreAns += node.score
 			}
 		}
 		if existFlag {
 			resultZset.Add(scoreAns, targetMember, nil)
 		}
-	}
+		return true
+	})
 	return resultZset
 }
 
 func ZsetUnion(sets ...*Zset) *Zset {
 	resultZset := NewZset()
 	for _, set := range sets {
-		for key, node := range set.dict {
+		set.dict.Range(func(key string, node *zskiplistNode) bool {
 			if resultZset.IsExists(key) {
 				resultZset.ZIncrBy(node.score, key)
 			} else {
 				resultZset.Add(node.score, key, nil)
 			}
-		}
+			return true
+		})
 	}
 	return resultZset
 }
+
+// Clone returns a copy of the sorted set
+func (z *Zset) Clone() *Zset {
+	clone := NewZset()
+	for x := z.zsl.head.level[0].forward; x != nil; x = x.level[0].forward {
+		clone.Add(x.score, x.member, x.value)
+	}
+	return clone
+}
+
+// MemoryUsage returns the approximate bytes used by the skiplist nodes and the member dict
+func (z *Zset) MemoryUsage() int {
+	levelSize := int(unsafe.Sizeof(&zskiplistLevel{})) + int(unsafe.Sizeof(zskiplistLevel{}))
+	size := int(unsafe.Sizeof(*z)) + int(unsafe.Sizeof(*z.zsl))
+	for x := z.zsl.head; x != nil; x = x.level[0].forward {
+		size += int(unsafe.Sizeof(*x)) + len(x.level)*levelSize + utils.ValueSize(x.value)
+	}
+	// the member strings are shared by the nodes and the dict, the dict counts them
+	return size + z.dict.MemoryUsage(nil)
+}
+
+// Scan returns the members of one bucket of the member dict and the cursor of the
+// next call, 0 when the scan is complete
+func (z *Zset) Scan(cursor uint64, fn func(member string, score float64)) uint64 {
+	return z.dict.Scan(cursor, func(member string, node *zskiplistNode) {
+		fn(member, node.score)
+	})
+}
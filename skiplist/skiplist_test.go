@@ -15,3 +15,18 @@ func TestSkipList_Insert(t *testing.T) {
 		skipList.Add(randomFloat64(), fmt.Sprintf("member_%d", i), fmt.Sprintf("val_%d", i))
 	}
 }
+
+func TestZset_Clone(t *testing.T) {
+	zset := NewZset()
+	for i := 0; i < 100; i++ {
+		zset.Add(randomFloat64(), fmt.Sprintf("member_%d", i), nil)
+	}
+	clone := zset.Clone()
+	if fmt.Sprint(zset.ZRangeWithScores(0, -1)) != fmt.Sprint(clone.ZRangeWithScores(0, -1)) {
+		t.Fatal("clone differs from source")
+	}
+	clone.ZRem("member_0")
+	if zset.ZCard() != 100 || clone.ZCard() != 99 {
+		t.Fatalf("unexpected card %d clone card %d", zset.ZCard(), clone.ZCard())
+	}
+}
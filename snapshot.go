@@ -0,0 +1,583 @@
+package polarisdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/projectxpolaris/polarisdb/list"
+	"github.com/projectxpolaris/polarisdb/set"
+	"github.com/projectxpolaris/polarisdb/skiplist"
+	"github.com/projectxpolaris/polarisdb/utils"
+)
+
+// A snapshot file is laid out as
+//
+//	magic, version
+//	aof position the snapshot was taken at: generation, segment, offset
+//	entries: type, key, absolute ttl in milliseconds or -1, value in its native encoding
+//	snapshotSelectDB and a database index before the entries of databases other than 0
+//	snapshotEOF, crc32 of everything before it
+//
+// integers are varints, byte strings are prefixed with their length.
+const (
+	snapshotMagic   = "PDBSNAP"
+	snapshotVersion = 2
+	// version 1 files have no snapshotSelectDB entries and still load
+	snapshotMinVersion = 1
+)
+
+// entry types
+const (
+	snapshotTypeString byte = iota + 1
+	snapshotTypeHash
+	snapshotTypeList
+	snapshotTypeIntSet
+	snapshotTypeHashSet
+	snapshotTypeZset
+	snapshotSelectDB byte = 0xfe
+	snapshotEOF      byte = 0xff
+)
+
+// tags of the loosely typed values held by HashObject and HashSet
+const (
+	snapshotValueBytes byte = iota
+	snapshotValueString
+	snapshotValueInt
+)
+
+var (
+	ErrBadSnapshot    = errors.New("bad snapshot")
+	ErrSaveInProgress = errors.New("background save already in progress")
+)
+
+// SnapshotStatus reports the state of the snapshots
+type SnapshotStatus struct {
+	InProgress bool      `json:"in_progress"`
+	LastSave   time.Time `json:"last_save"`
+	// LastError is the error of the last save, nil once a save succeeds again
+	LastError        error `json:"-"`
+	ChangesSinceSave int64 `json:"changes_since_save"`
+}
+
+type snapshotState struct {
+	sync.Mutex
+	saving   bool
+	lastSave time.Time
+	lastErr  error
+	// db.changes at the time the last successful snapshot was taken
+	savedChanges int64
+}
+
+type snapshotEncoder struct {
+	buf     bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *snapshotEncoder) writeUvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buf.Write(e.scratch[:n])
+}
+
+func (e *snapshotEncoder) writeVarint(v int64) {
+	n := binary.PutVarint(e.scratch[:], v)
+	e.buf.Write(e.scratch[:n])
+}
+
+func (e *snapshotEncoder) writeBytes(data []byte) {
+	e.writeUvarint(uint64(len(data)))
+	e.buf.Write(data)
+}
+
+func (e *snapshotEncoder) writeFloat(f float64) {
+	binary.BigEndian.PutUint64(e.scratch[:8], math.Float64bits(f))
+	e.buf.Write(e.scratch[:8])
+}
+
+func (e *snapshotEncoder) writeValue(value interface{}) {
+	switch val := value.(type) {
+	case []byte:
+		e.buf.WriteByte(snapshotValueBytes)
+		e.writeBytes(val)
+	case int64:
+		e.buf.WriteByte(snapshotValueInt)
+		e.writeVarint(val)
+	default:
+		e.buf.WriteByte(snapshotValueString)
+		e.writeBytes([]byte(utils.ToString(val)))
+	}
+}
+
+func (e *snapshotEncoder) writeEntry(key string, ttl int64, ent *KeyEntity) error {
+	switch obj := ent.Ptr.(type) {
+	case *StringStore:
+		data, err := obj.read([]byte(key))
+		if err != nil {
+			return err
+		}
+		e.writeHeader(snapshotTypeString, key, ttl)
+		e.writeBytes(data)
+	case *HashObject:
+		e.writeHeader(snapshotTypeHash, key, ttl)
+		e.writeUvarint(uint64(obj.Len()))
+		for field, value := range obj.GetAll() {
+			e.writeBytes([]byte(field))
+			e.writeValue(value)
+		}
+	case *ListObject:
+		e.writeHeader(snapshotTypeList, key, ttl)
+		zls := obj.Data.Ziplists()
+		e.writeUvarint(uint64(len(zls)))
+		for _, zl := range zls {
+			e.writeBytes(zl)
+		}
+	case *SetObject:
+		members := obj.Data.Members()
+		if obj.Data.IsIntSet() {
+			e.writeHeader(snapshotTypeIntSet, key, ttl)
+			e.writeUvarint(uint64(len(members)))
+			for _, member := range members {
+				e.writeVarint(member.(int64))
+			}
+			break
+		}
+		e.writeHeader(snapshotTypeHashSet, key, ttl)
+		e.writeUvarint(uint64(len(members)))
+		for _, member := range members {
+			e.writeValue(member)
+		}
+	case *ZsetObject:
+		e.writeHeader(snapshotTypeZset, key, ttl)
+		members := obj.Data.ZRangeWithScores(0, -1)
+		e.writeUvarint(uint64(len(members) / 2))
+		for i := 0; i+1 < len(members); i += 2 {
+			e.writeBytes([]byte(members[i].(string)))
+			e.writeFloat(members[i+1].(float64))
+		}
+	default:
+		return fmt.Errorf("snapshot: unknown type %T of key %s", ent.Ptr, key)
+	}
+	return nil
+}
+
+func (e *snapshotEncoder) writeHeader(entryType byte, key string, ttl int64) {
+	e.buf.WriteByte(entryType)
+	e.writeBytes([]byte(key))
+	e.writeVarint(ttl)
+}
+
+type snapshotDecoder struct {
+	r *bytes.Reader
+}
+
+func (d *snapshotDecoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, ErrBadSnapshot
+	}
+	return b, nil
+}
+
+func (d *snapshotDecoder) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, ErrBadSnapshot
+	}
+	return v, nil
+}
+
+func (d *snapshotDecoder) readVarint() (int64, error) {
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		return 0, ErrBadSnapshot
+	}
+	return v, nil
+}
+
+func (d *snapshotDecoder) readBytes() ([]byte, error) {
+	size, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(d.r.Len()) {
+		return nil, ErrBadSnapshot
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(d.r, data); err != nil {
+		return nil, ErrBadSnapshot
+	}
+	return data, nil
+}
+
+func (d *snapshotDecoder) readFloat() (float64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return 0, ErrBadSnapshot
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(buf[:])), nil
+}
+
+func (d *snapshotDecoder) readValue() (interface{}, error) {
+	tag, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case snapshotValueBytes:
+		return d.readBytes()
+	case snapshotValueString:
+		data, err := d.readBytes()
+		return string(data), err
+	case snapshotValueInt:
+		return d.readVarint()
+	default:
+		return nil, ErrBadSnapshot
+	}
+}
+
+// readCount reads the element count of a collection, every element takes at least one byte
+func (d *snapshotDecoder) readCount() (int, error) {
+	count, err := d.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if count > uint64(d.r.Len()) {
+		return 0, ErrBadSnapshot
+	}
+	return int(count), nil
+}
+
+// readObject decodes the value of an entry of the given type
+func (d *snapshotDecoder) readObject(entryType byte) (Object, error) {
+	switch entryType {
+	case snapshotTypeHash:
+		count, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		hashObj := NewHashObject()
+		for i := 0; i < count; i++ {
+			field, err := d.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readValue()
+			if err != nil {
+				return nil, err
+			}
+			hashObj.Set(string(field), value)
+		}
+		return hashObj, nil
+	case snapshotTypeList:
+		count, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		zls := make([][]byte, 0, count)
+		for i := 0; i < count; i++ {
+			zl, err := d.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			zls = append(zls, zl)
+		}
+		return &ListObject{Data: list.NewQuickListFromZiplists(zls)}, nil
+	case snapshotTypeIntSet:
+		count, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		contents := make([]int64, 0, count)
+		for i := 0; i < count; i++ {
+			value, err := d.readVarint()
+			if err != nil {
+				return nil, err
+			}
+			contents = append(contents, value)
+		}
+		return &SetObject{Data: set.NewIntSetFrom(contents)}, nil
+	case snapshotTypeHashSet:
+		count, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		members := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			member, err := d.readValue()
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, member)
+		}
+		return &SetObject{Data: set.NewHashSetFrom(members)}, nil
+	case snapshotTypeZset:
+		count, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		zset := skiplist.NewZset()
+		for i := 0; i < count; i++ {
+			member, err := d.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			score, err := d.readFloat()
+			if err != nil {
+				return nil, err
+			}
+			zset.Add(score, string(member), nil)
+		}
+		return &ZsetObject{Data: zset}, nil
+	default:
+		return nil, ErrBadSnapshot
+	}
+}
+
+func (db *PolarisDB) snapshotPath() string {
+	return filepath.Join(db.Config.Path, db.Config.SnapshotFile)
+}
+
+// encodeSnapshot serializes the data set, the caller holds the db lock
+func (db *PolarisDB) encodeSnapshot() ([]byte, error) {
+	// records that are not on disk yet must not be skipped by the replay after a crash
+	if err := db.Log.Sync(); err != nil {
+		return nil, err
+	}
+	pos, err := db.Log.Position()
+	if err != nil {
+		return nil, err
+	}
+	e := &snapshotEncoder{}
+	e.buf.WriteString(snapshotMagic)
+	e.buf.WriteByte(snapshotVersion)
+	e.writeUvarint(uint64(pos.Generation))
+	e.writeUvarint(uint64(pos.Segment))
+	e.writeUvarint(uint64(pos.Offset))
+	now := time.Now().UnixMilli()
+	for index, ks := range db.Keyspaces {
+		if index != 0 && ks.Dict.Len() != 0 {
+			e.buf.WriteByte(snapshotSelectDB)
+			e.writeUvarint(uint64(index))
+		}
+		for _, key := range ks.Dict.Keys() {
+			ent, isExist := ks.Dict.FindRaw(key)
+			if !isExist {
+				continue
+			}
+			ttl := ks.Sweeper.GetExpire(key)
+			if ttl != noExpire && ttl < now {
+				continue
+			}
+			if err = e.writeEntry(key, ttl, ent); err != nil {
+				return nil, err
+			}
+		}
+	}
+	e.buf.WriteByte(snapshotEOF)
+	binary.BigEndian.PutUint32(e.scratch[:4], crc32.Checksum(e.buf.Bytes(), crcTable))
+	e.buf.Write(e.scratch[:4])
+	return e.buf.Bytes(), nil
+}
+
+func (db *PolarisDB) writeSnapshot(data []byte) error {
+	path := db.snapshotPath()
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// loadSnapshot restores the data set from the snapshot and returns the aof position
+// to continue the replay at, nil when there is no usable snapshot
+func (db *PolarisDB) loadSnapshot() (*LogPosition, error) {
+	data, err := os.ReadFile(db.snapshotPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	headerSize := len(snapshotMagic) + 1
+	if len(data) < headerSize+5 || string(data[:len(snapshotMagic)]) != snapshotMagic ||
+		data[len(snapshotMagic)] < snapshotMinVersion || data[len(snapshotMagic)] > snapshotVersion ||
+		crc32.Checksum(data[:len(data)-4], crcTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		// the aof holds every write, a damaged snapshot only costs a longer startup
+		log.Printf("snapshot: %s is damaged, replaying the whole aof", db.snapshotPath())
+		return nil, nil
+	}
+	d := &snapshotDecoder{r: bytes.NewReader(data[headerSize : len(data)-4])}
+	var header [3]uint64
+	for i := range header {
+		if header[i], err = d.readUvarint(); err != nil {
+			return nil, err
+		}
+	}
+	pos := LogPosition{Generation: int(header[0]), Segment: int(header[1]), Offset: int64(header[2])}
+	if !db.Log.Contains(pos) {
+		// taken before the aof was rewritten
+		log.Printf("snapshot: aof position %+v is gone, replaying the whole aof", pos)
+		return nil, nil
+	}
+	now := time.Now().UnixMilli()
+	ks := db.Keyspaces[0]
+	for {
+		entryType, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if entryType == snapshotEOF {
+			break
+		}
+		if entryType == snapshotSelectDB {
+			index, err := d.readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			if ks = db.Keyspace(int(index)); ks == nil {
+				return nil, fmt.Errorf("%w: database %d, %d are configured", ErrBadSnapshot, index, len(db.Keyspaces))
+			}
+			continue
+		}
+		key, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		ttl, err := d.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		var obj Object = ks.StringStore
+		var value []byte
+		if entryType == snapshotTypeString {
+			value, err = d.readBytes()
+		} else {
+			obj, err = d.readObject(entryType)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ttl != noExpire && ttl < now {
+			continue
+		}
+		if entryType == snapshotTypeString {
+			ks.StringStore.write(key, value)
+		}
+		ks.Dict.Add(string(key), &KeyEntity{Ptr: obj})
+		if ttl != noExpire {
+			ks.Sweeper.SetKeyExpire(string(key), ttl)
+		}
+	}
+	db.snapshot.lastSave = time.Now()
+	return &pos, nil
+}
+
+// save takes a snapshot, the caller holds the db lock. In the background only the
+// encoding happens under the lock and the file is written afterwards.
+func (db *PolarisDB) save(background bool) error {
+	db.snapshot.Lock()
+	if db.snapshot.saving {
+		db.snapshot.Unlock()
+		return ErrSaveInProgress
+	}
+	db.snapshot.saving = true
+	db.snapshot.Unlock()
+	changes := atomic.LoadInt64(&db.changes)
+	data, err := db.encodeSnapshot()
+	if err != nil {
+		db.finishSave(changes, err)
+		return err
+	}
+	if !background {
+		err = db.writeSnapshot(data)
+		db.finishSave(changes, err)
+		return err
+	}
+	db.goBackground(func() {
+		err := db.writeSnapshot(data)
+		if err != nil {
+			log.Printf("snapshot: background save failed: %v", err)
+		}
+		db.finishSave(changes, err)
+	})
+	return nil
+}
+
+func (db *PolarisDB) finishSave(changes int64, err error) {
+	db.snapshot.Lock()
+	defer db.snapshot.Unlock()
+	db.snapshot.saving = false
+	db.snapshot.lastErr = err
+	if err == nil {
+		db.snapshot.lastSave = time.Now()
+		db.snapshot.savedChanges = changes
+	}
+}
+
+// Save writes a snapshot of the data set, writes are blocked until it is on disk
+func (db *PolarisDB) Save() error {
+	db.RLock()
+	defer db.RUnlock()
+	return db.save(false)
+}
+
+// BackgroundSave writes a snapshot of the data set in the background
+func (db *PolarisDB) BackgroundSave() error {
+	db.RLock()
+	defer db.RUnlock()
+	return db.save(true)
+}
+
+func (db *PolarisDB) SnapshotStatus() SnapshotStatus {
+	db.snapshot.Lock()
+	defer db.snapshot.Unlock()
+	return SnapshotStatus{
+		InProgress:       db.snapshot.saving,
+		LastSave:         db.snapshot.lastSave,
+		LastError:        db.snapshot.lastErr,
+		ChangesSinceSave: atomic.LoadInt64(&db.changes) - db.snapshot.savedChanges,
+	}
+}
+
+// snapshotLoop takes a background snapshot every SnapshotInterval when there were writes
+func (db *PolarisDB) snapshotLoop(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(db.Config.SnapshotInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if db.SnapshotStatus().ChangesSinceSave == 0 {
+				continue
+			}
+			if err := db.BackgroundSave(); err != nil && err != ErrSaveInProgress {
+				log.Printf("snapshot: scheduled save failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package polarisdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func fillSnapshotTestData(t *testing.T, db *PolarisDB) {
+	err := db.Update(func(tx *TX) error {
+		if err := tx.SetString("str", "v", false); err != nil {
+			return err
+		}
+		if err := tx.HSet("hash", Paris{Field: []byte("f"), Value: []byte("1")}); err != nil {
+			return err
+		}
+		if err := tx.SAdd("intset", "1", "2", "3"); err != nil {
+			return err
+		}
+		if err := tx.SAdd("hashset", "a", "b"); err != nil {
+			return err
+		}
+		if err := tx.ZAdd("zset", ZsetPair{Member: "a", Score: 1}, ZsetPair{Member: "b", Score: 2.5}); err != nil {
+			return err
+		}
+		for i := 0; i < 50; i++ {
+			if err := tx.LPush("list", []byte("some list element")); err != nil {
+				return err
+			}
+		}
+		return tx.SetString("ttl", "v", false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Update(func(tx *TX) error { return tx.HIncrBy("hash", "f", 1) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolarisDB_Save(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	fillSnapshotTestData(t, db)
+	ttl := time.Now().Add(time.Hour).UnixMilli()
+	db.Keyspaces[0].Sweeper.SetKeyExpire("ttl", ttl)
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if status := db.SnapshotStatus(); status.ChangesSinceSave != 0 || status.LastSave.IsZero() {
+		t.Fatalf("unexpected snapshot status %+v", status)
+	}
+	// written after the snapshot, only the aof replay restores them
+	err := db.Update(func(tx *TX) error {
+		if err := tx.SetString("after", "v", false); err != nil {
+			return err
+		}
+		return tx.LPush("list", []byte("after"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenTestDB(t, db)
+	if db.SnapshotStatus().LastSave.IsZero() {
+		t.Fatal("expect the snapshot to be loaded")
+	}
+	err = db.View(func(tx *TX) error {
+		for key, expect := range map[string]string{"str": "v", "after": "v"} {
+			if val, err := tx.Get(key); err != nil || val != expect {
+				t.Fatalf("expect %s=%s got %s %v", key, expect, val, err)
+			}
+		}
+		if val, err := tx.HGet("hash", "f"); err != nil || val != "2" {
+			t.Fatalf("expect hash field 2 got %s %v", val, err)
+		}
+		if ok, err := tx.SIsMember("intset", "2"); err != nil || !ok {
+			t.Fatalf("expect intset member got %v %v", ok, err)
+		}
+		if ok, err := tx.SIsMember("hashset", "b"); err != nil || !ok {
+			t.Fatalf("expect hashset member got %v %v", ok, err)
+		}
+		if score, err := tx.ZScore("zset", "b"); err != nil || score != 2.5 {
+			t.Fatalf("expect score 2.5 got %v %v", score, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Keyspaces[0].Sweeper.GetExpire("ttl") != ttl {
+		t.Fatalf("expect ttl %d got %d", ttl, db.Keyspaces[0].Sweeper.GetExpire("ttl"))
+	}
+}
+
+func TestPolarisDB_SaveBeforeRewrite(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	fillSnapshotTestData(t, db)
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RewriteAof(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *TX) error { return tx.SetString("after", "v", false) }); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTestDB(t, db)
+	if !db.SnapshotStatus().LastSave.IsZero() {
+		t.Fatal("expect the snapshot of the old aof generation to be ignored")
+	}
+	db.View(func(tx *TX) error {
+		for _, key := range []string{"str", "hash", "list", "after"} {
+			if exist, _ := tx.Exists(key); !exist {
+				t.Fatalf("expect key %s", key)
+			}
+		}
+		return nil
+	})
+}
+
+func TestPolarisDB_DamagedSnapshot(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	fillSnapshotTestData(t, db)
+	if err := db.BackgroundSave(); err != nil {
+		t.Fatal(err)
+	}
+	for db.SnapshotStatus().InProgress {
+		time.Sleep(time.Millisecond)
+	}
+	path := filepath.Join("./tmp", "dump.pdb")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(path, data, 0644)
+	db = reopenTestDB(t, db)
+	db.View(func(tx *TX) error {
+		if val, err := tx.Get("str"); err != nil || val != "v" {
+			t.Fatalf("expect str=v got %s %v", val, err)
+		}
+		return nil
+	})
+}
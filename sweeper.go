@@ -2,6 +2,8 @@ package polarisdb
 
 import (
 	"context"
+	"errors"
+	"log"
 	"math"
 	"math/rand"
 	"time"
@@ -17,12 +19,15 @@ var (
 	EvictAllKeyLRU    = "allkeys-lru"
 	EvictVolRandom    = "volatile-random"
 	EvictVolLRU       = "volatile-lru"
+	EvictAllKeyLFU    = "allkeys-lfu"
+	EvictVolLFU       = "volatile-lfu"
+	EvictVolTTL       = "volatile-ttl"
 	EvictNoEviction   = "noeviction"
 )
 
 type Sweeper struct {
 	Store *SweeperStore
-	db    *PolarisDB
+	space *Keyspace
 }
 
 type Sweepable interface {
@@ -30,10 +35,10 @@ type Sweepable interface {
 	keys() ([]string, error)
 }
 
-func NewSweeper(db *PolarisDB) *Sweeper {
+func NewSweeper(space *Keyspace) *Sweeper {
 	return &Sweeper{
 		Store: NewSweeperStore(),
-		db:    db,
+		space: space,
 	}
 }
 
@@ -46,58 +51,63 @@ func startupDelay() time.Duration {
 	return d
 }
 
+// run expires keys every SweeperInterval and evicts every EvicterInterval (ms) until stop is done
 func (s *Sweeper) run(stop context.Context) {
 	// get random interval
-	<-time.After(startupDelay())
-	ticker := time.NewTicker(time.Duration(s.db.Config.SweeperInterval) * time.Millisecond)
-	evictTicker := time.NewTicker(time.Duration(s.db.Config.EvicterInterval) * time.Second)
+	select {
+	case <-time.After(startupDelay()):
+	case <-stop.Done():
+		return
+	}
+	ticker := time.NewTicker(time.Duration(s.space.db.Config.SweeperInterval) * time.Millisecond)
+	defer ticker.Stop()
+	evictTicker := time.NewTicker(time.Duration(s.space.db.Config.EvicterInterval) * time.Millisecond)
+	defer evictTicker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			s.sweep()
 		case <-evictTicker.C:
-			s.evict()
+			if err := s.evict(); err != nil && !errors.Is(err, ErrOOM) {
+				log.Printf("evict: %v", err)
+			}
 		case <-stop.Done():
-			ticker.Stop()
 			return
 		}
 	}
 }
-func (s *Sweeper) sweep() error {
-	s.Store.Lock()
-	defer s.Store.Unlock()
-	for key, entity := range s.Store.TtlStore {
-		if entity.TTL < time.Now().UnixMilli() {
-			// evict the key
-			obj, isExist := s.db.Dict.Find(key)
-			if !isExist {
-				delete(s.Store.TtlStore, key)
-				continue
-			}
-			// is string obj
-			if strStore, ok := obj.Ptr.(*StringStore); ok {
-				strStore.delete([]byte(key))
-			}
-			s.db.Dict.Delete(key)
-			// is hash obj
-			delete(s.Store.TtlStore, key)
 
-		}
-	}
+// sweep removes expired keys with the active expire cycle
+func (s *Sweeper) sweep() error {
+	s.activeExpireCycle()
 	return nil
 }
 
+// evict removes keys under the eviction policy, down to MaxMemory when it is set
+// (a write over the limit also evicts right away) and otherwise a share of the keys
+// of the keyspace
 func (s *Sweeper) evict() error {
-	evictPolicy := s.db.Config.EvicterPolicy
-	switch evictPolicy {
+	db := s.space.db
+	if db.Config.MaxMemory > 0 {
+		db.Lock()
+		defer db.Unlock()
+		return db.freeMemory(nil)
+	}
+	switch db.Config.EvicterPolicy {
 	case EvictAllKeyRandom:
-		RandomSweeper(s.db)
+		RandomSweeper(s.space)
 	case EvictAllKeyLRU:
-		LruSweeper(s.db)
+		LruSweeper(s.space)
+	case EvictAllKeyLFU:
+		LfuSweeper(s.space)
 	case EvictVolRandom:
-		RandomExpireKeySweeper(s.db)
+		RandomExpireKeySweeper(s.space)
 	case EvictVolLRU:
-		LruSweeper(s.db)
+		LruTTLKeySweeper(s.space)
+	case EvictVolLFU:
+		LfuTTLKeySweeper(s.space)
+	case EvictVolTTL:
+		TTLKeySweeper(s.space)
 	}
 	return nil
 }
@@ -105,10 +115,7 @@ func (s *Sweeper) evict() error {
 func (s *Sweeper) SetKeyExpire(key string, ttl int64) {
 	s.Store.Lock()
 	defer s.Store.Unlock()
-	// find the type of the key
-	s.Store.TtlStore[key] = &ExpireEntity{
-		TTL: ttl,
-	}
+	s.Store.set(key, ttl)
 }
 func (s *Sweeper) GetExpire(key string) int64 {
 	s.Store.Lock()
@@ -131,43 +138,43 @@ func (s *Sweeper) isExpire(key string) bool {
 func (s *Sweeper) TryRemoveExpire(key string) {
 	s.Store.Lock()
 	defer s.Store.Unlock()
-	if _, ok := s.Store.TtlStore[key]; ok {
-		delete(s.Store.TtlStore, key)
-	}
+	s.Store.remove(key)
 }
 func (s *Sweeper) RemoveExpire(key string) {
 	s.Store.Lock()
 	defer s.Store.Unlock()
-	delete(s.Store.TtlStore, key)
+	s.Store.remove(key)
+}
+
+// sweepCount returns the keys a periodic eviction removes out of total, at least one
+func sweepCount(total int, factor float64) int {
+	return int(math.Max(math.Floor(float64(total)*factor), 1))
 }
 
 // allkey=random
-func RandomSweeper(db *PolarisDB) {
-	removeCount := float64(db.Dict.Len()) * db.Config.RandomRemoveFactor
+func RandomSweeper(space *Keyspace) {
+	removeCount := float64(space.Dict.Len()) * space.db.Config.RandomRemoveFactor
 	count := math.Floor(removeCount)
-	db.Dict.RandomRemoveKey(int(count))
+	space.evictCount(EvictAllKeyRandom, int(count))
 }
 
 // volatile-random
-func RandomExpireKeySweeper(db *PolarisDB) {
-	removeCount := float64(db.Dict.Len()) * db.Config.RandomRemoveFactor
+func RandomExpireKeySweeper(space *Keyspace) {
+	removeCount := float64(space.Dict.Len()) * space.db.Config.RandomRemoveFactor
 	count := math.Floor(removeCount)
-	keys := db.Sweeper.Store.SampleKeys(int(count))
-	for _, key := range keys {
-		db.Dict.Delete(key)
-	}
+	space.evictCount(EvictVolRandom, int(count))
 }
 
-func FindBestLRUKey(db *PolarisDB, keys []string) string {
+func FindBestLRUKey(space *Keyspace, keys []string) string {
 	largeLRU := -1.0
 	bestKey := ""
 	for _, key := range keys {
-		ent, isExist := db.Dict.FindRaw(key)
+		ent, isExist := space.Dict.FindRaw(key)
 		if !isExist {
 			continue
 		}
-		if db.Clock.GetLruNow(ent.LRU) > largeLRU {
-			largeLRU = db.Clock.GetLruNow(ent.LRU)
+		if space.db.Clock.GetLruNow(ent.LRU) > largeLRU {
+			largeLRU = space.db.Clock.GetLruNow(ent.LRU)
 			bestKey = key
 		}
 	}
@@ -175,28 +182,26 @@ func FindBestLRUKey(db *PolarisDB, keys []string) string {
 }
 
 // allkey=lru
-func LruSweeper(db *PolarisDB) {
-	removeCount := float64(db.Dict.Len()) * db.Config.LruSampleFactor
-	count := math.Floor(removeCount)
-	keys := db.Dict.SampleKeys(int(count))
-	bestKey := FindBestLRUKey(db, keys)
-	if bestKey != "" {
-		db.Dict.Delete(bestKey)
-	}
+func LruSweeper(space *Keyspace) {
+	space.evictCount(EvictAllKeyLRU, sweepCount(space.Dict.Len(), space.db.Config.LruSampleFactor))
+}
+
+// volatile-lru
+func LruTTLKeySweeper(space *Keyspace) {
+	space.evictCount(EvictVolLRU, sweepCount(space.Sweeper.Store.Len(), space.db.Config.LruSampleFactor))
+}
+
+// allkey=lfu
+func LfuSweeper(space *Keyspace) {
+	space.evictCount(EvictAllKeyLFU, sweepCount(space.Dict.Len(), space.db.Config.LruSampleFactor))
+}
+
+// volatile-lfu
+func LfuTTLKeySweeper(space *Keyspace) {
+	space.evictCount(EvictVolLFU, sweepCount(space.Sweeper.Store.Len(), space.db.Config.LruSampleFactor))
 }
 
 // volatile-ttl
-func LruTTLKeySweeper(db *PolarisDB) {
-	removeCount := float64(db.Sweeper.Store.Len()) * db.Config.LruSampleFactor
-	if (removeCount) < 1 {
-		removeCount = 1
-	}
-	keys := db.Sweeper.Store.SampleKeys(int(removeCount))
-	if len(keys) == 0 {
-		return
-	}
-	bestKey := FindBestLRUKey(db, keys)
-	if bestKey != "" {
-		db.Dict.Delete(bestKey)
-	}
+func TTLKeySweeper(space *Keyspace) {
+	space.evictCount(EvictVolTTL, sweepCount(space.Sweeper.Store.Len(), space.db.Config.LruSampleFactor))
 }
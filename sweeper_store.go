@@ -1,14 +1,45 @@
 package polarisdb
 
-import "sync"
+import (
+	"container/heap"
+	"sync"
+)
 
 type ExpireEntity struct {
 	TTL int64
+	key string
+	// position in the deadline heap
+	index int
+}
+
+// expireHeap orders the ttls by deadline, the first one expires first
+type expireHeap []*ExpireEntity
+
+func (h expireHeap) Len() int           { return len(h) }
+func (h expireHeap) Less(i, j int) bool { return h[i].TTL < h[j].TTL }
+func (h expireHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *expireHeap) Push(x interface{}) {
+	entity := x.(*ExpireEntity)
+	entity.index = len(*h)
+	*h = append(*h, entity)
+}
+func (h *expireHeap) Pop() interface{} {
+	old := *h
+	entity := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entity
 }
 
 type SweeperStore struct {
 	sync.RWMutex
 	TtlStore map[string]*ExpireEntity
+	// the same ttls ordered by deadline, so the expired ones are found without a scan
+	deadlines expireHeap
 }
 
 func NewSweeperStore() *SweeperStore {
@@ -23,6 +54,55 @@ func (s *SweeperStore) Len() int {
 	return len(s.TtlStore)
 }
 
+// set gives key the deadline ttl, the caller holds the lock
+func (s *SweeperStore) set(key string, ttl int64) {
+	if entity, ok := s.TtlStore[key]; ok {
+		entity.TTL = ttl
+		heap.Fix(&s.deadlines, entity.index)
+		return
+	}
+	entity := &ExpireEntity{TTL: ttl, key: key}
+	s.TtlStore[key] = entity
+	heap.Push(&s.deadlines, entity)
+}
+
+// remove drops the ttl of key, the caller holds the lock
+func (s *SweeperStore) remove(key string) {
+	if entity, ok := s.TtlStore[key]; ok {
+		heap.Remove(&s.deadlines, entity.index)
+		delete(s.TtlStore, key)
+	}
+}
+
+// Expired returns up to limit keys whose deadline is before now. The expired keys are
+// the top of the heap, finding them takes time in the number of them and not of all ttls.
+func (s *SweeperStore) Expired(now int64, limit int) []string {
+	s.RLock()
+	defer s.RUnlock()
+	keys := make([]string, 0)
+	stack := []int{0}
+	for len(stack) > 0 && len(keys) < limit {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if i >= len(s.deadlines) || s.deadlines[i].TTL >= now {
+			continue
+		}
+		keys = append(keys, s.deadlines[i].key)
+		stack = append(stack, 2*i+2, 2*i+1)
+	}
+	return keys
+}
+
+// NextDeadline returns the key that expires first and its deadline, false when no key has a ttl
+func (s *SweeperStore) NextDeadline() (string, int64, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.deadlines) == 0 {
+		return "", 0, false
+	}
+	return s.deadlines[0].key, s.deadlines[0].TTL, true
+}
+
 func (s *SweeperStore) SampleKeys(count int) []string {
 	s.Lock()
 	defer s.Unlock()
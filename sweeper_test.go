@@ -60,7 +60,7 @@ func TestRandomSweeper(t *testing.T) {
 		return
 	}
 	for i := 0; i < 100; i++ {
-		RandomSweeper(db)
+		RandomSweeper(db.Keyspaces[0])
 	}
 }
 
@@ -91,16 +91,14 @@ func TestLruSweeper(t *testing.T) {
 	}
 
 	for key, review := range time2Key {
-		for entKey, entity := range db.Dict.Data.Data {
-			if entKey == key {
-				entity.LRU = db.Clock.GetTime() - float64(review)
-			}
+		if entity, ok := db.Keyspaces[0].Dict.Data.Find(key); ok {
+			entity.LRU = db.Clock.GetTime() - float64(review)
 		}
 	}
 	for i := 0; i < 100; i++ {
-		LruSweeper(db)
+		LruSweeper(db.Keyspaces[0])
 	}
-	if db.Dict.Data.Len() != 0 {
+	if db.Keyspaces[0].Dict.Data.Len() != 0 {
 		t.Fatal("sweeper failed")
 		return
 	}
@@ -149,13 +147,14 @@ func TestLruTTLKeySweeper(t *testing.T) {
 		t.Fatal(err)
 		return
 	}
-	for _, entity := range db.Dict.Data.Data {
+	db.Keyspaces[0].Dict.Data.Range(func(_ string, entity *KeyEntity) bool {
 		entity.LRU = db.Clock.GetTime() - float64(generateRandomNum(0, 100))
-	}
+		return true
+	})
 	for i := 0; i < 100; i++ {
-		LruTTLKeySweeper(db)
+		LruTTLKeySweeper(db.Keyspaces[0])
 	}
-	if db.Dict.Data.Len() != 50 {
+	if db.Keyspaces[0].Dict.Data.Len() != 50 {
 		t.Fatal("sweeper failed")
 		return
 	}
@@ -205,10 +204,11 @@ func TestRandomTTLListSweeper(t *testing.T) {
 		t.Fatal(err)
 		return
 	}
-	for _, entity := range db.Dict.Data.Data {
+	db.Keyspaces[0].Dict.Data.Range(func(_ string, entity *KeyEntity) bool {
 		entity.LRU = db.Clock.GetTime() - float64(generateRandomNum(0, 100))
-	}
+		return true
+	})
 	for i := 0; i < 100; i++ {
-		RandomExpireKeySweeper(db)
+		RandomExpireKeySweeper(db.Keyspaces[0])
 	}
 }
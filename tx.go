@@ -3,7 +3,9 @@ package polarisdb
 import (
 	"errors"
 	"fmt"
+	"github.com/projectxpolaris/polarisdb/skiplist"
 	"github.com/projectxpolaris/polarisdb/utils"
+	"time"
 )
 
 type TXData struct {
@@ -11,124 +13,662 @@ type TXData struct {
 	key  []byte
 }
 type DataWriter interface {
-	Write(db *PolarisDB) (err error)
+	Write(tx *TX) (err error)
 	GetActionBlock() (*ActionBlock, error)
 }
 
+// TX collects its changes in a write set, the first write to a key works on a copy of
+// the value. Reads inside the transaction see the write set, the live stores only
+// change when Update commits it.
 type TX struct {
 	Writers []DataWriter
 	db      *PolarisDB
+	// the selected database and the write set of its keyspace
+	index int
+	ks    *Keyspace
+	*writeSet
+	// write sets of every keyspace the transaction wrote to
+	sets map[*Keyspace]*writeSet
+	// the databases as the transaction sees them after SWAPDB or FLUSHDB, nil while unchanged
+	spaces []*Keyspace
+	// database the logged actions apply to, a record starts in database 0
+	logged int
+	// the aof replay writes straight to the live stores
+	direct bool
+	// keyspace events published once the transaction commits
+	events []KeyspaceEvent
+}
+
+// writeSet holds the changes of a transaction to one keyspace
+type writeSet struct {
+	// written keys, a nil entity marks a deleted key
+	dirty map[string]*KeyEntity
+	// values of the written string keys, their entities point to it until commit
+	strings *StringStore
+	// ttl changes, noExpire removes the ttl
+	expires map[string]int64
+}
+
+func newWriteSet() *writeSet {
+	return &writeSet{
+		dirty:   make(map[string]*KeyEntity),
+		expires: make(map[string]int64),
+	}
+}
+
+func (db *PolarisDB) newTX() *TX {
+	t := &TX{
+		Writers: []DataWriter{},
+		db:      db,
+		sets:    make(map[*Keyspace]*writeSet),
+	}
+	t.Select(0)
+	return t
+}
+
+// keyspaces returns the databases as the transaction sees them
+func (t *TX) keyspaces() []*Keyspace {
+	if t.spaces != nil {
+		return t.spaces
+	}
+	return t.db.Keyspaces
+}
+
+// Select makes the following reads and writes of the transaction use database index
+func (t *TX) Select(index int) error {
+	spaces := t.keyspaces()
+	if index < 0 || index >= len(spaces) {
+		return ErrInvalidDBIndex
+	}
+	t.index = index
+	t.ks = spaces[index]
+	set, ok := t.sets[t.ks]
+	if !ok {
+		set = newWriteSet()
+		t.sets[t.ks] = set
+	}
+	t.writeSet = set
+	return nil
+}
+
+// DB returns the index of the selected database
+func (t *TX) DB() int {
+	return t.index
+}
+
+// log records an action, a SelectAct goes first when it applies to another database
+// than the action logged before
+func (t *TX) log(writer DataWriter) {
+	if t.logged != t.index {
+		t.Writers = append(t.Writers, &SelectAct{Index: t.index})
+		t.logged = t.index
+	}
+	t.Writers = append(t.Writers, writer)
+}
+
+// replaceKeyspace installs ks as database index, outside the replay only for this
+// transaction until it commits
+func (t *TX) replaceKeyspace(index int, ks *Keyspace) {
+	if t.direct {
+		t.db.Keyspaces[index] = ks
+	} else {
+		if t.spaces == nil {
+			t.spaces = append([]*Keyspace(nil), t.db.Keyspaces...)
+		}
+		t.spaces[index] = ks
+	}
+	t.Select(t.index)
+}
+
+func isExpired(ttl int64) bool {
+	return ttl != noExpire && ttl < time.Now().UnixMilli()
+}
+
+// ttl returns the absolute ttl of a key as the transaction sees it
+func (t *TX) ttl(key string) int64 {
+	if ttl, ok := t.expires[key]; ok {
+		return ttl
+	}
+	return t.ks.Sweeper.GetExpire(key)
+}
+
+// lookup returns the entity of a key as the transaction sees it, touch updates
+// the lru clock and expires the key lazily
+func (t *TX) lookup(key string, touch bool) (*KeyEntity, bool) {
+	if ent, ok := t.dirty[key]; ok {
+		if ent == nil || isExpired(t.ttl(key)) {
+			return nil, false
+		}
+		return ent, true
+	}
+	if ttl, ok := t.expires[key]; ok {
+		if isExpired(ttl) {
+			return nil, false
+		}
+		return t.ks.Dict.FindRaw(key)
+	}
+	// ttls that passed during the replay were still running when the records were written
+	if t.direct {
+		return t.ks.Dict.FindRaw(key)
+	}
+	if !touch {
+		ent, isExist := t.ks.Dict.FindRaw(key)
+		if !isExist || isExpired(t.ks.Sweeper.GetExpire(key)) {
+			return nil, false
+		}
+		return ent, true
+	}
+	return t.ks.Dict.Find(key)
+}
+
+func (t *TX) find(key string) (*KeyEntity, bool) {
+	return t.lookup(key, true)
+}
+
+// findForWrite returns an entity the transaction may change
+func (t *TX) findForWrite(key string) (*KeyEntity, bool) {
+	ent, isExist := t.find(key)
+	if !isExist || t.direct {
+		return ent, isExist
+	}
+	if _, ok := t.dirty[key]; ok {
+		return ent, true
+	}
+	clone, ok := t.copyEntity(key, ent, key)
+	if !ok {
+		return nil, false
+	}
+	t.dirty[key] = clone
+	return clone, true
+}
+
+// copyEntity returns a deep copy of the value of key, a string value is stored under dst
+func (t *TX) copyEntity(key string, ent *KeyEntity, dst string) (*KeyEntity, bool) {
+	clone := &KeyEntity{LRU: ent.LRU, Freq: ent.Freq, FreqTime: ent.FreqTime}
+	switch obj := ent.Ptr.(type) {
+	case *StringStore:
+		value, err := obj.read([]byte(key))
+		if err != nil {
+			return nil, false
+		}
+		store := t.stringStore()
+		store.write([]byte(dst), value)
+		clone.Ptr = store
+	case *HashObject:
+		clone.Ptr = obj.Clone()
+	case *ListObject:
+		clone.Ptr = &ListObject{Data: obj.Data.Clone()}
+	case *SetObject:
+		clone.Ptr = &SetObject{Data: obj.Data.Clone()}
+	case *ZsetObject:
+		clone.Ptr = &ZsetObject{Data: obj.Data.Clone()}
+	}
+	return clone, true
+}
+
+// stringStore returns the store new string values of the transaction go to
+func (t *TX) stringStore() *StringStore {
+	if t.direct {
+		return t.ks.StringStore
+	}
+	if t.strings == nil {
+		t.strings = NewStore()
+	}
+	return t.strings
+}
+
+// add creates or replaces a key, the ttl of the key is removed
+func (t *TX) add(key string, ent *KeyEntity) {
+	if t.direct {
+		t.deleteString(key)
+		t.ks.Dict.Add(key, ent)
+		return
+	}
+	t.dirty[key] = ent
+	t.expires[key] = noExpire
+}
+
+func (t *TX) delete(key string) {
+	if t.direct {
+		t.deleteString(key)
+		t.ks.Dict.Delete(key)
+		return
+	}
+	t.dirty[key] = nil
+	t.expires[key] = noExpire
+}
+
+// deleteString removes the value of a live string key from the shared store
+func (t *TX) deleteString(key string) {
+	if ent, isExist := t.ks.Dict.FindRaw(key); isExist {
+		if store, ok := ent.Ptr.(*StringStore); ok {
+			store.delete([]byte(key))
+		}
+	}
+}
+
+func (t *TX) setExpire(key string, ttl int64) {
+	if !t.direct {
+		t.expires[key] = ttl
+		return
+	}
+	if ttl == noExpire {
+		t.ks.Sweeper.RemoveExpire(key)
+		return
+	}
+	t.ks.Sweeper.SetKeyExpire(key, ttl)
+}
+
+// commit installs the write sets into the live stores
+func (t *TX) commit() {
+	if t.direct {
+		return
+	}
+	// versions come from one counter, a key that is deleted and recreated
+	// never gets a version it had before
+	t.db.version++
+	for ks, set := range t.sets {
+		t.ks, t.writeSet = ks, set
+		t.commitSet()
+	}
+	if t.spaces != nil {
+		// keyspaces that were flushed are dropped together with their write sets
+		old := t.db.Keyspaces
+		t.db.Keyspaces = t.spaces
+		t.db.replaceSweepers(old)
+	}
+}
+
+// commitSet installs the write set of the current keyspace
+func (t *TX) commitSet() {
+	for key, ent := range t.dirty {
+		ttl := t.ttl(key)
+		if ent == nil || ent.Ptr != Object(t.strings) {
+			t.deleteString(key)
+		}
+		if ent == nil {
+			t.ks.Dict.Delete(key)
+			continue
+		}
+		if ent.Ptr == Object(t.strings) {
+			value, _ := t.strings.read([]byte(key))
+			t.ks.StringStore.write([]byte(key), value)
+			ent.Ptr = t.ks.StringStore
+		}
+		ent.Version = t.db.version
+		t.ks.Dict.Add(key, ent)
+		if ttl != noExpire {
+			t.ks.Sweeper.SetKeyExpire(key, ttl)
+		}
+	}
+	for key, ttl := range t.expires {
+		if _, ok := t.dirty[key]; ok {
+			continue
+		}
+		if ent, isExist := t.ks.Dict.FindRaw(key); isExist {
+			ent.Version = t.db.version
+		}
+		if ttl == noExpire {
+			t.ks.Sweeper.RemoveExpire(key)
+			continue
+		}
+		t.ks.Sweeper.SetKeyExpire(key, ttl)
+	}
 }
 
 func (t *TX) Exists(key string) (bool, error) {
-	_, isExist := t.db.Dict.FindRaw(key)
-	if isExist && !t.db.Sweeper.isExpire(key) {
-		return true, nil
+	_, isExist := t.lookup(key, false)
+	return isExist, nil
+}
+
+// ExistsCount returns how many of the keys exist, a key given twice counts twice
+func (t *TX) ExistsCount(keys ...string) (int, error) {
+	return KeyExists(t, keys...), nil
+}
+
+func (t *TX) Type(key string) (string, error) {
+	return KeyType(t, key), nil
+}
+
+// Scan returns keys of the keyspace in steps, pass the returned cursor to the next
+// call until it is 0. Keys that exist for the whole scan are returned at least once.
+func (t *TX) Scan(cursor uint64, options ScanOptions) (uint64, []string, error) {
+	next, keys := KeyScan(t, cursor, options)
+	return next, keys, nil
+}
+
+// Keys returns the keys matching the glob pattern in lexicographic order
+func (t *TX) Keys(pattern string) ([]string, error) {
+	return KeyKeys(t, pattern), nil
+}
+
+// KeyRange returns up to count keys in [start, end) in lexicographic order, see KeyRange
+func (t *TX) KeyRange(start string, end string, count int) ([]string, error) {
+	return KeyRange(t, start, end, count), nil
+}
+
+func (t *TX) HScan(key string, cursor uint64, options ScanOptions) (uint64, []interface{}, error) {
+	return HashScan(t, key, cursor, options)
+}
+
+func (t *TX) SScan(key string, cursor uint64, options ScanOptions) (uint64, []interface{}, error) {
+	return SetScan(t, key, cursor, options)
+}
+
+func (t *TX) ZScan(key string, cursor uint64, options ScanOptions) (uint64, []ZsetPair, error) {
+	return ZsetScan(t, key, cursor, options)
+}
+
+// Del removes keys of any type and returns the number of removed keys
+func (t *TX) Del(keys ...string) (int, error) {
+	count := t.deleteKeys(keys)
+	if count > 0 {
+		t.log(&KeyDelAction{Keys: keys})
+	}
+	return count, nil
+}
+
+// Unlink is Del, values are freed right away as there is no background free
+func (t *TX) Unlink(keys ...string) (int, error) {
+	count := t.deleteKeys(keys)
+	if count > 0 {
+		t.log(&KeyUnlinkAction{Keys: keys})
+	}
+	return count, nil
+}
+
+// deleteKeys deletes keys with a del event for every key that was there
+func (t *TX) deleteKeys(keys []string) int {
+	count := 0
+	for _, key := range keys {
+		if KeyDelete(t, key) > 0 {
+			t.notify(NotifyGeneric, "del", key)
+			count++
+		}
+	}
+	return count
+}
+
+func (t *TX) Rename(key string, newKey string) error {
+	if _, err := KeyRename(t, key, newKey, false); err != nil {
+		return err
+	}
+	t.log(&KeyRenameAction{Key: key, NewKey: newKey})
+	t.notify(NotifyGeneric, "rename_from", key)
+	t.notify(NotifyGeneric, "rename_to", newKey)
+	return nil
+}
+
+func (t *TX) RenameNX(key string, newKey string) (bool, error) {
+	renamed, err := KeyRename(t, key, newKey, true)
+	if err != nil || !renamed {
+		return false, err
+	}
+	t.log(&KeyRenameNXAction{Key: key, NewKey: newKey})
+	t.notify(NotifyGeneric, "rename_from", key)
+	t.notify(NotifyGeneric, "rename_to", newKey)
+	return true, nil
+}
+
+// Copy copies the value and ttl of source to destination, it returns false when
+// nothing was copied
+func (t *TX) Copy(source string, destination string, replace bool) (bool, error) {
+	copied, err := KeyCopy(t, source, destination, replace)
+	if err != nil || !copied {
+		return false, err
+	}
+	t.log(&KeyCopyAction{Source: source, Destination: destination, Replace: replace})
+	t.notify(NotifyGeneric, "copy_to", destination)
+	return true, nil
+}
+
+// MemoryUsage returns the approximate bytes key and its value use, 0 when it is missing
+func (t *TX) MemoryUsage(key string) (int64, error) {
+	return KeyMemoryUsage(t, key), nil
+}
+
+// NextExpire returns the key of the selected database that expires first and its
+// deadline (unix ms), false when no key has a ttl. Ttls the transaction set are not seen.
+func (t *TX) NextExpire() (string, int64, bool) {
+	return t.ks.Sweeper.Store.NextDeadline()
+}
+
+// ObjectFreq returns the decayed LFU access counter of key, false when it is missing. It
+// does not count as an access.
+func (t *TX) ObjectFreq(key string) (int64, bool) {
+	ent, isExist := t.lookup(key, false)
+	if !isExist {
+		return 0, false
+	}
+	return int64(t.db.Clock.LFUCount(ent)), true
+}
+
+// Move moves key to database index, it returns false when nothing was moved
+func (t *TX) Move(key string, index int) (bool, error) {
+	moved, err := KeyMove(t, key, index)
+	if err != nil || !moved {
+		return false, err
 	}
-	return false, nil
+	t.log(&KeyMoveAction{Key: key, DB: index})
+	t.notify(NotifyGeneric, "move_from", key)
+	t.notifyDB(index, NotifyGeneric, "move_to", key)
+	return true, nil
+}
+
+// SwapDB exchanges the contents of two databases
+func (t *TX) SwapDB(first int, second int) error {
+	if err := SwapDB(t, first, second); err != nil {
+		return err
+	}
+	t.log(&SwapDBAct{First: first, Second: second})
+	return nil
+}
+
+// FlushDB removes every key of the selected database
+func (t *TX) FlushDB() error {
+	FlushDB(t)
+	t.log(&FlushDBAct{})
+	return nil
+}
+
+// FlushAll removes every key of every database
+func (t *TX) FlushAll() error {
+	FlushAll(t)
+	t.log(&FlushAllAct{})
+	return nil
 }
 
 func (t *TX) SetString(key string, value string, keepTTL bool) error {
-	WriteStringToStore(t.db, []byte(key), []byte(value), keepTTL)
-	t.Writers = append(t.Writers, &StringAct{Data: value, Key: key, KeepTTL: keepTTL})
+	WriteStringToStore(t, []byte(key), []byte(value), keepTTL)
+	t.log(&StringAct{Data: value, Key: key, KeepTTL: keepTTL})
+	t.notify(NotifyString, "set", key)
 	return nil
 }
 func (t *TX) SetExpire(key string, duration int64) error {
-	t.db.Sweeper.SetKeyExpire(key, utils.GetAbsExpireTime(duration))
-	t.Writers = append(t.Writers, &ExpireAct{Key: key, TTL: utils.GetAbsExpireTime(duration)})
+	t.setExpire(key, utils.GetAbsExpireTime(duration))
+	t.log(&ExpireAct{Key: key, TTL: utils.GetAbsExpireTime(duration)})
+	t.notify(NotifyGeneric, "expire", key)
 	return nil
 }
+
+// Expire sets the ttl of key to duration milliseconds from now under the
+// conditions of options, it returns false when the key is missing or the
+// conditions are not met
+func (t *TX) Expire(key string, duration int64, options ExpireOptions) (bool, error) {
+	return t.ExpireAt(key, time.Now().UnixMilli()+duration, options)
+}
+
+// ExpireAt sets the deadline of key to the unix time at in milliseconds, see Expire
+func (t *TX) ExpireAt(key string, at int64, options ExpireOptions) (bool, error) {
+	if at <= time.Now().UnixMilli() {
+		// a deadline that passed deletes the key like redis, -1 would read as no ttl
+		allowed, err := keyExpireAllowed(t, key, at, options)
+		if err != nil || !allowed {
+			return false, err
+		}
+		t.Del(key)
+		return true, nil
+	}
+	set, err := KeyExpireAt(t, key, at, options)
+	if err != nil || !set {
+		return false, err
+	}
+	t.log(&ExpireAct{Key: key, TTL: at})
+	t.notify(NotifyGeneric, "expire", key)
+	return true, nil
+}
+
+// Persist removes the ttl of key, it returns false when the key has none
+func (t *TX) Persist(key string) (bool, error) {
+	if !KeyPersist(t, key) {
+		return false, nil
+	}
+	t.log(&KeyPersistAction{Key: key})
+	t.notify(NotifyGeneric, "persist", key)
+	return true, nil
+}
+
+// PTTL returns the remaining time to live of key in milliseconds, or TTLNoKey and TTLNoExpire
+func (t *TX) PTTL(key string) (int64, error) {
+	at := KeyExpireTime(t, key)
+	if at < 0 {
+		return at, nil
+	}
+	ttl := at - time.Now().UnixMilli()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, nil
+}
+
+// TTL returns the remaining time to live of key in seconds rounded like redis, see PTTL
+func (t *TX) TTL(key string) (int64, error) {
+	ttl, err := t.PTTL(key)
+	if err != nil || ttl < 0 {
+		return ttl, err
+	}
+	return (ttl + 500) / 1000, nil
+}
+
+// ExpireTime returns the deadline of key as unix time in milliseconds, or TTLNoKey and TTLNoExpire
+func (t *TX) ExpireTime(key string) (int64, error) {
+	return KeyExpireTime(t, key), nil
+}
+
+// ExpireTimeSeconds is ExpireTime in seconds like EXPIRETIME
+func (t *TX) ExpireTimeSeconds(key string) (int64, error) {
+	at := KeyExpireTime(t, key)
+	if at < 0 {
+		return at, nil
+	}
+	return at / 1000, nil
+}
+
 func (t *TX) Append(key string, value string) error {
-	newData, err := AppendStringToStore(t.db, []byte(key), []byte(value))
+	newData, err := AppendStringToStore(t, []byte(key), []byte(value))
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &StringAct{Key: key, Data: string(newData)})
+	t.log(&StringAct{Key: key, Data: string(newData), KeepTTL: true})
+	t.notify(NotifyString, "append", key)
 	return nil
 }
 func (t *TX) Get(key string) (string, error) {
-	obj, exist := t.db.Dict.Find(key)
-	if !exist {
-		return "", errors.New("key not exist")
-	}
-	fmt.Sprintf("obj type is %f", obj.LRU)
-	val, err := obj.Ptr.(*StringStore).read([]byte(key))
+	val, exist, err := StringRead(t, key)
 	if err != nil {
 		return "", err
 	}
+	if !exist {
+		return "", ErrKeyNotFound
+	}
 	return string(val), nil
 }
 
 func (t *TX) Decr(key string) error {
-	newVal, err := StringCalculate(t.db, []byte(key), -1)
+	newVal, err := StringCalculate(t, []byte(key), -1)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &StringAct{Key: key, Data: newVal})
+	t.log(&StringAct{Key: key, Data: newVal, KeepTTL: true})
+	t.notify(NotifyString, "incrby", key)
 	return nil
 }
 
 func (t *TX) DecrBy(key string, byValue int64) error {
-	newVal, err := StringCalculate(t.db, []byte(key), -byValue)
+	newVal, err := StringCalculate(t, []byte(key), -byValue)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &StringAct{Key: key, Data: newVal})
+	t.log(&StringAct{Key: key, Data: newVal, KeepTTL: true})
+	t.notify(NotifyString, "incrby", key)
 	return nil
 }
 
 func (t *TX) Incr(key string) error {
-	newVal, err := StringCalculate(t.db, []byte(key), 1)
+	newVal, err := StringCalculate(t, []byte(key), 1)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &StringAct{Key: key, Data: newVal})
+	t.log(&StringAct{Key: key, Data: newVal, KeepTTL: true})
+	t.notify(NotifyString, "incrby", key)
 	return nil
 }
 
 func (t *TX) IncrBy(key string, byValue int64) error {
-	newVal, err := StringCalculate(t.db, []byte(key), byValue)
+	newVal, err := StringCalculate(t, []byte(key), byValue)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &StringAct{Key: key, Data: newVal})
+	t.log(&StringAct{Key: key, Data: newVal, KeepTTL: true})
+	t.notify(NotifyString, "incrby", key)
 	return nil
 }
 
 func (t *TX) GetDel(key string) (string, error) {
-	value, err := StringGetDel(t.db, []byte(key))
+	value, err := StringGetDel(t, []byte(key))
 	if err != nil {
 		return "", err
 	}
-	t.Writers = append(t.Writers, &StringDelAction{Key: key})
+	t.log(&StringDelAction{Key: key})
+	t.notify(NotifyGeneric, "del", key)
 	return value, nil
 }
 
+// GetEx returns the value of key and gives it a ttl of ex milliseconds, ex must be positive
 func (t *TX) GetEx(key string, ex int64) (string, error) {
-	obj, exist := t.db.Dict.Find(key)
-	if !exist {
-		return "", errors.New("key not exist")
+	if ex <= 0 {
+		return "", ErrInvalidExpire
 	}
-	value, err := obj.Ptr.(*StringStore).read([]byte(key))
+	return t.GetExAt(key, time.Now().UnixMilli()+ex)
+}
+
+// GetExAt returns the value of key and sets its deadline to the unix time at in
+// milliseconds, a deadline that passed deletes the key
+func (t *TX) GetExAt(key string, at int64) (string, error) {
+	value, exist, err := StringRead(t, key)
 	if err != nil {
 		return "", err
 	}
-	t.db.Sweeper.SetKeyExpire(key, utils.GetAbsExpireTime(ex))
-	t.Writers = append(t.Writers, &SetExAction{Key: key, TTL: utils.GetAbsExpireTime(ex)})
+	if !exist {
+		return "", ErrKeyNotFound
+	}
+	if at <= time.Now().UnixMilli() {
+		t.Del(key)
+		return string(value), nil
+	}
+	t.setExpire(key, at)
+	t.log(&SetExAction{Key: key, TTL: at})
+	t.notify(NotifyGeneric, "expire", key)
 	return string(value), nil
 }
 
 func (t *TX) GetRange(key string, start int64, end int64) (string, error) {
-	obj, exist := t.db.Dict.Find(key)
-	if !exist {
-		return "", errors.New("key not exist")
-	}
-	value, err := obj.Ptr.(*StringStore).read([]byte(key))
+	value, exist, err := StringRead(t, key)
 	if err != nil {
 		return "", err
 	}
-	if err != nil {
-		return "", err
+	if !exist {
+		return "", ErrKeyNotFound
 	}
 	if start < 0 {
 		start = int64(len(value)) + start
@@ -136,32 +676,28 @@ func (t *TX) GetRange(key string, start int64, end int64) (string, error) {
 	if end < 0 {
 		end = int64(len(value)) + end
 	}
-	if start > int64(len(value)) {
-		start = int64(len(value))
+	if start < 0 {
+		start = 0
 	}
 	if end > int64(len(value)) {
 		end = int64(len(value))
 	}
-	if start > end {
-		start = end
+	if start >= end {
+		return "", nil
 	}
 	return string(value[start:end]), nil
 }
 
+// Lcs returns the longest common subsequence of two strings, a missing key is an empty string
 func (t *TX) Lcs(key1 string, key2 string) (string, error) {
-	obj, exist := t.db.Dict.Find(key1)
-	if !exist {
-		return "", errors.New("key not exist")
-	}
-	value1, err := obj.Ptr.(*StringStore).read([]byte(key1))
+	value1, _, err := StringRead(t, key1)
 	if err != nil {
 		return "", err
 	}
-	obj, exist = t.db.Dict.Find(key2)
-	if !exist {
-		return "", errors.New("key not exist")
+	value2, _, err := StringRead(t, key2)
+	if err != nil {
+		return "", err
 	}
-	value2, err := obj.Ptr.(*StringStore).read([]byte(key2))
 	// longest common subsequence
 	lcs := utils.LongestCommonSubstring(value1, value2)
 	return string(lcs), nil
@@ -170,13 +706,9 @@ func (t *TX) Lcs(key1 string, key2 string) (string, error) {
 func (t *TX) MGet(keys ...string) ([]string, error) {
 	var values []string
 	for _, key := range keys {
-		obj, exist := t.db.Dict.Find(key)
-		if !exist {
-			values = append(values, "")
-			continue
-		}
-		value, err := obj.Ptr.(*StringStore).read([]byte(key))
-		if err != nil {
+		// a key of another type reads as a missing one like in redis
+		value, _, err := StringRead(t, key)
+		if err != nil && !errors.Is(err, ErrWrongType) {
 			return nil, err
 		}
 		values = append(values, string(value))
@@ -186,40 +718,49 @@ func (t *TX) MGet(keys ...string) ([]string, error) {
 
 func (t *TX) MSet(keyValues ...string) error {
 	if len(keyValues)%2 != 0 {
-		return errors.New("key and Value must be paired")
+		return fmt.Errorf("%w: key and value must be paired", ErrWrongArgCount)
 	}
 	for i := 0; i < len(keyValues); i += 2 {
-		t.Writers = append(t.Writers, &StringAct{Data: keyValues[i+1], Key: keyValues[i]})
+		WriteStringToStore(t, []byte(keyValues[i]), []byte(keyValues[i+1]), false)
+		t.log(&StringAct{Data: keyValues[i+1], Key: keyValues[i]})
+		t.notify(NotifyString, "set", keyValues[i])
 	}
 	return nil
 }
 
 func (t *TX) HSet(key string, paris ...Paris) error {
-	err := SetHashField(t.db, key, paris...)
+	err := SetHashField(t, key, paris...)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &HashHSetAction{Key: []byte(key), Paris: paris})
+	t.log(&HashHSetAction{Key: []byte(key), Paris: paris})
+	t.notify(NotifyHash, "hset", key)
 	return nil
 }
 func (t *TX) HGet(key string, field string) (string, error) {
-	ent, isExist := t.db.Dict.Find(key)
+	hashObj, isExist, err := findTyped[*HashObject](t, key)
+	if err != nil {
+		return "", err
+	}
 	if !isExist {
-		return "", errors.New("key not exist")
+		return "", ErrKeyNotFound
 	}
-	value, isFieldExist := ent.Ptr.(*HashObject).Get(field)
+	value, isFieldExist := hashObj.Get(field)
 	if !isFieldExist {
-		return "", errors.New("field not exist")
+		return "", ErrFieldNotFound
 	}
 	return utils.ToString(value), nil
 }
 
 func (t *TX) HGetAll(key string) (map[string]string, error) {
-	ent, isExist := t.db.Dict.Find(key)
+	hashObj, isExist, err := findTyped[*HashObject](t, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	value := ent.Ptr.(*HashObject).GetAll()
+	value := hashObj.GetAll()
 	result := make(map[string]string)
 	for k, v := range value {
 		result[utils.ToString(k)] = utils.ToString(v)
@@ -228,11 +769,14 @@ func (t *TX) HGetAll(key string) (map[string]string, error) {
 }
 
 func (t *TX) HExists(key string, field string) (bool, error) {
-	ent, isExist := t.db.Dict.Find(key)
+	hashObj, isExist, err := findTyped[*HashObject](t, key)
+	if err != nil {
+		return false, err
+	}
 	if !isExist {
-		return false, errors.New("key not exist")
+		return false, ErrKeyNotFound
 	}
-	_, isFieldExist := ent.Ptr.(*HashObject).Get(field)
+	_, isFieldExist := hashObj.Get(field)
 	return isFieldExist, nil
 }
 
@@ -241,31 +785,37 @@ func (t *TX) HDel(key string, fields ...string) error {
 	for _, field := range fields {
 		rawFields = append(rawFields, []byte(field))
 	}
-	err := HashDeleteFields(t.db, key, fields...)
+	err := HashDeleteFields(t, key, fields...)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &HashHDelAction{Key: []byte(key), Fields: rawFields})
+	t.log(&HashHDelAction{Key: []byte(key), Fields: rawFields})
+	t.notify(NotifyHash, "hdel", key)
+	t.notifyRemoved(key)
 	return nil
 }
 
 func (t *TX) HIncrBy(key string, field string, value int64) error {
-	newVal, err := HashFieldCalculation(t.db, key, field, value)
+	newVal, err := HashFieldCalculation(t, key, field, value)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &HashHSetAction{Key: []byte(key), Paris: []Paris{{
+	t.log(&HashHSetAction{Key: []byte(key), Paris: []Paris{{
 		Field: []byte(field), Value: []byte(fmt.Sprintf("%d", newVal)),
 	}}})
+	t.notify(NotifyHash, "hincrby", key)
 	return nil
 }
 
 func (t *TX) HKeys(key string) ([]string, error) {
-	ent, isExist := t.db.Dict.Find(key)
+	hashObj, isExist, err := findTyped[*HashObject](t, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	fields := ent.Ptr.(*HashObject).Keys()
+	fields := hashObj.Keys()
 	result := make([]string, 0)
 	for _, field := range fields {
 		result = append(result, utils.ToString(field))
@@ -274,19 +824,25 @@ func (t *TX) HKeys(key string) ([]string, error) {
 }
 
 func (t *TX) HLen(key string) (int64, error) {
-	ent, isExist := t.db.Dict.Find(key)
+	hashObj, isExist, err := findTyped[*HashObject](t, key)
+	if err != nil {
+		return 0, err
+	}
 	if !isExist {
-		return 0, errors.New("key not exist")
+		return 0, ErrKeyNotFound
 	}
-	return int64(ent.Ptr.(*HashObject).Len()), nil
+	return int64(hashObj.Len()), nil
 }
 
 func (t *TX) HVals(key string) ([]string, error) {
-	ent, isExist := t.db.Dict.Find(key)
+	hashObj, isExist, err := findTyped[*HashObject](t, key)
+	if err != nil {
+		return nil, err
+	}
 	if !isExist {
-		return nil, errors.New("key not exist")
+		return nil, ErrKeyNotFound
 	}
-	values := ent.Ptr.(*HashObject).Values()
+	values := hashObj.Values()
 	result := make([]string, 0)
 	for _, value := range values {
 		result = append(result, utils.ToString(value))
@@ -295,73 +851,80 @@ func (t *TX) HVals(key string) ([]string, error) {
 }
 
 func (t *TX) LPush(key string, value ...[]byte) error {
-	_, err := ListPush(t.db, key, value...)
+	err := ListPush(t, key, value...)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &ListLPushAction{Key: []byte(key), Data: value})
+	t.log(&ListLPushAction{Key: []byte(key), Data: value})
+	t.notify(NotifyList, "lpush", key)
 	return nil
 }
 
 func (t *TX) LPop(key string, count int) ([][]byte, error) {
-	value, err := ListPop(t.db, key, count)
+	value, err := ListPop(t, key, count)
 	if err != nil {
 		return nil, err
 	}
-	t.Writers = append(t.Writers, &ListLPopAction{Key: []byte(key), Count: count})
+	t.log(&ListLPopAction{Key: []byte(key), Count: count})
+	t.notify(NotifyList, "lpop", key)
+	t.notifyRemoved(key)
 	return value, nil
 }
 
 func (t *TX) LIndex(key string, index int) ([]byte, error) {
-	return ListIndex(t.db, key, index)
+	return ListIndex(t, key, index)
 }
 
 func (t *TX) LLen(key string) (int, error) {
-	return ListLen(t.db, key)
+	return ListLen(t, key)
 }
 
 func (t *TX) LRange(key string, start int, end int) ([][]byte, error) {
-	return ListRange(t.db, key, start, end)
+	return ListRange(t, key, start, end)
 }
 
 func (t *TX) LInsert(key string, position int, value string) error {
-	err := ListInsert(t.db, key, position, []byte(value))
+	err := ListInsert(t, key, position, []byte(value))
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &ListInsertAction{Key: []byte(key), Index: position, Data: []byte(value)})
+	t.log(&ListInsertAction{Key: []byte(key), Index: position, Data: []byte(value)})
+	t.notify(NotifyList, "linsert", key)
 	return nil
 }
 
 func (t *TX) SAdd(key string, members ...interface{}) error {
-	_, err := SetAdd(t.db, key, members...)
+	err := SetAdd(t, key, members...)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &SetAddAction{Key: key, Value: members})
+	t.log(&SetAddAction{Key: key, Value: members})
+	t.notify(NotifySet, "sadd", key)
 	return nil
 }
 
 func (t *TX) SRem(key string, members ...interface{}) error {
-	_, err := SetRemove(t.db, key, members...)
+	err := SetRemove(t, key, members...)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &SetRemAction{Key: key, Value: members})
+	t.log(&SetRemAction{Key: key, Value: members})
+	t.notify(NotifySet, "srem", key)
+	t.notifyRemoved(key)
 	return nil
 }
 
 func (t *TX) SIsMember(key string, member interface{}) (bool, error) {
-	return SetIsMember(t.db, key, member)
+	return SetIsMember(t, key, member)
 }
 
 func (t *TX) SCard(key string) (int, error) {
-	return SetSize(t.db, key)
+	return SetSize(t, key)
 }
 func (t *TX) SMIsMembers(key string, members ...interface{}) ([]bool, error) {
 	result := make([]bool, 0)
 	for _, member := range members {
-		isMember, err := SetIsMember(t.db, key, member)
+		isMember, err := SetIsMember(t, key, member)
 		if err != nil {
 			return nil, err
 		}
@@ -371,84 +934,106 @@ func (t *TX) SMIsMembers(key string, members ...interface{}) ([]bool, error) {
 }
 
 func (t *TX) SDiff(key string, others ...string) ([]interface{}, error) {
-	return SetDiff(t.db, key, others...)
+	return SetDiff(t, key, others...)
 }
 
 func (t *TX) SInter(keys ...string) ([]interface{}, error) {
-	return SetInter(t.db, keys...)
+	return SetInter(t, keys...)
 }
 
 func (t *TX) SUnion(keys ...string) ([]interface{}, error) {
-	return SetUnion(t.db, keys...)
+	return SetUnion(t, keys...)
 }
 
 func (t *TX) SMembers(key string) ([]interface{}, error) {
-	return SetMembers(t.db, key)
+	return SetMembers(t, key)
 }
 
 func (t *TX) SPop(key string, count int) ([]interface{}, error) {
-	vals, err := SetPop(t.db, key, count)
+	vals, err := SetPop(t, key, count)
 	if err != nil {
 		return nil, err
 	}
-	t.Writers = append(t.Writers, &SetRemAction{Key: key, Value: vals})
+	t.log(&SetRemAction{Key: key, Value: vals})
+	t.notify(NotifySet, "spop", key)
+	t.notifyRemoved(key)
 	return vals, nil
 }
 
 func (t *TX) SRandMember(key string, count int) ([]interface{}, error) {
-	return SetRandomMember(t.db, key, count)
+	return SetRandomMember(t, key, count)
 }
 
 func (t *TX) ZAdd(key string, pairs ...ZsetPair) error {
-	_, err := ZsetAdd(t.db, key, pairs...)
+	err := ZsetAdd(t, key, pairs...)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &ZsetAddAction{Key: key, Pairs: pairs})
+	t.log(&ZsetAddAction{Key: key, Pairs: pairs})
+	t.notify(NotifyZset, "zadd", key)
 	return nil
 }
 
 func (t *TX) ZRem(key string, members ...string) error {
-	_, err := ZsetRemove(t.db, key, members...)
+	err := ZsetRemove(t, key, members...)
 	if err != nil {
 		return err
 	}
-	t.Writers = append(t.Writers, &ZsetRemAction{Key: key, Members: members})
+	t.log(&ZsetRemAction{Key: key, Members: members})
+	t.notify(NotifyZset, "zrem", key)
+	t.notifyRemoved(key)
 	return nil
 }
 
 func (t *TX) ZCard(key string) (int, error) {
-	return ZsetCard(t.db, key)
+	return ZsetCard(t, key)
 }
 
 func (t *TX) ZRange(key string, start int, end int) ([]interface{}, error) {
-	return ZsetRange(t.db, key, start, end)
+	return ZsetRange(t, key, start, end)
 }
 
 func (t *TX) ZRangeWithScores(key string, start int, end int) ([]interface{}, error) {
-	return ZsetRangeWithScores(t.db, key, start, end)
+	return ZsetRangeWithScores(t, key, start, end)
 }
 func (t *TX) ZDiff(key string, others ...string) ([]interface{}, error) {
-	return ZdiffWithResult(t.db, append([]string{key}, others...)...)
+	return ZdiffWithResult(t, append([]string{key}, others...)...)
 }
 
-func (t *TX) ZDiffStore(saveKey string, targetKey string, others ...string) (int, error) {
-	result, err := Zdiff(t.db, append([]string{targetKey}, others...)...)
-	if err != nil {
-		return 0, err
+// storeZset replaces saveKey of any type with result and returns its size
+func (t *TX) storeZset(saveKey string, result *skiplist.Zset, event string) int {
+	if result.ZCard() == 0 {
+		// an empty result removes saveKey, like redis no empty key is stored
+		if t.deleteKeys([]string{saveKey}) > 0 {
+			t.log(&KeyDelAction{Keys: []string{saveKey}})
+		}
+		return 0
+	}
+	if KeyDelete(t, saveKey) > 0 {
+		// replay must not merge the result into the old value
+		t.log(&KeyDelAction{Keys: []string{saveKey}})
 	}
 	obj := NewZsetObject()
 	obj.Data = result
-	t.db.Dict.Add(saveKey, &KeyEntity{Ptr: obj})
+	t.add(saveKey, &KeyEntity{Ptr: obj})
 	// add to aof
 	resultVals := result.ZRangeWithScores(0, -1)
 	pairs := valsToPairs(resultVals)
-	t.Writers = append(t.Writers, &ZsetAddAction{Key: saveKey, Pairs: pairs})
-	return len(pairs), nil
+	t.log(&ZsetAddAction{Key: saveKey, Pairs: pairs})
+	t.notify(NotifyZset, event, saveKey)
+	return len(pairs)
+}
+
+func (t *TX) ZDiffStore(saveKey string, targetKey string, others ...string) (int, error) {
+	result, err := Zdiff(t, append([]string{targetKey}, others...)...)
+	if err != nil {
+		return 0, err
+	}
+	return t.storeZset(saveKey, result, "zdiffstore"), nil
 }
 
 func (t *TX) ZDiffCard(key string, others ...string) (int, error) {
-	result, err := Zdiff(t.db, append([]string{key}, others...)...)
+	result, err := Zdiff(t, append([]string{key}, others...)...)
 	if err != nil {
 		return 0, err
 	}
@@ -456,25 +1041,18 @@ func (t *TX) ZDiffCard(key string, others ...string) (int, error) {
 }
 
 func (t *TX) ZInter(keys ...string) ([]interface{}, error) {
-	return ZInterWithResult(t.db, keys...)
+	return ZInterWithResult(t, keys...)
 }
 
 func (t *TX) ZInterStore(saveKey string, keys ...string) (int, error) {
-	result, err := ZInter(t.db, keys...)
+	result, err := ZInter(t, keys...)
 	if err != nil {
 		return 0, err
 	}
-	obj := NewZsetObject()
-	obj.Data = result
-	t.db.Dict.Add(saveKey, &KeyEntity{Ptr: obj})
-	// add to aof
-	resultVals := result.ZRangeWithScores(0, -1)
-	pairs := valsToPairs(resultVals)
-	t.Writers = append(t.Writers, &ZsetAddAction{Key: saveKey, Pairs: pairs})
-	return len(pairs), nil
+	return t.storeZset(saveKey, result, "zinterstore"), nil
 }
 func (t *TX) ZInterCard(keys ...string) (int, error) {
-	result, err := ZInter(t.db, keys...)
+	result, err := ZInter(t, keys...)
 	if err != nil {
 		return 0, err
 	}
@@ -482,44 +1060,38 @@ func (t *TX) ZInterCard(keys ...string) (int, error) {
 }
 
 func (t *TX) ZUnion(keys ...string) ([]interface{}, error) {
-	return ZUnionWithResult(t.db, keys...)
+	return ZUnionWithResult(t, keys...)
 }
 
 func (t *TX) ZUnionStore(saveKey string, keys ...string) (int, error) {
-	result, err := ZUnion(t.db, keys...)
+	result, err := ZUnion(t, keys...)
 	if err != nil {
 		return 0, err
 	}
-	obj := NewZsetObject()
-	obj.Data = result
-	t.db.Dict.Add(saveKey, &KeyEntity{Ptr: obj})
-	// add to aof
-	resultVals := result.ZRangeWithScores(0, -1)
-	pairs := valsToPairs(resultVals)
-	t.Writers = append(t.Writers, &ZsetAddAction{Key: saveKey, Pairs: pairs})
-	return len(pairs), nil
+	return t.storeZset(saveKey, result, "zunionstore"), nil
 }
 
 func (t *TX) ZUnionCard(keys ...string) (int, error) {
-	result, err := ZUnion(t.db, keys...)
+	result, err := ZUnion(t, keys...)
 	if err != nil {
 		return 0, err
 	}
 	return result.ZCard(), nil
 }
 func (t *TX) ZIncrBy(key string, increment float64, member string) (float64, error) {
-	result, err := ZIncrBy(t.db, key, increment, member)
+	result, err := ZIncrBy(t, key, increment, member)
 	if err != nil {
 		return 0, err
 	}
-	t.Writers = append(t.Writers, &ZsetAddAction{Key: key, Pairs: []ZsetPair{{Member: member, Score: result}}})
+	t.log(&ZsetAddAction{Key: key, Pairs: []ZsetPair{{Member: member, Score: result}}})
+	t.notify(NotifyZset, "zincr", key)
 	return result, nil
 }
 func (t *TX) ZScore(key string, member string) (float64, error) {
-	return ZScore(t.db, key, member)
+	return ZScore(t, key, member)
 }
 func (t *TX) ZRank(key string, member string) (int64, error) {
-	return ZRank(t.db, key, member)
+	return ZRank(t, key, member)
 }
 func valsToPairs(vals []interface{}) []ZsetPair {
 	pairs := make([]ZsetPair, 0)
@@ -0,0 +1,487 @@
+package polarisdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func fillKeyTestData(t *testing.T, db *PolarisDB) {
+	err := db.Update(func(tx *TX) error {
+		if err := tx.SetString("str", "v", false); err != nil {
+			return err
+		}
+		if err := tx.HSet("hash", Paris{Field: []byte("f"), Value: []byte("v")}); err != nil {
+			return err
+		}
+		if err := tx.LPush("list", []byte("a")); err != nil {
+			return err
+		}
+		if err := tx.SAdd("set", "a"); err != nil {
+			return err
+		}
+		return tx.ZAdd("zset", ZsetPair{Member: "a", Score: 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTX_DelAndType(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	expects := map[string]string{"str": TypeString, "hash": TypeHash, "list": TypeList, "set": TypeSet, "zset": TypeZset, "missing": TypeNone}
+	db.View(func(tx *TX) error {
+		for key, expect := range expects {
+			if keyType, _ := tx.Type(key); keyType != expect {
+				t.Fatalf("expect type %s of %s got %s", expect, key, keyType)
+			}
+		}
+		if count, _ := tx.ExistsCount("str", "str", "missing"); count != 2 {
+			t.Fatalf("expect 2 got %d", count)
+		}
+		return nil
+	})
+	var count int
+	err = db.Update(func(tx *TX) error {
+		count, err = tx.Del("str", "hash", "list", "missing")
+		return err
+	})
+	if err != nil || count != 3 {
+		t.Fatalf("expect 3 deleted keys got %d %v", count, err)
+	}
+	err = db.Update(func(tx *TX) error {
+		count, err = tx.Unlink("set", "zset")
+		return err
+	})
+	if err != nil || count != 2 {
+		t.Fatalf("expect 2 unlinked keys got %d %v", count, err)
+	}
+	db = reopenTestDB(t, db)
+	db.View(func(tx *TX) error {
+		if count, _ := tx.ExistsCount("str", "hash", "list", "set", "zset"); count != 0 {
+			t.Fatalf("expect every key to be deleted after replay, %d left", count)
+		}
+		return nil
+	})
+}
+
+func TestTX_Rename(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	err = db.Update(func(tx *TX) error {
+		if err := tx.SetExpire("str", 60000); err != nil {
+			return err
+		}
+		if err := tx.Rename("str", "str2"); err != nil {
+			return err
+		}
+		if err := tx.Rename("hash", "list"); err != nil {
+			return err
+		}
+		renamed, err := tx.RenameNX("set", "zset")
+		if err != nil || renamed {
+			t.Fatalf("expect renamenx onto an existing key to fail got %v %v", renamed, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *TX) error { return tx.Rename("missing", "other") })
+	if err != ErrKeyNotFound {
+		t.Fatalf("expect key not found got %v", err)
+	}
+	check := func(db *PolarisDB) {
+		db.View(func(tx *TX) error {
+			if exist, _ := tx.Exists("str"); exist {
+				t.Fatal("expect str to be renamed")
+			}
+			if val, err := tx.Get("str2"); err != nil || val != "v" {
+				t.Fatalf("expect str2=v got %s %v", val, err)
+			}
+			if val, err := tx.HGet("list", "f"); err != nil || val != "v" {
+				t.Fatalf("expect the hash under list got %s %v", val, err)
+			}
+			if exist, _ := tx.Exists("set"); !exist {
+				t.Fatal("expect set to stay")
+			}
+			return nil
+		})
+		if ttl := db.Keyspaces[0].Sweeper.GetExpire("str2"); ttl <= time.Now().UnixMilli() {
+			t.Fatalf("expect the ttl to move to str2 got %d", ttl)
+		}
+		if ttl := db.Keyspaces[0].Sweeper.GetExpire("str"); ttl != noExpire {
+			t.Fatalf("expect no ttl on str got %d", ttl)
+		}
+	}
+	check(db)
+	check(reopenTestDB(t, db))
+}
+
+func TestTX_Copy(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	err = db.Update(func(tx *TX) error {
+		if copied, err := tx.Copy("str", "hash", false); err != nil || copied {
+			t.Fatalf("expect copy without replace to fail got %v %v", copied, err)
+		}
+		if copied, err := tx.Copy("str", "hash", true); err != nil || !copied {
+			t.Fatalf("expect copy with replace got %v %v", copied, err)
+		}
+		if copied, err := tx.Copy("set", "set2", false); err != nil || !copied {
+			t.Fatalf("expect set copy got %v %v", copied, err)
+		}
+		// the copy is independent of the source
+		return tx.SAdd("set2", "b")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *PolarisDB) {
+		db.View(func(tx *TX) error {
+			if val, err := tx.Get("hash"); err != nil || val != "v" {
+				t.Fatalf("expect hash=v got %s %v", val, err)
+			}
+			if val, err := tx.Get("str"); err != nil || val != "v" {
+				t.Fatalf("expect str=v got %s %v", val, err)
+			}
+			if card, _ := tx.SCard("set"); card != 1 {
+				t.Fatalf("expect the source set to keep 1 member got %d", card)
+			}
+			if card, _ := tx.SCard("set2"); card != 2 {
+				t.Fatalf("expect 2 members in the copy got %d", card)
+			}
+			return nil
+		})
+	}
+	check(db)
+	check(reopenTestDB(t, db))
+}
+
+func TestTX_Scan(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	err = db.Update(func(tx *TX) error {
+		for i := 0; i < 100; i++ {
+			if err := tx.SetString(fmt.Sprintf("scan:%d", i), "v", false); err != nil {
+				return err
+			}
+			if err := tx.SAdd("bigset", fmt.Sprintf("m%d", i)); err != nil {
+				return err
+			}
+			if err := tx.HSet("bighash", Paris{Field: []byte(fmt.Sprintf("f%d", i)), Value: []byte("v")}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *TX) error {
+		seen := map[string]bool{}
+		var cursor uint64
+		for {
+			var keys []string
+			cursor, keys, err = tx.Scan(cursor, ScanOptions{Match: "scan:*", Count: 7})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys {
+				seen[key] = true
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+		if len(seen) != 100 {
+			t.Fatalf("expect 100 matched keys got %d", len(seen))
+		}
+		_, keys, _ := tx.Scan(0, ScanOptions{Type: TypeZset, Count: 1000})
+		if len(keys) != 1 || keys[0] != "zset" {
+			t.Fatalf("expect only zset with TYPE zset got %v", keys)
+		}
+		members := map[interface{}]bool{}
+		cursor = 0
+		for {
+			var page []interface{}
+			cursor, page, _ = tx.SScan("bigset", cursor, ScanOptions{})
+			for _, member := range page {
+				members[member] = true
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+		if len(members) != 100 {
+			t.Fatalf("expect 100 set members got %d", len(members))
+		}
+		_, pairs, _ := tx.HScan("bighash", 0, ScanOptions{Match: "f1?", Count: 1000})
+		if len(pairs) != 20 {
+			t.Fatalf("expect 10 field value pairs, 20 items, got %d items", len(pairs))
+		}
+		cursor, pairs, _ = tx.HScan("missing", 0, ScanOptions{})
+		if cursor != 0 || len(pairs) != 0 {
+			t.Fatalf("expect an empty scan of a missing key got %d %v", cursor, pairs)
+		}
+		return nil
+	})
+}
+
+func TestTX_KeysAndRange(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	err = db.Update(func(tx *TX) error {
+		for _, key := range []string{"user:2", "user:10", "user:1", "session:a", "session:b", "users"} {
+			if err := tx.SetString(key, "v", false); err != nil {
+				return err
+			}
+		}
+		return tx.SAdd("user:3", "a")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *TX) error {
+		if _, err := tx.Del("user:10"); err != nil {
+			return err
+		}
+		if err := tx.SetString("user:0", "v", false); err != nil {
+			return err
+		}
+		// the write set of the transaction is visible
+		keys, _ := tx.Keys("user:*")
+		if fmt.Sprint(keys) != "[user:0 user:1 user:2 user:3]" {
+			t.Fatalf("unexpected keys in the transaction %v", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *TX) error {
+		cases := map[string]string{
+			"*":          "[session:a session:b user:0 user:1 user:2 user:3 users]",
+			"user:[0-1]": "[user:0 user:1]",
+			"*:a":        "[session:a]",
+			"user:10":    "[]",
+		}
+		for pattern, expect := range cases {
+			keys, _ := tx.Keys(pattern)
+			if fmt.Sprint(keys) != expect {
+				t.Fatalf("pattern %s expect %s got %v", pattern, expect, keys)
+			}
+		}
+		// page through the user: namespace two keys at a time
+		pages := make([]string, 0)
+		start := "user:"
+		for {
+			keys, _ := tx.KeyRange(start, "user;", 2)
+			if len(keys) == 0 {
+				break
+			}
+			pages = append(pages, fmt.Sprint(keys))
+			start = keys[len(keys)-1] + "\x00"
+		}
+		if fmt.Sprint(pages) != "[[user:0 user:1] [user:2 user:3]]" {
+			t.Fatalf("unexpected pages %v", pages)
+		}
+		return nil
+	})
+	err = db.Update(func(tx *TX) error {
+		return tx.SetExpire("session:a", 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(5 * time.Millisecond)
+	db.View(func(tx *TX) error {
+		if keys, _ := tx.Keys("session:*"); fmt.Sprint(keys) != "[session:b]" {
+			t.Fatalf("expect the expired key to be skipped got %v", keys)
+		}
+		if keys, _ := tx.KeyRange("", "", 1); fmt.Sprint(keys) != "[session:b]" {
+			t.Fatalf("expect the range to skip the expired key got %v", keys)
+		}
+		return nil
+	})
+}
+
+func TestTX_ExpireOptions(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	err = db.Update(func(tx *TX) error {
+		steps := []struct {
+			options ExpireOptions
+			ttl     int64
+			expect  bool
+		}{
+			{ExpireOptions{XX: true}, 10000, false},
+			{ExpireOptions{GT: true}, 10000, false},
+			{ExpireOptions{LT: true}, 20000, true},
+			{ExpireOptions{NX: true}, 10000, false},
+			{ExpireOptions{GT: true}, 10000, false},
+			{ExpireOptions{GT: true}, 30000, true},
+			{ExpireOptions{XX: true, LT: true}, 5000, true},
+		}
+		for i, step := range steps {
+			set, err := tx.Expire("str", step.ttl, step.options)
+			if err != nil {
+				return err
+			}
+			if set != step.expect {
+				t.Fatalf("step %d expect %v got %v", i, step.expect, set)
+			}
+		}
+		if ttl, _ := tx.TTL("str"); ttl != 5 {
+			t.Fatalf("expect ttl 5 got %d", ttl)
+		}
+		if _, err := tx.Expire("str", 1000, ExpireOptions{NX: true, GT: true}); err != ErrExpireNX {
+			t.Fatalf("expect ErrExpireNX got %v", err)
+		}
+		if set, _ := tx.Expire("missing", 1000, ExpireOptions{}); set {
+			t.Fatal("expect no ttl on a missing key")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *TX) error {
+		expects := map[string]int64{"missing": TTLNoKey, "hash": TTLNoExpire}
+		for key, expect := range expects {
+			if ttl, _ := tx.PTTL(key); ttl != expect {
+				t.Fatalf("expect pttl of %s %d got %d", key, expect, ttl)
+			}
+			if at, _ := tx.ExpireTime(key); at != expect {
+				t.Fatalf("expect expire time of %s %d got %d", key, expect, at)
+			}
+		}
+		return nil
+	})
+}
+
+func TestTX_PersistReplay(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	at := time.Now().Add(time.Hour).UnixMilli()
+	err = db.Update(func(tx *TX) error {
+		if _, err := tx.Expire("str", 1000, ExpireOptions{}); err != nil {
+			return err
+		}
+		if _, err := tx.ExpireAt("hash", at, ExpireOptions{}); err != nil {
+			return err
+		}
+		// a deadline in the past expires the key at once
+		_, err := tx.ExpireAt("list", time.Now().Add(-time.Second).UnixMilli(), ExpireOptions{})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *TX) error {
+		if removed, _ := tx.Persist("str"); !removed {
+			t.Fatal("expect persist to remove the ttl")
+		}
+		if removed, _ := tx.Persist("set"); removed {
+			t.Fatal("expect persist without a ttl to do nothing")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *PolarisDB) {
+		db.View(func(tx *TX) error {
+			if ttl, _ := tx.PTTL("str"); ttl != TTLNoExpire {
+				t.Fatalf("expect str to be persistent got %d", ttl)
+			}
+			if expireAt, _ := tx.ExpireTime("hash"); expireAt != at {
+				t.Fatalf("expect hash to expire at %d got %d", at, expireAt)
+			}
+			if ttl, _ := tx.PTTL("list"); ttl != TTLNoKey {
+				t.Fatalf("expect list to be expired got %d", ttl)
+			}
+			return nil
+		})
+	}
+	check(db)
+	check(reopenTestDB(t, db))
+}
+
+func TestTX_Errors(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer cleanTestData()
+	fillKeyTestData(t, db)
+	db.Update(func(tx *TX) error {
+		if _, err := tx.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expect ErrKeyNotFound got %v", err)
+		}
+		if _, err := tx.HGet("hash", "missing"); !errors.Is(err, ErrFieldNotFound) {
+			t.Fatalf("expect ErrFieldNotFound got %v", err)
+		}
+		if err := tx.Incr("str"); !errors.Is(err, ErrNotInteger) {
+			t.Fatalf("expect ErrNotInteger got %v", err)
+		}
+		if err := tx.LInsert("list", 10, "x"); !errors.Is(err, ErrOutOfRange) {
+			t.Fatalf("expect ErrOutOfRange got %v", err)
+		}
+		if _, err := tx.Get("hash"); !errors.Is(err, ErrWrongType) {
+			t.Fatalf("expect ErrWrongType got %v", err)
+		}
+		return nil
+	})
+	err = db.View(func(tx *TX) error {
+		return tx.SetString("foo", "bar", false)
+	})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly got %v", err)
+	}
+}
@@ -28,7 +28,6 @@ func TestTX_LPush(t *testing.T) {
 			}
 		}
 		return nil
-		return nil
 	})
 
 	db2 := NewDB(&DBConfig{Path: "./tmp"})
@@ -715,3 +715,36 @@ func TestTX_MSet(t *testing.T) {
 		return
 	}
 }
+
+func TestTX_InPlaceKeepsTTLAfterReopen(t *testing.T) {
+	db := NewDB(&DBConfig{Path: "./tmp"})
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanTestData()
+	for _, args := range [][]string{
+		{"set", "counter", "1"},
+		{"expire", "counter", "1000"},
+		{"incr", "counter"},
+		{"incrby", "counter", "2"},
+		{"decr", "counter"},
+		{"decrby", "counter", "2"},
+		{"set", "text", "a"},
+		{"expire", "text", "1000"},
+		{"append", "text", "b"},
+	} {
+		if _, err := db.Exec(args[0], args[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = reopenTestDB(t, db)
+	defer db.Close()
+	for key, value := range map[string]string{"counter": "1", "text": "ab"} {
+		if got, _ := db.Exec("get", key); got != value {
+			t.Fatalf("expect %s to be %s got %v", key, value, got)
+		}
+		if ttl, _ := db.Exec("ttl", key); ttl.(int64) < 999 {
+			t.Fatalf("expect %s to keep its ttl got %v", key, ttl)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package utils
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*a*b", "xxaxxbxb", true},
+		{"*a*b", "xxaxxbxc", false},
+	}
+	for _, c := range cases {
+		if GlobMatch(c.pattern, c.str) != c.match {
+			t.Fatalf("GlobMatch(%q, %q) expect %v", c.pattern, c.str, c.match)
+		}
+	}
+}
+
+func TestGlobPrefix(t *testing.T) {
+	cases := map[string]string{
+		"user:*":    "user:",
+		"user:?:id": "user:",
+		"[ab]*":     "",
+		"plain":     "plain",
+		"a\\*b":     "a",
+	}
+	for pattern, expect := range cases {
+		if prefix := GlobPrefix(pattern); prefix != expect {
+			t.Fatalf("pattern %q expect prefix %q got %q", pattern, expect, prefix)
+		}
+	}
+}
@@ -11,6 +11,9 @@ func FindLargestPrefix(a, b []byte) []byte {
 }
 
 func IsPrefix(a, b []byte) bool {
+	if len(a) > len(b) {
+		return false
+	}
 	for i := 0; i < len(a) && i < len(b); i++ {
 		if a[i] != b[i] {
 			return false
@@ -0,0 +1,13 @@
+package utils
+
+// ValueSize returns the approximate bytes a loosely typed value holds outside of
+// the interface that stores it
+func ValueSize(val interface{}) int {
+	switch v := val.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	}
+	return 0
+}